@@ -3,7 +3,9 @@ package handler
 import (
 	"context"
 	"ekolo/account/service"
-	"ekolo/pkg/storage"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/xerr"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
@@ -13,15 +15,23 @@ type UserHandler struct {
 	svc *service.UserService
 }
 
-func NewUserHandler(store storage.Storer) *UserHandler {
+func NewUserHandler(svc *service.UserService) *UserHandler {
 	return &UserHandler{
-		svc: service.NewUserService(store),
+		svc: svc,
 	}
 }
 
+// GetUserTypes returns the user types of the organization of the caller
 func (h *UserHandler) GetUserTypes(ctx context.Context) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		resp := h.svc.GetTypes(ctx)
+		p, ok := principal.FromContext(c.Request().Context())
+		if !ok {
+			return generic.RenderError(c, xerr.ErrUnauthenticated)
+		}
+		resp, err := h.svc.GetTypes(c.Request().Context(), p.OrgUUID)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
 		return c.JSON(http.StatusOK, resp)
 	}
 }
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type InvitationHandler struct {
+	acceptor *service.InvitationAcceptor
+}
+
+func NewInvitationHandler(acceptor *service.InvitationAcceptor) *InvitationHandler {
+	return &InvitationHandler{
+		acceptor: acceptor,
+	}
+}
+
+// Mount registers the invitation acceptance endpoint on the given Echo instance, it needs no authentication
+func (h *InvitationHandler) Mount(e *echo.Echo) {
+	e.POST("/invitation/accept", h.Accept()).Name = "invitation-accept"
+}
+
+// Accept accepts an invitation
+// @Summary Accept an invitation
+// @Description Create the invited user with the token of an invitation link and the password they chose, the token can only be used once
+// @ID invitation-accept
+// @Tags invitation
+// @Accept json
+// @Produce json
+// @Param request body service.RequestInvitationAccept true "Invitation token and password"
+// @Success 201 {object} service.Response
+// @Failure 400 {object} generic.Response
+// @Failure 409 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /invitation/accept [post]
+func (h *InvitationHandler) Accept() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestInvitationAccept
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		user, err := h.acceptor.Accept(c.Request().Context(), req)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusCreated, service.NewResponse(http.StatusCreated, nil, user))
+	}
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type UnlockHandler struct {
+	svc *service.UnlockService
+}
+
+func NewUnlockHandler(svc *service.UnlockService) *UnlockHandler {
+	return &UnlockHandler{
+		svc: svc,
+	}
+}
+
+// Mount registers the unlock endpoint on the given Echo instance, mw must authenticate and authorize requests
+func (h *UnlockHandler) Mount(e *echo.Echo, mw ...echo.MiddlewareFunc) {
+	e.POST("/organization/:org/user/:user/unlock", h.Unlock(), mw...).Name = "user-unlock"
+}
+
+// Unlock lifts the lockout of a user
+// @Summary Unlock a user
+// @Description Forget the failed logins of a user, whose account is locked after too many of them
+// @ID user-unlock
+// @Tags user
+// @Security ApiKeyAuth
+// @Param org path string true "Organization ID"
+// @Param user path string true "User ID"
+// @Success 204
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 404 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /organization/{org}/user/{user}/unlock [post]
+func (h *UnlockHandler) Unlock() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestUnlock
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.svc.Unlock(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/xerr"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ResetHandler struct {
+	svc *service.ResetService
+}
+
+func NewResetHandler(svc *service.ResetService) *ResetHandler {
+	return &ResetHandler{
+		svc: svc,
+	}
+}
+
+// Mount registers the password reset endpoints on the given Echo instance, they need no authentication
+func (h *ResetHandler) Mount(e *echo.Echo) {
+	g := e.Group("password")
+	g.POST("/reset", h.RequestReset()).Name = "password-reset"
+	g.POST("/reset/confirm", h.ConfirmReset()).Name = "password-reset-confirm"
+}
+
+// RequestReset sends a password reset link
+// @Summary Request a password reset
+// @Description Send a link to set a new password to the users having the email, the response does not tell whether any has
+// @ID password-reset
+// @Tags password
+// @Accept json
+// @Param request body service.RequestPasswordReset true "Email of the account"
+// @Success 202
+// @Failure 400 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /password/reset [post]
+func (h *ResetHandler) RequestReset() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestPasswordReset
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.svc.RequestReset(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// ConfirmReset sets a new password
+// @Summary Confirm a password reset
+// @Description Set a new password with the token of a reset link, the token can only be used once
+// @ID password-reset-confirm
+// @Tags password
+// @Accept json
+// @Param request body service.RequestPasswordResetConfirm true "Reset token and new password"
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /password/reset/confirm [post]
+func (h *ResetHandler) ConfirmReset() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestPasswordResetConfirm
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.svc.ConfirmReset(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// bind binds and validates the payload of a request
+func bind(c echo.Context, req any) error {
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	if errs := generic.Validate(req); errs != nil {
+		return xerr.Validation("validation failed", errs...)
+	}
+	return nil
+}
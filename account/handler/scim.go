@@ -0,0 +1,491 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// MIMESCIMJSON is the media type of SCIM messages
+const MIMESCIMJSON = "application/scim+json"
+
+type SCIMHandler struct {
+	svc *service.SCIMService
+}
+
+func NewSCIMHandler(svc *service.SCIMService) *SCIMHandler {
+	return &SCIMHandler{
+		svc: svc,
+	}
+}
+
+// SCIMErrorResponse is a SCIM error message
+type SCIMErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	SCIMType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// Mount registers the SCIM endpoints on the given Echo instance.
+// authMW must authenticate requests, only API keys are accepted and their scopes are checked by authorizer.
+func (h *SCIMHandler) Mount(e *echo.Echo, authMW echo.MiddlewareFunc, authorizer generic.IAuthorizer) {
+	g := e.Group(service.SCIMPath, authMW, requireAPIKey)
+	can := func(permissions ...rbac.Permission) echo.MiddlewareFunc {
+		return requireSCIMPermissions(authorizer, permissions...)
+	}
+	g.GET("/ServiceProviderConfig", h.ServiceProviderConfig()).Name = "scim-config"
+	g.GET("/Users", h.ListUsers(), can(rbac.UserRead)).Name = "scim-user-list"
+	g.POST("/Users", h.CreateUser(), can(rbac.UserCreate)).Name = "scim-user-create"
+	g.GET("/Users/:id", h.GetUser(), can(rbac.UserRead)).Name = "scim-user-get"
+	g.PUT("/Users/:id", h.ReplaceUser(), can(rbac.UserUpdate)).Name = "scim-user-replace"
+	g.PATCH("/Users/:id", h.PatchUser(), can(rbac.UserUpdate)).Name = "scim-user-patch"
+	g.DELETE("/Users/:id", h.DeleteUser(), can(rbac.UserDelete)).Name = "scim-user-delete"
+	g.GET("/Groups", h.ListGroups(), can(rbac.RoleRead, rbac.UserRead)).Name = "scim-group-list"
+	g.POST("/Groups", h.CreateGroup(), can(rbac.RoleCreate, rbac.UserUpdate)).Name = "scim-group-create"
+	g.GET("/Groups/:id", h.GetGroup(), can(rbac.RoleRead, rbac.UserRead)).Name = "scim-group-get"
+	g.PUT("/Groups/:id", h.ReplaceGroup(), can(rbac.RoleUpdate, rbac.UserUpdate)).Name = "scim-group-replace"
+	g.PATCH("/Groups/:id", h.PatchGroup(), can(rbac.RoleUpdate, rbac.UserUpdate)).Name = "scim-group-patch"
+	g.DELETE("/Groups/:id", h.DeleteGroup(), can(rbac.RoleDelete, rbac.UserUpdate)).Name = "scim-group-delete"
+}
+
+// ServiceProviderConfig returns the supported SCIM features
+// @Summary SCIM service provider configuration
+// @Description Describe the SCIM features supported by the service
+// @ID scim-config
+// @Tags scim
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} service.SCIMServiceProviderConfig
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Router /scim/v2/ServiceProviderConfig [get]
+func (h *SCIMHandler) ServiceProviderConfig() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return renderSCIM(c, http.StatusOK, h.svc.ServiceProviderConfig())
+	}
+}
+
+// ListUsers lists users
+// @Summary List users
+// @Description List the users of the organization of the API key. Filters compare attributes joined by and, or and not are not supported
+// @ID scim-user-list
+// @Tags scim
+// @Security ApiKeyAuth
+// @Produce json
+// @Param filter query string false "SCIM filter, like userName eq \"ada@ekolo.io\""
+// @Param startIndex query int false "1-based index of the first result"
+// @Param count query int false "Page size"
+// @Success 200 {object} service.SCIMListResponse{Resources=[]service.SCIMUser}
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Users [get]
+func (h *SCIMHandler) ListUsers() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var q service.SCIMQuery
+		if err := bindSCIMQuery(c, &q); err != nil {
+			return renderSCIMError(c, err)
+		}
+		page, err := h.svc.ListUsers(c.Request().Context(), q)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, page)
+	}
+}
+
+// GetUser gets a user
+// @Summary Get a user
+// @Description Get a user of the organization of the API key
+// @ID scim-user-get
+// @Tags scim
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} service.SCIMUser
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Users/{id} [get]
+func (h *SCIMHandler) GetUser() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u, err := h.svc.GetUser(c.Request().Context(), c.Param("id"))
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, u)
+	}
+}
+
+// CreateUser provisions a user
+// @Summary Create a user
+// @Description Provision a user in the organization of the API key, the user name is the email address and the user type a group
+// @ID scim-user-create
+// @Tags scim
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param user body service.SCIMUser true "User"
+// @Success 201 {object} service.SCIMUser
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 409 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Users [post]
+func (h *SCIMHandler) CreateUser() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var in service.SCIMUser
+		if err := decodeSCIM(c, &in); err != nil {
+			return renderSCIMError(c, err)
+		}
+		u, err := h.svc.CreateUser(c.Request().Context(), in)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		c.Response().Header().Set(echo.HeaderLocation, u.Meta.Location)
+		return renderSCIM(c, http.StatusCreated, u)
+	}
+}
+
+// ReplaceUser replaces a user
+// @Summary Replace a user
+// @Description Replace the attributes of a user, missing attributes are cleared but the user type and the active flag. Deactivating a user or setting their password ends their sessions
+// @ID scim-user-replace
+// @Tags scim
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param user body service.SCIMUser true "User"
+// @Success 200 {object} service.SCIMUser
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Users/{id} [put]
+func (h *SCIMHandler) ReplaceUser() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var in service.SCIMUser
+		if err := decodeSCIM(c, &in); err != nil {
+			return renderSCIMError(c, err)
+		}
+		u, err := h.svc.ReplaceUser(c.Request().Context(), c.Param("id"), in)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, u)
+	}
+}
+
+// PatchUser patches a user
+// @Summary Patch a user
+// @Description Add, replace or remove attributes of a user. Deactivating a user or setting their password ends their sessions
+// @ID scim-user-patch
+// @Tags scim
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param patch body service.SCIMPatch true "Operations"
+// @Success 200 {object} service.SCIMUser
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Users/{id} [patch]
+func (h *SCIMHandler) PatchUser() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var patch service.SCIMPatch
+		if err := decodeSCIM(c, &patch); err != nil {
+			return renderSCIMError(c, err)
+		}
+		u, err := h.svc.PatchUser(c.Request().Context(), c.Param("id"), patch)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, u)
+	}
+}
+
+// DeleteUser deletes a user
+// @Summary Delete a user
+// @Description Delete a user of the organization of the API key and end their sessions
+// @ID scim-user-delete
+// @Tags scim
+// @Security ApiKeyAuth
+// @Param id path string true "User ID"
+// @Success 204
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Users/{id} [delete]
+func (h *SCIMHandler) DeleteUser() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h.svc.DeleteUser(c.Request().Context(), c.Param("id")); err != nil {
+			return renderSCIMError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// ListGroups lists groups
+// @Summary List groups
+// @Description List the roles of the organization of the API key along with the users having them
+// @ID scim-group-list
+// @Tags scim
+// @Security ApiKeyAuth
+// @Produce json
+// @Param filter query string false "SCIM filter, like displayName eq \"TEACHER\""
+// @Param startIndex query int false "1-based index of the first result"
+// @Param count query int false "Page size"
+// @Success 200 {object} service.SCIMListResponse{Resources=[]service.SCIMGroup}
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Groups [get]
+func (h *SCIMHandler) ListGroups() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var q service.SCIMQuery
+		if err := bindSCIMQuery(c, &q); err != nil {
+			return renderSCIMError(c, err)
+		}
+		page, err := h.svc.ListGroups(c.Request().Context(), q)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, page)
+	}
+}
+
+// GetGroup gets a group
+// @Summary Get a group
+// @Description Get a role of the organization of the API key along with the users having it
+// @ID scim-group-get
+// @Tags scim
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path string true "Role ID"
+// @Success 200 {object} service.SCIMGroup
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Groups/{id} [get]
+func (h *SCIMHandler) GetGroup() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		g, err := h.svc.GetGroup(c.Request().Context(), c.Param("id"))
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, g)
+	}
+}
+
+// CreateGroup creates a group
+// @Summary Create a group
+// @Description Create a role granting no permission, its members are given the role
+// @ID scim-group-create
+// @Tags scim
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param group body service.SCIMGroup true "Group"
+// @Success 201 {object} service.SCIMGroup
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 409 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Groups [post]
+func (h *SCIMHandler) CreateGroup() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var in service.SCIMGroup
+		if err := decodeSCIM(c, &in); err != nil {
+			return renderSCIMError(c, err)
+		}
+		g, err := h.svc.CreateGroup(c.Request().Context(), in)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		c.Response().Header().Set(echo.HeaderLocation, g.Meta.Location)
+		return renderSCIM(c, http.StatusCreated, g)
+	}
+}
+
+// ReplaceGroup replaces a group
+// @Summary Replace a group
+// @Description Rename a role and set the users having it, users who are no longer members are left without a role
+// @ID scim-group-replace
+// @Tags scim
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Role ID"
+// @Param group body service.SCIMGroup true "Group"
+// @Success 200 {object} service.SCIMGroup
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 409 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Groups/{id} [put]
+func (h *SCIMHandler) ReplaceGroup() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var in service.SCIMGroup
+		if err := decodeSCIM(c, &in); err != nil {
+			return renderSCIMError(c, err)
+		}
+		g, err := h.svc.ReplaceGroup(c.Request().Context(), c.Param("id"), in)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, g)
+	}
+}
+
+// PatchGroup patches a group
+// @Summary Patch a group
+// @Description Rename a role, add or remove its members
+// @ID scim-group-patch
+// @Tags scim
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Role ID"
+// @Param patch body service.SCIMPatch true "Operations"
+// @Success 200 {object} service.SCIMGroup
+// @Failure 400 {object} SCIMErrorResponse
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 409 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Groups/{id} [patch]
+func (h *SCIMHandler) PatchGroup() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var patch service.SCIMPatch
+		if err := decodeSCIM(c, &patch); err != nil {
+			return renderSCIMError(c, err)
+		}
+		g, err := h.svc.PatchGroup(c.Request().Context(), c.Param("id"), patch)
+		if err != nil {
+			return renderSCIMError(c, err)
+		}
+		return renderSCIM(c, http.StatusOK, g)
+	}
+}
+
+// DeleteGroup deletes a group
+// @Summary Delete a group
+// @Description Delete a role, the users having it are left without a role
+// @ID scim-group-delete
+// @Tags scim
+// @Security ApiKeyAuth
+// @Param id path string true "Role ID"
+// @Success 204
+// @Failure 401 {object} SCIMErrorResponse
+// @Failure 403 {object} SCIMErrorResponse
+// @Failure 404 {object} SCIMErrorResponse
+// @Failure 500 {object} SCIMErrorResponse
+// @Router /scim/v2/Groups/{id} [delete]
+func (h *SCIMHandler) DeleteGroup() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h.svc.DeleteGroup(c.Request().Context(), c.Param("id")); err != nil {
+			return renderSCIMError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// requireAPIKey is a middleware denying requests which are not authenticated by an API key
+func requireAPIKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		p, ok := principal.FromContext(c.Request().Context())
+		if !ok {
+			return renderSCIMError(c, xerr.ErrUnauthenticated)
+		}
+		if p.APIKey == uuid.Nil {
+			return renderSCIMError(c, xerr.Forbidden("SCIM requires an API key of the organization"))
+		}
+		return next(c)
+	}
+}
+
+// requireSCIMPermissions is a middleware denying requests whose API key lacks the given scopes
+func requireSCIMPermissions(authorizer generic.IAuthorizer, permissions ...rbac.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := authorizer.Authorize(c.Request().Context(), uuid.Nil, permissions...); err != nil {
+				return renderSCIMError(c, err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// bindSCIMQuery binds the query parameters of a list request
+func bindSCIMQuery(c echo.Context, q *service.SCIMQuery) error {
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, q); err != nil {
+		return xerr.Invalid("invalid query parameters")
+	}
+	return nil
+}
+
+// decodeSCIM decodes a request body, SCIM clients send application/scim+json which echo does not bind
+func decodeSCIM(c echo.Context, v any) error {
+	if err := json.NewDecoder(c.Request().Body).Decode(v); err != nil {
+		return xerr.Invalid("invalid JSON body")
+	}
+	return nil
+}
+
+// renderSCIM writes a SCIM message
+func renderSCIM(c echo.Context, status int, v any) error {
+	// JSON keeps a content type which is already set
+	c.Response().Header().Set(echo.HeaderContentType, MIMESCIMJSON)
+	return c.JSON(status, v)
+}
+
+// renderSCIMError writes an error as a SCIM error message, the cause of internal errors is logged and never sent to the client
+func renderSCIMError(c echo.Context, err error) error {
+	resp := SCIMErrorResponse{Schemas: []string{service.SCIMErrorSchema}}
+	var (
+		serr *service.SCIMError
+		e    *xerr.Error
+	)
+	status := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &serr):
+		status, resp.SCIMType, resp.Detail = serr.Status(), serr.Type, serr.Detail
+	case errors.As(err, &e) && e.Kind != xerr.KindInternal:
+		status, resp.Detail = e.Kind.Status(), strings.Join(append([]string{e.Error()}, e.Details...), ", ")
+		if e.Kind == xerr.KindConflict {
+			resp.SCIMType = service.SCIMTypeUniqueness
+		}
+	default:
+		xlog.Error("internal-error", "err", err)
+		resp.Detail = xerr.ErrInternal.Message
+	}
+	resp.Status = strconv.Itoa(status)
+	return renderSCIM(c, status, resp)
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SessionHandler struct {
+	svc *service.SessionService
+}
+
+func NewSessionHandler(svc *service.SessionService) *SessionHandler {
+	return &SessionHandler{
+		svc: svc,
+	}
+}
+
+// Mount registers the session endpoints on the given Echo instance.
+// They act on the authenticated user, mw must authenticate requests.
+func (h *SessionHandler) Mount(e *echo.Echo, mw ...echo.MiddlewareFunc) {
+	g := e.Group("session", mw...)
+	g.GET("", h.List()).Name = "session-list"
+	g.DELETE("", h.RevokeAll()).Name = "session-revoke-all"
+	g.DELETE("/:session", h.Revoke()).Name = "session-revoke"
+}
+
+// List returns the sessions of the authenticated user
+// @Summary List sessions
+// @Description List the devices the authenticated user is logged in on, telling which one made the request
+// @ID session-list
+// @Tags session
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} service.Response{data=[]service.SessionView}
+// @Failure 401 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /session [get]
+func (h *SessionHandler) List() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sessions, err := h.svc.List(c.Request().Context())
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, service.NewResponse(http.StatusOK, nil, sessions))
+	}
+}
+
+// Revoke ends a session
+// @Summary Revoke a session
+// @Description Log the authenticated user out of a device, the tokens of the session are rejected from now on
+// @ID session-revoke
+// @Tags session
+// @Security ApiKeyAuth
+// @Param session path string true "Session ID"
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 404 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /session/{session} [delete]
+func (h *SessionHandler) Revoke() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestSession
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.svc.Revoke(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// RevokeAll ends every session
+// @Summary Revoke every session
+// @Description Log the authenticated user out of every device, the current one included
+// @ID session-revoke-all
+// @Tags session
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 401 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /session [delete]
+func (h *SessionHandler) RevokeAll() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h.svc.RevokeAll(c.Request().Context()); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type TwoFactorHandler struct {
+	svc *service.TwoFactorService
+}
+
+func NewTwoFactorHandler(svc *service.TwoFactorService) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		svc: svc,
+	}
+}
+
+// Mount registers the two-factor authentication endpoints on the given Echo instance.
+// They act on the authenticated user, mw must authenticate requests. They need no permission
+// so that users whose organization requires a second factor can enroll one.
+func (h *TwoFactorHandler) Mount(e *echo.Echo, mw ...echo.MiddlewareFunc) {
+	g := e.Group("2fa", mw...)
+	g.GET("", h.Status()).Name = "2fa-status"
+	g.POST("/enroll", h.Enroll()).Name = "2fa-enroll"
+	g.POST("/confirm", h.Confirm()).Name = "2fa-confirm"
+	g.POST("/recovery-codes", h.RegenerateRecoveryCodes()).Name = "2fa-recovery-codes"
+	g.POST("/disable", h.Disable()).Name = "2fa-disable"
+}
+
+// Status returns the two-factor authentication state of the authenticated user
+// @Summary Get the two-factor authentication state
+// @Description Tell whether the authenticated user enabled two-factor authentication, whether their organization requires it and how many recovery codes are left
+// @ID 2fa-status
+// @Tags 2fa
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} service.Response{data=service.TwoFactorStatus}
+// @Failure 401 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /2fa [get]
+func (h *TwoFactorHandler) Status() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		status, err := h.svc.Status(c.Request().Context())
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, service.NewResponse(http.StatusOK, nil, status))
+	}
+}
+
+// Enroll generates a TOTP secret
+// @Summary Enroll an authenticator
+// @Description Generate a TOTP secret for the authenticated user along with its otpauth URI and QR code. Two-factor authentication is enabled once a code is confirmed
+// @ID 2fa-enroll
+// @Tags 2fa
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} service.Response{data=service.Enrollment}
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 409 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /2fa/enroll [post]
+func (h *TwoFactorHandler) Enroll() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		enrollment, err := h.svc.Enroll(c.Request().Context())
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, service.NewResponse(http.StatusOK, nil, enrollment))
+	}
+}
+
+// Confirm enables two-factor authentication
+// @Summary Confirm an authenticator
+// @Description Enable two-factor authentication with a first code of the enrolled secret. The recovery codes are only returned once
+// @ID 2fa-confirm
+// @Tags 2fa
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param request body service.RequestTwoFactorCode true "Code of the authenticator"
+// @Success 200 {object} service.Response{data=service.RecoveryCodes}
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 409 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /2fa/confirm [post]
+func (h *TwoFactorHandler) Confirm() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestTwoFactorCode
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		codes, err := h.svc.Confirm(c.Request().Context(), req)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, service.NewResponse(http.StatusOK, nil, codes))
+	}
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes
+// @Summary Regenerate recovery codes
+// @Description Replace the recovery codes of the authenticated user, the previous ones can not be used anymore
+// @ID 2fa-recovery-codes
+// @Tags 2fa
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param request body service.RequestTwoFactorCode true "Code of the authenticator"
+// @Success 200 {object} service.Response{data=service.RecoveryCodes}
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /2fa/recovery-codes [post]
+func (h *TwoFactorHandler) RegenerateRecoveryCodes() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestTwoFactorCode
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		codes, err := h.svc.RegenerateRecoveryCodes(c.Request().Context(), req)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, service.NewResponse(http.StatusOK, nil, codes))
+	}
+}
+
+// Disable disables two-factor authentication
+// @Summary Disable two-factor authentication
+// @Description Remove the authenticator and recovery codes of the authenticated user, unless their organization requires a second factor
+// @ID 2fa-disable
+// @Tags 2fa
+// @Security ApiKeyAuth
+// @Accept json
+// @Param request body service.RequestTwoFactorDisable true "Password and code"
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /2fa/disable [post]
+func (h *TwoFactorHandler) Disable() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestTwoFactorDisable
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.svc.Disable(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
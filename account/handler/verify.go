@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"ekolo/account/service"
+	generic "ekolo/pkg/echogeneric"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type VerifyHandler struct {
+	verifier *service.Verifier
+}
+
+func NewVerifyHandler(verifier *service.Verifier) *VerifyHandler {
+	return &VerifyHandler{
+		verifier: verifier,
+	}
+}
+
+// Mount registers the email verification endpoints on the given Echo instance, they need no authentication
+func (h *VerifyHandler) Mount(e *echo.Echo) {
+	g := e.Group("email")
+	g.POST("/verify", h.Verify()).Name = "email-verify"
+	g.POST("/verify/resend", h.Resend()).Name = "email-verify-resend"
+}
+
+// Verify verifies an email address
+// @Summary Verify an email address
+// @Description Mark the email address of a user as verified with the token of a verification link
+// @ID email-verify
+// @Tags email
+// @Accept json
+// @Param request body service.RequestVerifyEmail true "Verification token"
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /email/verify [post]
+func (h *VerifyHandler) Verify() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestVerifyEmail
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.verifier.Verify(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// Resend sends a new verification link
+// @Summary Resend a verification link
+// @Description Send a new verification link to the unverified users having the email, the response does not tell whether any has
+// @ID email-verify-resend
+// @Tags email
+// @Accept json
+// @Param request body service.RequestVerifyResend true "Email of the account"
+// @Success 202
+// @Failure 400 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /email/verify/resend [post]
+func (h *VerifyHandler) Resend() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestVerifyResend
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.verifier.Resend(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
@@ -1,58 +1,173 @@
 package model
 
 import (
+	"ekolo/pkg/password"
+	"ekolo/pkg/rbac"
 	"ekolo/pkg/storage"
 	"ekolo/pkg/xlog"
+	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Organization is the organization model
 type Organization struct {
 	storage.BaseModel
-	Name  string  `json:"name"`
-	Email string  `json:"email"`
-	Phone *string `json:"phone"`
+	Name  string  `json:"name" validate:"required,max=255"`
+	Email string  `json:"email" validate:"omitempty,email"`
+	Phone *string `json:"phone" validate:"omitempty,max=32"`
+
+	RequireVerifiedEmail *bool `json:"require_verified_email"` // Users can neither log in nor act until their email address is verified.
+
+	// Types of users who can not act until they log in with a second factor
+	Require2FA []string `json:"require_2fa" gorm:"serializer:json" validate:"max=16,dive,max=64"`
 }
 
-// User is the user model
+// User is the account of a person, who belongs to organizations through memberships.
+// Email addresses identify accounts, only one account which is not deleted may use an address.
 type User struct {
 	storage.BaseModel
-	Email      string       `json:"email" gorm:"primaryKey;not null"`
-	Password   *string      `json:"password" `
-	FirstName  *string      `json:"first_name" `
-	LastName   *string      `json:"last_name" `
-	BirthDate  *string      `json:"birth_date" `
-	BirthPlace *string      `json:"birth_place" `
-	Address    *string      `json:"address" `
-	Phone      *string      `json:"phone" `
-	Type       *string      `json:"type" `
+	Email      string     `json:"email" gorm:"uniqueIndex:idx_users_unique_email,where:deleted_at IS NULL;not null" validate:"required,email"`
+	Password   *string    `json:"-"` // Hash of the password, it is never serialized.
+	FirstName  *string    `json:"first_name" validate:"omitempty,max=255"`
+	LastName   *string    `json:"last_name" validate:"omitempty,max=255"`
+	BirthDate  *string    `json:"birth_date" validate:"omitempty,datetime=2006-01-02"`
+	BirthPlace *string    `json:"birth_place" validate:"omitempty,max=255"`
+	Address    *string    `json:"address" validate:"omitempty,max=1024"`
+	Phone      *string    `json:"phone" validate:"omitempty,max=32"`
+	VerifiedAt *time.Time `json:"verified_at"` // Set once the user followed the link sent to their email address.
+}
+
+// Statuses of memberships
+const (
+	MembershipActive   = "active"
+	MembershipInactive = "inactive" // The user can not log into the organization.
+)
+
+// Membership makes a user a member of an organization with a role, a user may belong to several organizations
+type Membership struct {
+	storage.BaseModel
+	UserUUID   uuid.UUID    `json:"user" gorm:"uniqueIndex:idx_memberships_user_org,where:deleted_at IS NULL;not null"`
+	User       User         `json:"-" validate:"-"`
+	Type       *string      `json:"type" validate:"omitempty,max=64"` // Name of a role of the organization.
+	Status     string       `json:"status" gorm:"not null;default:active" validate:"omitempty,oneof=active inactive"`
+	ExternalID *string      `json:"external_id" validate:"omitempty,max=255"` // Identifier of the user in the system provisioning the organization.
+	OrgUUID    uuid.UUID    `json:"org" gorm:"index;uniqueIndex:idx_memberships_user_org"`
+	Org        Organization `json:"-" validate:"-"`
+}
+
+// Role grants permissions to the users of an organization whose type is its name
+type Role struct {
+	storage.BaseModel
+	Name        string            `json:"name" gorm:"uniqueIndex:idx_role_org_name,where:deleted_at IS NULL;not null"`
+	Description *string           `json:"description"`
+	Permissions []rbac.Permission `json:"permissions" gorm:"serializer:json"`
+	OrgUUID     uuid.UUID         `json:"org" gorm:"uniqueIndex:idx_role_org_name"`
+	Org         Organization      `json:"-" validate:"-"`
+}
+
+// PasswordReset is a single use token letting a user who forgot their password set a new one.
+// Only the hash of the token is stored.
+type PasswordReset struct {
+	storage.BaseModel
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null"`
+	UserUUID  uuid.UUID  `json:"user" gorm:"index"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// Invitation invites someone to join an organization as a user of the given type.
+// Only the hash of the token of the invitation link is stored.
+type Invitation struct {
+	storage.BaseModel
+	Email      string       `json:"email" gorm:"not null" validate:"required,email"`
+	Type       string       `json:"type" validate:"required,max=64"` // Name of a role of the organization.
+	TokenHash  string       `json:"-" gorm:"uniqueIndex;not null"`
+	ExpiresAt  time.Time    `json:"expires_at"`
+	AcceptedAt *time.Time   `json:"accepted_at"`
 	OrgUUID    uuid.UUID    `json:"org"`
-	Org        Organization `json:"-"`
+	Org        Organization `json:"-" validate:"-"`
+}
+
+// TwoFactor holds the TOTP secret of a user, two-factor authentication is enabled once a first code confirmed it
+type TwoFactor struct {
+	storage.BaseModel
+	UserUUID  uuid.UUID  `json:"user" gorm:"uniqueIndex:idx_two_factors_user_uuid,where:deleted_at IS NULL"`
+	Secret    string     `json:"-" gorm:"not null"`
+	EnabledAt *time.Time `json:"enabled_at"`
+	LastStep  int64      `json:"-"` // Time step of the last accepted code, a code can not be used twice.
+}
+
+// RecoveryCode is a single use code letting a user who lost their authenticator log in.
+// Only the hash of the code is stored.
+type RecoveryCode struct {
+	storage.BaseModel
+	CodeHash string     `json:"-" gorm:"not null"`
+	UserUUID uuid.UUID  `json:"user" gorm:"index"`
+	UsedAt   *time.Time `json:"used_at"`
 }
 
-func (u *User) SetPassword(password string) error {
-	hashBytePassword, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+// Session is a login of a user on a device, it lasts as long as its refresh tokens are rotated.
+// Revoking a session rejects its refresh tokens and, through the denylist, its access tokens.
+type Session struct {
+	storage.BaseModel
+	UserUUID   uuid.UUID  `json:"user" gorm:"index"`
+	Device     string     `json:"device"` // User agent of the client which logged in.
+	IP         string     `json:"ip"`     // Address the session was last seen from.
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+
+	// Membership the session logged into, its tokens act within the organization of the membership
+	MembershipUUID uuid.UUID `json:"membership" gorm:"index"`
+
+	// Platform administrator acting as the user through the session, if any.
+	// Such sessions can not be refreshed, they end after a short while.
+	Impersonator *uuid.UUID `json:"impersonator,omitempty"`
+}
+
+// APIKey authenticates a machine client on behalf of an organization, it is granted its scopes rather than a role.
+// Only the hash of the secret is stored, the secret is returned once when the key is created.
+type APIKey struct {
+	storage.BaseModel
+	Name       string            `json:"name" gorm:"not null" validate:"required,max=255"`
+	Prefix     string            `json:"prefix"` // Beginning of the secret, to tell keys apart.
+	SecretHash string            `json:"-" gorm:"uniqueIndex;not null"`
+	Scopes     []rbac.Permission `json:"scopes" gorm:"serializer:json"`
+	ExpiresAt  *time.Time        `json:"expires_at"` // Keys without expiry are valid until revoked.
+	LastUsedAt *time.Time        `json:"last_used_at"`
+	RevokedAt  *time.Time        `json:"revoked_at"`
+	CreatedBy  uuid.UUID         `json:"created_by"`
+	OrgUUID    uuid.UUID         `json:"org" gorm:"index"`
+	Org        Organization      `json:"-" validate:"-"`
+}
+
+// SetPassword replaces the password of the user by its hash
+func (u *User) SetPassword(h *password.Hasher, plain string) error {
+	hash, err := h.Hash(plain)
 	if err != nil {
 		xlog.Error("user", "set-password", err)
 		return err
 	}
-	hashPassword := string(hashBytePassword)
-	u.Password = &hashPassword
+	u.Password = &hash
 	return nil
 }
 
-func (u User) Authenticate(password string) error {
-	if err := bcrypt.CompareHashAndPassword([]byte(*u.Password), []byte(password)); err != nil {
-		xlog.Error("user", "authenticate", err)
-		return err
+// IsActive reports whether the membership was not deactivated
+func (m Membership) IsActive() bool {
+	return m.Status != MembershipInactive
+}
+
+// Authenticate checks the password of the user, rehash reports whether its hash is outdated
+func (u User) Authenticate(h *password.Hasher, plain string) (rehash bool, err error) {
+	if u.Password == nil {
+		return false, password.ErrMismatch
 	}
-	return nil
+	return h.Verify(*u.Password, plain)
 }
 
 func GetModels() []any {
 	return []any{
-		Organization{}, User{},
+		Organization{}, User{}, Membership{}, Role{}, PasswordReset{}, Invitation{}, TwoFactor{}, RecoveryCode{}, APIKey{}, Session{},
 	}
 }
@@ -0,0 +1,456 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// APIKeyPrefix starts every API key secret, telling them apart from access tokens
+	APIKeyPrefix = "ekolo_"
+	// apiKeyPrefixLen is the length of the beginning of a secret stored in clear to tell keys apart
+	apiKeyPrefixLen = len(APIKeyPrefix) + 6
+	// lastUsedPrecision bounds how often the last use of a key is written
+	lastUsedPrecision = time.Minute
+)
+
+var ErrInvalidAPIKey = xerr.Unauthenticated("invalid, expired or revoked API key")
+
+// APIKeyService is the service object
+type APIKeyService struct {
+	repo       storage.Storer
+	authorizer *rbac.Authorizer
+	now        func() time.Time
+}
+
+func (s APIKeyService) GetName() string {
+	return "organization/:org/api-key"
+}
+
+// GetPathParams returns service' path params
+func (s APIKeyService) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org"), generic.UUIDParam("key")}
+}
+
+// GetPermissions returns the permissions required by an operation
+func (s APIKeyService) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpCreate:
+		return []rbac.Permission{rbac.APIKeyCreate}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.APIKeyUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.APIKeyDelete}
+	default:
+		return []rbac.Permission{rbac.APIKeyRead}
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s APIKeyService) GetFilters() storage.Filters {
+	return storage.Filters{
+		"name":         {storage.OpEq, storage.OpIContains},
+		"prefix":       {storage.OpEq},
+		"revoked_at":   {storage.OpIsNull, storage.OpGte, storage.OpLte},
+		"expires_at":   {storage.OpIsNull, storage.OpGte, storage.OpLte},
+		"last_used_at": {storage.OpIsNull, storage.OpGte, storage.OpLte},
+		"created_at":   {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s APIKeyService) GetSortFields() []string {
+	return []string{"name", "expires_at", "last_used_at", "created_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s APIKeyService) GetDefaultSort() []string {
+	return []string{"-created_at"}
+}
+
+// GetRequest returns the request object for the service
+func (s APIKeyService) GetRequest(name string) generic.IRequest {
+	switch name {
+	case "create":
+		return &RequestAPIKeyCreate{}
+	case "get":
+		return &RequestAPIKeyGet{}
+	case "list":
+		return &RequestAPIKeyList{}
+	case "update":
+		return &RequestAPIKeyUpdate{}
+	case "delete":
+		return &RequestAPIKeyDelete{}
+	default:
+		return RequestAPIKey{}
+	}
+}
+
+// NewAPIKeyService returns a new service
+func NewAPIKeyService(repo storage.Storer) *APIKeyService {
+	return &APIKeyService{
+		repo:       repo,
+		authorizer: rbac.NewAuthorizer(NewRoleResolver(repo)),
+		now:        time.Now,
+	}
+}
+
+// RequestAPIKey is the request object for the service
+type RequestAPIKey struct{}
+
+func (r RequestAPIKey) GetID() string {
+	return "key"
+}
+
+// PayloadAPIKey is the struct representing the create request payload
+type PayloadAPIKey struct {
+	Name      string            `json:"name" validate:"required,max=255"`
+	Scopes    []rbac.Permission `json:"scopes" validate:"required,min=1,max=64"` // Permissions granted to the key, the creator must hold them.
+	ExpiresAt *time.Time        `json:"expires_at"`                              // The key never expires when empty.
+}
+
+// PayloadAPIKeyUpdate is the struct representing the update request payload
+type PayloadAPIKeyUpdate struct {
+	Name      *string           `json:"name" validate:"omitempty,max=255"`
+	Scopes    []rbac.Permission `json:"scopes" validate:"omitempty,max=64"`
+	ExpiresAt *time.Time        `json:"expires_at"`
+}
+
+// APIKeyCreated is a key along with its secret, which is only returned when the key is created
+type APIKeyCreated struct {
+	model.APIKey
+	Secret string `json:"secret"`
+}
+
+// RequestAPIKeyCreate is the request object for the create method
+type RequestAPIKeyCreate struct {
+	RequestAPIKey
+	PayloadAPIKey
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestAPIKeyGet is the request object for the get method
+type RequestAPIKeyGet struct {
+	RequestAPIKey
+	OrgParam uuid.UUID `param:"org" json:"-"`
+	KeyParam uuid.UUID `param:"key" json:"-"`
+}
+
+// RequestAPIKeyList is the request object for the list method
+type RequestAPIKeyList struct {
+	RequestAPIKey
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestAPIKeyUpdate is the request object for the update method
+type RequestAPIKeyUpdate struct {
+	RequestAPIKey
+	KeyParam uuid.UUID `param:"key" json:"-"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
+	PayloadAPIKeyUpdate
+}
+
+// RequestAPIKeyDelete is the request object for the delete method
+type RequestAPIKeyDelete struct {
+	RequestAPIKey
+	KeyParam uuid.UUID `param:"key" json:"-"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// Create creates an API key
+// @Summary Create an API key
+// @Description Create an API key authenticating a machine client on behalf of an organization. The secret is only returned by this call, send it as a bearer token
+// @ID key-create
+// @Tags api-key
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param key body PayloadAPIKey true "API key data"
+// @Success 200 {object} Response{data=APIKeyCreated}
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 422 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/api-key [post]
+func (s APIKeyService) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestAPIKeyCreate)
+	if p, _ := principal.FromContext(ctx); p.Impersonated() {
+		return nil, principal.ErrImpersonated
+	}
+	if err := s.checkScopes(ctx, r.OrgParam, r.Scopes); err != nil {
+		return nil, err
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(s.now()) {
+		return nil, xerr.Validation("validation failed", "expires_at: must be in the future")
+	}
+	plain, hash, err := token.New()
+	if err != nil {
+		return nil, err
+	}
+	secret := APIKeyPrefix + plain
+	key := model.APIKey{
+		Name:       r.Name,
+		Prefix:     secret[:apiKeyPrefixLen],
+		SecretHash: hash,
+		Scopes:     r.Scopes,
+		ExpiresAt:  r.ExpiresAt,
+		OrgUUID:    r.OrgParam,
+	}
+	if p, ok := principal.FromContext(ctx); ok {
+		key.CreatedBy = p.UserUUID
+	}
+	if _, err := s.repo.WithContext(ctx).Create(&key); err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, APIKeyCreated{APIKey: key, Secret: secret}), nil
+}
+
+// Get gets an API key
+// @Summary Get an API key
+// @Description Get an API key, its secret is never returned
+// @ID key-get
+// @Tags api-key
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param key path string true "API key ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/api-key/{key} [get]
+func (s APIKeyService) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	var (
+		r      = req.(*RequestAPIKeyGet)
+		key    model.APIKey
+		filter = map[string]any{
+			"uuid":     r.KeyParam,
+			"org_uuid": r.OrgParam,
+		}
+	)
+	_, err := s.repo.WithContext(ctx).Get(&key, filter)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, key), nil
+}
+
+// List lists API keys
+// @Summary List API keys
+// @Description List the API keys of an organization, revoked ones included
+// @ID keys-get
+// @Tags api-key
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
+// @Success 200 {object} generic.Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/api-key [get]
+func (s APIKeyService) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
+	var (
+		r    = req.(*RequestAPIKeyList)
+		keys []model.APIKey
+	)
+	filter["org_uuid"] = r.OrgParam
+	total, err := s.repo.WithContext(ctx).Count(&keys, filter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.repo.WithContext(ctx).List(&keys, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return generic.NewListResponse(200, keys, total, opts), nil
+}
+
+// Update updates an API key
+// @Summary Update an API key
+// @Description Rename an API key, change its scopes or its expiry. Revoked keys can not be updated
+// @ID key-update
+// @Tags api-key
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param key path string true "API key ID"
+// @Param payload body PayloadAPIKeyUpdate true "API key data"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/api-key/{key} [patch]
+func (s APIKeyService) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestAPIKeyUpdate)
+	if p, _ := principal.FromContext(ctx); p.Impersonated() {
+		return nil, principal.ErrImpersonated
+	}
+	if r.Scopes != nil {
+		if err := s.checkScopes(ctx, r.OrgParam, r.Scopes); err != nil {
+			return nil, err
+		}
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(s.now()) {
+		return nil, xerr.Validation("validation failed", "expires_at: must be in the future")
+	}
+	var key model.APIKey
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Get(&key, map[string]any{"uuid": r.KeyParam, "org_uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return xerr.Conflict("API key revoked")
+		}
+		if r.Name != nil {
+			key.Name = *r.Name
+		}
+		if r.Scopes != nil {
+			key.Scopes = r.Scopes
+		}
+		if r.ExpiresAt != nil {
+			key.ExpiresAt = r.ExpiresAt
+		}
+		_, err := tx.Update(&key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, key), nil
+}
+
+// Delete revokes an API key
+// @Summary Revoke an API key
+// @Description Revoke an API key, requests authenticated by it are rejected from now on. The key is still listed
+// @ID key-delete
+// @Tags api-key
+// @Security ApiKeyAuth
+// @Param org path string true "Organization ID"
+// @Param key path string true "API key ID"
+// @Success 204
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/api-key/{key} [delete]
+func (s APIKeyService) Delete(ctx context.Context, req generic.IRequest) error {
+	r := req.(*RequestAPIKeyDelete)
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		var key model.APIKey
+		if _, err := tx.Get(&key, map[string]any{"uuid": r.KeyParam, "org_uuid": r.OrgParam}); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return xerr.NotFound("API key not found")
+			}
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+		now := s.now()
+		_, err := tx.Update(&model.APIKey{BaseModel: storage.BaseModel{UUID: key.UUID}, RevokedAt: &now})
+		return err
+	})
+}
+
+// checkScopes returns a validation error listing the scopes which are unknown or which the caller does not hold itself,
+// so that a key never grants more than its creator.
+func (s APIKeyService) checkScopes(ctx context.Context, org uuid.UUID, scopes []rbac.Permission) error {
+	details := []string{}
+	for i, scope := range scopes {
+		switch {
+		case !rbac.IsKnown(scope):
+			details = append(details, fmt.Sprintf("scopes.%d: unknown permission %s", i, scope))
+		case rbac.IsPlatform(scope):
+			details = append(details, fmt.Sprintf("scopes.%d: %s can not be granted by a key", i, scope))
+		default:
+			err := s.authorizer.Authorize(ctx, org, scope)
+			if errors.Is(err, xerr.ErrForbidden) {
+				details = append(details, fmt.Sprintf("scopes.%d: %s is not granted to you", i, scope))
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	if len(details) > 0 {
+		return xerr.Validation("validation failed", details...)
+	}
+	return nil
+}
+
+// APIKeyVerifier authenticates requests holding an API key
+type APIKeyVerifier struct {
+	repo storage.Storer
+	now  func() time.Time
+}
+
+// NewAPIKeyVerifier returns a new verifier, keys are looked up by secret across organizations so repo must not be scoped to one
+func NewAPIKeyVerifier(repo storage.Storer) *APIKeyVerifier {
+	return &APIKeyVerifier{
+		repo: repo,
+		now:  time.Now,
+	}
+}
+
+// Verify returns the principal of a valid API key, granted the scopes of the key within its organization.
+// The last use of the key is recorded with a precision of a minute to spare writes.
+func (v APIKeyVerifier) Verify(ctx context.Context, secret string) (principal.Principal, error) {
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		return principal.Principal{}, ErrInvalidAPIKey
+	}
+	var key model.APIKey
+	if _, err := v.repo.WithContext(ctx).Get(&key, map[string]any{"secret_hash": token.Hash(strings.TrimPrefix(secret, APIKeyPrefix))}); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return principal.Principal{}, ErrInvalidAPIKey
+		}
+		return principal.Principal{}, err
+	}
+	now := v.now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) {
+		return principal.Principal{}, ErrInvalidAPIKey
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedPrecision {
+		used := model.APIKey{BaseModel: storage.BaseModel{UUID: key.UUID}, LastUsedAt: &now}
+		if _, err := v.repo.WithContext(ctx).Update(&used); err != nil {
+			xlog.Warn("api-key-last-used", "key", key.UUID, "err", err)
+		}
+	}
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = string(scope)
+	}
+	return principal.Principal{OrgUUID: key.OrgUUID, Verified: true, TwoFactor: true, APIKey: key.UUID, Scopes: scopes}, nil
+}
+
+// APIKeyService is the service interface
+var _ generic.IService = new(APIKeyService)
+var _ generic.IFilterable = new(APIKeyService)
+var _ generic.ISortable = new(APIKeyService)
+var _ generic.IAuthorized = new(APIKeyService)
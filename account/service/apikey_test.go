@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAPIKeyService(t *testing.T) {
+	var (
+		raw      = storage.NewMemoryStore()
+		store    = tenant.NewStore(raw, tenant.DefaultField)
+		svc      = NewAPIKeyService(store)
+		verifier = NewAPIKeyVerifier(raw)
+		org      = model.Organization{Name: "school"}
+	)
+	_, err := raw.Create(&org)
+	assert.Assert(t, err, nil)
+	manager := principal.Principal{UserUUID: uuid.New(), OrgUUID: org.UUID, Type: TypeMANAGER, Verified: true}
+	ctx := principal.NewContext(tenant.NewContext(context.Background(), org.UUID), manager)
+
+	// Keys can not grant more than their creator holds
+	for _, scopes := range [][]rbac.Permission{{"tag:publish"}, {rbac.OrgList}, {rbac.All}} {
+		_, err = svc.Create(ctx, &RequestAPIKeyCreate{OrgParam: org.UUID, PayloadAPIKey: PayloadAPIKey{Name: "sis", Scopes: scopes}})
+		assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+	}
+	past := time.Now().Add(-time.Minute)
+	_, err = svc.Create(ctx, &RequestAPIKeyCreate{OrgParam: org.UUID, PayloadAPIKey: PayloadAPIKey{Name: "sis", Scopes: []rbac.Permission{rbac.TagRead}, ExpiresAt: &past}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+
+	// Keys would outlive an impersonation
+	impersonated := manager
+	impersonated.Impersonator = uuid.New()
+	_, err = svc.Create(principal.NewContext(ctx, impersonated), &RequestAPIKeyCreate{OrgParam: org.UUID, PayloadAPIKey: PayloadAPIKey{Name: "sis", Scopes: []rbac.Permission{rbac.TagRead}}})
+	assert.Assert(t, errors.Is(err, principal.ErrImpersonated), true)
+
+	resp, err := svc.Create(ctx, &RequestAPIKeyCreate{OrgParam: org.UUID, PayloadAPIKey: PayloadAPIKey{Name: "sis", Scopes: []rbac.Permission{"tag:*", rbac.UserRead}}})
+	assert.Assert(t, err, nil)
+	created := resp.(Response).Data.(APIKeyCreated)
+	assert.Assert(t, strings.HasPrefix(created.Secret, APIKeyPrefix), true)
+	assert.Assert(t, strings.HasPrefix(created.Secret, created.Prefix), true)
+	assert.Assert(t, created.CreatedBy, manager.UserUUID)
+
+	// Only the hash of the secret is stored
+	var stored model.APIKey
+	_, err = raw.Get(&stored, map[string]any{"uuid": created.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, stored.SecretHash, token.Hash(strings.TrimPrefix(created.Secret, APIKeyPrefix)))
+	assert.Assert(t, stored.LastUsedAt == nil, true)
+
+	// The key authenticates as its organization with its scopes
+	p, err := verifier.Verify(context.Background(), created.Secret)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p, principal.Principal{OrgUUID: org.UUID, Verified: true, TwoFactor: true, APIKey: created.UUID, Scopes: []string{"tag:*", "user:read"}})
+	_, err = raw.Get(&stored, map[string]any{"uuid": created.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, stored.LastUsedAt != nil, true)
+	_, err = verifier.Verify(context.Background(), created.Secret+"x")
+	assert.Assert(t, errors.Is(err, ErrInvalidAPIKey), true)
+
+	// Keys are changed under the same rules as they are created
+	_, err = svc.Update(principal.NewContext(ctx, impersonated), &RequestAPIKeyUpdate{OrgParam: org.UUID, KeyParam: created.UUID, PayloadAPIKeyUpdate: PayloadAPIKeyUpdate{Scopes: []rbac.Permission{rbac.TagRead}}})
+	assert.Assert(t, errors.Is(err, principal.ErrImpersonated), true)
+	_, err = svc.Update(ctx, &RequestAPIKeyUpdate{OrgParam: org.UUID, KeyParam: created.UUID, PayloadAPIKeyUpdate: PayloadAPIKeyUpdate{ExpiresAt: &past}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+	_, err = raw.Get(&stored, map[string]any{"uuid": created.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, stored.ExpiresAt == nil, true)
+	assert.Assert(t, stored.Scopes, []rbac.Permission{"tag:*", rbac.UserRead})
+
+	// Keys expire
+	soon := time.Now().Add(time.Hour)
+	_, err = svc.Update(ctx, &RequestAPIKeyUpdate{OrgParam: org.UUID, KeyParam: created.UUID, PayloadAPIKeyUpdate: PayloadAPIKeyUpdate{ExpiresAt: &soon}})
+	assert.Assert(t, err, nil)
+	verifier.now = func() time.Time { return soon }
+	_, err = verifier.Verify(context.Background(), created.Secret)
+	assert.Assert(t, errors.Is(err, ErrInvalidAPIKey), true)
+	verifier.now = time.Now
+
+	// Revoked keys are rejected but still listed, keys of other organizations can not be revoked
+	other := tenant.NewContext(context.Background(), uuid.New())
+	err = svc.Delete(other, &RequestAPIKeyDelete{OrgParam: org.UUID, KeyParam: created.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	assert.Assert(t, svc.Delete(ctx, &RequestAPIKeyDelete{OrgParam: org.UUID, KeyParam: created.UUID}), nil)
+	_, err = verifier.Verify(context.Background(), created.Secret)
+	assert.Assert(t, errors.Is(err, ErrInvalidAPIKey), true)
+	_, err = svc.Update(ctx, &RequestAPIKeyUpdate{OrgParam: org.UUID, KeyParam: created.UUID, PayloadAPIKeyUpdate: PayloadAPIKeyUpdate{ExpiresAt: &soon}})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	n, err := raw.Count(&model.APIKey{}, map[string]any{"org_uuid": org.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
@@ -0,0 +1,516 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/mailer"
+	"ekolo/pkg/password"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+var ErrInvalidInvitation = xerr.Invalid("invalid or expired invitation")
+
+// InvitationOptions configures the invitation links
+type InvitationOptions struct {
+	URL string // Page of the web application accepting the invitation, the token is added to its query.
+	TTL time.Duration
+}
+
+// InvitationService is the service object
+type InvitationService struct {
+	repo   storage.Storer
+	mailer mailer.Mailer
+	opts   InvitationOptions
+	now    func() time.Time
+}
+
+func (s InvitationService) GetName() string {
+	return "organization/:org/invitation"
+}
+
+// GetPathParams returns service' path params
+func (s InvitationService) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org"), generic.UUIDParam("invitation")}
+}
+
+// GetPermissions returns the permissions required by an operation
+func (s InvitationService) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpCreate:
+		return []rbac.Permission{rbac.InvitationCreate}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.InvitationUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.InvitationDelete}
+	default:
+		return []rbac.Permission{rbac.InvitationRead}
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s InvitationService) GetFilters() storage.Filters {
+	return storage.Filters{
+		"email":       {storage.OpEq, storage.OpIContains},
+		"type":        {storage.OpEq, storage.OpIn},
+		"accepted_at": {storage.OpIsNull, storage.OpGte, storage.OpLte},
+		"expires_at":  {storage.OpGte, storage.OpLte},
+		"created_at":  {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s InvitationService) GetSortFields() []string {
+	return []string{"email", "type", "expires_at", "created_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s InvitationService) GetDefaultSort() []string {
+	return []string{"-created_at"}
+}
+
+// GetRequest returns the request object for the service
+func (s InvitationService) GetRequest(name string) generic.IRequest {
+	switch name {
+	case "create":
+		return &RequestInvitationCreate{}
+	case "get":
+		return &RequestInvitationGet{}
+	case "list":
+		return &RequestInvitationList{}
+	case "update":
+		return &RequestInvitationUpdate{}
+	case "delete":
+		return &RequestInvitationDelete{}
+	default:
+		return RequestInvitation{}
+	}
+}
+
+// NewInvitationService returns a new service
+func NewInvitationService(repo storage.Storer, m mailer.Mailer, opts InvitationOptions) *InvitationService {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultInvitationTTL
+	}
+	return &InvitationService{
+		repo:   repo,
+		mailer: m,
+		opts:   opts,
+		now:    time.Now,
+	}
+}
+
+// RequestInvitation is the request object for the service
+type RequestInvitation struct{}
+
+func (r RequestInvitation) GetID() string {
+	return "invitation"
+}
+
+// PayloadInvitation is the struct representing the create request payload
+type PayloadInvitation struct {
+	Email string `json:"email" validate:"required,email"`
+	Type  string `json:"type" validate:"required,max=64"` // Name of a role of the organization.
+}
+
+// PayloadInvitationUpdate is the struct representing the update request payload.
+// Updating an invitation sends a new link, the previous one can not be used anymore.
+type PayloadInvitationUpdate struct {
+	Type *string `json:"type" validate:"omitempty,max=64"`
+}
+
+// RequestInvitationCreate is the request object for the create method
+type RequestInvitationCreate struct {
+	RequestInvitation
+	PayloadInvitation
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestInvitationGet is the request object for the get method
+type RequestInvitationGet struct {
+	RequestInvitation
+	OrgParam        uuid.UUID `param:"org" json:"-"`
+	InvitationParam uuid.UUID `param:"invitation" json:"-"`
+}
+
+// RequestInvitationList is the request object for the list method
+type RequestInvitationList struct {
+	RequestInvitation
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestInvitationUpdate is the request object for the update method
+type RequestInvitationUpdate struct {
+	RequestInvitation
+	InvitationParam uuid.UUID `param:"invitation" json:"-"`
+	OrgParam        uuid.UUID `param:"org" json:"-"`
+	PayloadInvitationUpdate
+}
+
+// RequestInvitationDelete is the request object for the delete method
+type RequestInvitationDelete struct {
+	RequestInvitation
+	InvitationParam uuid.UUID `param:"invitation" json:"-"`
+	OrgParam        uuid.UUID `param:"org" json:"-"`
+}
+
+// Create creates an invitation and sends its link
+// @Summary Invite a user
+// @Description Invite someone to join an organization as a user of the given type, a link to accept the invitation is sent to their email address
+// @ID invitation-create
+// @Tags invitation
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param invitation body PayloadInvitation true "Invitation data"
+// @Success 201 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/invitation [post]
+func (s InvitationService) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestInvitationCreate)
+	invitation := model.Invitation{Email: r.Email, Type: r.Type, OrgUUID: r.OrgParam}
+	var plain string
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := checkInvitationType(tx, invitation); err != nil {
+			return err
+		}
+		if err := checkInvitationEmail(tx, invitation); err != nil {
+			return err
+		}
+		var err error
+		if plain, err = s.renew(&invitation); err != nil {
+			return err
+		}
+		_, err = tx.Create(&invitation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mailer.Send(ctx, s.newMessage(invitation, plain)); err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, invitation), nil
+}
+
+// Get gets an invitation
+// @Summary Get an invitation
+// @Description Get an invitation
+// @ID invitation-get
+// @Tags invitation
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param invitation path string true "Invitation ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/invitation/{invitation} [get]
+func (s InvitationService) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	var (
+		r          = req.(*RequestInvitationGet)
+		invitation model.Invitation
+		filter     = map[string]any{
+			"uuid":     r.InvitationParam,
+			"org_uuid": r.OrgParam,
+		}
+	)
+	_, err := s.repo.WithContext(ctx).Get(&invitation, filter)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, invitation), nil
+}
+
+// List lists invitations
+// @Summary List invitations
+// @Description List the invitations of an organization
+// @ID invitations-get
+// @Tags invitation
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
+// @Success 200 {object} generic.Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/invitation [get]
+func (s InvitationService) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
+	var (
+		r           = req.(*RequestInvitationList)
+		invitations []model.Invitation
+	)
+	filter["org_uuid"] = r.OrgParam
+	total, err := s.repo.WithContext(ctx).Count(&invitations, filter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.repo.WithContext(ctx).List(&invitations, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return generic.NewListResponse(200, invitations, total, opts), nil
+}
+
+// Update renews an invitation and sends its new link
+// @Summary Renew an invitation
+// @Description Send a new link to accept a pending invitation, optionally changing its type. The previous link can not be used anymore
+// @ID invitation-update
+// @Tags invitation
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param invitation path string true "Invitation ID"
+// @Param payload body PayloadInvitationUpdate true "Invitation data"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/invitation/{invitation} [patch]
+func (s InvitationService) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestInvitationUpdate)
+	var (
+		invitation model.Invitation
+		plain      string
+	)
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Get(&invitation, map[string]any{"uuid": r.InvitationParam, "org_uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if invitation.AcceptedAt != nil {
+			return xerr.Conflict("invitation already accepted")
+		}
+		if r.Type != nil {
+			invitation.Type = *r.Type
+			if err := checkInvitationType(tx, invitation); err != nil {
+				return err
+			}
+		}
+		var err error
+		if plain, err = s.renew(&invitation); err != nil {
+			return err
+		}
+		n, err := tx.Update(&invitation)
+		if err == nil && n == 0 {
+			return xerr.NotFound("invitation not found")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mailer.Send(ctx, s.newMessage(invitation, plain)); err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, invitation), nil
+}
+
+// Delete deletes an invitation
+// @Summary Revoke an invitation
+// @Description Delete an invitation, its link can not be used anymore
+// @ID invitation-delete
+// @Tags invitation
+// @Security ApiKeyAuth
+// @Param org path string true "Organization ID"
+// @Param invitation path string true "Invitation ID"
+// @Success 204
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/invitation/{invitation} [delete]
+func (s InvitationService) Delete(ctx context.Context, req generic.IRequest) error {
+	r := req.(*RequestInvitationDelete)
+	n, err := s.repo.WithContext(ctx).Delete(&model.Invitation{}, map[string]any{"uuid": r.InvitationParam, "org_uuid": r.OrgParam})
+	if err == nil && n == 0 {
+		return xerr.NotFound("invitation not found")
+	}
+	return err
+}
+
+// renew sets a new token and expiry on an invitation, it returns the token to send
+func (s InvitationService) renew(invitation *model.Invitation) (string, error) {
+	plain, hash, err := token.New()
+	if err != nil {
+		return "", err
+	}
+	invitation.TokenHash = hash
+	invitation.ExpiresAt = s.now().Add(s.opts.TTL)
+	return plain, nil
+}
+
+// newMessage returns the email holding the link of an invitation
+func (s InvitationService) newMessage(invitation model.Invitation, plain string) mailer.Message {
+	link := s.opts.URL
+	if target, err := url.Parse(s.opts.URL); err == nil {
+		query := target.Query()
+		query.Set("token", plain)
+		target.RawQuery = query.Encode()
+		link = target.String()
+	}
+	body := fmt.Sprintf("You are invited to join ekolo.\n\n"+
+		"Follow this link to choose your password, it expires on %s:\n%s", invitation.ExpiresAt.UTC().Format(time.RFC1123), link)
+	return mailer.Message{To: invitation.Email, Subject: "You are invited to ekolo", Body: body}
+}
+
+// checkInvitationType returns a validation error unless the type of an invitation names a role of its organization
+func checkInvitationType(repo storage.Storer, invitation model.Invitation) error {
+	return checkUserType(repo, model.Membership{Type: &invitation.Type, OrgUUID: invitation.OrgUUID})
+}
+
+// checkInvitationEmail returns a conflict error when the email is already a user of the organization
+func checkInvitationEmail(repo storage.Storer, invitation model.Invitation) error {
+	var users []model.User
+	if _, err := repo.List(&users, map[string]any{"email": invitation.Email}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	n, err := repo.Count(&model.Membership{}, map[string]any{"org_uuid": invitation.OrgUUID, "user_uuid": userUUIDs(users)})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errAlreadyMember(invitation.Email)
+	}
+	return nil
+}
+
+// InvitationAcceptor lets invitees accept their invitation by choosing their password
+type InvitationAcceptor struct {
+	repo    storage.Storer
+	hasher  *password.Hasher
+	limiter *lockout.Limiter
+	now     func() time.Time
+}
+
+// NewInvitationAcceptor returns a new acceptor, invitations are looked up by token across organizations so repo must not be scoped to one.
+// limiter throttles the passwords given for invitees who already have an account, it is kept in memory when nil.
+func NewInvitationAcceptor(repo storage.Storer, hasher *password.Hasher, limiter *lockout.Limiter) *InvitationAcceptor {
+	return &InvitationAcceptor{
+		repo:    repo,
+		hasher:  hasher,
+		limiter: accountLimiter(limiter),
+		now:     time.Now,
+	}
+}
+
+// RequestInvitationAccept is the payload of the invitation acceptance endpoint
+type RequestInvitationAccept struct {
+	Token     string  `json:"token" validate:"required"`
+	Password  string  `json:"password" validate:"required,min=8,maxbytes=72"`
+	FirstName *string `json:"first_name" validate:"omitempty,max=255"`
+	LastName  *string `json:"last_name" validate:"omitempty,max=255"`
+}
+
+// Accept makes the invitee of a valid invitation a user of its organization, the invitation can not be used anymore.
+// An account is created unless the email address already has one, whose password must then be given.
+// The email address of the user is verified since the invitation link was sent to it.
+func (a InvitationAcceptor) Accept(ctx context.Context, req RequestInvitationAccept) (model.User, error) {
+	invitation, err := getInvitation(a.repo.WithContext(ctx), req.Token, a.now())
+	if err != nil {
+		return model.User{}, err
+	}
+	// The invitee may already have an account through another organization, which only its password unlocks
+	account, err := findAccount(a.repo.WithContext(ctx), invitation.Email)
+	if err != nil {
+		return model.User{}, err
+	}
+	if account != nil {
+		if err := authenticateAccount(ctx, a.limiter, a.hasher, *account, req.Password); err != nil {
+			return model.User{}, err
+		}
+	}
+	var user model.User
+	err = a.repo.WithTx(ctx, func(tx storage.Storer) error {
+		now := a.now()
+		invitation, err := getInvitation(tx, req.Token, now)
+		if err != nil {
+			return err
+		}
+		// The role may have been removed since the invitation was sent
+		if err := checkInvitationType(tx, invitation); err != nil {
+			return err
+		}
+		// The invitation is accepted only if no concurrent acceptance accepted it first
+		n, err := tx.UpdateWhere(&model.Invitation{BaseModel: storage.BaseModel{UUID: invitation.UUID}, AcceptedAt: &now}, map[string]any{"accepted_at__isnull": true})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrInvalidInvitation
+		}
+		if account != nil {
+			user = *account
+			if user.VerifiedAt == nil {
+				user.VerifiedAt = &now
+				if _, err := tx.Update(&model.User{BaseModel: storage.BaseModel{UUID: user.UUID}, VerifiedAt: &now}); err != nil {
+					return err
+				}
+			}
+		} else {
+			user = model.User{Email: invitation.Email, FirstName: req.FirstName, LastName: req.LastName, VerifiedAt: &now}
+			if err := user.SetPassword(a.hasher, req.Password); err != nil {
+				return err
+			}
+			if _, err := tx.Create(&user); err != nil {
+				return err
+			}
+		}
+		m := model.Membership{UserUUID: user.UUID, OrgUUID: invitation.OrgUUID, Type: &invitation.Type, Status: model.MembershipActive}
+		return createMembership(tx, &m, invitation.Email)
+	})
+	return user, err
+}
+
+// getInvitation returns the invitation of a token which can still be accepted at now
+func getInvitation(repo storage.Storer, plain string, now time.Time) (model.Invitation, error) {
+	var invitation model.Invitation
+	_, err := repo.Get(&invitation, map[string]any{"token_hash": token.Hash(plain)})
+	if errors.Is(err, storage.ErrNotFound) {
+		return invitation, ErrInvalidInvitation
+	}
+	if err != nil {
+		return invitation, err
+	}
+	if invitation.AcceptedAt != nil || !now.Before(invitation.ExpiresAt) {
+		return invitation, ErrInvalidInvitation
+	}
+	return invitation, nil
+}
+
+// InvitationService is the service interface
+var _ generic.IService = new(InvitationService)
+var _ generic.IFilterable = new(InvitationService)
+var _ generic.ISortable = new(InvitationService)
+var _ generic.IAuthorized = new(InvitationService)
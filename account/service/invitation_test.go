@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestInvitationService(t *testing.T) {
+	var (
+		raw      = storage.NewMemoryStore()
+		store    = tenant.NewStore(raw, tenant.DefaultField)
+		hasher   = password.Default()
+		mails    = &outbox{}
+		svc      = NewInvitationService(store, mails, InvitationOptions{URL: "https://app.ekolo.io/invitation/accept"})
+		acceptor = NewInvitationAcceptor(raw, hasher, nil)
+		org      = uuid.New()
+		ctx      = tenant.NewContext(context.Background(), org)
+	)
+	manager := model.User{Email: "manager@ekolo.io"}
+	_, err := raw.Create(&manager)
+	assert.Assert(t, err, nil)
+	_, err = raw.Create(&model.Membership{UserUUID: manager.UUID, OrgUUID: org, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+
+	// Invitations name a role of the organization and someone who is not yet a user of it
+	_, err = svc.Create(ctx, &RequestInvitationCreate{OrgParam: org, PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: "JANITOR"}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+	_, err = svc.Create(ctx, &RequestInvitationCreate{OrgParam: org, PayloadInvitation: PayloadInvitation{Email: "manager@ekolo.io", Type: TypeTEACHER}})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	assert.Assert(t, len(mails.messages), 0)
+
+	resp, err := svc.Create(ctx, &RequestInvitationCreate{OrgParam: org, PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: TypeSTUDENT}})
+	assert.Assert(t, err, nil)
+	invitation := resp.(Response).Data.(model.Invitation)
+	assert.Assert(t, invitation.OrgUUID, org)
+	assert.Assert(t, len(mails.messages), 1)
+	assert.Assert(t, mails.messages[0].To, "ada@ekolo.io")
+	first := linkToken(t, mails.messages[0])
+	assert.Assert(t, invitation.TokenHash != first, true)
+
+	// Renewing an invitation voids its previous link
+	teacher := TypeTEACHER
+	resp, err = svc.Update(ctx, &RequestInvitationUpdate{OrgParam: org, InvitationParam: invitation.UUID, PayloadInvitationUpdate: PayloadInvitationUpdate{Type: &teacher}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(Response).Data.(model.Invitation).Type, TypeTEACHER)
+	assert.Assert(t, len(mails.messages), 2)
+	second := linkToken(t, mails.messages[1])
+	_, err = acceptor.Accept(ctx, RequestInvitationAccept{Token: first, Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, ErrInvalidInvitation), true)
+
+	// Other organizations can not see the invitation
+	other := tenant.NewContext(context.Background(), uuid.New())
+	_, err = svc.Get(other, &RequestInvitationGet{OrgParam: org, InvitationParam: invitation.UUID})
+	assert.Assert(t, errors.Is(err, storage.ErrNotFound), true)
+
+	user, err := acceptor.Accept(context.Background(), RequestInvitationAccept{Token: second, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, user.Email, "ada@ekolo.io")
+	assert.Assert(t, user.VerifiedAt != nil, true)
+	var m model.Membership
+	_, err = raw.Get(&m, map[string]any{"user_uuid": user.UUID, "org_uuid": org})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *m.Type, TypeTEACHER)
+	assert.Assert(t, m.Status, model.MembershipActive)
+	var stored model.User
+	_, err = raw.Get(&stored, map[string]any{"uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	_, err = stored.Authenticate(hasher, "s3cret")
+	assert.Assert(t, err, nil)
+
+	// Invitations are single use
+	_, err = acceptor.Accept(context.Background(), RequestInvitationAccept{Token: second, Password: "other"})
+	assert.Assert(t, errors.Is(err, ErrInvalidInvitation), true)
+	_, err = svc.Update(ctx, &RequestInvitationUpdate{OrgParam: org, InvitationParam: invitation.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	assert.Assert(t, svc.Delete(ctx, &RequestInvitationDelete{OrgParam: org, InvitationParam: invitation.UUID}), nil)
+	err = svc.Delete(ctx, &RequestInvitationDelete{OrgParam: org, InvitationParam: invitation.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+}
+
+func TestInvitationExpiry(t *testing.T) {
+	var (
+		store    = storage.NewMemoryStore()
+		mails    = &outbox{}
+		svc      = NewInvitationService(store, mails, InvitationOptions{URL: "https://app.ekolo.io/invitation/accept", TTL: time.Minute})
+		acceptor = NewInvitationAcceptor(store, password.Default(), nil)
+		ctx      = context.Background()
+	)
+	_, err := svc.Create(ctx, &RequestInvitationCreate{OrgParam: uuid.New(), PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: TypeSTUDENT}})
+	assert.Assert(t, err, nil)
+	acceptor.now = func() time.Time { return time.Now().Add(time.Minute) }
+	_, err = acceptor.Accept(ctx, RequestInvitationAccept{Token: linkToken(t, mails.messages[0]), Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, ErrInvalidInvitation), true)
+}
+
+func TestInvitationExistingAccount(t *testing.T) {
+	var (
+		store    = storage.NewMemoryStore()
+		hasher   = password.Default()
+		mails    = &outbox{}
+		svc      = NewInvitationService(store, mails, InvitationOptions{URL: "https://app.ekolo.io/invitation/accept"})
+		acceptor = NewInvitationAcceptor(store, hasher, nil)
+		ctx      = context.Background()
+		school   = uuid.New()
+		college  = uuid.New()
+	)
+	user := model.User{Email: "ada@ekolo.io"}
+	assert.Assert(t, user.SetPassword(hasher, "s3cret"), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: school, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+
+	// Someone who has an account joins another organization with it, which takes its password
+	_, err = svc.Create(ctx, &RequestInvitationCreate{OrgParam: college, PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: TypeTEACHER}})
+	assert.Assert(t, err, nil)
+	plain := linkToken(t, mails.messages[0])
+	_, err = acceptor.Accept(ctx, RequestInvitationAccept{Token: plain, Password: "guess"})
+	assert.Assert(t, errors.Is(err, ErrAccountPassword), true)
+	accepted, err := acceptor.Accept(ctx, RequestInvitationAccept{Token: plain, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, accepted.UUID, user.UUID)
+	n, err := store.Count(&model.Membership{}, map[string]any{"user_uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+
+	_, err = svc.Create(ctx, &RequestInvitationCreate{OrgParam: college, PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: TypeSTUDENT}})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	// A user joins an organization once, even when they joined it since they were invited
+	_, err = store.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: college, Status: model.MembershipActive})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	university := uuid.New()
+	_, err = svc.Create(ctx, &RequestInvitationCreate{OrgParam: university, PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: TypeTEACHER}})
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: university, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+	_, err = acceptor.Accept(ctx, RequestInvitationAccept{Token: linkToken(t, mails.messages[1]), Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	n, err = store.Count(&model.Membership{}, map[string]any{"user_uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(3))
+
+	// Leaving an organization lets the user join it again
+	_, err = store.Delete(&model.Membership{}, map[string]any{"user_uuid": user.UUID, "org_uuid": university})
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: university, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+}
+
+func TestInvitationAcceptConcurrent(t *testing.T) {
+	var (
+		store    = storage.NewMemoryStore()
+		mails    = &outbox{}
+		svc      = NewInvitationService(store, mails, InvitationOptions{URL: "https://app.ekolo.io/invitation/accept"})
+		acceptor = NewInvitationAcceptor(store, password.Default(), nil)
+		ctx      = context.Background()
+		org      = uuid.New()
+	)
+	_, err := svc.Create(ctx, &RequestInvitationCreate{OrgParam: org, PayloadInvitation: PayloadInvitation{Email: "ada@ekolo.io", Type: TypeSTUDENT}})
+	assert.Assert(t, err, nil)
+	plain := linkToken(t, mails.messages[0])
+
+	// An invitation accepted twice at once makes a single user
+	var (
+		wg       sync.WaitGroup
+		accepted atomic.Int32
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := acceptor.Accept(ctx, RequestInvitationAccept{Token: plain, Password: "s3cret"})
+			if err == nil {
+				accepted.Add(1)
+			} else if !errors.Is(err, ErrInvalidInvitation) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Assert(t, accepted.Load(), int32(1))
+	n, err := store.Count(&model.Membership{}, map[string]any{"org_uuid": org})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"ekolo/pkg/audit"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/storage"
+
+	"github.com/google/uuid"
+)
+
+// RequestUnlock is the payload of the unlock endpoint
+type RequestUnlock struct {
+	OrgParam  uuid.UUID `param:"org" json:"-"`
+	UserParam uuid.UUID `param:"user" json:"-"`
+}
+
+// UnlockService lifts the lockout of accounts after too many failed logins
+type UnlockService struct {
+	repo     storage.Storer
+	limiter  *lockout.Limiter
+	recorder audit.Recorder
+}
+
+// NewUnlockService returns a service resetting the failed logins tracked by limiter
+func NewUnlockService(repo storage.Storer, limiter *lockout.Limiter, recorder audit.Recorder) *UnlockService {
+	return &UnlockService{repo: repo, limiter: limiter, recorder: recorder}
+}
+
+// Unlock forgets the failed logins of a user of the organization, who can then log in right away
+func (s UnlockService) Unlock(ctx context.Context, req RequestUnlock) error {
+	user, m, err := getMember(s.repo.WithContext(ctx), req.OrgParam, req.UserParam)
+	if err != nil {
+		return err
+	}
+	if err := s.limiter.Reset(ctx, lockout.UserKey(user.UUID)); err != nil {
+		return err
+	}
+	e := audit.NewEvent(ctx, audit.AccountUnlocked)
+	e.User, e.Org = user.UUID, m.OrgUUID
+	s.recorder.Record(ctx, e)
+	return nil
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/audit"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestUnlockService(t *testing.T) {
+	var (
+		raw      = storage.NewMemoryStore()
+		store    = tenant.NewStore(raw, tenant.DefaultField)
+		limiter  = lockout.New(lockout.NewMemoryStore(), lockout.Options{LockAfter: 1})
+		recorder = &audit.MemoryRecorder{}
+		svc      = NewUnlockService(store, limiter, recorder)
+		org      = uuid.New()
+		admin    = uuid.New()
+	)
+	user := model.User{Email: "ada@ekolo.io"}
+	_, err := raw.Create(&user)
+	assert.Assert(t, err, nil)
+	_, err = raw.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: org, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+	key := lockout.UserKey(user.UUID)
+	_, locked, err := limiter.Fail(context.Background(), key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, locked, true)
+
+	// Users of other organizations can not be unlocked
+	other := tenant.NewContext(context.Background(), uuid.New())
+	err = svc.Unlock(other, RequestUnlock{OrgParam: org, UserParam: user.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	assert.Assert(t, errors.Is(limiter.Allow(context.Background(), key), xerr.ErrTooManyRequests), true)
+
+	ctx := principal.NewContext(tenant.NewContext(context.Background(), org), principal.Principal{UserUUID: admin, OrgUUID: org})
+	assert.Assert(t, svc.Unlock(ctx, RequestUnlock{OrgParam: org, UserParam: user.UUID}), nil)
+	assert.Assert(t, limiter.Allow(context.Background(), key), nil)
+	events := recorder.Events(audit.AccountUnlocked)
+	assert.Assert(t, len(events), 1)
+	assert.Assert(t, events[0].Actor, admin)
+	assert.Assert(t, events[0].User, user.UUID)
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Member is a user as seen by an organization, the account of the user along with their membership
+type Member struct {
+	model.User
+	OrgUUID    uuid.UUID `json:"org"`
+	Type       *string   `json:"type"`
+	Status     string    `json:"status"`
+	ExternalID *string   `json:"external_id"`
+}
+
+// ErrAccountPassword is returned when someone joins an organization with the email address of an account but not its password
+var ErrAccountPassword = xerr.Unauthenticated("the email address already has an account, its password is required")
+
+// membershipColumns are the attributes of members stored by their membership rather than their account
+var membershipColumns = map[string]bool{"user_uuid": true, "type": true, "status": true, "external_id": true}
+
+// splitMembershipFilter splits a filter on members into the filter of their accounts and the one of their memberships
+func splitMembershipFilter(filter map[string]any) (users, memberships map[string]any) {
+	users, memberships = map[string]any{}, map[string]any{}
+	for key, value := range filter {
+		if column, _, _ := strings.Cut(key, "__"); membershipColumns[column] {
+			memberships[key] = value
+		} else {
+			users[key] = value
+		}
+	}
+	return users, memberships
+}
+
+// newMember returns the member a membership makes of a user
+func newMember(u model.User, m model.Membership) Member {
+	return Member{User: u, OrgUUID: m.OrgUUID, Type: m.Type, Status: m.Status, ExternalID: m.ExternalID}
+}
+
+// PayloadMembership is the membership of a user written by clients
+type PayloadMembership struct {
+	Type       *string `json:"type" validate:"omitempty,max=64"` // Name of a role of the organization.
+	Status     string  `json:"status" validate:"omitempty,oneof=active inactive"`
+	ExternalID *string `json:"external_id" validate:"omitempty,max=255"`
+}
+
+// membership returns the membership of user in org set by the payload
+func (p PayloadMembership) membership(user, org uuid.UUID) model.Membership {
+	return model.Membership{UserUUID: user, OrgUUID: org, Type: p.Type, Status: p.Status, ExternalID: p.ExternalID}
+}
+
+// getMember returns a user of an organization along with their membership
+func getMember(repo storage.Storer, org, user uuid.UUID) (model.User, model.Membership, error) {
+	var (
+		u model.User
+		m model.Membership
+	)
+	_, err := repo.Get(&m, map[string]any{"org_uuid": org, "user_uuid": user})
+	if err == nil {
+		_, err = repo.Get(&u, map[string]any{"uuid": user})
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return u, m, xerr.NotFound("user not found")
+	}
+	return u, m, err
+}
+
+// getUserByEmail returns the account of an email address
+func getUserByEmail(repo storage.Storer, email string) (model.User, error) {
+	var user model.User
+	_, err := repo.Get(&user, map[string]any{"email": email})
+	return user, err
+}
+
+// findAccount returns the account of an email address, nil when it has none
+func findAccount(repo storage.Storer, email string) (*model.User, error) {
+	user, err := getUserByEmail(repo, email)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// authenticateAccount checks the password of an existing account joining an organization, or of a user disabling their second factor.
+// Failures count against the lockout of the account as failed logins do, so that joining can not be used to guess passwords.
+// It must run out of transactions, the limiter keeps its records apart from them.
+func authenticateAccount(ctx context.Context, limiter *lockout.Limiter, h *password.Hasher, user model.User, plain string) error {
+	key := lockout.UserKey(user.UUID)
+	if err := limiter.Allow(ctx, key); err != nil {
+		return err
+	}
+	if _, err := user.Authenticate(h, plain); err != nil {
+		if _, _, err := limiter.Fail(ctx, key); err != nil {
+			return err
+		}
+		return ErrAccountPassword
+	}
+	return nil
+}
+
+// accountLimiter returns limiter, or one keeping its records in memory when it is nil
+func accountLimiter(limiter *lockout.Limiter) *lockout.Limiter {
+	if limiter == nil {
+		return lockout.New(lockout.NewMemoryStore(), lockout.Options{})
+	}
+	return limiter
+}
+
+// checkNotMember returns a conflict error when a user already belongs to an organization.
+// It spares the password check to members, concurrent joins are settled by createMembership.
+func checkNotMember(repo storage.Storer, org uuid.UUID, user model.User) error {
+	n, err := repo.Count(&model.Membership{}, map[string]any{"org_uuid": org, "user_uuid": user.UUID})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errAlreadyMember(user.Email)
+	}
+	return nil
+}
+
+// createMembership stores a membership, the unique index of memberships turns a user joining twice into a conflict error
+func createMembership(repo storage.Storer, m *model.Membership, email string) error {
+	_, err := repo.Create(m)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return errAlreadyMember(email)
+	}
+	return err
+}
+
+// errAlreadyMember returns the conflict error of an email address which is already a user of the organization
+func errAlreadyMember(email string) error {
+	return xerr.Conflict(fmt.Sprintf("%s is already a user of the organization", email))
+}
+
+// countOtherMemberships returns how many organizations other than org a user belongs to
+func countOtherMemberships(repo storage.Storer, org, user uuid.UUID) (int64, error) {
+	return tenant.Unscoped(repo).Count(&model.Membership{}, map[string]any{"user_uuid": user, "org_uuid__ne": org})
+}
+
+// filterMembers keeps the users who belong to org, or all of them when org is nil
+func filterMembers(repo storage.Storer, users []model.User, org *uuid.UUID) ([]model.User, error) {
+	if org == nil || len(users) == 0 {
+		return users, nil
+	}
+	var mm []model.Membership
+	if _, err := repo.List(&mm, map[string]any{"org_uuid": *org, "user_uuid": userUUIDs(users)}, storage.ListOptions{}); err != nil {
+		return nil, err
+	}
+	members := memberUUIDs(mm)
+	return slices.DeleteFunc(users, func(u model.User) bool { return !slices.Contains(members, u.UUID) }), nil
+}
+
+// removeMember removes a user from an organization and ends the sessions they logged into it with.
+// The account of the user is deleted along with their last membership.
+func removeMember(repo storage.Storer, org, user uuid.UUID) error {
+	var m model.Membership
+	_, err := repo.Get(&m, map[string]any{"org_uuid": org, "user_uuid": user})
+	if errors.Is(err, storage.ErrNotFound) {
+		return xerr.NotFound("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := repo.Delete(&model.Membership{}, map[string]any{"uuid": m.UUID}); err != nil {
+		return err
+	}
+	if err := RevokeMembershipSessions(repo, m.UUID, time.Now()); err != nil {
+		return err
+	}
+	n, err := countOtherMemberships(repo, org, user)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = repo.Delete(&model.User{}, map[string]any{"uuid": user})
+	return err
+}
+
+// userUUIDs returns the identifiers of users
+func userUUIDs(uu []model.User) []uuid.UUID {
+	uuids := make([]uuid.UUID, len(uu))
+	for i, u := range uu {
+		uuids[i] = u.UUID
+	}
+	return uuids
+}
+
+// memberUUIDs returns the users of memberships
+func memberUUIDs(mm []model.Membership) []uuid.UUID {
+	uuids := make([]uuid.UUID, len(mm))
+	for i, m := range mm {
+		uuids[i] = m.UserUUID
+	}
+	return uuids
+}
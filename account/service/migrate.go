@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xlog"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// legacyUsersTable holds the users stored before memberships until they are migrated
+const legacyUsersTable = "legacy_users"
+
+// legacyUserIndexes are the indexes of the users table stored before memberships, the new table creates them again
+var legacyUserIndexes = []string{"idx_users_deleted_at", "idx_users_email"}
+
+// legacyUser is a row of the users table as stored when each user belonged to a single organization.
+// It is not soft deleted, users are merged into the account sharing their email address by deleting them.
+type legacyUser struct {
+	UUID       uuid.UUID `gorm:"primaryKey"`
+	CreatedAt  *time.Time
+	DeletedAt  *time.Time
+	Email      string
+	VerifiedAt *time.Time
+	Type       *string
+	Active     *bool
+	ExternalID *string
+	OrgUUID    *uuid.UUID
+	MergedInto *uuid.UUID // Account the user was merged into.
+}
+
+func (legacyUser) TableName() string {
+	return legacyUsersTable
+}
+
+// PrepareMemberships moves aside the users table stored before memberships, it must run before the schema migration.
+// Its primary key was made of the email address along with the uuid, which the schema migration can not change.
+func PrepareMemberships(store *storage.Store) error {
+	if !store.HasColumn(&model.User{}, "org_uuid") {
+		return nil
+	}
+	return store.RenameTable(&model.User{}, legacyUsersTable, legacyUserIndexes...)
+}
+
+// MigrateMemberships moves the users stored before memberships back into the users table, making them members of their organization.
+// Users of several organizations had an account in each, they are merged into a single account.
+// Their sessions are bound to the new membership. Every step leaves the migrated rows as they are,
+// so that the migration resumes where it stopped until the legacy table is dropped.
+func MigrateMemberships(ctx context.Context, store *storage.Store) error {
+	if !store.HasTable(&legacyUser{}) {
+		return nil
+	}
+	if err := store.RunMigrations(&legacyUser{}); err != nil {
+		return err
+	}
+	if err := mergeLegacyUsers(ctx, store); err != nil {
+		return err
+	}
+	// Merged users are copied as deleted accounts
+	if err := store.CopyTable(legacyUsersTable, &model.User{}); err != nil {
+		return err
+	}
+	err := store.WithTx(ctx, func(tx storage.Storer) error {
+		var users, merged []legacyUser
+		if _, err := tx.List(&users, map[string]any{"deleted_at__isnull": true, "org_uuid__isnull": false}, storage.ListOptions{}); err != nil {
+			return err
+		}
+		migrated := 0
+		for _, u := range users {
+			m, created, err := migrateMembership(tx, u, u.UUID)
+			if err != nil {
+				return err
+			}
+			if !created {
+				continue
+			}
+			if err := bindSessions(tx, *m); err != nil {
+				return err
+			}
+			migrated++
+		}
+		// Accounts join the organizations of the users merged into them once they are members of their own
+		if _, err := tx.List(&merged, map[string]any{"merged_into__isnull": false}, storage.ListOptions{}); err != nil {
+			return err
+		}
+		for _, u := range merged {
+			if err := mergeLegacyUser(tx, u); err != nil {
+				return err
+			}
+		}
+		xlog.Info("migration", "memberships", migrated, "merged", len(merged))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.DropTable(&legacyUser{})
+}
+
+// mergeLegacyUsers picks the account of the users stored before memberships which share an email address,
+// the verified one if any, else the oldest. The others are deleted and marked as merged into it.
+func mergeLegacyUsers(ctx context.Context, store *storage.Store) error {
+	return store.WithTx(ctx, func(tx storage.Storer) error {
+		var users []legacyUser
+		if _, err := tx.List(&users, map[string]any{"deleted_at__isnull": true}, storage.ListOptions{Sort: []string{"email", "created_at"}}); err != nil {
+			return err
+		}
+		now := time.Now()
+		for start := 0; start < len(users); {
+			end := start + 1
+			for end < len(users) && users[end].Email == users[start].Email {
+				end++
+			}
+			group := users[start:end]
+			start = end
+			account := group[0]
+			for _, u := range group {
+				if u.VerifiedAt != nil {
+					account = u
+					break
+				}
+			}
+			for _, u := range group {
+				if u.UUID == account.UUID {
+					continue
+				}
+				if _, err := tx.Update(&legacyUser{UUID: u.UUID, DeletedAt: &now, MergedInto: &account.UUID}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// mergeLegacyUser makes the account a user was merged into a member of the user's organization.
+// The sessions of the user, the API keys they created and, unless the account has its own, their second factor move to the account.
+// The account keeps its own password.
+func mergeLegacyUser(tx storage.Storer, u legacyUser) error {
+	account := *u.MergedInto
+	m, _, err := migrateMembership(tx, u, account)
+	if err != nil {
+		return err
+	}
+	var sessions []model.Session
+	if _, err := tx.List(&sessions, map[string]any{"user_uuid": u.UUID}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		moved := model.Session{BaseModel: storage.BaseModel{UUID: session.UUID}, UserUUID: account}
+		if m != nil && session.MembershipUUID == uuid.Nil {
+			moved.MembershipUUID = m.UUID
+		}
+		if _, err := tx.Update(&moved); err != nil {
+			return err
+		}
+	}
+	var impersonations []model.Session
+	if _, err := tx.List(&impersonations, map[string]any{"impersonator": u.UUID}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, session := range impersonations {
+		if _, err := tx.Update(&model.Session{BaseModel: storage.BaseModel{UUID: session.UUID}, Impersonator: &account}); err != nil {
+			return err
+		}
+	}
+	var keys []model.APIKey
+	if _, err := tx.List(&keys, map[string]any{"created_by": u.UUID}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := tx.Update(&model.APIKey{BaseModel: storage.BaseModel{UUID: key.UUID}, CreatedBy: account}); err != nil {
+			return err
+		}
+	}
+	if err := mergeTwoFactor(tx, u.UUID, account); err != nil {
+		return err
+	}
+	// Links sent to reset the password of the user would reset the password of the account
+	_, err = tx.Delete(&model.PasswordReset{}, map[string]any{"user_uuid": u.UUID})
+	return err
+}
+
+// mergeTwoFactor moves the second factor of a user to the account they are merged into, unless it has its own
+func mergeTwoFactor(tx storage.Storer, user, account uuid.UUID) error {
+	tf, err := getTwoFactor(tx, user)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = getTwoFactor(tx, account)
+	if err == nil {
+		if _, err := tx.Delete(&model.TwoFactor{}, map[string]any{"uuid": tf.UUID}); err != nil {
+			return err
+		}
+		_, err = tx.Delete(&model.RecoveryCode{}, map[string]any{"user_uuid": user})
+		return err
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if _, err := tx.Update(&model.TwoFactor{BaseModel: storage.BaseModel{UUID: tf.UUID}, UserUUID: account}); err != nil {
+		return err
+	}
+	var codes []model.RecoveryCode
+	if _, err := tx.List(&codes, map[string]any{"user_uuid": user}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.Update(&model.RecoveryCode{BaseModel: storage.BaseModel{UUID: code.UUID}, UserUUID: account}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMembership makes the account a member of the organization of a legacy user, with the user's type and status.
+// It returns the membership of the account in the organization and whether it created it, nil when the user had no organization.
+func migrateMembership(tx storage.Storer, u legacyUser, account uuid.UUID) (*model.Membership, bool, error) {
+	if u.OrgUUID == nil || *u.OrgUUID == uuid.Nil {
+		return nil, false, nil
+	}
+	var m model.Membership
+	_, err := tx.Get(&m, map[string]any{"user_uuid": account, "org_uuid": *u.OrgUUID})
+	if err == nil {
+		return &m, false, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, false, err
+	}
+	m = model.Membership{UserUUID: account, OrgUUID: *u.OrgUUID, Type: nonEmpty(u.Type), Status: model.MembershipActive, ExternalID: nonEmpty(u.ExternalID)}
+	if u.Active != nil && !*u.Active {
+		m.Status = model.MembershipInactive
+	}
+	if _, err := tx.Create(&m); err != nil {
+		return nil, false, err
+	}
+	return &m, true, nil
+}
+
+// bindSessions binds the sessions a user logged in with before memberships to their membership
+func bindSessions(repo storage.Storer, m model.Membership) error {
+	var sessions []model.Session
+	if _, err := repo.List(&sessions, map[string]any{"user_uuid": m.UserUUID}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		// The column added by the schema migration is null in the rows stored before it
+		if session.MembershipUUID != uuid.Nil {
+			continue
+		}
+		if _, err := repo.Update(&model.Session{BaseModel: storage.BaseModel{UUID: session.UUID}, MembershipUUID: m.UUID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
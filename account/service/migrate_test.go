@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/storage"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// legacyUserRow is a row of the users table as created before memberships
+type legacyUserRow struct {
+	storage.BaseModel
+	Email      string `gorm:"primaryKey;index"`
+	Password   *string
+	FirstName  *string
+	LastName   *string
+	BirthDate  *string
+	BirthPlace *string
+	Address    *string
+	Phone      *string
+	VerifiedAt *time.Time
+	Type       *string
+	Active     *bool
+	ExternalID *string
+	OrgUUID    *uuid.UUID
+}
+
+func (legacyUserRow) TableName() string {
+	return "users"
+}
+
+func TestMigrateMemberships(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		org      = model.Organization{Name: "school"}
+		college  = model.Organization{Name: "college"}
+		teacher  = "TEACHER"
+		external = "42"
+		inactive = false
+		hash     = "hash"
+	)
+	store, err := storage.NewStore(storage.DriverMemory, "")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, store.RunMigrations(&model.Organization{}, &legacyUserRow{}, &model.Session{}, &model.TwoFactor{}), nil)
+	_, err = store.Create(&org)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&college)
+	assert.Assert(t, err, nil)
+	ada := legacyUserRow{Email: "ada@ekolo.io", Password: &hash, Type: &teacher, ExternalID: &external, OrgUUID: &org.UUID}
+	_, err = store.Create(&ada)
+	assert.Assert(t, err, nil)
+	bob := legacyUserRow{Email: "bob@ekolo.io", Active: &inactive, OrgUUID: &org.UUID}
+	_, err = store.Create(&bob)
+	assert.Assert(t, err, nil)
+	session := model.Session{UserUUID: ada.UUID, ExpiresAt: time.Now().Add(time.Hour)}
+	_, err = store.Create(&session)
+	assert.Assert(t, err, nil)
+
+	// Carol has an account in both organizations, the one of the college is verified
+	now := time.Now()
+	carol := legacyUserRow{Email: "carol@ekolo.io", Type: &teacher, OrgUUID: &org.UUID}
+	_, err = store.Create(&carol)
+	assert.Assert(t, err, nil)
+	verified := legacyUserRow{Email: "carol@ekolo.io", Password: &hash, VerifiedAt: &now, OrgUUID: &college.UUID}
+	_, err = store.Create(&verified)
+	assert.Assert(t, err, nil)
+	carolSession := model.Session{UserUUID: carol.UUID, ExpiresAt: time.Now().Add(time.Hour)}
+	_, err = store.Create(&carolSession)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&model.TwoFactor{UserUUID: carol.UUID, Secret: "secret"})
+	assert.Assert(t, err, nil)
+
+	// The users table is created again with the uuid as its primary key, accounts keep their uuid
+	assert.Assert(t, PrepareMemberships(store), nil)
+	assert.Assert(t, store.RunMigrations(model.GetModels()...), nil)
+	assert.Assert(t, MigrateMemberships(ctx, store), nil)
+	assert.Assert(t, store.HasTable(&legacyUser{}), false)
+	var account model.User
+	_, err = store.Get(&account, map[string]any{"uuid": ada.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, account.Email, "ada@ekolo.io")
+	assert.Assert(t, *account.Password, hash)
+
+	// Users become members of their organization, keeping their role and their status
+	var teaching, deactivated model.Membership
+	_, err = store.Get(&teaching, map[string]any{"user_uuid": ada.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, teaching.OrgUUID, org.UUID)
+	assert.Assert(t, *teaching.Type, teacher)
+	assert.Assert(t, *teaching.ExternalID, external)
+	assert.Assert(t, teaching.Status, model.MembershipActive)
+	_, err = store.Get(&deactivated, map[string]any{"user_uuid": bob.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, deactivated.Status, model.MembershipInactive)
+	assert.Assert(t, deactivated.Type == nil, true)
+
+	// Their sessions go on within the organization
+	var bound model.Session
+	_, err = store.Get(&bound, map[string]any{"uuid": session.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, bound.MembershipUUID, teaching.UUID)
+
+	// Accounts sharing an email address are merged into the verified one, a member of both organizations
+	var carols []model.User
+	_, err = store.List(&carols, map[string]any{"email": "carol@ekolo.io"}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(carols), 1)
+	assert.Assert(t, carols[0].UUID, verified.UUID)
+	n, err := store.Count(&model.Membership{}, map[string]any{"user_uuid": verified.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+	var merged model.Membership
+	_, err = store.Get(&merged, map[string]any{"user_uuid": verified.UUID, "org_uuid": org.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *merged.Type, teacher)
+	var moved model.Session
+	_, err = store.Get(&moved, map[string]any{"uuid": carolSession.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, moved.UserUUID, verified.UUID)
+	assert.Assert(t, moved.MembershipUUID, merged.UUID)
+	_, err = getTwoFactor(store, verified.UUID)
+	assert.Assert(t, err, nil)
+
+	// Running it again leaves the users as they are
+	assert.Assert(t, PrepareMemberships(store), nil)
+	assert.Assert(t, store.RunMigrations(model.GetModels()...), nil)
+	assert.Assert(t, MigrateMemberships(ctx, store), nil)
+	n, err = store.Count(&model.Membership{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(4))
+	n, err = store.Count(&model.User{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(3))
+
+	// Email addresses now identify a single account
+	_, err = store.Create(&model.User{Email: "carol@ekolo.io"})
+	assert.Assert(t, errors.Is(err, storage.ErrDuplicate), true)
+}
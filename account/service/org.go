@@ -4,8 +4,12 @@ import (
 	"context"
 	"ekolo/account/model"
 	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/rbac"
 	"ekolo/pkg/storage"
-	"errors"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
 
 	"github.com/google/uuid"
 )
@@ -15,12 +19,23 @@ func GetModels() []any {
 	return []any{
 		model.Organization{},
 		model.User{},
+		model.Membership{},
+		model.Role{},
+		model.PasswordReset{},
+		model.Invitation{},
+		model.TwoFactor{},
+		model.RecoveryCode{},
+		model.APIKey{},
+		model.Session{},
 	}
 }
 
 // Service is the service object
 type Service struct {
-	repo storage.Storer
+	repo     storage.Storer
+	hasher   *password.Hasher
+	limiter  *lockout.Limiter
+	verifier *Verifier
 }
 
 func (s Service) GetName() string {
@@ -28,8 +43,45 @@ func (s Service) GetName() string {
 }
 
 // GetPathParams returns service' path params
-func (s Service) GetPathParams() []string {
-	return []string{"org"}
+func (s Service) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org")}
+}
+
+// GetPermissions returns the permissions required by an operation, anyone can create an organization
+func (s Service) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpGet:
+		return []rbac.Permission{rbac.OrgRead}
+	case generic.OpList:
+		return []rbac.Permission{rbac.OrgList}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.OrgUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.OrgDelete}
+	default:
+		return nil
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s Service) GetFilters() storage.Filters {
+	return storage.Filters{
+		"name":       {storage.OpEq, storage.OpIContains, storage.OpStartsWith},
+		"email":      {storage.OpEq, storage.OpIContains},
+		"phone":      {storage.OpEq, storage.OpIsNull},
+		"created_at": {storage.OpGte, storage.OpLte},
+		"updated_at": {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s Service) GetSortFields() []string {
+	return []string{"name", "email", "created_at", "updated_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s Service) GetDefaultSort() []string {
+	return []string{"name"}
 }
 
 // GetRequest returns the request object for the service
@@ -50,10 +102,14 @@ func (s Service) GetRequest(name string) generic.IRequest {
 	}
 }
 
-// New returns a new service
-func New(repo storage.Storer) *Service {
+// New returns a new service, first managers are sent a verification link unless verifier is nil.
+// limiter throttles the passwords given for managers who already have an account, it is kept in memory when nil.
+func New(repo storage.Storer, hasher *password.Hasher, limiter *lockout.Limiter, verifier *Verifier) *Service {
 	return &Service{
-		repo: repo,
+		repo:     repo,
+		hasher:   hasher,
+		limiter:  accountLimiter(limiter),
+		verifier: verifier,
 	}
 }
 
@@ -68,12 +124,19 @@ func (r Request) GetID() string {
 type RequestOrgCreate struct {
 	Request
 	model.Organization
+	Manager *PayloadManager `json:"manager,omitempty"`
+}
+
+// PayloadManager is the first manager of an organization
+type PayloadManager struct {
+	model.User
+	PayloadPassword
 }
 
 // RequestOrgGet is the request object for the get method
 type RequestOrgGet struct {
 	Request
-	OrgParam string `param:"org"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
 }
 
 // RequestOrgList is the request object for the list method
@@ -81,17 +144,26 @@ type RequestOrgList struct {
 	Request
 }
 
+// PayloadOrgUpdate is the struct representing the update request payload, fields which are not given are kept
+type PayloadOrgUpdate struct {
+	Name                 *string  `json:"name" validate:"omitempty,max=255"`
+	Email                *string  `json:"email" validate:"omitempty,email"`
+	Phone                *string  `json:"phone" validate:"omitempty,max=32"`
+	RequireVerifiedEmail *bool    `json:"require_verified_email"`
+	Require2FA           []string `json:"require_2fa" validate:"omitempty,max=16,dive,max=64"`
+}
+
 // RequestOrgUpdate is the request object for the update method
 type RequestOrgUpdate struct {
 	Request
-	OrgParam string `param:"org"`
-	model.Organization
+	OrgParam uuid.UUID `param:"org" json:"-"`
+	PayloadOrgUpdate
 }
 
 // RequestOrgDelete is the request object for the delete method
 type RequestOrgDelete struct {
 	Request
-	OrgParam string `param:"org"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
 }
 
 // Response is the response object for the service
@@ -125,13 +197,62 @@ func (r Response) GetStatusCode() int {
 // @Param organization body RequestOrgCreate true "Organization data"
 // @Success 201 {object} Response
 // @Failure 400 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization [post]
 func (s Service) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
 	r := req.(*RequestOrgCreate)
-	_, err := s.repo.Create(&r.Organization)
+	var account *model.User
+	if r.Manager != nil {
+		// The manager may already have an account through another organization, which only its password unlocks
+		var err error
+		if account, err = findAccount(s.repo.WithContext(ctx), r.Manager.Email); err != nil {
+			return nil, err
+		}
+		if account != nil {
+			if err := authenticateAccount(ctx, s.limiter, s.hasher, *account, ptrValue(r.Manager.PayloadPassword.Password)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	created := false
+	// The organization, its default roles and its first manager are created together or not at all
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Create(&r.Organization); err != nil {
+			return err
+		}
+		// There is no principal yet, the rest of the organization is created on its behalf
+		tx = tx.WithContext(tenant.NewContext(ctx, r.Organization.UUID))
+		for _, role := range newDefaultRoles(r.Organization.UUID) {
+			if _, err := tx.Create(&role); err != nil {
+				return err
+			}
+		}
+		if r.Manager == nil {
+			return nil
+		}
+		if account != nil {
+			r.Manager.User = *account
+		} else {
+			r.Manager.VerifiedAt = nil
+			if err := setPassword(s.hasher, &r.Manager.User, r.Manager.PayloadPassword); err != nil {
+				return err
+			}
+			if _, err := tx.Create(&r.Manager.User); err != nil {
+				return err
+			}
+			created = true
+		}
+		managerType := TypeMANAGER
+		_, err := tx.Create(&model.Membership{UserUUID: r.Manager.UUID, OrgUUID: r.Organization.UUID, Type: &managerType, Status: model.MembershipActive})
+		return err
+	})
 	if err != nil {
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
+	}
+	if created {
+		s.verifier.sendAfterCreate(ctx, r.Manager.User)
 	}
 	return NewResponse(200, nil, r.Organization), err
 }
@@ -141,10 +262,14 @@ func (s Service) Create(ctx context.Context, req generic.IRequest) (generic.IRes
 // @Description Get an organization
 // @ID org-get
 // @Tags organization
+// @Security ApiKeyAuth
 // @Produce json
 // @Param uuid path string true "Organization ID"
 // @Success 200 {object} Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{uuid} [get]
 func (s Service) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
@@ -155,12 +280,9 @@ func (s Service) Get(ctx context.Context, req generic.IRequest) (generic.IRespon
 			"uuid": r.OrgParam,
 		}
 	)
-	_, err := s.repo.Get(&org, filter)
+	_, err := s.repo.WithContext(ctx).Get(&org, filter)
 	if err != nil {
-		if errors.Is(err, storage.ErrNotFound) {
-			return NewResponse(404, []string{err.Error()}, nil), err
-		}
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
 	return NewResponse(200, nil, org), err
 
@@ -171,21 +293,32 @@ func (s Service) Get(ctx context.Context, req generic.IRequest) (generic.IRespon
 // @Description List organizations
 // @ID orgs-get
 // @Tags organization
+// @Security ApiKeyAuth
 // @Produce json
-// @Success 200 {object} Response
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
+// @Success 200 {object} generic.Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization [get]
-func (s Service) List(ctx context.Context, req generic.IRequest, filter map[string]any) (generic.IResponse, error) {
+func (s Service) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
 	var (
 		_    = req.(*RequestOrgList)
 		orgs []model.Organization
 	)
-	_, err := s.repo.List(&orgs, filter)
+	total, err := s.repo.WithContext(ctx).Count(&orgs, filter)
 	if err != nil {
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
-	return NewResponse(200, nil, orgs), nil
+	_, err = s.repo.WithContext(ctx).List(&orgs, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return generic.NewListResponse(200, orgs, total, opts), nil
 }
 
 // Update updates an organization
@@ -193,22 +326,51 @@ func (s Service) List(ctx context.Context, req generic.IRequest, filter map[stri
 // @Description Update an organization
 // @ID org-update
 // @Tags organization
+// @Security ApiKeyAuth
 // @Accept json
 // @Produce json
 // @Param uuid path string true "Organization ID"
-// @Param organization body RequestOrgUpdate true "Organization data"
+// @Param organization body PayloadOrgUpdate true "Organization data"
 // @Success 201 {object} Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 422 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{uuid} [patch]
 func (s Service) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
 	r := req.(*RequestOrgUpdate)
-	r.UUID = uuid.MustParse(r.OrgParam)
-	_, err := s.repo.Update(r.Organization)
+	var org model.Organization
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Get(&org, map[string]any{"uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if r.Name != nil {
+			org.Name = *r.Name
+		}
+		if r.Email != nil {
+			org.Email = *r.Email
+		}
+		if r.Phone != nil {
+			org.Phone = r.Phone
+		}
+		if r.RequireVerifiedEmail != nil {
+			org.RequireVerifiedEmail = r.RequireVerifiedEmail
+		}
+		if r.Require2FA != nil {
+			org.Require2FA = r.Require2FA
+		}
+		n, err := tx.Update(&org)
+		if err == nil && n == 0 {
+			return xerr.NotFound("organization not found")
+		}
+		return err
+	})
 	if err != nil {
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
-	return NewResponse(200, nil, r.Organization), nil
+	return NewResponse(200, nil, org), nil
 }
 
 // Delete deletes an organization
@@ -216,9 +378,13 @@ func (s Service) Update(ctx context.Context, req generic.IRequest) (generic.IRes
 // @Description Delete an organization
 // @ID org-delete
 // @Tags organization
+// @Security ApiKeyAuth
 // @Param uuid path string true "Organization ID"
-// @Success 200 {object} Response
+// @Success 204
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{uuid} [delete]
 func (s Service) Delete(ctx context.Context, req generic.IRequest) error {
@@ -228,12 +394,18 @@ func (s Service) Delete(ctx context.Context, req generic.IRequest) error {
 			"uuid": req.(*RequestOrgDelete).OrgParam,
 		}
 	)
-	_, err := s.repo.Delete(&org, filter)
+	n, err := s.repo.WithContext(ctx).Delete(&org, filter)
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return xerr.NotFound("organization not found")
+	}
 	return nil
 }
 
 // Service is the service interface
 var _ generic.IService = new(Service)
+var _ generic.IFilterable = new(Service)
+var _ generic.ISortable = new(Service)
+var _ generic.IAuthorized = new(Service)
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOrgService(t *testing.T) {
+	var (
+		ctx = context.Background()
+		svc = New(storage.NewMemoryStore(), password.Default(), nil, nil)
+	)
+
+	resp, err := svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "school", Email: "school@ekolo.io"}})
+	assert.Assert(t, err, nil)
+	org := resp.(Response).Data.(model.Organization)
+
+	resp, err = svc.Get(ctx, &RequestOrgGet{OrgParam: org.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(Response).Data.(model.Organization).Name, "school")
+
+	resp, err = svc.List(ctx, &RequestOrgList{}, map[string]any{"name": "school"}, storage.ListOptions{Limit: 10})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(resp.(generic.Response).Data.([]model.Organization)), 1)
+	assert.Assert(t, resp.(generic.Response).Pagination.Total, int64(1))
+
+	// Updates only write the fields they are given, which are all optional
+	phone := "+33 1 23 45 67 89"
+	update := &RequestOrgUpdate{OrgParam: org.UUID, PayloadOrgUpdate: PayloadOrgUpdate{Phone: &phone}}
+	assert.Assert(t, len(generic.Validate(update)), 0)
+	resp, err = svc.Update(ctx, update)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *resp.(Response).Data.(model.Organization).Phone, phone)
+	assert.Assert(t, resp.(Response).Data.(model.Organization).Name, "school")
+
+	err = svc.Delete(ctx, &RequestOrgDelete{OrgParam: org.UUID})
+	assert.Assert(t, err, nil)
+
+	_, err = svc.Get(ctx, &RequestOrgGet{OrgParam: org.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	err = svc.Delete(ctx, &RequestOrgDelete{OrgParam: org.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	_, err = svc.Update(ctx, update)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+}
+
+func TestOrgServiceCreateWithManager(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		store   = storage.NewMemoryStore()
+		svc     = New(store, password.Default(), nil, nil)
+		manager = PayloadManager{User: model.User{Email: "manager@ekolo.io"}}
+	)
+
+	resp, err := svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "school"}, Manager: &manager})
+	assert.Assert(t, err, nil)
+	org := resp.(Response).Data.(model.Organization)
+
+	var members []model.Membership
+	_, err = store.List(&members, map[string]any{"org_uuid": org.UUID}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(members), 1)
+	assert.Assert(t, *members[0].Type, TypeMANAGER)
+}
+
+func TestOrgServiceCreateWithExistingManager(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		store   = storage.NewMemoryStore()
+		limiter = lockout.New(lockout.NewMemoryStore(), lockout.Options{FreeAttempts: 1, BaseDelay: time.Hour})
+		svc     = New(store, password.Default(), limiter, nil)
+		plain   = "s3cret-pass"
+		wrong   = "wrong-pass"
+	)
+	_, err := svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "school"}, Manager: &PayloadManager{User: model.User{Email: "manager@ekolo.io"}, PayloadPassword: PayloadPassword{Password: &plain}}})
+	assert.Assert(t, err, nil)
+
+	// Managers who already have an account join with its password, guesses are throttled as failed logins are
+	manager := PayloadManager{User: model.User{Email: "manager@ekolo.io"}, PayloadPassword: PayloadPassword{Password: &wrong}}
+	_, err = svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "college"}, Manager: &manager})
+	assert.Assert(t, errors.Is(err, ErrAccountPassword), true)
+	_, err = svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "college"}, Manager: &manager})
+	assert.Assert(t, errors.Is(err, ErrAccountPassword), true)
+	manager.PayloadPassword.Password = &plain
+	_, err = svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "college"}, Manager: &manager})
+	assert.Assert(t, errors.Is(err, xerr.ErrTooManyRequests), true)
+	n, err := store.Count(&model.Organization{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	var account model.User
+	_, err = store.Get(&account, map[string]any{"email": "manager@ekolo.io"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, limiter.Reset(ctx, lockout.UserKey(account.UUID)), nil)
+	resp, err := svc.Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "college"}, Manager: &manager})
+	assert.Assert(t, err, nil)
+	n, err = store.Count(&model.Membership{}, map[string]any{"user_uuid": account.UUID, "org_uuid": resp.(Response).Data.(model.Organization).UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
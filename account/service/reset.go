@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/mailer"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DefaultResetTTL = time.Hour
+
+var ErrInvalidResetToken = xerr.Invalid("invalid or expired reset token")
+
+// ResetOptions configures the password reset links
+type ResetOptions struct {
+	URL string // Page of the web application setting the new password, the token is added to its query.
+	TTL time.Duration
+}
+
+// ResetService lets users who forgot their password set a new one through a link sent by email
+type ResetService struct {
+	repo   storage.Storer
+	hasher *password.Hasher
+	mailer mailer.Mailer
+	opts   ResetOptions
+	now    func() time.Time
+}
+
+// NewResetService returns a new service, users are looked up across organizations so repo must not be scoped to one
+func NewResetService(repo storage.Storer, hasher *password.Hasher, m mailer.Mailer, opts ResetOptions) *ResetService {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultResetTTL
+	}
+	return &ResetService{
+		repo:   repo,
+		hasher: hasher,
+		mailer: m,
+		opts:   opts,
+		now:    time.Now,
+	}
+}
+
+// RequestPasswordReset is the payload of the reset request endpoint
+type RequestPasswordReset struct {
+	Email string     `json:"email" validate:"required,email"`
+	Org   *uuid.UUID `json:"org"` // Restricts the reset to one organization when the email is registered in several.
+}
+
+// RequestPasswordResetConfirm is the payload of the reset confirmation endpoint
+type RequestPasswordResetConfirm struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,maxbytes=72"`
+}
+
+// RequestReset sends a reset link to every user matching the request.
+// Unknown emails are not reported so that the endpoint does not reveal who has an account.
+func (s ResetService) RequestReset(ctx context.Context, req RequestPasswordReset) error {
+	var users []model.User
+	if _, err := s.repo.WithContext(ctx).List(&users, map[string]any{"email": req.Email}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	users, err := filterMembers(s.repo.WithContext(ctx), users, req.Org)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		plain, hash, err := token.New()
+		if err != nil {
+			return err
+		}
+		expiresAt := s.now().Add(s.opts.TTL)
+		reset := model.PasswordReset{TokenHash: hash, UserUUID: u.UUID, ExpiresAt: expiresAt}
+		if _, err := s.repo.WithContext(ctx).Create(&reset); err != nil {
+			return err
+		}
+		if err := s.mailer.Send(ctx, s.newMessage(u, plain, expiresAt)); err != nil {
+			xlog.Error("password-reset", "user", u.UUID, "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfirmReset sets the password of the user of a valid reset token and ends their sessions.
+// The token and every other pending token of the user can not be used anymore.
+func (s ResetService) ConfirmReset(ctx context.Context, req RequestPasswordResetConfirm) error {
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		var reset model.PasswordReset
+		_, err := tx.Get(&reset, map[string]any{"token_hash": token.Hash(req.Token)})
+		if errors.Is(err, storage.ErrNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		if reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+		// The token is used only if no concurrent confirmation used it first
+		n, err := tx.UpdateWhere(&model.PasswordReset{BaseModel: storage.BaseModel{UUID: reset.UUID}, UsedAt: &now}, map[string]any{"used_at__isnull": true})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrInvalidResetToken
+		}
+		var user model.User
+		if _, err := tx.Get(&user, map[string]any{"uuid": reset.UserUUID}); err != nil {
+			return err
+		}
+		u := model.User{BaseModel: storage.BaseModel{UUID: user.UUID}, Email: user.Email}
+		if err := u.SetPassword(s.hasher, req.Password); err != nil {
+			return err
+		}
+		if _, err := tx.Update(&u); err != nil {
+			return err
+		}
+		if err := RevokeSessions(tx, user.UUID, now); err != nil {
+			return err
+		}
+		var pending []model.PasswordReset
+		filter := map[string]any{"user_uuid": user.UUID, "used_at__isnull": true}
+		if _, err := tx.List(&pending, filter, storage.ListOptions{}); err != nil {
+			return err
+		}
+		for i := range pending {
+			pending[i].UsedAt = &now
+			if _, err := tx.Update(&pending[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// newMessage returns the email holding the reset link of a user
+func (s ResetService) newMessage(u model.User, plain string, expiresAt time.Time) mailer.Message {
+	link := s.opts.URL
+	if target, err := url.Parse(s.opts.URL); err == nil {
+		query := target.Query()
+		query.Set("token", plain)
+		target.RawQuery = query.Encode()
+		link = target.String()
+	}
+	body := fmt.Sprintf("A password reset was requested for your account.\n\n"+
+		"Follow this link to choose a new password, it expires on %s:\n%s\n\n"+
+		"You can ignore this email if you did not ask for it.", expiresAt.UTC().Format(time.RFC1123), link)
+	return mailer.Message{To: u.Email, Subject: "Reset your password", Body: body}
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/mailer"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// outbox is a mailer keeping the messages it is asked to send
+type outbox struct {
+	messages []mailer.Message
+}
+
+func (o *outbox) Send(ctx context.Context, msg mailer.Message) error {
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// linkToken returns the token of the link of a message
+func linkToken(t *testing.T, msg mailer.Message) string {
+	for _, field := range strings.Fields(msg.Body) {
+		if link, err := url.Parse(field); err == nil && link.Query().Has("token") {
+			return link.Query().Get("token")
+		}
+	}
+	t.Fatalf("no link in %q", msg.Body)
+	return ""
+}
+
+func TestResetService(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = storage.NewMemoryStore()
+		hasher = password.Default()
+		mails  = &outbox{}
+		svc    = NewResetService(store, hasher, mails, ResetOptions{URL: "https://app.ekolo.io/password/reset"})
+		user   = model.User{Email: "ada@ekolo.io"}
+	)
+	assert.Assert(t, user.SetPassword(hasher, "forgotten"), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	org := uuid.New()
+	_, err = store.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: org, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+
+	// Unknown emails, and users of other organizations than the requested one, are silently ignored
+	assert.Assert(t, svc.RequestReset(ctx, RequestPasswordReset{Email: "bob@ekolo.io"}), nil)
+	other := uuid.New()
+	assert.Assert(t, svc.RequestReset(ctx, RequestPasswordReset{Email: user.Email, Org: &other}), nil)
+	assert.Assert(t, len(mails.messages), 0)
+
+	assert.Assert(t, svc.RequestReset(ctx, RequestPasswordReset{Email: user.Email, Org: &org}), nil)
+	assert.Assert(t, svc.RequestReset(ctx, RequestPasswordReset{Email: user.Email}), nil)
+	assert.Assert(t, len(mails.messages), 2)
+	assert.Assert(t, mails.messages[0].To, user.Email)
+	first, second := linkToken(t, mails.messages[0]), linkToken(t, mails.messages[1])
+
+	// Only hashes of the tokens are stored
+	var resets []model.PasswordReset
+	_, err = store.List(&resets, map[string]any{"user_uuid": user.UUID}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(resets), 2)
+	assert.Assert(t, resets[0].TokenHash != first && resets[0].TokenHash != second, true)
+
+	err = svc.ConfirmReset(ctx, RequestPasswordResetConfirm{Token: "forged", Password: "n3w-pass"})
+	assert.Assert(t, errors.Is(err, ErrInvalidResetToken), true)
+
+	session := model.Session{UserUUID: user.UUID}
+	_, err = store.Create(&session)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, svc.ConfirmReset(ctx, RequestPasswordResetConfirm{Token: second, Password: "n3w-pass"}), nil)
+	_, err = store.Get(&session, map[string]any{"uuid": session.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, session.RevokedAt != nil, true)
+	var stored model.User
+	_, err = store.Get(&stored, map[string]any{"uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	_, err = stored.Authenticate(hasher, "n3w-pass")
+	assert.Assert(t, err, nil)
+
+	// Tokens are single use and a reset voids the other pending ones
+	err = svc.ConfirmReset(ctx, RequestPasswordResetConfirm{Token: second, Password: "other-pass"})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	err = svc.ConfirmReset(ctx, RequestPasswordResetConfirm{Token: first, Password: "other-pass"})
+	assert.Assert(t, errors.Is(err, ErrInvalidResetToken), true)
+}
+
+func TestResetServiceExpiry(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = storage.NewMemoryStore()
+		hasher = password.Default()
+		mails  = &outbox{}
+		svc    = NewResetService(store, hasher, mails, ResetOptions{URL: "https://app.ekolo.io/password/reset", TTL: time.Minute})
+		user   = model.User{Email: "ada@ekolo.io"}
+	)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+
+	assert.Assert(t, svc.RequestReset(ctx, RequestPasswordReset{Email: user.Email}), nil)
+	svc.now = func() time.Time { return time.Now().Add(time.Minute) }
+	err = svc.ConfirmReset(ctx, RequestPasswordResetConfirm{Token: linkToken(t, mails.messages[0]), Password: "n3w-pass"})
+	assert.Assert(t, errors.Is(err, ErrInvalidResetToken), true)
+}
+
+func TestResetServiceConcurrent(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = storage.NewMemoryStore()
+		hasher = password.Default()
+		mails  = &outbox{}
+		svc    = NewResetService(store, hasher, mails, ResetOptions{URL: "https://app.ekolo.io/password/reset"})
+		user   = model.User{Email: "ada@ekolo.io"}
+	)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, svc.RequestReset(ctx, RequestPasswordReset{Email: user.Email}), nil)
+
+	// A single one of concurrent confirmations of a token sets the password
+	var (
+		wg        sync.WaitGroup
+		confirmed atomic.Int32
+	)
+	plain := linkToken(t, mails.messages[0])
+	for _, pass := range []string{"n3w-pass", "other-pass"} {
+		wg.Add(1)
+		go func(pass string) {
+			defer wg.Done()
+			if svc.ConfirmReset(ctx, RequestPasswordResetConfirm{Token: plain, Password: pass}) == nil {
+				confirmed.Add(1)
+			}
+		}(pass)
+	}
+	wg.Wait()
+	assert.Assert(t, confirmed.Load(), int32(1))
+}
@@ -0,0 +1,499 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// getRole returns a role of an organization.
+// Organizations created before custom roles have none, they keep the default ones.
+func getRole(repo storage.Storer, org uuid.UUID, name string) (*model.Role, error) {
+	var role model.Role
+	_, err := repo.Get(&role, map[string]any{"org_uuid": org, "name": name})
+	if err == nil {
+		return &role, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	n, err := repo.Count(&model.Role{}, map[string]any{"org_uuid": org})
+	if err != nil {
+		return nil, err
+	}
+	if permissions, ok := DefaultRoles[name]; ok && n == 0 {
+		return &model.Role{Name: name, Permissions: permissions, OrgUUID: org}, nil
+	}
+	return nil, xerr.NotFound("role not found")
+}
+
+// getRoleNames returns the names of the roles of an organization
+func getRoleNames(repo storage.Storer, org uuid.UUID) ([]string, error) {
+	var roles []model.Role
+	_, err := repo.List(&roles, map[string]any{"org_uuid": org}, storage.ListOptions{Sort: []string{"name"}})
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return getUserTypes(), nil
+	}
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = role.Name
+	}
+	return names, nil
+}
+
+// newDefaultRoles returns the roles every organization starts with
+func newDefaultRoles(org uuid.UUID) []model.Role {
+	roles := []model.Role{}
+	for _, name := range getUserTypes() {
+		roles = append(roles, model.Role{Name: name, Permissions: DefaultRoles[name], OrgUUID: org})
+	}
+	return roles
+}
+
+// checkUserType returns a validation error unless the type of a membership names a role of its organization
+func checkUserType(repo storage.Storer, m model.Membership) error {
+	if m.Type == nil {
+		return nil
+	}
+	_, err := getRole(repo, m.OrgUUID, *m.Type)
+	if errors.Is(err, xerr.ErrNotFound) {
+		return xerr.Validation("validation failed", "type: must be a role of the organization")
+	}
+	return err
+}
+
+// RoleResolver resolves the permissions of a role from the roles of its organization
+type RoleResolver struct {
+	repo storage.Storer
+}
+
+// NewRoleResolver returns a new resolver
+func NewRoleResolver(repo storage.Storer) *RoleResolver {
+	return &RoleResolver{
+		repo: repo,
+	}
+}
+
+// GetPermissions returns the permissions of a role, unknown roles have none.
+// Users whose organization requires verified email addresses have none until theirs is,
+// neither do users who did not log in with a second factor their organization requires.
+func (r RoleResolver) GetPermissions(ctx context.Context, org uuid.UUID, name string) ([]rbac.Permission, error) {
+	if err := requireVerifiedPrincipal(ctx, r.repo.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	if err := requireTwoFactorPrincipal(ctx, r.repo.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	role, err := getRole(r.repo.WithContext(ctx), org, name)
+	if errors.Is(err, xerr.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role.Permissions, nil
+}
+
+// RoleService is the service object
+type RoleService struct {
+	repo storage.Storer
+}
+
+func (s RoleService) GetName() string {
+	return "organization/:org/role"
+}
+
+// GetPathParams returns service' path params
+func (s RoleService) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org"), generic.UUIDParam("role")}
+}
+
+// GetPermissions returns the permissions required by an operation
+func (s RoleService) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpCreate:
+		return []rbac.Permission{rbac.RoleCreate}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.RoleUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.RoleDelete}
+	default:
+		return []rbac.Permission{rbac.RoleRead}
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s RoleService) GetFilters() storage.Filters {
+	return storage.Filters{
+		"name":       {storage.OpEq, storage.OpIContains},
+		"created_at": {storage.OpGte, storage.OpLte},
+		"updated_at": {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s RoleService) GetSortFields() []string {
+	return []string{"name", "created_at", "updated_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s RoleService) GetDefaultSort() []string {
+	return []string{"name"}
+}
+
+// GetRequest returns the request object for the service
+func (s RoleService) GetRequest(name string) generic.IRequest {
+	switch name {
+	case "create":
+		return &RequestRoleCreate{}
+	case "get":
+		return &RequestRoleGet{}
+	case "list":
+		return &RequestRoleList{}
+	case "update":
+		return &RequestRoleUpdate{}
+	case "delete":
+		return &RequestRoleDelete{}
+	default:
+		return RequestRole{}
+	}
+}
+
+// NewRoleService returns a new service
+func NewRoleService(repo storage.Storer) *RoleService {
+	return &RoleService{
+		repo: repo,
+	}
+}
+
+// RequestRole is the request object for the service
+type RequestRole struct{}
+
+func (r RequestRole) GetID() string {
+	return "role"
+}
+
+// PayloadRole is the struct representing the create request payload
+type PayloadRole struct {
+	Name        string            `json:"name" validate:"required,max=64"`
+	Description *string           `json:"description" validate:"omitempty,max=1024"`
+	Permissions []rbac.Permission `json:"permissions" validate:"max=64"`
+}
+
+// validate returns a validation error listing the permissions an organization role can not grant,
+// listing every organization is not granted within one.
+func (p PayloadRole) validate() error {
+	details := []string{}
+	for i, permission := range p.Permissions {
+		switch {
+		case !rbac.IsKnown(permission):
+			details = append(details, fmt.Sprintf("permissions.%d: unknown permission %s", i, permission))
+		case rbac.IsPlatform(permission):
+			details = append(details, fmt.Sprintf("permissions.%d: %s can not be granted by a role", i, permission))
+		}
+	}
+	if len(details) > 0 {
+		return xerr.Validation("validation failed", details...)
+	}
+	return nil
+}
+
+// PayloadRoleUpdate is the struct representing the update request payload, fields which are not given are kept
+type PayloadRoleUpdate struct {
+	Name        *string           `json:"name" validate:"omitempty,max=64"`
+	Description *string           `json:"description" validate:"omitempty,max=1024"`
+	Permissions []rbac.Permission `json:"permissions" validate:"omitempty,max=64"`
+}
+
+// validate returns a validation error listing the permissions an organization role can not grant
+func (p PayloadRoleUpdate) validate() error {
+	return PayloadRole{Permissions: p.Permissions}.validate()
+}
+
+// RequestRoleCreate is the request object for the create method
+type RequestRoleCreate struct {
+	RequestRole
+	PayloadRole
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestRoleGet is the request object for the get method
+type RequestRoleGet struct {
+	RequestRole
+	OrgParam  uuid.UUID `param:"org" json:"-"`
+	RoleParam uuid.UUID `param:"role" json:"-"`
+}
+
+// RequestRoleList is the request object for the list method
+type RequestRoleList struct {
+	RequestRole
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestRoleUpdate is the request object for the update method
+type RequestRoleUpdate struct {
+	RequestRole
+	RoleParam uuid.UUID `param:"role" json:"-"`
+	OrgParam  uuid.UUID `param:"org" json:"-"`
+	PayloadRoleUpdate
+}
+
+// RequestRoleDelete is the request object for the delete method
+type RequestRoleDelete struct {
+	RequestRole
+	RoleParam uuid.UUID `param:"role" json:"-"`
+	OrgParam  uuid.UUID `param:"org" json:"-"`
+}
+
+// Create creates a new role
+// @Summary Create a role
+// @Description Create a role granting permissions to the users of an organization
+// @ID role-create
+// @Tags role
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param role body PayloadRole true "Role data"
+// @Success 201 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/role [post]
+func (s RoleService) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestRoleCreate)
+	if err := r.PayloadRole.validate(); err != nil {
+		return nil, err
+	}
+	role := model.Role{
+		Name:        r.Name,
+		Description: r.Description,
+		Permissions: r.Permissions,
+		OrgUUID:     r.OrgParam,
+	}
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := checkRoleName(tx, role); err != nil {
+			return err
+		}
+		// Organizations which still use the default roles get them stored along their first custom role
+		n, err := tx.Count(&model.Role{}, map[string]any{"org_uuid": r.OrgParam})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			for _, d := range newDefaultRoles(r.OrgParam) {
+				if d.Name == role.Name {
+					continue
+				}
+				if _, err := tx.Create(&d); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = tx.Create(&role)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, role), nil
+}
+
+// Get gets a role
+// @Summary Get a role
+// @Description Get a role
+// @ID role-get
+// @Tags role
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param role path string true "Role ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/role/{role} [get]
+func (s RoleService) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	var (
+		r      = req.(*RequestRoleGet)
+		role   model.Role
+		filter = map[string]any{
+			"uuid":     r.RoleParam,
+			"org_uuid": r.OrgParam,
+		}
+	)
+	_, err := s.repo.WithContext(ctx).Get(&role, filter)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, role), nil
+}
+
+// List lists roles
+// @Summary List roles
+// @Description List the roles of an organization
+// @ID roles-get
+// @Tags role
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
+// @Success 200 {object} generic.Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/role [get]
+func (s RoleService) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
+	var (
+		r     = req.(*RequestRoleList)
+		roles []model.Role
+	)
+	filter["org_uuid"] = r.OrgParam
+	total, err := s.repo.WithContext(ctx).Count(&roles, filter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.repo.WithContext(ctx).List(&roles, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return generic.NewListResponse(200, roles, total, opts), nil
+}
+
+// Update updates a role
+// @Summary Update a role
+// @Description Update a role, a role can not be renamed while users have it
+// @ID role-update
+// @Tags role
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param role path string true "Role ID"
+// @Param payload body PayloadRoleUpdate true "Role data"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/role/{role} [patch]
+func (s RoleService) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestRoleUpdate)
+	if err := r.PayloadRoleUpdate.validate(); err != nil {
+		return nil, err
+	}
+	var role model.Role
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Get(&role, map[string]any{"uuid": r.RoleParam, "org_uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if r.Name != nil && *r.Name != role.Name {
+			if err := checkRoleName(tx, model.Role{Name: *r.Name, OrgUUID: role.OrgUUID}); err != nil {
+				return err
+			}
+			if err := checkRoleUnused(tx, role); err != nil {
+				return err
+			}
+			role.Name = *r.Name
+		}
+		if r.Description != nil {
+			role.Description = r.Description
+		}
+		if r.Permissions != nil {
+			role.Permissions = r.Permissions
+		}
+		n, err := tx.Update(&role)
+		if err == nil && n == 0 {
+			return xerr.NotFound("role not found")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, role), nil
+}
+
+// Delete deletes a role
+// @Summary Delete a role
+// @Description Delete a role which no user has
+// @ID role-delete
+// @Tags role
+// @Security ApiKeyAuth
+// @Param org path string true "Organization ID"
+// @Param role path string true "Role ID"
+// @Success 204
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Failure 500 {object} Response
+// @Router /organization/{org}/role/{role} [delete]
+func (s RoleService) Delete(ctx context.Context, req generic.IRequest) error {
+	r := req.(*RequestRoleDelete)
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		var role model.Role
+		if _, err := tx.Get(&role, map[string]any{"uuid": r.RoleParam, "org_uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if err := checkRoleUnused(tx, role); err != nil {
+			return err
+		}
+		_, err := tx.Delete(&role, map[string]any{"uuid": role.UUID})
+		return err
+	})
+}
+
+// checkRoleName returns a conflict error when the organization already has a role of the same name
+func checkRoleName(repo storage.Storer, role model.Role) error {
+	n, err := repo.Count(&model.Role{}, map[string]any{"org_uuid": role.OrgUUID, "name": role.Name})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return xerr.Conflict(fmt.Sprintf("role %s already exists", role.Name))
+	}
+	return nil
+}
+
+// checkRoleUnused returns a conflict error when users of the organization have the role
+func checkRoleUnused(repo storage.Storer, role model.Role) error {
+	n, err := repo.Count(&model.Membership{}, map[string]any{"org_uuid": role.OrgUUID, "type": role.Name})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return xerr.Conflict(fmt.Sprintf("role %s is assigned to %d users", role.Name, n))
+	}
+	return nil
+}
+
+// RoleService is the service interface
+var _ generic.IService = new(RoleService)
+var _ generic.IFilterable = new(RoleService)
+var _ generic.ISortable = new(RoleService)
+var _ generic.IAuthorized = new(RoleService)
+var _ rbac.Resolver = new(RoleResolver)
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/password"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRoleService(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		store     = storage.NewMemoryStore()
+		svc       = NewRoleService(store)
+		users     = NewUserService(store, password.Default(), nil, nil)
+		resolver  = NewRoleResolver(store)
+		librarian = "LIBRARIAN"
+	)
+
+	resp, err := New(store, password.Default(), nil, nil).Create(ctx, &RequestOrgCreate{Organization: model.Organization{Name: "school"}})
+	assert.Assert(t, err, nil)
+	org := resp.(Response).Data.(model.Organization).UUID
+
+	// Organizations start with the default roles
+	resp, err = svc.List(ctx, &RequestRoleList{OrgParam: org}, map[string]any{}, storage.ListOptions{Sort: []string{"name"}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(generic.Response).Pagination.Total, int64(3))
+
+	_, err = svc.Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: librarian, Permissions: []rbac.Permission{"tag:publish"}}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+	_, err = svc.Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: librarian, Permissions: []rbac.Permission{"org:*"}}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+	_, err = svc.Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: TypeTEACHER}})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	resp, err = svc.Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: librarian, Permissions: []rbac.Permission{"tag:*"}}})
+	assert.Assert(t, err, nil)
+	role := resp.(Response).Data.(model.Role)
+
+	permissions, err := resolver.GetPermissions(ctx, org, librarian)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, permissions, []rbac.Permission{"tag:*"})
+	permissions, err = resolver.GetPermissions(ctx, uuid.New(), librarian)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(permissions), 0)
+
+	resp, err = users.GetTypes(ctx, org)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(Response).Data, []string{librarian, TypeMANAGER, TypeSTUDENT, TypeTEACHER})
+
+	// Users can only have the roles of their organization
+	unknown := "JANITOR"
+	_, err = users.Create(ctx, &RequestUserCreate{OrgParam: org, User: model.User{Email: "bob@ekolo.io"}, PayloadMembership: PayloadMembership{Type: &unknown}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+	_, err = users.Create(ctx, &RequestUserCreate{OrgParam: org, User: model.User{Email: "ada@ekolo.io"}, PayloadMembership: PayloadMembership{Type: &librarian}})
+	assert.Assert(t, err, nil)
+
+	// Roles users have can neither be renamed nor deleted
+	archivist := "ARCHIVIST"
+	_, err = svc.Update(ctx, &RequestRoleUpdate{OrgParam: org, RoleParam: role.UUID, PayloadRoleUpdate: PayloadRoleUpdate{Name: &archivist}})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	err = svc.Delete(ctx, &RequestRoleDelete{OrgParam: org, RoleParam: role.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	// Updates only write the fields they are given, the name may be left out
+	update := &RequestRoleUpdate{OrgParam: org, RoleParam: role.UUID, PayloadRoleUpdate: PayloadRoleUpdate{Permissions: []rbac.Permission{rbac.TagRead}}}
+	assert.Assert(t, len(generic.Validate(update)), 0)
+	resp, err = svc.Update(ctx, update)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(Response).Data.(model.Role).Name, librarian)
+	permissions, err = resolver.GetPermissions(ctx, org, librarian)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, permissions, []rbac.Permission{rbac.TagRead})
+
+	_, err = svc.Get(ctx, &RequestRoleGet{OrgParam: uuid.New(), RoleParam: role.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	// A deleted role can be created again
+	resp, err = svc.Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: archivist}})
+	assert.Assert(t, err, nil)
+	err = svc.Delete(ctx, &RequestRoleDelete{OrgParam: org, RoleParam: resp.(Response).Data.(model.Role).UUID})
+	assert.Assert(t, err, nil)
+	_, err = svc.Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: archivist}})
+	assert.Assert(t, err, nil)
+}
+
+func TestRoleResolverDefaults(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		store    = storage.NewMemoryStore()
+		resolver = NewRoleResolver(store)
+		org      = uuid.New()
+	)
+
+	// Organizations without roles have the default ones until they define their own
+	permissions, err := resolver.GetPermissions(ctx, org, TypeSTUDENT)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, permissions, DefaultRoles[TypeSTUDENT])
+
+	_, err = NewRoleService(store).Create(ctx, &RequestRoleCreate{OrgParam: org, PayloadRole: PayloadRole{Name: "LIBRARIAN"}})
+	assert.Assert(t, err, nil)
+	permissions, err = resolver.GetPermissions(ctx, org, TypeSTUDENT)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, permissions, DefaultRoles[TypeSTUDENT])
+
+	var roles []model.Role
+	_, err = store.List(&roles, map[string]any{"org_uuid": org}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(roles), 4)
+}
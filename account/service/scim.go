@@ -0,0 +1,1079 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SCIMPath is the base path of the SCIM endpoints
+const SCIMPath = "/scim/v2"
+
+const (
+	SCIMUserSchema        = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMGroupSchema       = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCIMListSchema        = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchSchema       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema       = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMProviderSchema    = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	DefaultSCIMCount      = 100
+	MaxSCIMCount          = 1000
+	SCIMTypeInvalidFilter = "invalidFilter"
+	SCIMTypeUniqueness    = "uniqueness"
+	SCIMTypeInvalidValue  = "invalidValue"
+	SCIMTypeMutability    = "mutability"
+	SCIMTypeInvalidSyntax = "invalidSyntax"
+	SCIMTypeInvalidPath   = "invalidPath"
+	SCIMTypeNoTarget      = "noTarget"
+)
+
+// scimUserPathPrefix prefixes the fully qualified paths of user attributes
+const scimUserPathPrefix = SCIMUserSchema + ":"
+
+// SCIMError is a SCIM protocol error, rendered as such so that provisioning clients understand it.
+// It unwraps to an application error of the matching kind.
+type SCIMError struct {
+	Type   string
+	Detail string
+	kind   xerr.Kind
+}
+
+func (e *SCIMError) Error() string {
+	return e.Type + ": " + e.Detail
+}
+
+func (e *SCIMError) Unwrap() error {
+	return xerr.New(e.kind, e.Detail)
+}
+
+// Status returns the HTTP status code of the error
+func (e *SCIMError) Status() int {
+	return e.kind.Status()
+}
+
+func newSCIMError(kind xerr.Kind, scimType, detail string) *SCIMError {
+	return &SCIMError{Type: scimType, Detail: detail, kind: kind}
+}
+
+func invalidSCIMFilter(detail string) *SCIMError {
+	return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidFilter, detail)
+}
+
+func invalidSCIMValue(detail string) *SCIMError {
+	return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidValue, detail)
+}
+
+// SCIMName is the name of a SCIM user
+type SCIMName struct {
+	Formatted  string  `json:"formatted,omitempty"`
+	GivenName  *string `json:"givenName,omitempty"`
+	FamilyName *string `json:"familyName,omitempty"`
+}
+
+// SCIMValue is an item of a multi-valued SCIM attribute
+type SCIMValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMMeta describes a SCIM resource
+type SCIMMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+// SCIMUser is a user as SCIM represents it.
+// The user name is the email address, emails are read from it, groups are the role of the user.
+type SCIMUser struct {
+	Schemas      []string    `json:"schemas"`
+	ID           string      `json:"id,omitempty"`
+	ExternalID   *string     `json:"externalId,omitempty"`
+	UserName     string      `json:"userName"`
+	Name         *SCIMName   `json:"name,omitempty"`
+	DisplayName  string      `json:"displayName,omitempty"`
+	Emails       []SCIMValue `json:"emails,omitempty"`
+	PhoneNumbers []SCIMValue `json:"phoneNumbers,omitempty"`
+	UserType     *string     `json:"userType,omitempty"` // Name of a role of the organization.
+	Active       *bool       `json:"active,omitempty"`
+	Password     *string     `json:"password,omitempty"` // Only ever written.
+	Groups       []SCIMValue `json:"groups,omitempty"`
+	Meta         *SCIMMeta   `json:"meta,omitempty"`
+
+	clearType bool // Set when a patch removed the user type.
+}
+
+// SCIMGroup is a role of the organization as SCIM represents it, its members are the users having it
+type SCIMGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []SCIMValue `json:"members"`
+	Meta        *SCIMMeta   `json:"meta,omitempty"`
+}
+
+// SCIMListResponse is a page of SCIM resources
+type SCIMListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int64    `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    any      `json:"Resources"`
+}
+
+// SCIMQuery selects the resources of a list request, startIndex is 1-based
+type SCIMQuery struct {
+	Filter     string `query:"filter"`
+	StartIndex int    `query:"startIndex"`
+	Count      *int   `query:"count"`
+}
+
+// SCIMOperation is an operation of a PATCH request
+type SCIMOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SCIMPatch is the body of a PATCH request
+type SCIMPatch struct {
+	Schemas    []string        `json:"schemas"`
+	Operations []SCIMOperation `json:"Operations"`
+}
+
+// SCIMSupported tells whether an optional SCIM feature is supported
+type SCIMSupported struct {
+	Supported bool `json:"supported"`
+}
+
+// SCIMFilterSupport tells whether filters are supported and how many results a page holds at most
+type SCIMFilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+// SCIMBulkSupport tells whether bulk operations are supported
+type SCIMBulkSupport struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+// SCIMAuthenticationScheme is a way clients authenticate to the SCIM endpoints
+type SCIMAuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// SCIMServiceProviderConfig describes the SCIM features supported by the service
+type SCIMServiceProviderConfig struct {
+	Schemas               []string                   `json:"schemas"`
+	Patch                 SCIMSupported              `json:"patch"`
+	Bulk                  SCIMBulkSupport            `json:"bulk"`
+	Filter                SCIMFilterSupport          `json:"filter"`
+	ChangePassword        SCIMSupported              `json:"changePassword"`
+	Sort                  SCIMSupported              `json:"sort"`
+	ETag                  SCIMSupported              `json:"etag"`
+	AuthenticationSchemes []SCIMAuthenticationScheme `json:"authenticationSchemes"`
+}
+
+// SCIMService provisions the users and the roles of an organization from an external system, such as an identity provider.
+// It acts on the organization of the principal, which authenticates with an API key of the organization.
+type SCIMService struct {
+	repo    storage.Storer
+	hasher  *password.Hasher
+	limiter *lockout.Limiter
+	now     func() time.Time
+}
+
+// NewSCIMService returns a new service.
+// limiter throttles the passwords given for users who already have an account, it is kept in memory when nil.
+func NewSCIMService(repo storage.Storer, hasher *password.Hasher, limiter *lockout.Limiter) *SCIMService {
+	return &SCIMService{
+		repo:    repo,
+		hasher:  hasher,
+		limiter: accountLimiter(limiter),
+		now:     time.Now,
+	}
+}
+
+// ServiceProviderConfig returns the SCIM features supported by the service
+func (s SCIMService) ServiceProviderConfig() SCIMServiceProviderConfig {
+	return SCIMServiceProviderConfig{
+		Schemas:        []string{SCIMProviderSchema},
+		Patch:          SCIMSupported{Supported: true},
+		Filter:         SCIMFilterSupport{Supported: true, MaxResults: MaxSCIMCount},
+		ChangePassword: SCIMSupported{Supported: true},
+		AuthenticationSchemes: []SCIMAuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "API key",
+			Description: "Bearer API key of the organization, scoped to the user and role permissions",
+		}},
+	}
+}
+
+// ListUsers returns a page of the users of the organization matching the query
+func (s SCIMService) ListUsers(ctx context.Context, q SCIMQuery) (SCIMListResponse, error) {
+	var (
+		users []model.User
+		mm    []model.Membership
+	)
+	filter, err := parseSCIMFilter(q.Filter, scimUserAttributes)
+	if err != nil {
+		return SCIMListResponse{}, err
+	}
+	repo := s.repo.WithContext(ctx)
+	filter, mFilter := splitMembershipFilter(filter)
+	filter["uuid"] = storage.Subquery{Model: &model.Membership{}, Column: "user_uuid", Filter: mFilter}
+	page, err := listSCIM(repo, &users, filter, q, "email")
+	if err != nil {
+		return page, err
+	}
+	if len(users) > 0 {
+		if _, err := repo.List(&mm, map[string]any{"user_uuid": userUUIDs(users)}, storage.ListOptions{}); err != nil {
+			return page, err
+		}
+	}
+	roles, err := getRoleIDs(repo)
+	if err != nil {
+		return page, err
+	}
+	memberships := make(map[uuid.UUID]model.Membership, len(mm))
+	for _, m := range mm {
+		memberships[m.UserUUID] = m
+	}
+	resources := make([]SCIMUser, len(users))
+	for i, u := range users {
+		resources[i] = newSCIMUser(u, memberships[u.UUID], roles)
+	}
+	page.Resources = resources
+	return page, nil
+}
+
+// GetUser returns a user of the organization
+func (s SCIMService) GetUser(ctx context.Context, id string) (SCIMUser, error) {
+	repo := s.repo.WithContext(ctx)
+	u, m, err := getSCIMUser(repo, id)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	roles, err := getRoleIDs(repo)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	return newSCIMUser(u, m, roles), nil
+}
+
+// CreateUser provisions a user in the organization, provisioned users are not sent a verification link.
+// A person who already has an account through another organization joins with it and its password, keeping its attributes.
+func (s SCIMService) CreateUser(ctx context.Context, in SCIMUser) (SCIMUser, error) {
+	org, ok := tenant.FromContext(ctx)
+	if !ok {
+		return SCIMUser{}, xerr.ErrUnauthenticated
+	}
+	u := model.User{Email: strings.TrimSpace(in.UserName)}
+	m := model.Membership{OrgUUID: org}
+	if err := s.setSCIMAttributes(&u, &m, in, false); err != nil {
+		return SCIMUser{}, err
+	}
+	if m.Status == "" {
+		m.Status = model.MembershipActive
+	}
+	account, err := s.getAccount(ctx, org, u.Email, ptrValue(in.Password))
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	var roles map[string]uuid.UUID
+	err = s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := checkSCIMUser(tx, u, m); err != nil {
+			return err
+		}
+		if account != nil {
+			u = *account
+		} else if _, err := tx.Create(&u); errors.Is(err, xerr.ErrConflict) {
+			return newSCIMError(xerr.KindConflict, SCIMTypeUniqueness, fmt.Sprintf("user %s already exists", u.Email))
+		} else if err != nil {
+			return err
+		}
+		m.UserUUID = u.UUID
+		if err := createMembership(tx, &m, u.Email); errors.Is(err, xerr.ErrConflict) {
+			return newSCIMError(xerr.KindConflict, SCIMTypeUniqueness, fmt.Sprintf("user %s already exists", u.Email))
+		} else if err != nil {
+			return err
+		}
+		var err error
+		roles, err = getRoleIDs(tx)
+		return err
+	})
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	return newSCIMUser(u, m, roles), nil
+}
+
+// getAccount returns the account a user provisioned in org joins, nil when the email address has none.
+// Accounts of other organizations are only unlocked by their password, anything else is a uniqueness error to the provisioning system.
+func (s SCIMService) getAccount(ctx context.Context, org uuid.UUID, email, plain string) (*model.User, error) {
+	repo := s.repo.WithContext(ctx)
+	account, err := findAccount(repo, email)
+	if err != nil || account == nil {
+		return nil, err
+	}
+	if err := checkNotMember(repo, org, *account); err != nil {
+		return nil, newSCIMError(xerr.KindConflict, SCIMTypeUniqueness, fmt.Sprintf("user %s already exists", email))
+	}
+	err = authenticateAccount(ctx, s.limiter, s.hasher, *account, plain)
+	if errors.Is(err, ErrAccountPassword) {
+		return nil, newSCIMError(xerr.KindConflict, SCIMTypeUniqueness, fmt.Sprintf("%s already has an account, its password is required", email))
+	}
+	return account, err
+}
+
+// ReplaceUser replaces the attributes of a user, the attributes missing from the request are cleared but the user type and the active flag
+func (s SCIMService) ReplaceUser(ctx context.Context, id string, in SCIMUser) (SCIMUser, error) {
+	return s.updateUser(ctx, id, func(SCIMUser) (SCIMUser, error) { return in, nil })
+}
+
+// PatchUser applies the operations of a PATCH request to a user
+func (s SCIMService) PatchUser(ctx context.Context, id string, patch SCIMPatch) (SCIMUser, error) {
+	if len(patch.Operations) == 0 {
+		return SCIMUser{}, newSCIMError(xerr.KindInvalid, SCIMTypeInvalidSyntax, "no operation")
+	}
+	return s.updateUser(ctx, id, func(current SCIMUser) (SCIMUser, error) {
+		for _, op := range patch.Operations {
+			if err := current.apply(op); err != nil {
+				return current, err
+			}
+		}
+		return current, nil
+	})
+}
+
+// updateUser replaces the attributes of a user by the ones the given function derives from its current ones.
+// Setting the password of a user ends their sessions, deactivating them ends the ones of the organization.
+// The password of a user of other organizations can not be set.
+func (s SCIMService) updateUser(ctx context.Context, id string, fn func(SCIMUser) (SCIMUser, error)) (SCIMUser, error) {
+	var result SCIMUser
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		stored, sm, err := getSCIMUser(tx, id)
+		if err != nil {
+			return err
+		}
+		roles, err := getRoleIDs(tx)
+		if err != nil {
+			return err
+		}
+		in, err := fn(newSCIMUser(stored, sm, roles))
+		if err != nil {
+			return err
+		}
+		// The email address identifies the account, which other organizations may share
+		if strings.TrimSpace(in.UserName) != stored.Email {
+			return newSCIMError(xerr.KindInvalid, SCIMTypeMutability, "userName can not be changed")
+		}
+		u := model.User{BaseModel: storage.BaseModel{UUID: stored.UUID}, Email: stored.Email}
+		m := model.Membership{BaseModel: storage.BaseModel{UUID: sm.UUID}, OrgUUID: sm.OrgUUID}
+		if err := s.setSCIMAttributes(&u, &m, in, true); err != nil {
+			return err
+		}
+		if err := checkSCIMUser(tx, u, m); err != nil {
+			return err
+		}
+		if u.Password != nil {
+			n, err := countOtherMemberships(tx, sm.OrgUUID, u.UUID)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return newSCIMError(xerr.KindInvalid, SCIMTypeMutability, "password of a user of other organizations can not be set")
+			}
+		}
+		if _, err := tx.Update(&u); err != nil {
+			return err
+		}
+		if _, err := tx.Update(&m); err != nil {
+			return err
+		}
+		if stored, sm, err = getSCIMUser(tx, id); err != nil {
+			return err
+		}
+		if u.Password != nil {
+			if err := RevokeSessions(tx, u.UUID, s.now()); err != nil {
+				return err
+			}
+		}
+		if !sm.IsActive() {
+			if err := RevokeMembershipSessions(tx, sm.UUID, s.now()); err != nil {
+				return err
+			}
+		}
+		result = newSCIMUser(stored, sm, roles)
+		return nil
+	})
+	return result, err
+}
+
+// DeleteUser removes a user from the organization and ends the sessions they logged into it with.
+// The account of the user is deleted unless they belong to other organizations.
+func (s SCIMService) DeleteUser(ctx context.Context, id string) error {
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		_, m, err := getSCIMUser(tx, id)
+		if err != nil {
+			return err
+		}
+		return removeMember(tx, m.OrgUUID, m.UserUUID)
+	})
+}
+
+// setSCIMAttributes sets the attributes of a SCIM user on a user and their membership.
+// When replacing, the optional attributes missing from the SCIM user are cleared.
+func (s SCIMService) setSCIMAttributes(u *model.User, m *model.Membership, in SCIMUser, replace bool) error {
+	var first, last *string
+	if in.Name != nil {
+		first, last = in.Name.GivenName, in.Name.FamilyName
+	}
+	var phone *string
+	for _, number := range in.PhoneNumbers {
+		if phone == nil || number.Primary {
+			phone = &number.Value
+		}
+	}
+	u.FirstName = orCleared(first, replace)
+	u.LastName = orCleared(last, replace)
+	u.Phone = orCleared(phone, replace)
+	m.ExternalID = orCleared(in.ExternalID, replace)
+	m.Type = in.UserType
+	if in.clearType {
+		m.Type = new(string)
+	}
+	switch {
+	case in.Active == nil:
+	case *in.Active:
+		m.Status = model.MembershipActive
+	default:
+		m.Status = model.MembershipInactive
+	}
+	if in.Password == nil {
+		return nil
+	}
+	if details := generic.Validate(PayloadPassword{Password: in.Password}); len(details) > 0 {
+		return invalidSCIMValue(strings.Join(details, ", "))
+	}
+	return u.SetPassword(s.hasher, *in.Password)
+}
+
+// ListGroups returns a page of the roles of the organization matching the query, along with their members
+func (s SCIMService) ListGroups(ctx context.Context, q SCIMQuery) (SCIMListResponse, error) {
+	filter, err := parseSCIMFilter(q.Filter, scimGroupAttributes)
+	if err != nil {
+		return SCIMListResponse{}, err
+	}
+	var page SCIMListResponse
+	err = s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := storeDefaultRoles(tx); err != nil {
+			return err
+		}
+		var roles []model.Role
+		if page, err = listSCIM(tx, &roles, filter, q, "name"); err != nil {
+			return err
+		}
+		resources := make([]SCIMGroup, len(roles))
+		for i, role := range roles {
+			if resources[i], err = newSCIMGroup(tx, role); err != nil {
+				return err
+			}
+		}
+		page.Resources = resources
+		return nil
+	})
+	return page, err
+}
+
+// GetGroup returns a role of the organization along with its members
+func (s SCIMService) GetGroup(ctx context.Context, id string) (SCIMGroup, error) {
+	var group SCIMGroup
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := storeDefaultRoles(tx); err != nil {
+			return err
+		}
+		role, err := getSCIMGroup(tx, id)
+		if err != nil {
+			return err
+		}
+		group, err = newSCIMGroup(tx, role)
+		return err
+	})
+	return group, err
+}
+
+// CreateGroup creates a role granting no permission, its members are given the role
+func (s SCIMService) CreateGroup(ctx context.Context, in SCIMGroup) (SCIMGroup, error) {
+	org, ok := tenant.FromContext(ctx)
+	if !ok {
+		return SCIMGroup{}, xerr.ErrUnauthenticated
+	}
+	var group SCIMGroup
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := storeDefaultRoles(tx); err != nil {
+			return err
+		}
+		role := model.Role{Name: strings.TrimSpace(in.DisplayName), OrgUUID: org}
+		if err := checkSCIMGroupName(tx, role); err != nil {
+			return err
+		}
+		if _, err := tx.Create(&role); err != nil {
+			return err
+		}
+		return s.writeGroup(tx, role, in, &group)
+	})
+	return group, err
+}
+
+// ReplaceGroup renames a role and sets its members, users who are no longer members are left without a role
+func (s SCIMService) ReplaceGroup(ctx context.Context, id string, in SCIMGroup) (SCIMGroup, error) {
+	return s.updateGroup(ctx, id, func(SCIMGroup) (SCIMGroup, error) { return in, nil })
+}
+
+// PatchGroup applies the operations of a PATCH request to a role
+func (s SCIMService) PatchGroup(ctx context.Context, id string, patch SCIMPatch) (SCIMGroup, error) {
+	if len(patch.Operations) == 0 {
+		return SCIMGroup{}, newSCIMError(xerr.KindInvalid, SCIMTypeInvalidSyntax, "no operation")
+	}
+	return s.updateGroup(ctx, id, func(current SCIMGroup) (SCIMGroup, error) {
+		for _, op := range patch.Operations {
+			if err := current.apply(op); err != nil {
+				return current, err
+			}
+		}
+		return current, nil
+	})
+}
+
+// updateGroup replaces a role and its members by the ones the given function derives from the current ones
+func (s SCIMService) updateGroup(ctx context.Context, id string, fn func(SCIMGroup) (SCIMGroup, error)) (SCIMGroup, error) {
+	var group SCIMGroup
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := storeDefaultRoles(tx); err != nil {
+			return err
+		}
+		role, err := getSCIMGroup(tx, id)
+		if err != nil {
+			return err
+		}
+		current, err := newSCIMGroup(tx, role)
+		if err != nil {
+			return err
+		}
+		in, err := fn(current)
+		if err != nil {
+			return err
+		}
+		return s.writeGroup(tx, role, in, &group)
+	})
+	return group, err
+}
+
+// writeGroup renames a role after a SCIM group and gives the role to its members only.
+// Members keep the role when it is renamed.
+func (s SCIMService) writeGroup(tx storage.Storer, role model.Role, in SCIMGroup, out *SCIMGroup) error {
+	name := strings.TrimSpace(in.DisplayName)
+	if name != role.Name {
+		if err := checkSCIMGroupName(tx, model.Role{Name: name, OrgUUID: role.OrgUUID}); err != nil {
+			return err
+		}
+		if _, err := tx.Update(&model.Role{BaseModel: storage.BaseModel{UUID: role.UUID}, Name: name}); err != nil {
+			return err
+		}
+	}
+	members := map[uuid.UUID]bool{}
+	for _, member := range in.Members {
+		id, err := uuid.Parse(member.Value)
+		if err != nil {
+			return invalidSCIMValue(fmt.Sprintf("unknown member %s", member.Value))
+		}
+		members[id] = true
+	}
+	var current []model.Membership
+	if _, err := tx.List(&current, map[string]any{"type": role.Name}, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, m := range current {
+		switch {
+		case !members[m.UserUUID]:
+			if err := setUserType(tx, m, ""); err != nil {
+				return err
+			}
+		case name != role.Name:
+			if err := setUserType(tx, m, name); err != nil {
+				return err
+			}
+		}
+		delete(members, m.UserUUID)
+	}
+	for id := range members {
+		var m model.Membership
+		_, err := tx.Get(&m, map[string]any{"user_uuid": id})
+		if errors.Is(err, storage.ErrNotFound) {
+			return invalidSCIMValue(fmt.Sprintf("unknown member %s", id))
+		}
+		if err != nil {
+			return err
+		}
+		if err := setUserType(tx, m, name); err != nil {
+			return err
+		}
+	}
+	role, err := getSCIMGroup(tx, role.UUID.String())
+	if err != nil {
+		return err
+	}
+	*out, err = newSCIMGroup(tx, role)
+	return err
+}
+
+// DeleteGroup deletes a role, its members are left without a role
+func (s SCIMService) DeleteGroup(ctx context.Context, id string) error {
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := storeDefaultRoles(tx); err != nil {
+			return err
+		}
+		role, err := getSCIMGroup(tx, id)
+		if err != nil {
+			return err
+		}
+		var members []model.Membership
+		if _, err := tx.List(&members, map[string]any{"type": role.Name}, storage.ListOptions{}); err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err := setUserType(tx, m, ""); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Delete(&model.Role{}, map[string]any{"uuid": role.UUID})
+		return err
+	})
+}
+
+// apply applies a PATCH operation to a SCIM user.
+// Display names, emails and extension attributes are derived or not stored, operations on them are ignored.
+func (u *SCIMUser) apply(op SCIMOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidSyntax, fmt.Sprintf("unsupported operation %s", op.Op))
+	}
+	path := strings.ToLower(op.Path)
+	if len(path) > len(scimUserPathPrefix) && strings.EqualFold(op.Path[:len(scimUserPathPrefix)], scimUserPathPrefix) {
+		path = path[len(scimUserPathPrefix):]
+	}
+	if path == "" {
+		return applyToAttributes(op, kind, u.apply)
+	}
+	remove := kind == "remove"
+	switch {
+	case path == "username":
+		if remove {
+			return scimRequired(op.Path)
+		}
+		return decodeSCIMValue(op.Value, &u.UserName)
+	case path == "active":
+		if remove {
+			return scimRequired(op.Path)
+		}
+		active, err := decodeSCIMBool(op.Value)
+		u.Active = &active
+		return err
+	case path == "password":
+		if remove {
+			return scimRequired(op.Path)
+		}
+		return decodeSCIMValue(op.Value, &u.Password)
+	case path == "externalid":
+		u.ExternalID = nil
+		if remove {
+			return nil
+		}
+		return decodeSCIMValue(op.Value, &u.ExternalID)
+	case path == "usertype":
+		u.UserType, u.clearType = nil, remove
+		if remove {
+			return nil
+		}
+		return decodeSCIMValue(op.Value, &u.UserType)
+	case path == "name":
+		if remove {
+			u.Name = nil
+			return nil
+		}
+		var name SCIMName
+		if err := decodeSCIMValue(op.Value, &name); err != nil {
+			return err
+		}
+		if u.Name == nil {
+			u.Name = &SCIMName{}
+		}
+		if name.GivenName != nil {
+			u.Name.GivenName = name.GivenName
+		}
+		if name.FamilyName != nil {
+			u.Name.FamilyName = name.FamilyName
+		}
+		return nil
+	case path == "name.givenname" || path == "name.familyname":
+		if u.Name == nil {
+			u.Name = &SCIMName{}
+		}
+		target := &u.Name.GivenName
+		if path == "name.familyname" {
+			target = &u.Name.FamilyName
+		}
+		*target = nil
+		if remove {
+			return nil
+		}
+		return decodeSCIMValue(op.Value, target)
+	case path == "phonenumbers":
+		u.PhoneNumbers = nil
+		if remove {
+			return nil
+		}
+		return decodeSCIMValue(op.Value, &u.PhoneNumbers)
+	case strings.HasPrefix(path, "phonenumbers["):
+		// Only one phone number is stored, whatever its type
+		u.PhoneNumbers = nil
+		if remove {
+			return nil
+		}
+		var number string
+		if err := decodeSCIMValue(op.Value, &number); err != nil {
+			return err
+		}
+		u.PhoneNumbers = []SCIMValue{{Value: number}}
+		return nil
+	case path == "groups" || strings.HasPrefix(path, "groups["):
+		return newSCIMError(xerr.KindInvalid, SCIMTypeMutability, "groups are changed through the members of groups")
+	case path == "displayname", strings.HasPrefix(path, "emails"), strings.HasPrefix(path, "urn:"):
+		return nil
+	default:
+		return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidPath, fmt.Sprintf("unsupported path %s", op.Path))
+	}
+}
+
+// scimMemberPath matches the path removing a member of a group
+var scimMemberPath = regexp.MustCompile(`(?i)^members\[value eq "([^"]*)"\]$`)
+
+// apply applies a PATCH operation to a SCIM group
+func (g *SCIMGroup) apply(op SCIMOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidSyntax, fmt.Sprintf("unsupported operation %s", op.Op))
+	}
+	if op.Path == "" {
+		return applyToAttributes(op, kind, g.apply)
+	}
+	if m := scimMemberPath.FindStringSubmatch(op.Path); m != nil {
+		if kind != "remove" {
+			return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidPath, fmt.Sprintf("unsupported path %s", op.Path))
+		}
+		g.Members = withoutMembers(g.Members, []SCIMValue{{Value: m[1]}})
+		return nil
+	}
+	switch strings.ToLower(op.Path) {
+	case "displayname":
+		if kind == "remove" {
+			return scimRequired(op.Path)
+		}
+		return decodeSCIMValue(op.Value, &g.DisplayName)
+	case "members":
+		var members []SCIMValue
+		if len(op.Value) > 0 {
+			if err := decodeSCIMValue(op.Value, &members); err != nil {
+				return err
+			}
+		}
+		switch {
+		case kind == "add":
+			g.Members = append(withoutMembers(g.Members, members), members...)
+		case kind == "replace":
+			g.Members = members
+		case len(members) > 0:
+			g.Members = withoutMembers(g.Members, members)
+		default:
+			g.Members = nil
+		}
+		return nil
+	case "id", "externalid":
+		return nil
+	default:
+		return newSCIMError(xerr.KindInvalid, SCIMTypeInvalidPath, fmt.Sprintf("unsupported path %s", op.Path))
+	}
+}
+
+// applyToAttributes applies an operation without path, whose value holds the attributes to add or replace
+func applyToAttributes(op SCIMOperation, kind string, apply func(SCIMOperation) error) error {
+	if kind == "remove" {
+		return newSCIMError(xerr.KindInvalid, SCIMTypeNoTarget, "remove requires a path")
+	}
+	var attributes map[string]json.RawMessage
+	if err := decodeSCIMValue(op.Value, &attributes); err != nil {
+		return err
+	}
+	for path, value := range attributes {
+		if path == "schemas" {
+			continue
+		}
+		if err := apply(SCIMOperation{Op: op.Op, Path: path, Value: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withoutMembers returns the members which are not removed
+func withoutMembers(members, removed []SCIMValue) []SCIMValue {
+	kept := []SCIMValue{}
+	for _, member := range members {
+		found := false
+		for _, r := range removed {
+			found = found || strings.EqualFold(member.Value, r.Value)
+		}
+		if !found {
+			kept = append(kept, member)
+		}
+	}
+	return kept
+}
+
+// decodeSCIMValue decodes the value of an operation
+func decodeSCIMValue(value json.RawMessage, v any) error {
+	if err := json.Unmarshal(value, v); err != nil {
+		return invalidSCIMValue(fmt.Sprintf("invalid value %s", value))
+	}
+	return nil
+}
+
+// decodeSCIMBool decodes a boolean, some clients send them as strings
+func decodeSCIMBool(value json.RawMessage) (bool, error) {
+	var b any
+	if err := decodeSCIMValue(value, &b); err != nil {
+		return false, err
+	}
+	switch v := b.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if strings.EqualFold(v, "true") || strings.EqualFold(v, "false") {
+			return strings.EqualFold(v, "true"), nil
+		}
+	}
+	return false, invalidSCIMValue(fmt.Sprintf("invalid boolean %s", value))
+}
+
+// scimRequired returns the error of a removal of a required attribute
+func scimRequired(path string) error {
+	return newSCIMError(xerr.KindInvalid, SCIMTypeMutability, fmt.Sprintf("%s can not be removed", path))
+}
+
+// orCleared returns the value of an attribute, or an empty value clearing it when it is missing and cleared is set
+func orCleared(value *string, cleared bool) *string {
+	if value == nil && cleared {
+		return new(string)
+	}
+	return value
+}
+
+// nonEmpty returns nil for empty values, the storage clears attributes by writing empty values
+func nonEmpty(value *string) *string {
+	if value == nil || *value == "" {
+		return nil
+	}
+	return value
+}
+
+// newSCIMUser returns the SCIM representation of a user and their membership, roles maps the names of the stored roles to their ID
+func newSCIMUser(u model.User, m model.Membership, roles map[string]uuid.UUID) SCIMUser {
+	active := m.IsActive()
+	result := SCIMUser{
+		Schemas:    []string{SCIMUserSchema},
+		ID:         u.UUID.String(),
+		ExternalID: nonEmpty(m.ExternalID),
+		UserName:   u.Email,
+		Emails:     []SCIMValue{{Value: u.Email, Type: "work", Primary: true}},
+		UserType:   nonEmpty(m.Type),
+		Active:     &active,
+		Meta:       &SCIMMeta{ResourceType: "User", Created: u.CreatedAt, LastModified: u.UpdatedAt, Location: SCIMPath + "/Users/" + u.UUID.String()},
+	}
+	first, last := nonEmpty(u.FirstName), nonEmpty(u.LastName)
+	if first != nil || last != nil {
+		result.Name = &SCIMName{GivenName: first, FamilyName: last}
+		result.Name.Formatted = strings.TrimSpace(strings.Join([]string{ptrValue(first), ptrValue(last)}, " "))
+		result.DisplayName = result.Name.Formatted
+	}
+	if phone := nonEmpty(u.Phone); phone != nil {
+		result.PhoneNumbers = []SCIMValue{{Value: *phone, Primary: true}}
+	}
+	if id, ok := roles[ptrValue(m.Type)]; ok {
+		result.Groups = []SCIMValue{{Value: id.String(), Display: *m.Type}}
+	}
+	return result
+}
+
+// newSCIMGroup returns the SCIM representation of a role, listing its members
+func newSCIMGroup(repo storage.Storer, role model.Role) (SCIMGroup, error) {
+	var (
+		mm    []model.Membership
+		users []model.User
+	)
+	if _, err := repo.List(&mm, map[string]any{"type": role.Name}, storage.ListOptions{}); err != nil {
+		return SCIMGroup{}, err
+	}
+	if _, err := repo.List(&users, map[string]any{"uuid": memberUUIDs(mm)}, storage.ListOptions{Sort: []string{"email"}}); err != nil {
+		return SCIMGroup{}, err
+	}
+	members := make([]SCIMValue, len(users))
+	for i, u := range users {
+		members[i] = SCIMValue{Value: u.UUID.String(), Display: u.Email}
+	}
+	return SCIMGroup{
+		Schemas:     []string{SCIMGroupSchema},
+		ID:          role.UUID.String(),
+		DisplayName: role.Name,
+		Members:     members,
+		Meta:        &SCIMMeta{ResourceType: "Group", Created: role.CreatedAt, LastModified: role.UpdatedAt, Location: SCIMPath + "/Groups/" + role.UUID.String()},
+	}, nil
+}
+
+// ptrValue returns the value of a string pointer, empty when nil
+func ptrValue(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// listSCIM lists a page of resources, the page has no resources when the count is 0
+func listSCIM(repo storage.Storer, m any, filter map[string]any, q SCIMQuery, sort string) (SCIMListResponse, error) {
+	page := SCIMListResponse{Schemas: []string{SCIMListSchema}, StartIndex: max(q.StartIndex, 1), ItemsPerPage: DefaultSCIMCount}
+	if q.Count != nil {
+		page.ItemsPerPage = min(max(*q.Count, 0), MaxSCIMCount)
+	}
+	total, err := repo.Count(m, filter)
+	if err != nil {
+		return page, err
+	}
+	page.TotalResults = total
+	if page.ItemsPerPage == 0 {
+		return page, nil
+	}
+	_, err = repo.List(m, filter, storage.ListOptions{Limit: page.ItemsPerPage, Offset: page.StartIndex - 1, Sort: []string{sort}})
+	return page, err
+}
+
+// getSCIMUser returns a user of the organization by its SCIM ID, along with their membership
+func getSCIMUser(repo storage.Storer, id string) (model.User, model.Membership, error) {
+	var (
+		u model.User
+		m model.Membership
+	)
+	parsed, err := uuid.Parse(id)
+	if err == nil {
+		_, err = repo.Get(&m, map[string]any{"user_uuid": parsed})
+	}
+	if err == nil {
+		_, err = repo.Get(&u, map[string]any{"uuid": parsed})
+	}
+	if err != nil && (errors.Is(err, storage.ErrNotFound) || parsed == uuid.Nil) {
+		return u, m, xerr.NotFound("user not found")
+	}
+	return u, m, err
+}
+
+// getSCIMGroup returns a role of the organization by its SCIM ID
+func getSCIMGroup(repo storage.Storer, id string) (model.Role, error) {
+	var role model.Role
+	parsed, err := uuid.Parse(id)
+	if err == nil {
+		_, err = repo.Get(&role, map[string]any{"uuid": parsed})
+	}
+	if err != nil && (errors.Is(err, storage.ErrNotFound) || parsed == uuid.Nil) {
+		return role, xerr.NotFound("group not found")
+	}
+	return role, err
+}
+
+// getRoleIDs maps the names of the stored roles of the organization to their ID
+func getRoleIDs(repo storage.Storer) (map[string]uuid.UUID, error) {
+	var roles []model.Role
+	if _, err := repo.List(&roles, map[string]any{}, storage.ListOptions{}); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]uuid.UUID, len(roles))
+	for _, role := range roles {
+		ids[role.Name] = role.UUID
+	}
+	return ids, nil
+}
+
+// storeDefaultRoles stores the default roles of an organization which has none, groups need an ID
+func storeDefaultRoles(tx storage.Storer) error {
+	n, err := tx.Count(&model.Role{}, map[string]any{})
+	if err != nil || n > 0 {
+		return err
+	}
+	for _, role := range newDefaultRoles(uuid.Nil) {
+		if _, err := tx.Create(&role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSCIMUser returns an error unless a provisioned user and their membership are valid, users may have no role
+func checkSCIMUser(repo storage.Storer, u model.User, m model.Membership) error {
+	details := append(generic.Validate(u), generic.Validate(m)...)
+	if len(details) > 0 {
+		return invalidSCIMValue(strings.Join(details, ", "))
+	}
+	if m.Type == nil || *m.Type == "" {
+		return nil
+	}
+	if err := checkUserType(repo, m); err != nil {
+		return invalidSCIMValue(fmt.Sprintf("userType %s is not a group", *m.Type))
+	}
+	return nil
+}
+
+// checkSCIMGroupName returns an error unless a role can be named after a group
+func checkSCIMGroupName(repo storage.Storer, role model.Role) error {
+	if details := generic.Validate(PayloadRole{Name: role.Name}); len(details) > 0 {
+		return invalidSCIMValue(strings.Join(details, ", "))
+	}
+	err := checkRoleName(repo, role)
+	if errors.Is(err, xerr.ErrConflict) {
+		return newSCIMError(xerr.KindConflict, SCIMTypeUniqueness, fmt.Sprintf("group %s already exists", role.Name))
+	}
+	return err
+}
+
+// setUserType gives a role to a member, an empty type leaves the member without a role
+func setUserType(repo storage.Storer, m model.Membership, name string) error {
+	_, err := repo.Update(&model.Membership{BaseModel: storage.BaseModel{UUID: m.UUID}, Type: &name})
+	return err
+}
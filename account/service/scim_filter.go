@@ -0,0 +1,182 @@
+package service
+
+import (
+	"ekolo/account/model"
+	"ekolo/pkg/storage"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// scimKind is the type of the values of a SCIM attribute
+type scimKind int
+
+const (
+	scimString scimKind = iota
+	scimBool
+	scimStatus // A boolean standing for the status of a membership.
+	scimUUID
+	scimTime
+)
+
+// scimAttribute is the column a SCIM attribute is stored in
+type scimAttribute struct {
+	column string
+	kind   scimKind
+}
+
+// scimUserAttributes are the user attributes filters can name, lower cased since attribute names are case insensitive
+var scimUserAttributes = map[string]scimAttribute{
+	"id":                {"user_uuid", scimUUID},
+	"username":          {"email", scimString},
+	"emails":            {"email", scimString},
+	"emails.value":      {"email", scimString},
+	"externalid":        {"external_id", scimString},
+	"name.givenname":    {"first_name", scimString},
+	"name.familyname":   {"last_name", scimString},
+	"usertype":          {"type", scimString},
+	"active":            {"status", scimStatus},
+	"meta.created":      {"created_at", scimTime},
+	"meta.lastmodified": {"updated_at", scimTime},
+}
+
+// scimGroupAttributes are the group attributes filters can name
+var scimGroupAttributes = map[string]scimAttribute{
+	"id":                {"uuid", scimUUID},
+	"displayname":       {"name", scimString},
+	"meta.created":      {"created_at", scimTime},
+	"meta.lastmodified": {"updated_at", scimTime},
+}
+
+// scimOperators maps the comparison operators of SCIM filters to the storage ones, eq being the default one
+var scimOperators = map[string]string{
+	"eq": "",
+	"ne": storage.OpNe,
+	"co": storage.OpIContains,
+	"sw": storage.OpStartsWith,
+	"gt": storage.OpGt,
+	"ge": storage.OpGte,
+	"lt": storage.OpLt,
+	"le": storage.OpLte,
+}
+
+// parseSCIMFilter translates a SCIM filter into a storage filter.
+// Comparisons of the given attributes joined by and are supported, or, not and value paths are not.
+func parseSCIMFilter(filter string, attributes map[string]scimAttribute) (map[string]any, error) {
+	result := map[string]any{}
+	tokens, err := tokenizeSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	for len(tokens) > 0 {
+		if len(tokens) < 2 {
+			return nil, invalidSCIMFilter("incomplete comparison")
+		}
+		attr, ok := attributes[strings.ToLower(tokens[0])]
+		if !ok {
+			return nil, invalidSCIMFilter(fmt.Sprintf("unsupported attribute %s", tokens[0]))
+		}
+		op := strings.ToLower(tokens[1])
+		var key string
+		var value any
+		if op == "pr" {
+			key, value = attr.column+"__"+storage.OpIsNull, false
+			tokens = tokens[2:]
+		} else {
+			storageOp, ok := scimOperators[op]
+			if !ok || len(tokens) < 3 {
+				return nil, invalidSCIMFilter(fmt.Sprintf("unsupported operator %s", tokens[1]))
+			}
+			if value, err = parseSCIMValue(tokens[2], attr.kind); err != nil {
+				return nil, err
+			}
+			key = attr.column
+			if storageOp != "" {
+				key += "__" + storageOp
+			}
+			tokens = tokens[3:]
+		}
+		if _, ok := result[key]; ok {
+			return nil, invalidSCIMFilter(fmt.Sprintf("%s is compared twice the same way", key))
+		}
+		result[key] = value
+		if len(tokens) > 0 {
+			if !strings.EqualFold(tokens[0], "and") || len(tokens) == 1 {
+				return nil, invalidSCIMFilter(fmt.Sprintf("unsupported expression %s", tokens[0]))
+			}
+			tokens = tokens[1:]
+		}
+	}
+	return result, nil
+}
+
+// tokenizeSCIMFilter splits a filter on spaces, quoted strings are kept whole along with their quotes
+func tokenizeSCIMFilter(filter string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			return nil, invalidSCIMFilter("grouping and value paths are not supported")
+		case c == '"':
+			end := i + 1
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, invalidSCIMFilter("unterminated string")
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := strings.IndexAny(filter[i:], " \"()[]")
+			if end < 0 {
+				end = len(filter) - i
+			}
+			tokens = append(tokens, filter[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// parseSCIMValue returns the value of a comparison as stored in the column of an attribute of the given kind
+func parseSCIMValue(token string, kind scimKind) (any, error) {
+	var value any
+	if err := json.Unmarshal([]byte(token), &value); err != nil {
+		return nil, invalidSCIMFilter(fmt.Sprintf("invalid value %s", token))
+	}
+	switch v := value.(type) {
+	case bool:
+		switch kind {
+		case scimBool:
+			return v, nil
+		case scimStatus:
+			if v {
+				return model.MembershipActive, nil
+			}
+			return model.MembershipInactive, nil
+		}
+	case string:
+		switch kind {
+		case scimString:
+			return v, nil
+		case scimUUID:
+			// Malformed ids match no resource rather than failing the request
+			id, _ := uuid.Parse(v)
+			return id, nil
+		case scimTime:
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return nil, invalidSCIMFilter(fmt.Sprintf("invalid value %s", token))
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/password"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	id := uuid.New()
+	filter, err := parseSCIMFilter(`userName eq "ada@ekolo.io" and active eq true and name.familyName co "Love" and id eq "`+id.String()+`"`, scimUserAttributes)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, filter, map[string]any{"email": "ada@ekolo.io", "status": model.MembershipActive, "last_name__icontains": "Love", "user_uuid": id})
+
+	filter, err = parseSCIMFilter(`externalId pr AND meta.created gt "2024-01-02T03:04:05Z"`, scimUserAttributes)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, filter, map[string]any{"external_id__isnull": false, "created_at__gt": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+
+	filter, err = parseSCIMFilter("", scimGroupAttributes)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(filter), 0)
+
+	for _, invalid := range []string{
+		`userName eq "ada@ekolo.io" or userName eq "bob@ekolo.io"`,
+		`not (userName eq "ada@ekolo.io")`,
+		`emails[type eq "work"]`,
+		`password eq "s3cret"`,
+		`userName ew "@ekolo.io"`,
+		`active eq "yes"`,
+		`userName eq "ada@ekolo.io`,
+		`userName eq`,
+	} {
+		_, err = parseSCIMFilter(invalid, scimUserAttributes)
+		var serr *SCIMError
+		assert.Assert(t, errors.As(err, &serr), true)
+		assert.Assert(t, serr.Type, SCIMTypeInvalidFilter)
+	}
+}
+
+func TestSCIMUsers(t *testing.T) {
+	var (
+		raw   = storage.NewMemoryStore()
+		store = tenant.NewStore(raw, tenant.DefaultField)
+		svc   = NewSCIMService(store, password.Default(), nil)
+		org   = uuid.New()
+		ctx   = tenant.NewContext(context.Background(), org)
+		first = "Ada"
+		typ   = TypeTEACHER
+	)
+
+	_, err := svc.CreateUser(ctx, SCIMUser{UserName: "ada"})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	unknown := "JANITOR"
+	_, err = svc.CreateUser(ctx, SCIMUser{UserName: "ada@ekolo.io", UserType: &unknown})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+
+	in := SCIMUser{UserName: "ada@ekolo.io", Name: &SCIMName{GivenName: &first}, UserType: &typ, PhoneNumbers: []SCIMValue{{Value: "+33100000000"}}}
+	created, err := svc.CreateUser(ctx, in)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *created.Active, true)
+	assert.Assert(t, created.DisplayName, "Ada")
+	assert.Assert(t, created.Meta.Location, SCIMPath+"/Users/"+created.ID)
+	_, err = svc.CreateUser(ctx, in)
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	// Users of other organizations are not reachable
+	_, err = svc.GetUser(tenant.NewContext(context.Background(), uuid.New()), created.ID)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	_, err = svc.GetUser(ctx, "not-an-id")
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	count := 1
+	page, err := svc.ListUsers(ctx, SCIMQuery{Filter: `userName sw "ada" and active eq true`, Count: &count})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, page.TotalResults, int64(1))
+	assert.Assert(t, page.Resources.([]SCIMUser)[0].ID, created.ID)
+	count = 0
+	page, err = svc.ListUsers(ctx, SCIMQuery{Count: &count})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, page.TotalResults, int64(1))
+	assert.Assert(t, len(page.Resources.([]SCIMUser)), 0)
+
+	// Patches follow the attribute names of SCIM, whatever their case
+	var m model.Membership
+	_, err = raw.Get(&m, map[string]any{"user_uuid": uuid.MustParse(created.ID)})
+	assert.Assert(t, err, nil)
+	session := model.Session{UserUUID: m.UserUUID, MembershipUUID: m.UUID, ExpiresAt: time.Now().Add(time.Hour)}
+	_, err = raw.Create(&session)
+	assert.Assert(t, err, nil)
+	patched, err := svc.PatchUser(ctx, created.ID, SCIMPatch{Operations: []SCIMOperation{
+		{Op: "Replace", Path: "name.familyName", Value: json.RawMessage(`"Lovelace"`)},
+		{Op: "remove", Path: "phoneNumbers"},
+		{Op: "replace", Value: json.RawMessage(`{"active": "False", "externalId": "42"}`)},
+		{Op: "add", Path: "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber", Value: json.RawMessage(`"7"`)},
+	}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *patched.Name.FamilyName, "Lovelace")
+	assert.Assert(t, *patched.Name.GivenName, "Ada")
+	assert.Assert(t, len(patched.PhoneNumbers), 0)
+	assert.Assert(t, *patched.ExternalID, "42")
+	assert.Assert(t, *patched.UserType, typ)
+
+	// Deactivated users are logged out
+	assert.Assert(t, *patched.Active, false)
+	_, err = raw.Get(&session, map[string]any{"uuid": session.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, session.RevokedAt != nil, true)
+
+	for _, op := range []SCIMOperation{
+		{Op: "remove", Path: "userName"},
+		{Op: "replace", Path: "userName", Value: json.RawMessage(`"bob@ekolo.io"`)},
+		{Op: "replace", Path: "nickName", Value: json.RawMessage(`"Ada"`)},
+		{Op: "move", Path: "active"},
+		{Op: "remove"},
+	} {
+		_, err = svc.PatchUser(ctx, created.ID, SCIMPatch{Operations: []SCIMOperation{op}})
+		assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	}
+
+	// Replacing clears the missing attributes but the user type
+	replaced, err := svc.ReplaceUser(ctx, created.ID, SCIMUser{UserName: "ada@ekolo.io"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, replaced.Name == nil, true)
+	assert.Assert(t, replaced.ExternalID == nil, true)
+	assert.Assert(t, *replaced.UserType, typ)
+
+	assert.Assert(t, svc.DeleteUser(ctx, created.ID), nil)
+	_, err = svc.GetUser(ctx, created.ID)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+}
+
+func TestSCIMUsersAcrossOrganizations(t *testing.T) {
+	var (
+		raw     = storage.NewMemoryStore()
+		store   = tenant.NewStore(raw, tenant.DefaultField)
+		svc     = NewSCIMService(store, password.Default(), nil)
+		school  = tenant.NewContext(context.Background(), uuid.New())
+		college = tenant.NewContext(context.Background(), uuid.New())
+		plain   = "s3cret-pass"
+	)
+	created, err := svc.CreateUser(school, SCIMUser{UserName: "ada@ekolo.io", Password: &plain})
+	assert.Assert(t, err, nil)
+
+	// Provisioning the same person in another organization adds the existing account to it, given its password
+	_, err = svc.CreateUser(college, SCIMUser{UserName: "ada@ekolo.io", ExternalID: &plain})
+	var serr *SCIMError
+	assert.Assert(t, errors.As(err, &serr), true)
+	assert.Assert(t, serr.Type, SCIMTypeUniqueness)
+	joined, err := svc.CreateUser(college, SCIMUser{UserName: "ada@ekolo.io", ExternalID: &plain, Password: &plain})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, joined.ID, created.ID)
+	assert.Assert(t, *joined.ExternalID, plain)
+	page, err := svc.ListUsers(college, SCIMQuery{Filter: `externalId eq "` + plain + `"`})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, page.TotalResults, int64(1))
+	page, err = svc.ListUsers(school, SCIMQuery{Filter: `externalId eq "` + plain + `"`})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, page.TotalResults, int64(0))
+
+	// Neither organization can set the password of the shared account
+	_, err = svc.PatchUser(college, created.ID, SCIMPatch{Operations: []SCIMOperation{{Op: "replace", Path: "password", Value: json.RawMessage(`"0ther-pass"`)}}})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+
+	// Deprovisioning removes the user from the organization, the account goes along with the last one
+	assert.Assert(t, svc.DeleteUser(school, created.ID), nil)
+	_, err = svc.GetUser(school, created.ID)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	_, err = svc.GetUser(college, created.ID)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, svc.DeleteUser(college, created.ID), nil)
+	n, err := raw.Count(&model.User{}, map[string]any{"email": "ada@ekolo.io"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+}
+
+func TestSCIMGroups(t *testing.T) {
+	var (
+		store = tenant.NewStore(storage.NewMemoryStore(), tenant.DefaultField)
+		svc   = NewSCIMService(store, password.Default(), nil)
+		ctx   = tenant.NewContext(context.Background(), uuid.New())
+	)
+	ada, err := svc.CreateUser(ctx, SCIMUser{UserName: "ada@ekolo.io"})
+	assert.Assert(t, err, nil)
+	bob, err := svc.CreateUser(ctx, SCIMUser{UserName: "bob@ekolo.io"})
+	assert.Assert(t, err, nil)
+
+	// The default roles are groups too
+	page, err := svc.ListGroups(ctx, SCIMQuery{Filter: `displayName eq "TEACHER"`})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, page.TotalResults, int64(1))
+	_, err = svc.CreateGroup(ctx, SCIMGroup{DisplayName: TypeTEACHER})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	_, err = svc.CreateGroup(ctx, SCIMGroup{DisplayName: "LIBRARIAN", Members: []SCIMValue{{Value: uuid.NewString()}}})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+
+	// Members of a group have its role
+	group, err := svc.CreateGroup(ctx, SCIMGroup{DisplayName: "LIBRARIAN", Members: []SCIMValue{{Value: ada.ID}}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, group.Members, []SCIMValue{{Value: ada.ID, Display: "ada@ekolo.io"}})
+	u, err := svc.GetUser(ctx, ada.ID)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *u.UserType, "LIBRARIAN")
+	assert.Assert(t, u.Groups, []SCIMValue{{Value: group.ID, Display: "LIBRARIAN"}})
+
+	// Renamed groups keep their members, removed members are left without a role
+	group, err = svc.PatchGroup(ctx, group.ID, SCIMPatch{Operations: []SCIMOperation{
+		{Op: "add", Path: "members", Value: json.RawMessage(`[{"value": "` + bob.ID + `"}]`)},
+		{Op: "remove", Path: `members[value eq "` + ada.ID + `"]`},
+		{Op: "replace", Path: "displayName", Value: json.RawMessage(`"LIBRARY"`)},
+	}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, group.DisplayName, "LIBRARY")
+	assert.Assert(t, group.Members, []SCIMValue{{Value: bob.ID, Display: "bob@ekolo.io"}})
+	u, err = svc.GetUser(ctx, ada.ID)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, u.UserType == nil, true)
+	u, err = svc.GetUser(ctx, bob.ID)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *u.UserType, "LIBRARY")
+
+	assert.Assert(t, svc.DeleteGroup(ctx, group.ID), nil)
+	_, err = svc.GetGroup(ctx, group.ID)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	u, err = svc.GetUser(ctx, bob.ID)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, u.UserType == nil, true)
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SessionService lets users see where they are logged in and end those sessions
+type SessionService struct {
+	repo storage.Storer
+	now  func() time.Time
+}
+
+// NewSessionService returns a new service
+func NewSessionService(repo storage.Storer) *SessionService {
+	return &SessionService{
+		repo: repo,
+		now:  time.Now,
+	}
+}
+
+// SessionView is a session of the authenticated user
+type SessionView struct {
+	model.Session
+	Current bool `json:"current"` // Whether the request was authenticated by this session.
+}
+
+// RequestSession is the request object of the session revocation endpoint
+type RequestSession struct {
+	SessionParam uuid.UUID `param:"session" json:"-"`
+}
+
+// List returns the active sessions of the authenticated user, most recently seen first
+func (s SessionService) List(ctx context.Context) ([]SessionView, error) {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return nil, xerr.ErrUnauthenticated
+	}
+	var sessions []model.Session
+	filter := map[string]any{"user_uuid": p.UserUUID, "revoked_at__isnull": true, "expires_at__gt": s.now()}
+	if _, err := s.repo.WithContext(ctx).List(&sessions, filter, storage.ListOptions{Sort: []string{"-last_seen_at"}}); err != nil {
+		return nil, err
+	}
+	views := make([]SessionView, len(sessions))
+	for i, session := range sessions {
+		views[i] = SessionView{Session: session, Current: session.UUID == p.Session}
+	}
+	return views, nil
+}
+
+// Revoke ends a session of the authenticated user, its tokens are rejected from now on
+func (s SessionService) Revoke(ctx context.Context, req RequestSession) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return xerr.ErrUnauthenticated
+	}
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		var session model.Session
+		_, err := tx.Get(&session, map[string]any{"uuid": req.SessionParam, "user_uuid": p.UserUUID})
+		if errors.Is(err, storage.ErrNotFound) {
+			return xerr.NotFound("session not found")
+		}
+		if err != nil || session.RevokedAt != nil {
+			return err
+		}
+		return RevokeSession(tx, session.UUID, s.now())
+	})
+}
+
+// RevokeAll ends every session of the authenticated user, the current one included
+func (s SessionService) RevokeAll(ctx context.Context) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return xerr.ErrUnauthenticated
+	}
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		return RevokeSessions(tx, p.UserUUID, s.now())
+	})
+}
+
+// RevokeSessions ends every session of a user which is not revoked yet, like when their password changes
+func RevokeSessions(repo storage.Storer, user uuid.UUID, now time.Time) error {
+	return revokeSessions(repo, map[string]any{"user_uuid": user}, now)
+}
+
+// RevokeMembershipSessions ends the sessions logged into an organization through a membership, like when it is deactivated
+func RevokeMembershipSessions(repo storage.Storer, membership uuid.UUID, now time.Time) error {
+	return revokeSessions(repo, map[string]any{"membership_uuid": membership}, now)
+}
+
+// revokeSessions ends the sessions matching filter which are not revoked yet
+func revokeSessions(repo storage.Storer, filter map[string]any, now time.Time) error {
+	var sessions []model.Session
+	filter["revoked_at__isnull"] = true
+	if _, err := repo.List(&sessions, filter, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := RevokeSession(repo, session.UUID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeSession marks a session revoked, its tokens are rejected from now on
+func RevokeSession(repo storage.Storer, session uuid.UUID, now time.Time) error {
+	_, err := repo.Update(&model.Session{BaseModel: storage.BaseModel{UUID: session}, RevokedAt: &now})
+	return err
+}
@@ -0,0 +1,430 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"ekolo/account/model"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/qr"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/token"
+	"ekolo/pkg/totp"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"encoding/base32"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultTOTPIssuer = "ekolo"
+	RecoveryCodeCount = 10
+
+	qrScale = 4
+)
+
+var (
+	ErrOTPRequired          = xerr.Unauthenticated("two-factor code required")
+	ErrInvalidOTP           = xerr.Invalid("invalid two-factor code")
+	ErrTwoFactorRequired    = xerr.Forbidden("two-factor authentication is required")
+	ErrTwoFactorEnabled     = xerr.Conflict("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnrolled = xerr.Invalid("two-factor authentication is not enrolled")
+)
+
+// TwoFactorService lets users enroll an authenticator application and manage their recovery codes
+type TwoFactorService struct {
+	repo    storage.Storer
+	hasher  *password.Hasher
+	limiter *lockout.Limiter
+	issuer  string
+	now     func() time.Time
+}
+
+// NewTwoFactorService returns a new service, issuer names the application in authenticators.
+// limiter throttles the passwords given to disable the second factor, it is kept in memory when nil.
+func NewTwoFactorService(repo storage.Storer, hasher *password.Hasher, limiter *lockout.Limiter, issuer string) *TwoFactorService {
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+	return &TwoFactorService{
+		repo:    repo,
+		hasher:  hasher,
+		limiter: accountLimiter(limiter),
+		issuer:  issuer,
+		now:     time.Now,
+	}
+}
+
+// TwoFactorStatus is the two-factor authentication state of a user
+type TwoFactorStatus struct {
+	Enabled       bool       `json:"enabled"`
+	EnabledAt     *time.Time `json:"enabled_at"`
+	RecoveryCodes int        `json:"recovery_codes"` // Number of unused recovery codes.
+	Required      bool       `json:"required"`       // Whether an organization of the user requires it for their type.
+}
+
+// Enrollment is the secret an authenticator application is set up with
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`               // otpauth URI holding the secret.
+	QRCode []byte `json:"qr_code,omitempty"` // PNG image of the QR code of the URI, base64 encoded. It is left out when the URI is too long for a QR code.
+}
+
+// RecoveryCodes are the recovery codes of a user, they are only shown once
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// RequestTwoFactorCode is the payload of the endpoints checking a code of the authenticator
+type RequestTwoFactorCode struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+// RequestTwoFactorDisable is the payload of the endpoint disabling two-factor authentication
+type RequestTwoFactorDisable struct {
+	Password string `json:"password" validate:"required"`
+	Code     string `json:"code" validate:"required,max=32"` // Code of the authenticator or recovery code.
+}
+
+// Status returns the two-factor authentication state of the authenticated user
+func (s TwoFactorService) Status(ctx context.Context) (*TwoFactorStatus, error) {
+	user, err := s.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &TwoFactorStatus{}
+	if status.Required, err = requireTwoFactorAny(s.repo.WithContext(ctx), user.UUID); err != nil {
+		return nil, err
+	}
+	tf, err := getTwoFactor(s.repo.WithContext(ctx), user.UUID)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && tf.EnabledAt == nil) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.repo.WithContext(ctx).Count(&model.RecoveryCode{}, map[string]any{"user_uuid": user.UUID, "used_at__isnull": true})
+	if err != nil {
+		return nil, err
+	}
+	status.Enabled, status.EnabledAt, status.RecoveryCodes = true, tf.EnabledAt, int(n)
+	return status, nil
+}
+
+// Enroll generates a new secret for the authenticated user, it replaces any secret not confirmed yet.
+// Two-factor authentication is only enabled once a code of the secret is confirmed.
+func (s TwoFactorService) Enroll(ctx context.Context) (*Enrollment, error) {
+	user, err := s.manageUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	// The QR code is drawn before the secret is stored, a URI too long for a code is returned alone
+	enrollment := &Enrollment{Secret: secret, URI: totp.URI(s.issuer, user.Email, secret)}
+	code, err := qr.Encode(enrollment.URI)
+	switch {
+	case errors.Is(err, qr.ErrTooLong):
+		xlog.Warn("2fa-qr-code", "user", user.UUID, "err", err)
+	case err != nil:
+		return nil, err
+	default:
+		if enrollment.QRCode, err = code.PNG(qrScale); err != nil {
+			return nil, err
+		}
+	}
+	err = s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		current, err := getTwoFactor(tx, user.UUID)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+		case err != nil:
+			return err
+		case current.EnabledAt != nil:
+			return ErrTwoFactorEnabled
+		default:
+			if _, err := tx.Delete(&model.TwoFactor{}, map[string]any{"uuid": current.UUID}); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Create(&model.TwoFactor{UserUUID: user.UUID, Secret: secret})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+// Confirm enables two-factor authentication with a first code of the enrolled secret and returns new recovery codes
+func (s TwoFactorService) Confirm(ctx context.Context, req RequestTwoFactorCode) (*RecoveryCodes, error) {
+	user, err := s.manageUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var codes *RecoveryCodes
+	err = s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		tf, err := getTwoFactor(tx, user.UUID)
+		if errors.Is(err, storage.ErrNotFound) {
+			return ErrTwoFactorNotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		if tf.EnabledAt != nil {
+			return ErrTwoFactorEnabled
+		}
+		now := s.now()
+		step, ok := totp.Validate(tf.Secret, req.Code, now)
+		if !ok {
+			return ErrInvalidOTP
+		}
+		if _, err := tx.Update(&model.TwoFactor{BaseModel: storage.BaseModel{UUID: tf.UUID}, EnabledAt: &now, LastStep: step}); err != nil {
+			return err
+		}
+		codes, err = newRecoveryCodes(tx, user.UUID)
+		return err
+	})
+	return codes, err
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the authenticated user, a code of the authenticator is required
+func (s TwoFactorService) RegenerateRecoveryCodes(ctx context.Context, req RequestTwoFactorCode) (*RecoveryCodes, error) {
+	user, err := s.manageUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var codes *RecoveryCodes
+	err = s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		tf, err := getTwoFactor(tx, user.UUID)
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && tf.EnabledAt == nil) {
+			return ErrTwoFactorNotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTOTP(tx, tf, req.Code, s.now()); err != nil {
+			return err
+		}
+		codes, err = newRecoveryCodes(tx, user.UUID)
+		return err
+	})
+	return codes, err
+}
+
+// Disable disables two-factor authentication of the authenticated user, unless the organization requires it.
+// Both the password and a code are required so that a stolen session can not disable it.
+func (s TwoFactorService) Disable(ctx context.Context, req RequestTwoFactorDisable) error {
+	user, err := s.manageUser(ctx)
+	if err != nil {
+		return err
+	}
+	// Failures count against the lockout of the account, so that the password can not be guessed here rather than by logging in
+	err = authenticateAccount(ctx, s.limiter, s.hasher, user, req.Password)
+	if errors.Is(err, ErrAccountPassword) {
+		return xerr.Invalid("invalid password")
+	}
+	if err != nil {
+		return err
+	}
+	required, err := requireTwoFactorAny(s.repo.WithContext(ctx), user.UUID)
+	if err != nil {
+		return err
+	}
+	if required {
+		return xerr.Forbidden("two-factor authentication is required by an organization of the user")
+	}
+	if _, err := CheckTwoFactor(ctx, s.repo.WithContext(ctx), user, req.Code); err != nil {
+		if errors.Is(err, ErrOTPRequired) {
+			return ErrInvalidOTP
+		}
+		return err
+	}
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Delete(&model.TwoFactor{}, map[string]any{"user_uuid": user.UUID}); err != nil {
+			return err
+		}
+		_, err := tx.Delete(&model.RecoveryCode{}, map[string]any{"user_uuid": user.UUID})
+		return err
+	})
+}
+
+// manageUser returns the authenticated user for an operation changing their second factor, which impersonation forbids
+func (s TwoFactorService) manageUser(ctx context.Context) (model.User, error) {
+	if p, _ := principal.FromContext(ctx); p.Impersonated() {
+		return model.User{}, principal.ErrImpersonated
+	}
+	return s.getUser(ctx)
+}
+
+// getUser returns the authenticated user
+func (s TwoFactorService) getUser(ctx context.Context) (model.User, error) {
+	var user model.User
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return user, xerr.ErrUnauthenticated
+	}
+	_, err := s.repo.WithContext(ctx).Get(&user, map[string]any{"uuid": p.UserUUID})
+	if errors.Is(err, storage.ErrNotFound) {
+		return user, xerr.ErrUnauthenticated
+	}
+	return user, err
+}
+
+// CheckTwoFactor checks a code of the authenticator or a recovery code of a user, enabled reports whether the user has two-factor authentication.
+// Nothing is checked when it is not, ErrOTPRequired is returned when it is and code is empty.
+// Accepted codes can not be used again.
+func CheckTwoFactor(ctx context.Context, repo storage.Storer, user model.User, code string) (enabled bool, err error) {
+	err = repo.WithTx(ctx, func(tx storage.Storer) error {
+		tf, err := getTwoFactor(tx, user.UUID)
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && tf.EnabledAt == nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		enabled = true
+		if code == "" {
+			return ErrOTPRequired
+		}
+		if isTOTP(code) {
+			return checkTOTP(tx, tf, code, time.Now())
+		}
+		return useRecoveryCode(tx, user.UUID, code)
+	})
+	return enabled, err
+}
+
+// RequireTwoFactor reports whether the organization of a membership requires two-factor authentication for its type
+func RequireTwoFactor(repo storage.Storer, m model.Membership) (bool, error) {
+	if m.Type == nil {
+		return false, nil
+	}
+	var org model.Organization
+	_, err := repo.Get(&org, map[string]any{"uuid": m.OrgUUID})
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(org.Require2FA, *m.Type), nil
+}
+
+// requireTwoFactorAny reports whether any organization of a user requires two-factor authentication for their type,
+// the second factor of a user is shared by all their organizations
+func requireTwoFactorAny(repo storage.Storer, user uuid.UUID) (bool, error) {
+	var mm []model.Membership
+	if _, err := tenant.Unscoped(repo).List(&mm, map[string]any{"user_uuid": user}, storage.ListOptions{}); err != nil {
+		return false, err
+	}
+	for _, m := range mm {
+		if required, err := RequireTwoFactor(repo, m); err != nil || required {
+			return required, err
+		}
+	}
+	return false, nil
+}
+
+// requireTwoFactorPrincipal returns ErrTwoFactorRequired when the principal of ctx did not log in with a second factor
+// while its organization requires one for its type
+func requireTwoFactorPrincipal(ctx context.Context, repo storage.Storer) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.TwoFactor {
+		return nil
+	}
+	required, err := RequireTwoFactor(repo, model.Membership{OrgUUID: p.OrgUUID, Type: &p.Type})
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrTwoFactorRequired
+	}
+	return nil
+}
+
+func getTwoFactor(repo storage.Storer, user uuid.UUID) (model.TwoFactor, error) {
+	var tf model.TwoFactor
+	_, err := repo.Get(&tf, map[string]any{"user_uuid": user})
+	return tf, err
+}
+
+// isTOTP reports whether a code looks like a code of an authenticator rather than a recovery code
+func isTOTP(code string) bool {
+	code = strings.TrimSpace(code)
+	return len(code) == totp.Digits && strings.Trim(code, "0123456789") == ""
+}
+
+// checkTOTP checks a code of the authenticator, codes of the last accepted step or before are refused
+func checkTOTP(repo storage.Storer, tf model.TwoFactor, code string, now time.Time) error {
+	step, ok := totp.Validate(tf.Secret, code, now)
+	if !ok || step <= tf.LastStep {
+		return ErrInvalidOTP
+	}
+	// The step is accepted only if no concurrent check accepted it, or a later one, first
+	n, err := repo.UpdateWhere(&model.TwoFactor{BaseModel: storage.BaseModel{UUID: tf.UUID}, LastStep: step}, map[string]any{"last_step__lt": step})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidOTP
+	}
+	return nil
+}
+
+// normalizeRecoveryCode returns a recovery code without its separators, as hashed
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// useRecoveryCode marks an unused recovery code of a user as used
+func useRecoveryCode(repo storage.Storer, user uuid.UUID, code string) error {
+	var rc model.RecoveryCode
+	filter := map[string]any{"user_uuid": user, "code_hash": token.Hash(normalizeRecoveryCode(code)), "used_at__isnull": true}
+	_, err := repo.Get(&rc, filter)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrInvalidOTP
+	}
+	if err != nil {
+		return err
+	}
+	// The code is used only if no concurrent check used it first
+	now := time.Now()
+	n, err := repo.UpdateWhere(&model.RecoveryCode{BaseModel: storage.BaseModel{UUID: rc.UUID}, UsedAt: &now}, map[string]any{"used_at__isnull": true})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidOTP
+	}
+	return nil
+}
+
+// newRecoveryCodes replaces the recovery codes of a user and returns the new ones, formatted as xxxx-xxxx-xxxx-xxxx
+func newRecoveryCodes(repo storage.Storer, user uuid.UUID) (*RecoveryCodes, error) {
+	if _, err := repo.Delete(&model.RecoveryCode{}, map[string]any{"user_uuid": user}); err != nil {
+		return nil, err
+	}
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := &RecoveryCodes{Codes: make([]string, RecoveryCodeCount)}
+	for i := range codes.Codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		plain := strings.ToLower(encoding.EncodeToString(b))
+		codes.Codes[i] = plain[0:4] + "-" + plain[4:8] + "-" + plain[8:12] + "-" + plain[12:16]
+		if _, err := repo.Create(&model.RecoveryCode{CodeHash: token.Hash(plain), UserUUID: user}); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
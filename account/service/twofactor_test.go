@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/totp"
+	"ekolo/pkg/xerr"
+	"errors"
+	"image/png"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// currentCode returns the code of the authenticator of a secret at a time
+func currentCode(t *testing.T, secret string, at time.Time) string {
+	code, err := totp.Code(secret, totp.Step(at))
+	assert.Assert(t, err, nil)
+	return code
+}
+
+func TestTwoFactorService(t *testing.T) {
+	var (
+		store  = storage.NewMemoryStore()
+		hasher = password.Default()
+		svc    = NewTwoFactorService(store, hasher, nil, "")
+		user   = model.User{Email: "ada@ekolo.io"}
+	)
+	assert.Assert(t, user.SetPassword(hasher, "s3cret"), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	ctx := principal.NewContext(context.Background(), principal.Principal{UserUUID: user.UUID})
+
+	_, err = svc.Enroll(context.Background())
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+
+	// Enrolling again replaces a secret which is not confirmed
+	_, err = svc.Enroll(ctx)
+	assert.Assert(t, err, nil)
+	enrollment, err := svc.Enroll(ctx)
+	assert.Assert(t, err, nil)
+	uri, err := url.Parse(enrollment.URI)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, uri.Query().Get("secret"), enrollment.Secret)
+	assert.Assert(t, uri.Query().Get("issuer"), DefaultTOTPIssuer)
+	_, err = png.Decode(bytes.NewReader(enrollment.QRCode))
+	assert.Assert(t, err, nil)
+	n, err := store.Count(&model.TwoFactor{}, map[string]any{"user_uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	// An administrator acting as the user sees their second factor but can not change it
+	impersonated := principal.NewContext(context.Background(), principal.Principal{UserUUID: user.UUID, Impersonator: uuid.New()})
+	_, err = svc.Enroll(impersonated)
+	assert.Assert(t, errors.Is(err, principal.ErrImpersonated), true)
+	_, err = svc.Status(impersonated)
+	assert.Assert(t, err, nil)
+
+	status, err := svc.Status(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, status.Enabled, false)
+
+	now := time.Now()
+	_, err = svc.Confirm(ctx, RequestTwoFactorCode{Code: "000000"})
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+	codes, err := svc.Confirm(ctx, RequestTwoFactorCode{Code: currentCode(t, enrollment.Secret, now)})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(codes.Codes), RecoveryCodeCount)
+	_, err = svc.Enroll(ctx)
+	assert.Assert(t, errors.Is(err, ErrTwoFactorEnabled), true)
+
+	// Only hashes of the recovery codes are stored
+	var stored []model.RecoveryCode
+	_, err = store.List(&stored, map[string]any{"user_uuid": user.UUID}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(stored), RecoveryCodeCount)
+	for _, rc := range stored {
+		assert.Assert(t, rc.CodeHash != codes.Codes[0], true)
+	}
+
+	// Codes are accepted once, recovery codes whatever their case and separators
+	enabled, err := CheckTwoFactor(ctx, store, user, "")
+	assert.Assert(t, enabled, true)
+	assert.Assert(t, errors.Is(err, ErrOTPRequired), true)
+	_, err = CheckTwoFactor(ctx, store, user, currentCode(t, enrollment.Secret, now))
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+	_, err = CheckTwoFactor(ctx, store, user, currentCode(t, enrollment.Secret, now.Add(totp.Period)))
+	assert.Assert(t, err, nil)
+	recovery := codes.Codes[0]
+	_, err = CheckTwoFactor(ctx, store, user, " "+recovery[:9]+recovery[10:])
+	assert.Assert(t, err, nil)
+	_, err = CheckTwoFactor(ctx, store, user, recovery)
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+	status, err = svc.Status(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, status.Enabled, true)
+	assert.Assert(t, status.RecoveryCodes, RecoveryCodeCount-1)
+
+	// Regenerating the recovery codes voids the previous ones
+	regenerated, err := svc.RegenerateRecoveryCodes(ctx, RequestTwoFactorCode{Code: currentCode(t, enrollment.Secret, now.Add(-totp.Period))})
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+	svc.now = func() time.Time { return now.Add(2 * totp.Period) }
+	regenerated, err = svc.RegenerateRecoveryCodes(ctx, RequestTwoFactorCode{Code: currentCode(t, enrollment.Secret, svc.now())})
+	assert.Assert(t, err, nil)
+	_, err = CheckTwoFactor(ctx, store, user, codes.Codes[1])
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+
+	err = svc.Disable(ctx, RequestTwoFactorDisable{Password: "wrong", Code: regenerated.Codes[0]})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	assert.Assert(t, svc.Disable(ctx, RequestTwoFactorDisable{Password: "s3cret", Code: regenerated.Codes[0]}), nil)
+	enabled, err = CheckTwoFactor(ctx, store, user, "")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, enabled, false)
+	n, err = store.Count(&model.RecoveryCode{}, map[string]any{"user_uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+}
+
+func TestTwoFactorEnrollLongURI(t *testing.T) {
+	var (
+		store = storage.NewMemoryStore()
+		svc   = NewTwoFactorService(store, password.Default(), nil, "")
+		user  = model.User{Email: strings.Repeat("a", 200) + "@ekolo.io"}
+	)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	ctx := principal.NewContext(context.Background(), principal.Principal{UserUUID: user.UUID})
+
+	// The URI of an address too long for a QR code is returned without one
+	enrollment, err := svc.Enroll(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, enrollment.URI != "", true)
+	assert.Assert(t, len(enrollment.QRCode), 0)
+	n, err := store.Count(&model.TwoFactor{}, map[string]any{"user_uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
+
+func TestRequireTwoFactor(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		store    = storage.NewMemoryStore()
+		hasher   = password.Default()
+		svc      = NewTwoFactorService(store, hasher, nil, "")
+		resolver = NewRoleResolver(store)
+	)
+	org := model.Organization{Name: "school", Require2FA: []string{TypeMANAGER}}
+	_, err := store.Create(&org)
+	assert.Assert(t, err, nil)
+	manager, teacher := TypeMANAGER, TypeTEACHER
+	user := model.User{Email: "manager@ekolo.io"}
+	assert.Assert(t, user.SetPassword(hasher, "s3cret"), nil)
+	_, err = store.Create(&user)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&model.Membership{UserUUID: user.UUID, OrgUUID: org.UUID, Type: &manager, Status: model.MembershipActive})
+	assert.Assert(t, err, nil)
+
+	// Managers who did not log in with a second factor have no permission, other types are not concerned
+	p := principal.Principal{UserUUID: user.UUID, OrgUUID: org.UUID, Type: TypeMANAGER, Verified: true}
+	_, err = resolver.GetPermissions(principal.NewContext(ctx, p), org.UUID, TypeMANAGER)
+	assert.Assert(t, errors.Is(err, ErrTwoFactorRequired), true)
+	permissions, err := resolver.GetPermissions(principal.NewContext(ctx, principal.Principal{OrgUUID: org.UUID, Type: TypeTEACHER, Verified: true}), org.UUID, teacher)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(permissions) > 0, true)
+	p.TwoFactor = true
+	permissions, err = resolver.GetPermissions(principal.NewContext(ctx, p), org.UUID, TypeMANAGER)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, permissions, DefaultRoles[TypeMANAGER])
+
+	// They can still enroll, but not disable it
+	p.TwoFactor = false
+	userCtx := principal.NewContext(ctx, p)
+	enrollment, err := svc.Enroll(userCtx)
+	assert.Assert(t, err, nil)
+	codes, err := svc.Confirm(userCtx, RequestTwoFactorCode{Code: currentCode(t, enrollment.Secret, time.Now())})
+	assert.Assert(t, err, nil)
+	status, err := svc.Status(userCtx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, status.Required, true)
+	err = svc.Disable(userCtx, RequestTwoFactorDisable{Password: "s3cret", Code: codes.Codes[0]})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+}
+
+func TestCheckTwoFactorConcurrent(t *testing.T) {
+	var (
+		store  = storage.NewMemoryStore()
+		hasher = password.Default()
+		svc    = NewTwoFactorService(store, hasher, nil, "")
+		user   = model.User{Email: "ada@ekolo.io"}
+	)
+	assert.Assert(t, user.SetPassword(hasher, "s3cret"), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	ctx := principal.NewContext(context.Background(), principal.Principal{UserUUID: user.UUID})
+	enrollment, err := svc.Enroll(ctx)
+	assert.Assert(t, err, nil)
+	now := time.Now()
+	codes, err := svc.Confirm(ctx, RequestTwoFactorCode{Code: currentCode(t, enrollment.Secret, now)})
+	assert.Assert(t, err, nil)
+
+	// Two logins with the same code: exactly one of them is accepted
+	for _, code := range []string{currentCode(t, enrollment.Secret, now.Add(totp.Period)), codes.Codes[0]} {
+		var (
+			wg       sync.WaitGroup
+			accepted atomic.Int32
+		)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(code string) {
+				defer wg.Done()
+				_, err := CheckTwoFactor(ctx, store, user, code)
+				if err == nil {
+					accepted.Add(1)
+				} else if !errors.Is(err, ErrInvalidOTP) {
+					t.Error(err)
+				}
+			}(code)
+		}
+		wg.Wait()
+		assert.Assert(t, accepted.Load(), int32(1))
+	}
+}
+
+func TestTwoFactorDisableLockout(t *testing.T) {
+	var (
+		store   = storage.NewMemoryStore()
+		hasher  = password.Default()
+		limiter = lockout.New(lockout.NewMemoryStore(), lockout.Options{LockAfter: 1})
+		svc     = NewTwoFactorService(store, hasher, limiter, "")
+		user    = model.User{Email: "ada@ekolo.io"}
+	)
+	assert.Assert(t, user.SetPassword(hasher, "s3cret"), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	ctx := principal.NewContext(context.Background(), principal.Principal{UserUUID: user.UUID})
+	enrollment, err := svc.Enroll(ctx)
+	assert.Assert(t, err, nil)
+	codes, err := svc.Confirm(ctx, RequestTwoFactorCode{Code: currentCode(t, enrollment.Secret, time.Now())})
+	assert.Assert(t, err, nil)
+
+	// Wrong passwords lock the account as failed logins do, even the right one is then refused
+	err = svc.Disable(ctx, RequestTwoFactorDisable{Password: "wrong", Code: codes.Codes[0]})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	err = svc.Disable(ctx, RequestTwoFactorDisable{Password: "s3cret", Code: codes.Codes[0]})
+	assert.Assert(t, errors.Is(err, xerr.ErrTooManyRequests), true)
+	status, err := svc.Status(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, status.Enabled, true)
+
+	assert.Assert(t, limiter.Reset(context.Background(), lockout.UserKey(user.UUID)), nil)
+	assert.Assert(t, svc.Disable(ctx, RequestTwoFactorDisable{Password: "s3cret", Code: codes.Codes[0]}), nil)
+}
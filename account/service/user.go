@@ -4,9 +4,14 @@ import (
 	"context"
 	"ekolo/account/model"
 	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
 	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
 	"ekolo/pkg/xlog"
-	"errors"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -17,14 +22,38 @@ const (
 	TypeSTUDENT = "STUDENT"
 )
 
+// DefaultRoles are the roles organizations start with, granting permissions to each type of users
+var DefaultRoles = rbac.Roles{
+	TypeMANAGER: {rbac.OrgRead, rbac.OrgUpdate, rbac.OrgDelete, "user:*", "tag:*", "role:*", "invitation:*", "apikey:*", "client:*"},
+	TypeTEACHER: {rbac.OrgRead, rbac.UserRead, "tag:*"},
+	TypeSTUDENT: {rbac.OrgRead, rbac.TagRead},
+}
+
 // getUserTypes returns types of users
 func getUserTypes() []string {
 	return []string{TypeMANAGER, TypeTEACHER, TypeSTUDENT}
 }
 
+// PayloadPassword is the password written by clients, only its hash is stored and it is never returned
+type PayloadPassword struct {
+	Password *string `json:"password" validate:"omitempty,min=8,maxbytes=72"`
+}
+
+// setPassword sets the hash of the password of the payload, if any, on a user
+func setPassword(h *password.Hasher, u *model.User, p PayloadPassword) error {
+	u.Password = nil
+	if p.Password == nil {
+		return nil
+	}
+	return u.SetPassword(h, *p.Password)
+}
+
 // UserService is the service object
 type UserService struct {
-	repo storage.Storer
+	repo     storage.Storer
+	hasher   *password.Hasher
+	limiter  *lockout.Limiter
+	verifier *Verifier
 }
 
 func (s UserService) GetName() string {
@@ -32,8 +61,45 @@ func (s UserService) GetName() string {
 }
 
 // GetPathParams returns service' path params
-func (s UserService) GetPathParams() []string {
-	return []string{"user"}
+func (s UserService) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org"), generic.UUIDParam("user")}
+}
+
+// GetPermissions returns the permissions required by an operation
+func (s UserService) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpCreate:
+		return []rbac.Permission{rbac.UserCreate}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.UserUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.UserDelete}
+	default:
+		return []rbac.Permission{rbac.UserRead}
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s UserService) GetFilters() storage.Filters {
+	return storage.Filters{
+		"email":      {storage.OpEq, storage.OpIContains},
+		"first_name": {storage.OpEq, storage.OpIContains},
+		"last_name":  {storage.OpEq, storage.OpIContains},
+		"type":       {storage.OpEq, storage.OpIn},
+		"status":     {storage.OpEq},
+		"created_at": {storage.OpGte, storage.OpLte},
+		"updated_at": {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s UserService) GetSortFields() []string {
+	return []string{"email", "first_name", "last_name", "created_at", "updated_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s UserService) GetDefaultSort() []string {
+	return []string{"email"}
 }
 
 // GetRequest returns the request object for the service
@@ -54,10 +120,14 @@ func (s UserService) GetRequest(name string) generic.IRequest {
 	}
 }
 
-// New returns a new service
-func NewUserService(repo storage.Storer) *UserService {
+// New returns a new service, new users are sent a verification link unless verifier is nil.
+// limiter throttles the passwords given for users who already have an account, it is kept in memory when nil.
+func NewUserService(repo storage.Storer, hasher *password.Hasher, limiter *lockout.Limiter, verifier *Verifier) *UserService {
 	return &UserService{
-		repo: repo,
+		repo:     repo,
+		hasher:   hasher,
+		limiter:  accountLimiter(limiter),
+		verifier: verifier,
 	}
 }
 
@@ -71,57 +141,132 @@ func (r RequestUser) GetID() string {
 // RequestUserCreate is the request object for the create method
 type RequestUserCreate struct {
 	RequestUser
+	OrgParam uuid.UUID `param:"org" json:"-"`
 	model.User
+	PayloadPassword
+	PayloadMembership
 }
 
 // RequestUserGet is the request object for the get method
 type RequestUserGet struct {
 	RequestUser
-	UserParam string `param:"user"`
-	OrgParam  string `param:"org"`
+	UserParam uuid.UUID `param:"user" json:"-"`
+	OrgParam  uuid.UUID `param:"org" json:"-"`
 }
 
 // RequestUserList is the request object for the list method
 type RequestUserList struct {
 	RequestUser
-	OrgParam string `param:"org"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// PayloadUserUpdate is the struct representing the update request payload, fields which are not given are kept
+type PayloadUserUpdate struct {
+	Email      string  `json:"email" validate:"omitempty,email"` // The address can not be changed, it is only checked when given.
+	FirstName  *string `json:"first_name" validate:"omitempty,max=255"`
+	LastName   *string `json:"last_name" validate:"omitempty,max=255"`
+	BirthDate  *string `json:"birth_date" validate:"omitempty,datetime=2006-01-02"`
+	BirthPlace *string `json:"birth_place" validate:"omitempty,max=255"`
+	Address    *string `json:"address" validate:"omitempty,max=1024"`
+	Phone      *string `json:"phone" validate:"omitempty,max=32"`
+}
+
+// user returns the user set by the payload
+func (p PayloadUserUpdate) user(user uuid.UUID) model.User {
+	return model.User{
+		BaseModel:  storage.BaseModel{UUID: user},
+		FirstName:  p.FirstName,
+		LastName:   p.LastName,
+		BirthDate:  p.BirthDate,
+		BirthPlace: p.BirthPlace,
+		Address:    p.Address,
+		Phone:      p.Phone,
+	}
 }
 
 // RequestUserUpdate is the request object for the update method
 type RequestUserUpdate struct {
 	RequestUser
-	UserParam string `param:"user"`
-	OrgParam  string `param:"org"`
-	model.User
+	UserParam uuid.UUID `param:"user" json:"-"`
+	OrgParam  uuid.UUID `param:"org" json:"-"`
+	PayloadUserUpdate
+	PayloadPassword
+	PayloadMembership
 }
 
 // RequestUserDelete is the request object for the delete method
 type RequestUserDelete struct {
 	RequestUser
-	UserParam string `param:"user"`
-	OrgParam  string `param:"org"`
+	UserParam uuid.UUID `param:"user" json:"-"`
+	OrgParam  uuid.UUID `param:"org" json:"-"`
 }
 
-// Create creates a new user
+// Create creates a new user, or adds the existing account of the email address to the organization
 // @Summary Create an user
-// @Description Create an user
+// @Description Create an user, a person who already has an account through another organization joins with it and its password
 // @ID user-create
 // @Tags user
+// @Security ApiKeyAuth
 // @Accept json
 // @Produce json
 // @Param org path string true "Organization ID"
 // @Param user body RequestUserCreate true "user data"
 // @Success 201 {object} Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/user [post]
 func (s UserService) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
 	r := req.(*RequestUserCreate)
-	_, err := s.repo.Create(&r.User)
+	r.VerifiedAt = nil
+	m := r.PayloadMembership.membership(uuid.Nil, r.OrgParam)
+	if m.Status == "" {
+		m.Status = model.MembershipActive
+	}
+	// The person may already have an account through another organization, which only its password unlocks
+	repo := s.repo.WithContext(ctx)
+	account, err := findAccount(repo, r.Email)
 	if err != nil {
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
+	}
+	if account != nil {
+		if err := checkNotMember(repo, r.OrgParam, *account); err != nil {
+			return nil, err
+		}
+		if err := authenticateAccount(ctx, s.limiter, s.hasher, *account, ptrValue(r.PayloadPassword.Password)); err != nil {
+			return nil, err
+		}
+	}
+	created := false
+	err = s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if err := checkUserType(tx, m); err != nil {
+			return err
+		}
+		if account != nil {
+			// The account keeps its profile and password
+			r.User = *account
+		} else {
+			if err := setPassword(s.hasher, &r.User, r.PayloadPassword); err != nil {
+				return err
+			}
+			if _, err := tx.Create(&r.User); err != nil {
+				return err
+			}
+			created = true
+		}
+		m.UserUUID = r.User.UUID
+		return createMembership(tx, &m, r.User.Email)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		s.verifier.sendAfterCreate(ctx, r.User)
 	}
-	return NewResponse(200, nil, r.User), err
+	return NewResponse(200, nil, newMember(r.User, m)), nil
 }
 
 // Get gets an user
@@ -129,31 +274,24 @@ func (s UserService) Create(ctx context.Context, req generic.IRequest) (generic.
 // @Description Get an user
 // @ID user-get
 // @Tags user
+// @Security ApiKeyAuth
 // @Produce json
 // @Param org path string true "organization ID"
 // @Param uuid path string true "user ID"
 // @Success 200 {object} Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/user/{uuid} [get]
 func (s UserService) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
-	var (
-		r      = req.(*RequestUserGet)
-		org    model.User
-		filter = map[string]any{
-			"uuid":     r.UserParam,
-			"orgUUUID": r.OrgParam,
-		}
-	)
-	_, err := s.repo.Get(&org, filter)
+	r := req.(*RequestUserGet)
+	user, m, err := getMember(s.repo.WithContext(ctx), r.OrgParam, r.UserParam)
 	if err != nil {
-		if errors.Is(err, storage.ErrNotFound) {
-			return NewResponse(404, []string{err.Error()}, nil), err
-		}
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
-	return NewResponse(200, nil, org), err
-
+	return NewResponse(200, nil, newMember(user, m)), nil
 }
 
 // List lists users
@@ -161,31 +299,61 @@ func (s UserService) Get(ctx context.Context, req generic.IRequest) (generic.IRe
 // @Description List user users
 // @ID users-get
 // @Tags user
+// @Security ApiKeyAuth
 // @Produce json
 // @Param org path string true "organization ID"
-// @Success 200 {object} Response
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
+// @Success 200 {object} generic.Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/user [get]
-func (s UserService) List(ctx context.Context, req generic.IRequest, filter map[string]any) (generic.IResponse, error) {
+func (s UserService) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
 	var (
-		r  = req.(*RequestUserList)
-		uu []model.User
+		r    = req.(*RequestUserList)
+		repo = s.repo.WithContext(ctx)
+		mm   []model.Membership
+		uu   []model.User
 	)
-	filter["org_uuid"] = r.OrgParam
-	xlog.Debug("params", "filter", filter, "req", r)
-	_, err := s.repo.List(&uu, filter)
+	// Filters on the membership select the users of the organization, the others apply to their accounts
+	filter, mFilter := splitMembershipFilter(filter)
+	mFilter["org_uuid"] = r.OrgParam
+	xlog.Debug("params", "filter", filter, "membership", mFilter, "req", r)
+	filter["uuid"] = storage.Subquery{Model: &model.Membership{}, Column: "user_uuid", Filter: mFilter}
+	total, err := repo.Count(&uu, filter)
 	if err != nil {
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
+	}
+	if _, err = repo.List(&uu, filter, opts); err != nil {
+		return nil, err
+	}
+	// Only the memberships of the page are loaded
+	if len(uu) > 0 {
+		if _, err := repo.List(&mm, map[string]any{"org_uuid": r.OrgParam, "user_uuid": userUUIDs(uu)}, storage.ListOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	memberships := make(map[uuid.UUID]model.Membership, len(mm))
+	for _, m := range mm {
+		memberships[m.UserUUID] = m
 	}
-	return NewResponse(200, nil, uu), nil
+	members := make([]Member, len(uu))
+	for i, u := range uu {
+		members[i] = newMember(u, memberships[u.UUID])
+	}
+	return generic.NewListResponse(200, members, total, opts), nil
 }
 
 // Update updates an user
 // @Summary Update an organization user
-// @Description Update an organization user
+// @Description Update an organization user, the email address of a user can not be changed
 // @ID user-update
 // @Tags user
+// @Security ApiKeyAuth
 // @Accept json
 // @Produce json
 // @Param org path string true "organization ID"
@@ -193,56 +361,117 @@ func (s UserService) List(ctx context.Context, req generic.IRequest, filter map[
 // @Param user body RequestUserUpdate true "user data"
 // @Success 201 {object} Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
+// @Failure 422 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/user/{uuid} [patch]
 func (s UserService) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
-	r := req.(*RequestUserUpdate)
-	r.UUID = uuid.MustParse(r.UserParam)
-	r.OrgUUID = uuid.MustParse(r.OrgParam)
-	_, err := s.repo.Update(&r.User)
+	var (
+		r      = req.(*RequestUserUpdate)
+		member Member
+	)
+	if p, _ := principal.FromContext(ctx); p.Impersonated() && r.PayloadPassword.Password != nil {
+		return nil, principal.ErrImpersonated
+	}
+	u := r.PayloadUserUpdate.user(r.UserParam)
+	if err := setPassword(s.hasher, &u, r.PayloadPassword); err != nil {
+		return nil, err
+	}
+	// The user must belong to the organization of the path before it is written
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		user, m, err := getMember(tx, r.OrgParam, r.UserParam)
+		if err != nil {
+			return err
+		}
+		// The address identifies the account, which other organizations may share
+		if r.Email != "" && r.Email != user.Email {
+			return xerr.Invalid("email can not be changed")
+		}
+		if r.PayloadPassword.Password != nil {
+			n, err := countOtherMemberships(tx, r.OrgParam, r.UserParam)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return xerr.Forbidden("the password of a user of other organizations can only be changed by the user")
+			}
+		}
+		membership := r.PayloadMembership.membership(r.UserParam, r.OrgParam)
+		membership.UUID = m.UUID
+		if err := checkUserType(tx, membership); err != nil {
+			return err
+		}
+		if _, err := tx.Update(&u); err != nil {
+			return err
+		}
+		if _, err := tx.Update(&membership); err != nil {
+			return err
+		}
+		if user, m, err = getMember(tx, r.OrgParam, r.UserParam); err != nil {
+			return err
+		}
+		member = newMember(user, m)
+		// Whoever knew the previous password must not stay logged in, nor may deactivated users
+		if r.PayloadPassword.Password != nil {
+			return RevokeSessions(tx, r.UserParam, time.Now())
+		}
+		if !m.IsActive() {
+			return RevokeMembershipSessions(tx, m.UUID, time.Now())
+		}
+		return nil
+	})
 	if err != nil {
-		return NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
-	return NewResponse(200, nil, r.User), nil
+	return NewResponse(200, nil, member), nil
 }
 
 // Delete deletes an user
 // @Summary Delete organization user
-// @Description Delete organization user
+// @Description Delete organization user, the account of the user is deleted along with their last organization
 // @ID user-delete
 // @Tags user
+// @Security ApiKeyAuth
 // @Param org path string true "organization ID"
 // @Param uuid path string true "user ID"
-// @Success 200 {object} Response
+// @Success 204
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
+// @Failure 404 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/user/{uuid} [delete]
 func (s UserService) Delete(ctx context.Context, req generic.IRequest) error {
-	var (
-		org    model.User
-		filter = map[string]any{
-			"uuid": req.(*RequestUserDelete).UserParam,
-		}
-	)
-	_, err := s.repo.Delete(&org, filter)
-	if err != nil {
-		return err
-	}
-	return nil
+	r := req.(*RequestUserDelete)
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		return removeMember(tx, r.OrgParam, r.UserParam)
+	})
 }
 
-// Types returns users' types
+// GetTypes returns users' types, the names of the roles of an organization
 // @Summary List users's type
-// @Description List users' type
+// @Description List users' type, the names of the roles of the organization of the caller
 // @ID user-types
 // @Tags user
+// @Security ApiKeyAuth
 // @Success 200 {object} Response
 // @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 403 {object} Response
 // @Failure 500 {object} Response
 // @Router /user/types [get]
-func (s UserService) GetTypes(ctx context.Context) generic.IResponse {
-	return NewResponse(200, nil, getUserTypes())
+func (s UserService) GetTypes(ctx context.Context, org uuid.UUID) (generic.IResponse, error) {
+	names, err := getRoleNames(s.repo.WithContext(ctx), org)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, names), nil
 }
 
 // UserService is the service interface
 var _ generic.IService = new(UserService)
+var _ generic.IFilterable = new(UserService)
+var _ generic.ISortable = new(UserService)
+var _ generic.IAuthorized = new(UserService)
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
+	"ekolo/pkg/xerr"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestUserServiceScopedToOrg(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		svc   = NewUserService(storage.NewMemoryStore(), password.Default(), nil, nil)
+		org   = uuid.New()
+		other = uuid.New()
+		name  = "Ada"
+	)
+
+	resp, err := svc.Create(ctx, &RequestUserCreate{
+		OrgParam: org,
+		User:     model.User{Email: "ada@ekolo.io"},
+	})
+	assert.Assert(t, err, nil)
+	user := resp.(Response).Data.(Member)
+	assert.Assert(t, user.OrgUUID, org)
+	assert.Assert(t, user.Status, model.MembershipActive)
+
+	resp, err = svc.Get(ctx, &RequestUserGet{OrgParam: org, UserParam: user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(Response).Data.(Member).Email, "ada@ekolo.io")
+
+	_, err = svc.Get(ctx, &RequestUserGet{OrgParam: other, UserParam: user.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	update := &RequestUserUpdate{OrgParam: other, UserParam: user.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: user.Email, FirstName: &name}}
+	_, err = svc.Update(ctx, update)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	err = svc.Delete(ctx, &RequestUserDelete{OrgParam: other, UserParam: user.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	// Updates only write the fields they are given, the email address may be left out
+	update = &RequestUserUpdate{OrgParam: org, UserParam: user.UUID, PayloadUserUpdate: PayloadUserUpdate{FirstName: &name}}
+	assert.Assert(t, len(generic.Validate(update)), 0)
+	_, err = svc.Update(ctx, update)
+	assert.Assert(t, err, nil)
+
+	resp, err = svc.Get(ctx, &RequestUserGet{OrgParam: org, UserParam: user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *resp.(Response).Data.(Member).FirstName, "Ada")
+
+	err = svc.Delete(ctx, &RequestUserDelete{OrgParam: org, UserParam: user.UUID})
+	assert.Assert(t, err, nil)
+}
+
+func TestUserServiceTenantStore(t *testing.T) {
+	var (
+		store   = tenant.NewStore(storage.NewMemoryStore(), tenant.DefaultField)
+		svc     = NewUserService(store, password.Default(), nil, nil)
+		manager = PayloadManager{User: model.User{Email: "manager@ekolo.io"}}
+	)
+
+	// Organizations are created without a principal
+	resp, err := New(store, password.Default(), nil, nil).Create(context.Background(), &RequestOrgCreate{Organization: model.Organization{Name: "school"}, Manager: &manager})
+	assert.Assert(t, err, nil)
+	org := resp.(Response).Data.(model.Organization).UUID
+
+	// The storage refuses rows of another organization even when the path names it
+	ctx := principal.NewContext(context.Background(), principal.Principal{UserUUID: uuid.New(), OrgUUID: uuid.New()})
+	resp, err = svc.List(ctx, &RequestUserList{OrgParam: org}, map[string]any{}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(generic.Response).Pagination.Total, int64(0))
+	_, err = svc.Get(ctx, &RequestUserGet{OrgParam: org, UserParam: manager.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	_, err = svc.Create(ctx, &RequestUserCreate{OrgParam: org, User: model.User{Email: "eve@ekolo.io"}})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	err = svc.Delete(ctx, &RequestUserDelete{OrgParam: org, UserParam: manager.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	ctx = principal.NewContext(context.Background(), principal.Principal{UserUUID: manager.UUID, OrgUUID: org})
+	resp, err = svc.List(ctx, &RequestUserList{OrgParam: org}, map[string]any{}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(generic.Response).Pagination.Total, int64(1))
+}
+
+func TestUserServicePassword(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = storage.NewMemoryStore()
+		hasher = password.Default()
+		svc    = NewUserService(store, hasher, nil, nil)
+		org    = uuid.New()
+		plain  = "s3cret-pass"
+		hash   = "not-a-hash"
+	)
+
+	// Clients can neither send a hash nor read the password back
+	resp, err := svc.Create(ctx, &RequestUserCreate{
+		OrgParam:        org,
+		User:            model.User{Email: "ada@ekolo.io", Password: &hash},
+		PayloadPassword: PayloadPassword{Password: &plain},
+	})
+	assert.Assert(t, err, nil)
+	user := resp.(Response).Data.(Member)
+	body, err := json.Marshal(resp)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, strings.Contains(string(body), "password"), false)
+
+	var stored model.User
+	_, err = store.Get(&stored, map[string]any{"uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *stored.Password != plain, true)
+	_, err = stored.Authenticate(hasher, plain)
+	assert.Assert(t, err, nil)
+
+	// Passwords are bounded in bytes, which bcrypt reads, not in characters
+	for _, test := range []struct {
+		password string
+		valid    bool
+	}{{"short", false}, {strings.Repeat("a", 72), true}, {strings.Repeat("é", 36), true}, {strings.Repeat("é", 37), false}} {
+		details := generic.Validate(PayloadPassword{Password: &test.password})
+		assert.Assert(t, len(details) == 0, test.valid)
+	}
+
+	session := model.Session{UserUUID: user.UUID}
+	_, err = store.Create(&session)
+	assert.Assert(t, err, nil)
+
+	// Updates without a password keep the current one, and the sessions of the user
+	name := "Ada"
+	_, err = svc.Update(ctx, &RequestUserUpdate{OrgParam: org, UserParam: user.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: user.Email, FirstName: &name}})
+	assert.Assert(t, err, nil)
+	_, err = store.Get(&stored, map[string]any{"uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	_, err = stored.Authenticate(hasher, plain)
+	assert.Assert(t, err, nil)
+
+	n, err := store.Count(&model.Session{}, map[string]any{"user_uuid": user.UUID, "revoked_at__isnull": true})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	// Administrators acting as a user can not set a password
+	changed := "n3w-pass"
+	impersonated := principal.NewContext(ctx, principal.Principal{UserUUID: user.UUID, OrgUUID: org, Impersonator: uuid.New()})
+	_, err = svc.Update(impersonated, &RequestUserUpdate{OrgParam: org, UserParam: user.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: user.Email}, PayloadPassword: PayloadPassword{Password: &changed}})
+	assert.Assert(t, errors.Is(err, principal.ErrImpersonated), true)
+
+	// Changing the password ends the sessions of the user
+	_, err = svc.Update(ctx, &RequestUserUpdate{OrgParam: org, UserParam: user.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: user.Email}, PayloadPassword: PayloadPassword{Password: &changed}})
+	assert.Assert(t, err, nil)
+	_, err = store.Get(&stored, map[string]any{"uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	_, err = stored.Authenticate(hasher, plain)
+	assert.Assert(t, errors.Is(err, password.ErrMismatch), true)
+	n, err = store.Count(&model.Session{}, map[string]any{"user_uuid": user.UUID, "revoked_at__isnull": true})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	_, err = stored.Authenticate(hasher, changed)
+	assert.Assert(t, err, nil)
+}
+
+func TestUserServiceMemberships(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		store   = storage.NewMemoryStore()
+		svc     = NewUserService(store, password.Default(), nil, nil)
+		school  = uuid.New()
+		college = uuid.New()
+		plain   = "s3cret-pass"
+		other   = "0ther-pass"
+		teacher = TypeTEACHER
+	)
+	for _, org := range []uuid.UUID{school, college} {
+		for _, role := range newDefaultRoles(org) {
+			_, err := store.Create(&role)
+			assert.Assert(t, err, nil)
+		}
+	}
+
+	resp, err := svc.Create(ctx, &RequestUserCreate{OrgParam: school, User: model.User{Email: "ada@ekolo.io"}, PayloadPassword: PayloadPassword{Password: &plain}})
+	assert.Assert(t, err, nil)
+	first := resp.(Response).Data.(Member)
+
+	// A teacher of two schools has a single account, which only its password adds to another organization
+	join := RequestUserCreate{
+		OrgParam:          college,
+		User:              model.User{Email: "ada@ekolo.io"},
+		PayloadPassword:   PayloadPassword{Password: &other},
+		PayloadMembership: PayloadMembership{Type: &teacher},
+	}
+	_, err = svc.Create(ctx, &join)
+	assert.Assert(t, errors.Is(err, ErrAccountPassword), true)
+	n, err := store.Count(&model.Membership{}, map[string]any{"org_uuid": college})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	join.PayloadPassword.Password = &plain
+	resp, err = svc.Create(ctx, &join)
+	assert.Assert(t, err, nil)
+	second := resp.(Response).Data.(Member)
+	assert.Assert(t, second.UUID, first.UUID)
+	assert.Assert(t, second.OrgUUID, college)
+	assert.Assert(t, *second.Type, TypeTEACHER)
+	n, err = store.Count(&model.User{}, map[string]any{"email": "ada@ekolo.io"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+	var stored model.User
+	_, err = store.Get(&stored, map[string]any{"uuid": first.UUID})
+	assert.Assert(t, err, nil)
+	_, err = stored.Authenticate(password.Default(), plain)
+	assert.Assert(t, err, nil)
+
+	_, err = svc.Create(ctx, &RequestUserCreate{OrgParam: college, User: model.User{Email: "ada@ekolo.io"}})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	// Organizations filter their users on their own memberships
+	resp, err = svc.List(ctx, &RequestUserList{OrgParam: college}, map[string]any{"type": TypeTEACHER}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(generic.Response).Pagination.Total, int64(1))
+	resp, err = svc.List(ctx, &RequestUserList{OrgParam: school}, map[string]any{"type": TypeTEACHER}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(generic.Response).Pagination.Total, int64(0))
+
+	// Neither organization can take over the account shared with the other one
+	_, err = svc.Update(ctx, &RequestUserUpdate{OrgParam: college, UserParam: first.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: "eve@ekolo.io"}})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	_, err = svc.Update(ctx, &RequestUserUpdate{OrgParam: college, UserParam: first.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: first.Email}, PayloadPassword: PayloadPassword{Password: &other}})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+
+	// Deactivating a membership ends the sessions logged into its organization only
+	var memberships []model.Membership
+	_, err = store.List(&memberships, map[string]any{"user_uuid": first.UUID}, storage.ListOptions{Sort: []string{"created_at"}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(memberships), 2)
+	for _, m := range memberships {
+		_, err = store.Create(&model.Session{UserUUID: first.UUID, MembershipUUID: m.UUID})
+		assert.Assert(t, err, nil)
+	}
+	resp, err = svc.Update(ctx, &RequestUserUpdate{OrgParam: college, UserParam: first.UUID, PayloadUserUpdate: PayloadUserUpdate{Email: first.Email}, PayloadMembership: PayloadMembership{Status: model.MembershipInactive}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(Response).Data.(Member).Status, model.MembershipInactive)
+	n, err = store.Count(&model.Session{}, map[string]any{"user_uuid": first.UUID, "revoked_at__isnull": true})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	// The account goes along with its last membership
+	assert.Assert(t, svc.Delete(ctx, &RequestUserDelete{OrgParam: school, UserParam: first.UUID}), nil)
+	_, err = store.Get(&stored, map[string]any{"uuid": first.UUID})
+	assert.Assert(t, err, nil)
+	n, err = store.Count(&model.Session{}, map[string]any{"user_uuid": first.UUID, "revoked_at__isnull": true})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	assert.Assert(t, svc.Delete(ctx, &RequestUserDelete{OrgParam: college, UserParam: first.UUID}), nil)
+	_, err = store.Get(&stored, map[string]any{"uuid": first.UUID})
+	assert.Assert(t, errors.Is(err, storage.ErrNotFound), true)
+}
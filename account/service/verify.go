@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"ekolo/account/model"
+	"ekolo/pkg/mailer"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultVerifyTTL = 48 * time.Hour
+
+	verifyAudience = "email-verification"
+)
+
+var (
+	ErrInvalidVerifyToken = xerr.Invalid("invalid or expired verification token")
+	ErrEmailNotVerified   = xerr.Forbidden("email address is not verified")
+)
+
+// VerifyOptions configures the verification links
+type VerifyOptions struct {
+	Secret []byte // Key from which the key signing the links is derived.
+	URL    string // Page of the web application confirming the verification, the token is added to its query.
+	TTL    time.Duration
+}
+
+// verifyClaims are the claims of a verification token, the subject is the user uuid.
+// The email is part of the token so that it can not verify another address of the user.
+type verifyClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+// Verifier sends signed verification links to users and verifies their email address when they follow them
+type Verifier struct {
+	repo   storage.Storer
+	mailer mailer.Mailer
+	opts   VerifyOptions
+	key    []byte
+	now    func() time.Time
+}
+
+// NewVerifier returns a new verifier, users are looked up across organizations so repo must not be scoped to one
+func NewVerifier(repo storage.Storer, m mailer.Mailer, opts VerifyOptions) *Verifier {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultVerifyTTL
+	}
+	// A dedicated key keeps verification tokens from being accepted where tokens signed with the secret are
+	mac := hmac.New(sha256.New, opts.Secret)
+	mac.Write([]byte(verifyAudience))
+	return &Verifier{
+		repo:   repo,
+		mailer: m,
+		opts:   opts,
+		key:    mac.Sum(nil),
+		now:    time.Now,
+	}
+}
+
+// RequestVerifyEmail is the payload of the verification endpoint
+type RequestVerifyEmail struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// RequestVerifyResend is the payload of the endpoint sending a new verification link
+type RequestVerifyResend struct {
+	Email string     `json:"email" validate:"required,email"`
+	Org   *uuid.UUID `json:"org"` // Restricts the sending to one organization when the email is registered in several.
+}
+
+// Send sends a verification link to a user, it does nothing when v is nil or the user is verified
+func (v *Verifier) Send(ctx context.Context, user model.User) error {
+	if v == nil || user.VerifiedAt != nil {
+		return nil
+	}
+	now := v.now()
+	claims := verifyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.UUID.String(),
+			Audience:  jwt.ClaimStrings{verifyAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(v.opts.TTL)),
+		},
+		Email: user.Email,
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(v.key)
+	if err != nil {
+		return err
+	}
+	link := v.opts.URL
+	if target, err := url.Parse(v.opts.URL); err == nil {
+		query := target.Query()
+		query.Set("token", signed)
+		target.RawQuery = query.Encode()
+		link = target.String()
+	}
+	body := fmt.Sprintf("Welcome to ekolo!\n\n"+
+		"Follow this link to verify your email address, it expires on %s:\n%s", claims.ExpiresAt.UTC().Format(time.RFC1123), link)
+	return v.mailer.Send(ctx, mailer.Message{To: user.Email, Subject: "Verify your email address", Body: body})
+}
+
+// sendAfterCreate sends a verification link to a user who was just created, failures are only logged since a new link can be requested
+func (v *Verifier) sendAfterCreate(ctx context.Context, user model.User) {
+	if err := v.Send(ctx, user); err != nil {
+		xlog.Error("email-verification", "user", user.UUID, "err", err)
+	}
+}
+
+// Resend sends a new verification link to every unverified user matching the request.
+// Unknown emails are not reported so that the endpoint does not reveal who has an account.
+func (v *Verifier) Resend(ctx context.Context, req RequestVerifyResend) error {
+	var users []model.User
+	filter := map[string]any{"email": req.Email, "verified_at__isnull": true}
+	if _, err := v.repo.WithContext(ctx).List(&users, filter, storage.ListOptions{}); err != nil {
+		return err
+	}
+	users, err := filterMembers(v.repo.WithContext(ctx), users, req.Org)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := v.Send(ctx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify marks the email address of the user of a valid token as verified, verifying it again does nothing
+func (v *Verifier) Verify(ctx context.Context, req RequestVerifyEmail) error {
+	claims := &verifyClaims{}
+	_, err := jwt.ParseWithClaims(req.Token, claims, func(*jwt.Token) (any, error) {
+		return v.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(verifyAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(v.now),
+	)
+	if err != nil {
+		return ErrInvalidVerifyToken
+	}
+	userUUID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return ErrInvalidVerifyToken
+	}
+	var user model.User
+	_, err = v.repo.WithContext(ctx).Get(&user, map[string]any{"uuid": userUUID, "email": claims.Email})
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrInvalidVerifyToken
+	}
+	if err != nil || user.VerifiedAt != nil {
+		return err
+	}
+	now := v.now()
+	_, err = v.repo.WithContext(ctx).Update(&model.User{BaseModel: storage.BaseModel{UUID: user.UUID}, Email: user.Email, VerifiedAt: &now})
+	return err
+}
+
+// RequireVerified returns ErrEmailNotVerified when an organization of the user requires verified email addresses and the user's is not
+func RequireVerified(repo storage.Storer, user model.User, org uuid.UUID) error {
+	if user.VerifiedAt != nil {
+		return nil
+	}
+	var o model.Organization
+	_, err := repo.Get(&o, map[string]any{"uuid": org})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if o.RequireVerifiedEmail != nil && *o.RequireVerifiedEmail {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// requireVerifiedPrincipal applies RequireVerified to the principal of ctx, if any.
+// The flag of the principal is set when its token is issued, the user is read again when it is not.
+func requireVerifiedPrincipal(ctx context.Context, repo storage.Storer) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.Verified {
+		return nil
+	}
+	var user model.User
+	_, err := repo.Get(&user, map[string]any{"uuid": p.UserUUID})
+	if errors.Is(err, storage.ErrNotFound) {
+		return xerr.ErrUnauthenticated
+	}
+	if err != nil {
+		return err
+	}
+	return RequireVerified(repo, user, p.OrgUUID)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"ekolo/account/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifier(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		store    = storage.NewMemoryStore()
+		mails    = &outbox{}
+		verifier = NewVerifier(store, mails, VerifyOptions{Secret: []byte("secret"), URL: "https://app.ekolo.io/email/verify"})
+		orgs     = New(store, password.Default(), nil, verifier)
+		users    = NewUserService(store, password.Default(), nil, verifier)
+		verified = time.Now()
+	)
+
+	// First managers and new users are sent a link, whatever they claim
+	resp, err := orgs.Create(ctx, &RequestOrgCreate{
+		Organization: model.Organization{Name: "school"},
+		Manager:      &PayloadManager{User: model.User{Email: "manager@ekolo.io", VerifiedAt: &verified}},
+	})
+	assert.Assert(t, err, nil)
+	org := resp.(Response).Data.(model.Organization).UUID
+	resp, err = users.Create(ctx, &RequestUserCreate{OrgParam: org, User: model.User{Email: "ada@ekolo.io", VerifiedAt: &verified}})
+	assert.Assert(t, err, nil)
+	user := resp.(Response).Data.(Member)
+	assert.Assert(t, user.VerifiedAt == nil, true)
+	assert.Assert(t, len(mails.messages), 2)
+	assert.Assert(t, mails.messages[1].To, "ada@ekolo.io")
+
+	// Tokens are signed and bound to the email address
+	link := linkToken(t, mails.messages[1])
+	err = verifier.Verify(ctx, RequestVerifyEmail{Token: link + "x"})
+	assert.Assert(t, errors.Is(err, ErrInvalidVerifyToken), true)
+	other := NewVerifier(store, mails, VerifyOptions{Secret: []byte("other")})
+	err = other.Verify(ctx, RequestVerifyEmail{Token: link})
+	assert.Assert(t, errors.Is(err, ErrInvalidVerifyToken), true)
+
+	assert.Assert(t, verifier.Verify(ctx, RequestVerifyEmail{Token: link}), nil)
+	assert.Assert(t, verifier.Verify(ctx, RequestVerifyEmail{Token: link}), nil)
+	var stored model.User
+	_, err = store.Get(&stored, map[string]any{"uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, stored.VerifiedAt != nil, true)
+
+	// Links are only sent again to unverified users
+	assert.Assert(t, verifier.Resend(ctx, RequestVerifyResend{Email: "ada@ekolo.io"}), nil)
+	assert.Assert(t, verifier.Resend(ctx, RequestVerifyResend{Email: "manager@ekolo.io", Org: &org}), nil)
+	assert.Assert(t, len(mails.messages), 3)
+	assert.Assert(t, mails.messages[2].To, "manager@ekolo.io")
+
+	verifier.now = func() time.Time { return time.Now().Add(DefaultVerifyTTL) }
+	err = verifier.Verify(ctx, RequestVerifyEmail{Token: linkToken(t, mails.messages[2])})
+	assert.Assert(t, errors.Is(err, ErrInvalidVerifyToken), true)
+}
+
+func TestRequireVerified(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		store    = storage.NewMemoryStore()
+		resolver = NewRoleResolver(store)
+		required = true
+	)
+	resp, err := New(store, password.Default(), nil, nil).Create(ctx, &RequestOrgCreate{
+		Organization: model.Organization{Name: "school"},
+		Manager:      &PayloadManager{User: model.User{Email: "manager@ekolo.io"}},
+	})
+	assert.Assert(t, err, nil)
+	org := resp.(Response).Data.(model.Organization)
+	var (
+		member  model.Membership
+		manager model.User
+	)
+	_, err = store.Get(&member, map[string]any{"org_uuid": org.UUID})
+	assert.Assert(t, err, nil)
+	_, err = store.Get(&manager, map[string]any{"uuid": member.UserUUID})
+	assert.Assert(t, err, nil)
+	ctx = principal.NewContext(ctx, principal.Principal{UserUUID: manager.UUID, OrgUUID: org.UUID, Type: TypeMANAGER})
+
+	// Unverified users keep their permissions until the organization requires verified addresses
+	assert.Assert(t, RequireVerified(store, manager, org.UUID), nil)
+	permissions, err := resolver.GetPermissions(ctx, org.UUID, TypeMANAGER)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, permissions, DefaultRoles[TypeMANAGER])
+
+	_, err = store.Update(&model.Organization{BaseModel: org.BaseModel, RequireVerifiedEmail: &required})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, errors.Is(RequireVerified(store, manager, org.UUID), ErrEmailNotVerified), true)
+	_, err = resolver.GetPermissions(ctx, org.UUID, TypeMANAGER)
+	assert.Assert(t, errors.Is(err, ErrEmailNotVerified), true)
+	err = rbac.NewAuthorizer(resolver).Authorize(ctx, org.UUID, rbac.UserRead)
+	assert.Assert(t, errors.Is(err, ErrEmailNotVerified), true)
+
+	// Verifying takes effect before the token of the principal is renewed
+	now := time.Now()
+	_, err = store.Update(&model.User{BaseModel: manager.BaseModel, Email: manager.Email, VerifiedAt: &now})
+	assert.Assert(t, err, nil)
+	_, err = resolver.GetPermissions(ctx, org.UUID, TypeMANAGER)
+	assert.Assert(t, err, nil)
+}
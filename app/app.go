@@ -2,16 +2,30 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	accountHandler "ekolo/account/handler"
 	account "ekolo/account/service"
 	"ekolo/app/config"
+	authHandler "ekolo/auth/handler"
+	auth "ekolo/auth/service"
+	oidcHandler "ekolo/oidc/handler"
+	oidc "ekolo/oidc/service"
+	"ekolo/pkg/audit"
 	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/mailer"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
 	"ekolo/pkg/storage"
+	"ekolo/pkg/tenant"
 	"ekolo/pkg/xlog"
 	tag "ekolo/tag/service"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -48,13 +62,31 @@ func New() App {
 // @in header
 // @name Authorization
 func (a App) Run() {
-	store, err := storage.NewStore(a.Opts.GetDBDSN())
+	store, err := storage.NewStore(a.Opts.DBDriver, a.Opts.GetDBDSN())
 	if err != nil {
 		xlog.Error("error while initializing storage", "err", err)
 		return
 	}
+	hasher, err := password.New(a.Opts.Password)
+	if err != nil {
+		xlog.Error("error while initializing password hashing", "err", err)
+		return
+	}
+	// OpenID Connect provider signing users into the clients of their organization
+	provider, err := oidc.NewProvider(store, oidc.Options{
+		Issuer:   a.Opts.OIDCIssuer,
+		LoginURL: strings.TrimSuffix(a.Opts.AppURL, "/") + "/oidc/authorize",
+		Key:      a.getOIDCKey(),
+		TokenTTL: a.Opts.AccessTTL,
+	})
+	if err != nil {
+		xlog.Error("error while initializing the OpenID Connect provider", "err", err)
+		return
+	}
 	e := echo.New()
 	e.Debug = true
+	e.HTTPErrorHandler = generic.ErrorHandler
+	e.IPExtractor = a.getIPExtractor()
 	// e.Pre(middleware.AddTrailingSlash())
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
@@ -69,7 +101,9 @@ func (a App) Run() {
 		LogProtocol:  true,
 		HandleError:  true,
 		LogValuesFunc: func(c echo.Context, values middleware.RequestLoggerValues) error {
-			xlog.Info("request", "values", values)
+			// Requests of impersonations name the administrator along with the user
+			p, _ := principal.FromContext(c.Request().Context())
+			xlog.Info("request", "values", values, "user", p.UserUUID, "impersonator", p.Impersonator)
 			return nil
 		},
 	}))
@@ -83,21 +117,107 @@ func (a App) Run() {
 
 	e.GET("/swagger/*", echoSwagger.WrapHandler)
 
+	secret := a.getJWTSecret()
+	mails := a.getMailer()
+
+	// Failed logins are tracked in the database so that every instance enforces them
+	attempts := lockout.NewStorageStore(store)
+	userLimiter := lockout.New(attempts, lockout.Options{LockAfter: a.Opts.LockoutThreshold, LockFor: a.Opts.LockoutDuration})
+	recorder := audit.LogRecorder{}
+
+	// Auth endpoints
+	authH := authHandler.NewAuthHandler(auth.New(store, auth.Options{
+		Secret:           secret,
+		AccessTTL:        a.Opts.AccessTTL,
+		RefreshTTL:       a.Opts.RefreshTTL,
+		ImpersonationTTL: a.Opts.ImpersonationTTL,
+		Hasher:           hasher,
+		UserLimiter:      userLimiter,
+		IPLimiter:        lockout.New(attempts, auth.DefaultIPLimits),
+		Audit:            recorder,
+		APIKeys:          account.NewAPIKeyVerifier(store),
+	}))
+	authH.Mount(e)
+	// Organizations are created along with their first manager before anyone can log in
+	authMW := authH.Middleware(func(c echo.Context) bool {
+		return c.Request().Method == http.MethodPost && c.Request().URL.Path == "/organization"
+	})
+
+	// Password reset endpoints, users are looked up across organizations
+	resetH := accountHandler.NewResetHandler(account.NewResetService(store, hasher, mails, account.ResetOptions{
+		URL: strings.TrimSuffix(a.Opts.AppURL, "/") + "/password/reset",
+		TTL: a.Opts.ResetTTL,
+	}))
+	resetH.Mount(e)
+	// Email verification endpoints, links are signed with a key derived from the jwt secret
+	verifier := account.NewVerifier(store, mails, account.VerifyOptions{
+		Secret: secret,
+		URL:    strings.TrimSuffix(a.Opts.AppURL, "/") + "/email/verify",
+		TTL:    a.Opts.VerifyTTL,
+	})
+	accountHandler.NewVerifyHandler(verifier).Mount(e)
+	// Invitation acceptance endpoint, invitations are looked up by token across organizations
+	accountHandler.NewInvitationHandler(account.NewInvitationAcceptor(store, hasher, userLimiter)).Mount(e)
+
+	// Models owned by an organization are only reachable on behalf of it, logins still look across organizations
+	tenantStore := tenant.NewStore(store, tenant.DefaultField)
+
+	// Permissions are granted by the role of the organization named by the type of the authenticated user,
+	// platform administrators are granted the platform permissions on top of it
+	authorizer := rbac.NewAuthorizer(account.NewRoleResolver(tenantStore), a.Opts.PlatformAdmins...)
+	mountOpts := []generic.MountOption{generic.WithMiddleware(authMW), generic.WithAuthorizer(authorizer)}
+
 	// Organization CRUD endpoints
-	generic.MountService(e, account.New(store))
+	generic.MountService(e, account.New(tenantStore, hasher, userLimiter, verifier), mountOpts...)
 	// User CRUD endpoints
-	generic.MountService(e, account.NewUserService(store))
+	userSvc := account.NewUserService(tenantStore, hasher, userLimiter, verifier)
+	generic.MountService(e, userSvc, mountOpts...)
+	// Role CRUD endpoints
+	generic.MountService(e, account.NewRoleService(tenantStore), mountOpts...)
+	// Invitation CRUD endpoints
+	generic.MountService(e, account.NewInvitationService(tenantStore, mails, account.InvitationOptions{
+		URL: strings.TrimSuffix(a.Opts.AppURL, "/") + "/invitation/accept",
+		TTL: a.Opts.InviteTTL,
+	}), mountOpts...)
+	// API key CRUD endpoints, keys authenticate machine clients alongside access tokens
+	generic.MountService(e, account.NewAPIKeyService(tenantStore), mountOpts...)
 	// User extra endpoints
-	userH := accountHandler.NewUserHandler(store)
-	e.GET("/user/types", userH.GetUserTypes(ctx))
+	userH := accountHandler.NewUserHandler(userSvc)
+	e.GET("/user/types", userH.GetUserTypes(ctx), authMW, generic.RequirePermissions(authorizer, rbac.UserRead))
+	accountHandler.NewUnlockHandler(account.NewUnlockService(tenantStore, userLimiter, recorder)).Mount(e, authMW, generic.RequirePermissions(authorizer, rbac.UserUpdate))
+	// Two-factor authentication endpoints of the authenticated user
+	accountHandler.NewTwoFactorHandler(account.NewTwoFactorService(tenantStore, hasher, userLimiter, account.DefaultTOTPIssuer)).Mount(e, authMW)
+	// Impersonation endpoints, platform administrators act as users to see what they see
+	authH.MountImpersonation(e, authMW, authorizer)
+	// Session endpoints of the authenticated user
+	accountHandler.NewSessionHandler(account.NewSessionService(tenantStore)).Mount(e, authMW)
+	// SCIM provisioning endpoints, external systems authenticate with an API key of the organization
+	accountHandler.NewSCIMHandler(account.NewSCIMService(tenantStore, hasher, userLimiter)).Mount(e, authMW, authorizer)
+	// OpenID Connect endpoints, users log in and authorize clients on the web application
+	oidcHandler.NewOIDCHandler(provider).Mount(e, authMW)
+	// OpenID Connect client CRUD endpoints
+	generic.MountService(e, oidc.NewClientService(tenantStore), mountOpts...)
 	// Tag CRUD endpoints
-	generic.MountService(e, tag.New(store))
+	generic.MountService(e, tag.New(tenantStore), mountOpts...)
 
 	// Run migrations
 	models := []any{}
 	models = append(models, account.GetModels()...)
+	models = append(models, auth.GetModels()...)
 	models = append(models, tag.GetModels()...)
+	models = append(models, oidc.GetModels()...)
+	models = append(models, lockout.GetModels()...)
+	if err := account.PrepareMemberships(store); err != nil {
+		xlog.Error("error while migrating users to memberships", "err", err)
+		cancel()
+		return
+	}
 	store.RunMigrations(models...)
+	if err := account.MigrateMemberships(context.Background(), store); err != nil {
+		xlog.Error("error while migrating users to memberships", "err", err)
+		cancel()
+		return
+	}
 
 	xlog.Debug("routes", "values", e.Routes())
 
@@ -118,3 +238,58 @@ func (a App) Run() {
 	}
 
 }
+
+// getMailer returns the configured mailer, emails are logged unless a file or an SMTP relay is configured
+func (a App) getMailer() mailer.Mailer {
+	switch a.Opts.Mailer {
+	case "smtp":
+		return mailer.SMTPMailer{Addr: a.Opts.SMTPAddr, From: a.Opts.MailFrom, Username: a.Opts.SMTPUser, Password: a.Opts.SMTPPass}
+	case "file":
+		return mailer.NewFileMailer(a.Opts.MailFile, a.Opts.MailFrom)
+	default:
+		return mailer.LogMailer{}
+	}
+}
+
+// getJWTSecret returns the configured key signing access tokens.
+// Without one a random key is used, tokens are then invalidated on every restart.
+func (a App) getJWTSecret() []byte {
+	if a.Opts.JWTSecret != "" {
+		return []byte(a.Opts.JWTSecret)
+	}
+	xlog.Warn("no jwt secret configured, using a random one")
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+// getIPExtractor returns how the address of clients is read, which throttles and audit events key on.
+// Forwarding headers are only trusted when sent by the configured proxies, since clients could otherwise pick any address.
+func (a App) getIPExtractor() echo.IPExtractor {
+	if len(a.Opts.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, ipRange := range a.Opts.TrustedProxies {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// getOIDCKey returns the configured key signing OpenID Connect tokens.
+// Without one a random key is used, clients then reject the tokens issued before a restart.
+func (a App) getOIDCKey() *rsa.PrivateKey {
+	if a.Opts.OIDCKey != "" {
+		data, err := os.ReadFile(a.Opts.OIDCKey)
+		if err == nil {
+			var key *rsa.PrivateKey
+			if key, err = oidc.ParsePrivateKey(data); err == nil {
+				return key
+			}
+		}
+		xlog.Error("error while reading the OpenID Connect key, using a random one", "err", err)
+		return nil
+	}
+	xlog.Warn("no OpenID Connect key configured, using a random one")
+	return nil
+}
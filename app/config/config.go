@@ -1,31 +1,107 @@
 package config
 
 import (
+	"ekolo/pkg/password"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 const (
-	envHTTP   = "EKOLO_HTTP"
-	envDBHost = "EKOLO_DB_HOST"
-	envDBPort = "EKOLO_DB_PORT"
-	envDBName = "EKOLO_DB_NAME"
-	envDBUser = "EKOLO_DB_USER"
-	envDBPass = "EKOLO_DB_PASS"
+	envHTTP           = "EKOLO_HTTP"
+	envTrustedProxies = "EKOLO_TRUSTED_PROXIES"
+	envDBDriver       = "EKOLO_DB_DRIVER"
+	envDBHost         = "EKOLO_DB_HOST"
+	envDBPort         = "EKOLO_DB_PORT"
+	envDBName         = "EKOLO_DB_NAME"
+	envDBUser         = "EKOLO_DB_USER"
+	envDBPass         = "EKOLO_DB_PASS"
+	envDBPath         = "EKOLO_DB_PATH"
+
+	envJWTSecret  = "EKOLO_JWT_SECRET"
+	envAccessTTL  = "EKOLO_ACCESS_TTL"
+	envRefreshTTL = "EKOLO_REFRESH_TTL"
+
+	envPlatformAdmins   = "EKOLO_PLATFORM_ADMINS"
+	envImpersonationTTL = "EKOLO_IMPERSONATION_TTL"
+
+	envOIDCIssuer = "EKOLO_OIDC_ISSUER"
+	envOIDCKey    = "EKOLO_OIDC_KEY"
+
+	envLockoutThreshold = "EKOLO_LOCKOUT_THRESHOLD"
+	envLockoutDuration  = "EKOLO_LOCKOUT_DURATION"
+
+	envPasswordHash  = "EKOLO_PASSWORD_HASH"
+	envBcryptCost    = "EKOLO_BCRYPT_COST"
+	envArgon2Memory  = "EKOLO_ARGON2_MEMORY"
+	envArgon2Time    = "EKOLO_ARGON2_TIME"
+	envArgon2Threads = "EKOLO_ARGON2_THREADS"
+
+	envAppURL    = "EKOLO_APP_URL"
+	envResetTTL  = "EKOLO_RESET_TTL"
+	envVerifyTTL = "EKOLO_VERIFY_TTL"
+	envInviteTTL = "EKOLO_INVITE_TTL"
+	envMailer    = "EKOLO_MAILER"
+	envMailFrom  = "EKOLO_MAIL_FROM"
+	envMailFile  = "EKOLO_MAIL_FILE"
+	envSMTPAddr  = "EKOLO_SMTP_ADDR"
+	envSMTPUser  = "EKOLO_SMTP_USER"
+	envSMTPPass  = "EKOLO_SMTP_PASS"
 )
 
 type Config struct {
-	HTTPAddr string
+	HTTPAddr       string
+	TrustedProxies []*net.IPNet // Reverse proxies whose X-Forwarded-For header gives the client address, the peer address is used when none.
+
+	DBDriver string
 	DBHost   string
 	DBPort   string
 	DBUser   string
 	DBPass   string
 	DBName   string
+	DBPath   string
+
+	JWTSecret  string        // Key signing access tokens, a random one is used when empty.
+	AccessTTL  time.Duration // Lifetime of access tokens (e.g. 15m).
+	RefreshTTL time.Duration // Lifetime of refresh tokens (e.g. 720h).
+
+	PlatformAdmins   []uuid.UUID   // Users granted the platform permissions, such as impersonating any user.
+	ImpersonationTTL time.Duration // Lifetime of the access tokens of impersonations, which can not be refreshed.
+
+	OIDCIssuer string // Public URL of the API, identifying it as an OpenID Connect provider.
+	OIDCKey    string // PEM file of the RSA key signing ID tokens, a random one is used when empty.
+
+	LockoutThreshold int           // Failed logins locking an account.
+	LockoutDuration  time.Duration // How long an account stays locked, unless unlocked by an administrator.
+
+	Password password.Options // Hashing of new passwords (bcrypt or argon2id), outdated hashes are replaced on login.
+
+	AppURL    string        // Base URL of the web application, links sent by email point to it.
+	ResetTTL  time.Duration // Lifetime of password reset links.
+	VerifyTTL time.Duration // Lifetime of email verification links.
+	InviteTTL time.Duration // Lifetime of invitation links.
+	Mailer    string        // How emails are sent: log, file or smtp.
+	MailFrom  string
+	MailFile  string // File the file mailer appends emails to.
+	SMTPAddr  string // host:port of the SMTP relay.
+	SMTPUser  string
+	SMTPPass  string
 }
 
+// GetDBDSN returns the data source name matching the configured driver
 func (cfg Config) GetDBDSN() string {
-	dsn := "host=%s port=%s dbname=%s user='%s' password=%s sslmode=disable"
-	return fmt.Sprintf(dsn, cfg.DBHost, cfg.DBPort, cfg.DBName, cfg.DBUser, cfg.DBPass)
+	switch cfg.DBDriver {
+	case "sqlite", "memory":
+		return cfg.DBPath
+	default:
+		dsn := "host=%s port=%s dbname=%s user='%s' password=%s sslmode=disable"
+		return fmt.Sprintf(dsn, cfg.DBHost, cfg.DBPort, cfg.DBName, cfg.DBUser, cfg.DBPass)
+	}
 }
 
 func getValue(envKey string) string {
@@ -39,11 +115,39 @@ func getValue(envKey string) string {
 func New() Config {
 	var cfg = Config{
 		HTTPAddr: ":8080",
+		DBDriver: "postgres",
 		DBPort:   "5432",
+		DBPath:   "ekolo.db",
+
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 30 * 24 * time.Hour,
+
+		ImpersonationTTL: 10 * time.Minute,
+
+		OIDCIssuer: "http://localhost:8080",
+
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Hour,
+
+		AppURL:    "http://localhost:8080",
+		ResetTTL:  time.Hour,
+		VerifyTTL: 48 * time.Hour,
+		InviteTTL: 7 * 24 * time.Hour,
+		Mailer:    "log",
+		MailFrom:  "noreply@ekolo.io",
+		MailFile:  "mails.txt",
 	}
 	if v := getValue(envHTTP); v != "" {
 		cfg.HTTPAddr = v
 	}
+	for _, v := range strings.Split(getValue(envTrustedProxies), ",") {
+		if _, ipRange, err := net.ParseCIDR(strings.TrimSpace(v)); err == nil {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, ipRange)
+		}
+	}
+	if v := getValue(envDBDriver); v != "" {
+		cfg.DBDriver = v
+	}
 	cfg.DBHost = getValue(envDBHost)
 	if p := getValue(envDBPort); p != "" {
 		cfg.DBPort = p
@@ -51,5 +155,70 @@ func New() Config {
 	cfg.DBUser = getValue(envDBUser)
 	cfg.DBPass = getValue(envDBPass)
 	cfg.DBName = getValue(envDBName)
+	if v := getValue(envDBPath); v != "" {
+		cfg.DBPath = v
+	}
+	cfg.JWTSecret = getValue(envJWTSecret)
+	if d, err := time.ParseDuration(getValue(envAccessTTL)); err == nil && d > 0 {
+		cfg.AccessTTL = d
+	}
+	if d, err := time.ParseDuration(getValue(envRefreshTTL)); err == nil && d > 0 {
+		cfg.RefreshTTL = d
+	}
+	for _, v := range strings.Split(getValue(envPlatformAdmins), ",") {
+		if id, err := uuid.Parse(strings.TrimSpace(v)); err == nil {
+			cfg.PlatformAdmins = append(cfg.PlatformAdmins, id)
+		}
+	}
+	if d, err := time.ParseDuration(getValue(envImpersonationTTL)); err == nil && d > 0 {
+		cfg.ImpersonationTTL = d
+	}
+	if v := getValue(envOIDCIssuer); v != "" {
+		cfg.OIDCIssuer = v
+	}
+	cfg.OIDCKey = getValue(envOIDCKey)
+	if n, err := strconv.Atoi(getValue(envLockoutThreshold)); err == nil && n > 0 {
+		cfg.LockoutThreshold = n
+	}
+	if d, err := time.ParseDuration(getValue(envLockoutDuration)); err == nil && d > 0 {
+		cfg.LockoutDuration = d
+	}
+	cfg.Password.Algorithm = getValue(envPasswordHash)
+	if n, err := strconv.Atoi(getValue(envBcryptCost)); err == nil && n > 0 {
+		cfg.Password.BcryptCost = n
+	}
+	if n, err := strconv.ParseUint(getValue(envArgon2Memory), 10, 32); err == nil {
+		cfg.Password.Argon2Memory = uint32(n)
+	}
+	if n, err := strconv.ParseUint(getValue(envArgon2Time), 10, 32); err == nil {
+		cfg.Password.Argon2Time = uint32(n)
+	}
+	if n, err := strconv.ParseUint(getValue(envArgon2Threads), 10, 8); err == nil {
+		cfg.Password.Argon2Threads = uint8(n)
+	}
+	if v := getValue(envAppURL); v != "" {
+		cfg.AppURL = v
+	}
+	if d, err := time.ParseDuration(getValue(envResetTTL)); err == nil && d > 0 {
+		cfg.ResetTTL = d
+	}
+	if d, err := time.ParseDuration(getValue(envVerifyTTL)); err == nil && d > 0 {
+		cfg.VerifyTTL = d
+	}
+	if d, err := time.ParseDuration(getValue(envInviteTTL)); err == nil && d > 0 {
+		cfg.InviteTTL = d
+	}
+	if v := getValue(envMailer); v != "" {
+		cfg.Mailer = v
+	}
+	if v := getValue(envMailFrom); v != "" {
+		cfg.MailFrom = v
+	}
+	if v := getValue(envMailFile); v != "" {
+		cfg.MailFile = v
+	}
+	cfg.SMTPAddr = getValue(envSMTPAddr)
+	cfg.SMTPUser = getValue(envSMTPUser)
+	cfg.SMTPPass = getValue(envSMTPPass)
 	return cfg
 }
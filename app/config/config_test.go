@@ -2,17 +2,54 @@ package config
 
 import (
 	"ekolo/pkg/assert"
+	"ekolo/pkg/password"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 var env_vars = map[string]string{
-	envHTTP:   ":8080",
-	envDBHost: "db.koko.com",
-	envDBPort: "5432",
-	envDBName: "koko",
-	envDBUser: "koko",
-	envDBPass: "kokopwd",
+	envHTTP:           ":8080",
+	envTrustedProxies: "10.0.0.0/8, 10.0.0.1",
+	envDBDriver:       "postgres",
+	envDBHost:         "db.koko.com",
+	envDBPort:         "5432",
+	envDBName:         "koko",
+	envDBUser:         "koko",
+	envDBPass:         "kokopwd",
+	envDBPath:         "/tmp/koko.db",
+
+	envJWTSecret:  "kokosecret",
+	envAccessTTL:  "5m",
+	envRefreshTTL: "24h",
+
+	envPlatformAdmins:   "9b2f3c4e-6a1d-4f7e-8c5b-2d3e4f5a6b7c, not-a-uuid",
+	envImpersonationTTL: "5m",
+
+	envOIDCIssuer: "https://api.koko.com",
+	envOIDCKey:    "/etc/koko/oidc.pem",
+
+	envLockoutThreshold: "5",
+	envLockoutDuration:  "30m",
+
+	envPasswordHash:  "bcrypt",
+	envBcryptCost:    "12",
+	envArgon2Memory:  "65536",
+	envArgon2Time:    "3",
+	envArgon2Threads: "4",
+
+	envAppURL:    "https://koko.com",
+	envResetTTL:  "30m",
+	envVerifyTTL: "72h",
+	envInviteTTL: "96h",
+	envMailer:    "smtp",
+	envMailFrom:  "noreply@koko.com",
+	envMailFile:  "/tmp/koko-mails.txt",
+	envSMTPAddr:  "smtp.koko.com:587",
+	envSMTPUser:  "koko",
+	envSMTPPass:  "kokosmtp",
 }
 
 func TestConfig(t *testing.T) {
@@ -23,9 +60,37 @@ func TestConfig(t *testing.T) {
 	cf := New()
 
 	assert.Assert(t, cf.HTTPAddr, env_vars["EKOLO_HTTP"])
+	assert.Assert(t, len(cf.TrustedProxies), 1)
+	assert.Assert(t, cf.TrustedProxies[0].String(), "10.0.0.0/8")
+	assert.Assert(t, cf.DBDriver, env_vars["EKOLO_DB_DRIVER"])
 	assert.Assert(t, cf.DBHost, env_vars["EKOLO_DB_HOST"])
 	assert.Assert(t, cf.DBPort, env_vars["EKOLO_DB_PORT"])
 	assert.Assert(t, cf.DBName, env_vars["EKOLO_DB_NAME"])
 	assert.Assert(t, cf.DBUser, env_vars["EKOLO_DB_USER"])
 	assert.Assert(t, cf.DBPass, env_vars["EKOLO_DB_PASS"])
+	assert.Assert(t, cf.DBPath, env_vars["EKOLO_DB_PATH"])
+	assert.Assert(t, cf.JWTSecret, env_vars["EKOLO_JWT_SECRET"])
+	assert.Assert(t, cf.AccessTTL, 5*time.Minute)
+	assert.Assert(t, cf.RefreshTTL, 24*time.Hour)
+	assert.Assert(t, cf.PlatformAdmins, []uuid.UUID{uuid.MustParse("9b2f3c4e-6a1d-4f7e-8c5b-2d3e4f5a6b7c")})
+	assert.Assert(t, cf.ImpersonationTTL, 5*time.Minute)
+	assert.Assert(t, cf.OIDCIssuer, env_vars["EKOLO_OIDC_ISSUER"])
+	assert.Assert(t, cf.OIDCKey, env_vars["EKOLO_OIDC_KEY"])
+	assert.Assert(t, cf.LockoutThreshold, 5)
+	assert.Assert(t, cf.LockoutDuration, 30*time.Minute)
+	assert.Assert(t, cf.Password, password.Options{Algorithm: "bcrypt", BcryptCost: 12, Argon2Memory: 65536, Argon2Time: 3, Argon2Threads: 4})
+	assert.Assert(t, cf.AppURL, env_vars["EKOLO_APP_URL"])
+	assert.Assert(t, cf.ResetTTL, 30*time.Minute)
+	assert.Assert(t, cf.VerifyTTL, 72*time.Hour)
+	assert.Assert(t, cf.InviteTTL, 96*time.Hour)
+	assert.Assert(t, cf.Mailer, env_vars["EKOLO_MAILER"])
+	assert.Assert(t, cf.MailFrom, env_vars["EKOLO_MAIL_FROM"])
+	assert.Assert(t, cf.MailFile, env_vars["EKOLO_MAIL_FILE"])
+	assert.Assert(t, cf.SMTPAddr, env_vars["EKOLO_SMTP_ADDR"])
+	assert.Assert(t, cf.SMTPUser, env_vars["EKOLO_SMTP_USER"])
+	assert.Assert(t, cf.SMTPPass, env_vars["EKOLO_SMTP_PASS"])
+	assert.Assert(t, cf.GetDBDSN(), "host=db.koko.com port=5432 dbname=koko user='koko' password=kokopwd sslmode=disable")
+
+	cf.DBDriver = "sqlite"
+	assert.Assert(t, cf.GetDBDSN(), env_vars["EKOLO_DB_PATH"])
 }
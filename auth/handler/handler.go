@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"ekolo/auth/service"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/xerr"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+type AuthHandler struct {
+	svc *service.Service
+}
+
+func NewAuthHandler(svc *service.Service) *AuthHandler {
+	return &AuthHandler{
+		svc: svc,
+	}
+}
+
+// Mount registers the auth endpoints on the given Echo instance
+func (h *AuthHandler) Mount(e *echo.Echo) {
+	g := e.Group("auth")
+	g.POST("/login", h.Login()).Name = "auth-login"
+	g.POST("/refresh", h.Refresh()).Name = "auth-refresh"
+	g.POST("/logout", h.Logout()).Name = "auth-logout"
+}
+
+// MountImpersonation registers the impersonation endpoints on the given Echo instance.
+// Only platform administrators may start one, the impersonation token itself ends it.
+func (h *AuthHandler) MountImpersonation(e *echo.Echo, authMW echo.MiddlewareFunc, authorizer generic.IAuthorizer) {
+	g := e.Group("auth/impersonate", authMW)
+	g.POST("", h.Impersonate(), generic.RequirePermissions(authorizer, rbac.PlatformImpersonate)).Name = "auth-impersonate"
+	g.DELETE("", h.EndImpersonation()).Name = "auth-impersonate-end"
+}
+
+// Login issues tokens to a user
+// @Summary Log in
+// @Description Exchange an email and a password for an access token and a refresh token
+// @ID auth-login
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param credentials body service.RequestLogin true "Credentials"
+// @Success 200 {object} service.Tokens
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 429 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /auth/login [post]
+func (h *AuthHandler) Login() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestLogin
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		req.IP, req.Device = c.RealIP(), c.Request().UserAgent()
+		tokens, err := h.svc.Login(c.Request().Context(), req)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// Refresh rotates a refresh token
+// @Summary Refresh tokens
+// @Description Exchange a refresh token for a new access token and a new refresh token
+// @ID auth-refresh
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param token body service.RequestRefresh true "Refresh token"
+// @Success 200 {object} service.Tokens
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /auth/refresh [post]
+func (h *AuthHandler) Refresh() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestRefresh
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		req.IP = c.RealIP()
+		tokens, err := h.svc.Refresh(c.Request().Context(), req)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// Logout revokes a refresh token
+// @Summary Log out
+// @Description Revoke a refresh token and the tokens it was rotated from or into
+// @ID auth-logout
+// @Tags auth
+// @Accept json
+// @Param token body service.RequestRefresh true "Refresh token"
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /auth/logout [post]
+func (h *AuthHandler) Logout() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestRefresh
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		if err := h.svc.Logout(c.Request().Context(), req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// Impersonate issues an access token acting as another user
+// @Summary Impersonate a user
+// @Description Act as any user to see what they see, the access token names the administrator and can not be refreshed
+// @ID auth-impersonate
+// @Tags auth
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param impersonation body service.RequestImpersonate true "User to act as"
+// @Success 200 {object} service.Tokens
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 404 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /auth/impersonate [post]
+func (h *AuthHandler) Impersonate() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestImpersonate
+		if err := bind(c, &req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		req.IP, req.Device = c.RealIP(), c.Request().UserAgent()
+		tokens, err := h.svc.Impersonate(c.Request().Context(), req)
+		if err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// EndImpersonation revokes the impersonation token of the request
+// @Summary End an impersonation
+// @Description Revoke the impersonation the access token was issued for, it is rejected from now on
+// @ID auth-impersonate-end
+// @Tags auth
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /auth/impersonate [delete]
+func (h *AuthHandler) EndImpersonation() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h.svc.EndImpersonation(c.Request().Context(), c.RealIP()); err != nil {
+			return generic.RenderError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// Middleware authenticates requests holding a bearer access token and puts their principal into the request context.
+// Requests for which skipper returns true go through unauthenticated.
+func (h *AuthHandler) Middleware(skipper middleware.Skipper) echo.MiddlewareFunc {
+	if skipper == nil {
+		skipper = middleware.DefaultSkipper
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipper(c) {
+				return next(c)
+			}
+			scheme, token, _ := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+			if !strings.EqualFold(scheme, service.TokenType) || token == "" {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, service.TokenType)
+				return generic.RenderError(c, xerr.Unauthenticated("missing bearer token"))
+			}
+			p, err := h.svc.Verify(c.Request().Context(), token)
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, service.TokenType)
+				return generic.RenderError(c, err)
+			}
+			c.SetRequest(c.Request().WithContext(principal.NewContext(c.Request().Context(), p)))
+			return next(c)
+		}
+	}
+}
+
+// bind binds and validates the payload of a request
+func bind(c echo.Context, req any) error {
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	if errs := generic.Validate(req); errs != nil {
+		return xerr.Validation("validation failed", errs...)
+	}
+	return nil
+}
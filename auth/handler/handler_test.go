@@ -0,0 +1,83 @@
+package handler
+
+import (
+	accountModel "ekolo/account/model"
+	"ekolo/auth/service"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestServer(t *testing.T) *echo.Echo {
+	store := storage.NewMemoryStore()
+	user := accountModel.User{Email: "ada@ekolo.io"}
+	assert.Assert(t, user.SetPassword(password.Default(), "s3cret"), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&accountModel.Membership{UserUUID: user.UUID, OrgUUID: uuid.New(), Status: accountModel.MembershipActive})
+	assert.Assert(t, err, nil)
+
+	e := echo.New()
+	h := NewAuthHandler(service.New(store, service.Options{Secret: []byte("secret")}))
+	h.Mount(e)
+	e.GET("/me", func(c echo.Context) error {
+		p, _ := principal.FromContext(c.Request().Context())
+		return c.JSON(http.StatusOK, p)
+	}, h.Middleware(nil))
+	return e
+}
+
+func doRequest(e *echo.Echo, method, target, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthHandler(t *testing.T) {
+	e := newTestServer(t)
+
+	rec := doRequest(e, http.MethodPost, "/auth/login", `{"email":"ada@ekolo.io","password":"wrong"}`, "")
+	assert.Assert(t, rec.Code, 401)
+	rec = doRequest(e, http.MethodPost, "/auth/login", `{"email":"ada"}`, "")
+	assert.Assert(t, rec.Code, 422)
+
+	rec = doRequest(e, http.MethodPost, "/auth/login", `{"email":"ada@ekolo.io","password":"s3cret"}`, "")
+	assert.Assert(t, rec.Code, 200)
+	var tokens service.Tokens
+	json.Unmarshal(rec.Body.Bytes(), &tokens)
+
+	rec = doRequest(e, http.MethodGet, "/me", "", "")
+	assert.Assert(t, rec.Code, 401)
+	assert.Assert(t, rec.Header().Get(echo.HeaderWWWAuthenticate), "Bearer")
+	rec = doRequest(e, http.MethodGet, "/me", "", "not-a-jwt")
+	assert.Assert(t, rec.Code, 401)
+
+	rec = doRequest(e, http.MethodGet, "/me", "", tokens.AccessToken)
+	assert.Assert(t, rec.Code, 200)
+	var p principal.Principal
+	json.Unmarshal(rec.Body.Bytes(), &p)
+	assert.Assert(t, p.UserUUID != uuid.Nil, true)
+
+	rec = doRequest(e, http.MethodPost, "/auth/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`, "")
+	assert.Assert(t, rec.Code, 200)
+	json.Unmarshal(rec.Body.Bytes(), &tokens)
+
+	rec = doRequest(e, http.MethodPost, "/auth/logout", `{"refresh_token":"`+tokens.RefreshToken+`"}`, "")
+	assert.Assert(t, rec.Code, 204)
+	rec = doRequest(e, http.MethodPost, "/auth/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`, "")
+	assert.Assert(t, rec.Code, 401)
+}
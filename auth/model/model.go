@@ -0,0 +1,26 @@
+package model
+
+import (
+	"ekolo/pkg/storage"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefreshToken is a long lived token exchanged for new access tokens.
+// Only the hash of the token is stored, tokens issued by rotating one another share a family.
+type RefreshToken struct {
+	storage.BaseModel
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;not null"`
+	FamilyUUID uuid.UUID  `json:"family" gorm:"index"`
+	UserUUID   uuid.UUID  `json:"user" gorm:"index"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	TwoFactor  bool       `json:"two_factor"` // Whether the family was issued by a login with a second factor.
+}
+
+func GetModels() []any {
+	return []any{
+		RefreshToken{},
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	accountModel "ekolo/account/model"
+	"ekolo/pkg/audit"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// impersonationDevice prefixes the user agent of impersonation sessions, so that users see who acted as them
+const impersonationDevice = "Impersonation by "
+
+// RequestImpersonate is the payload of the impersonation endpoint
+type RequestImpersonate struct {
+	User   uuid.UUID  `json:"user" validate:"required"` // User to act as, in any organization.
+	Org    *uuid.UUID `json:"org"`                      // Needed when the user belongs to several organizations.
+	IP     string     `json:"-"`
+	Device string     `json:"-"`
+}
+
+// Impersonate issues an access token acting as another user to the platform administrator of ctx, so that support sees what the user sees.
+// The token names the administrator as its actor and can not be refreshed, its session ends after the impersonation lifetime.
+func (s Service) Impersonate(ctx context.Context, req RequestImpersonate) (*Tokens, error) {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return nil, xerr.ErrUnauthenticated
+	}
+	if p.Impersonator != uuid.Nil || p.APIKey != uuid.Nil {
+		return nil, xerr.Forbidden("impersonation requires being logged in as yourself")
+	}
+	if req.User == p.UserUUID {
+		return nil, xerr.Invalid("you can not impersonate yourself")
+	}
+	repo := s.repo.WithContext(ctx)
+	var user accountModel.User
+	if _, err := repo.Get(&user, map[string]any{"uuid": req.User}); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, xerr.NotFound("user not found")
+		}
+		return nil, err
+	}
+	filter := map[string]any{"user_uuid": user.UUID}
+	if req.Org != nil {
+		filter["org_uuid"] = *req.Org
+	}
+	var mm []accountModel.Membership
+	if _, err := repo.List(&mm, filter, storage.ListOptions{}); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(mm) == 0:
+		return nil, xerr.NotFound("the user does not belong to the organization")
+	case len(mm) > 1:
+		return nil, ErrOrgRequired
+	case !mm[0].IsActive():
+		return nil, xerr.Forbidden("the user is deactivated")
+	}
+	member := mm[0]
+	now := s.now()
+	device := impersonationDevice + p.UserUUID.String() + " " + req.Device
+	if len(device) > maxDeviceLen {
+		device = device[:maxDeviceLen]
+	}
+	session := accountModel.Session{
+		UserUUID:       user.UUID,
+		MembershipUUID: member.UUID,
+		Device:         device,
+		IP:             req.IP,
+		LastSeenAt:     now,
+		ExpiresAt:      now.Add(s.opts.ImpersonationTTL),
+		Impersonator:   &p.UserUUID,
+	}
+	if _, err := repo.Create(&session); err != nil {
+		return nil, err
+	}
+	// The second factor of the administrator stands for the one of the user
+	target := newPrincipal(user, member, session.UUID, p.TwoFactor)
+	target.Impersonator = p.UserUUID
+	access, err := s.signAccessToken(target, now, s.opts.ImpersonationTTL)
+	if err != nil {
+		return nil, err
+	}
+	e := audit.NewEvent(ctx, audit.ImpersonationStarted)
+	e.User, e.IP, e.Detail = user.UUID, req.IP, map[string]string{"session": session.UUID.String()}
+	s.opts.Audit.Record(ctx, e)
+	return &Tokens{
+		AccessToken: access,
+		TokenType:   TokenType,
+		ExpiresIn:   int(s.opts.ImpersonationTTL.Seconds()),
+	}, nil
+}
+
+// EndImpersonation ends the impersonation the access token of ctx was issued for, the token is rejected from now on
+func (s Service) EndImpersonation(ctx context.Context, ip string) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return xerr.ErrUnauthenticated
+	}
+	if p.Impersonator == uuid.Nil {
+		return xerr.Invalid("the access token is not an impersonation")
+	}
+	if err := s.endSession(s.repo.WithContext(ctx), p.Session, s.now()); err != nil {
+		return err
+	}
+	e := audit.NewEvent(ctx, audit.ImpersonationEnded)
+	e.User, e.IP, e.Detail = p.UserUUID, ip, map[string]string{"session": p.Session.String()}
+	s.opts.Audit.Record(ctx, e)
+	return nil
+}
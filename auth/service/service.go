@@ -0,0 +1,475 @@
+package service
+
+import (
+	"context"
+	accountModel "ekolo/account/model"
+	account "ekolo/account/service"
+	"ekolo/auth/model"
+	"ekolo/pkg/audit"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultIssuer     = "ekolo"
+	DefaultAccessTTL  = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+	DefaultLockAfter  = 10 // Failed logins locking an account.
+
+	DefaultImpersonationTTL = 10 * time.Minute
+)
+
+// DefaultIPLimits slows down an IP address guessing passwords of many accounts without ever locking it out,
+// since users behind the same address would be locked out with it.
+var DefaultIPLimits = lockout.Options{FreeAttempts: 20, MaxDelay: 5 * time.Minute}
+
+var (
+	ErrInvalidCredentials = xerr.Unauthenticated("invalid credentials")
+	ErrInvalidToken       = xerr.Unauthenticated("invalid or expired token")
+	ErrOrgRequired        = xerr.Invalid("org is required, the email is registered in several organizations")
+	ErrInvalidOTP         = xerr.Unauthenticated("invalid two-factor code")
+)
+
+// GetModels returns the models used by the service
+func GetModels() []any {
+	return model.GetModels()
+}
+
+// Options configures the tokens issued by the service
+type Options struct {
+	Secret     []byte // HMAC key signing access tokens.
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	Hasher     *password.Hasher // Verifies passwords and rehashes outdated ones.
+
+	ImpersonationTTL time.Duration // Lifetime of the access tokens of impersonations, which can not be refreshed.
+
+	// Failed logins are delayed per user and per IP, the user limiter also locks accounts.
+	// In-memory limiters are used when none is given.
+	UserLimiter *lockout.Limiter
+	IPLimiter   *lockout.Limiter
+	Audit       audit.Recorder // Records logins and lockouts, they are logged when nil.
+
+	APIKeys  KeyVerifier // Verifies bearer tokens holding an API key rather than an access token, if any.
+	Denylist Denylist    // Rejects access tokens of revoked sessions, the sessions are read from the storage when nil.
+}
+
+// KeyVerifier returns the principal of an API key
+type KeyVerifier interface {
+	Verify(ctx context.Context, key string) (principal.Principal, error)
+}
+
+// Service issues and verifies tokens
+type Service struct {
+	repo      storage.Storer
+	opts      Options
+	now       func() time.Time
+	dummyHash string // Compared against when no user matches so that unknown emails take as long as wrong passwords.
+}
+
+// New returns a new service, zero options are replaced by their default
+func New(repo storage.Storer, opts Options) *Service {
+	if opts.Issuer == "" {
+		opts.Issuer = DefaultIssuer
+	}
+	if opts.AccessTTL == 0 {
+		opts.AccessTTL = DefaultAccessTTL
+	}
+	if opts.RefreshTTL == 0 {
+		opts.RefreshTTL = DefaultRefreshTTL
+	}
+	if opts.ImpersonationTTL == 0 {
+		opts.ImpersonationTTL = DefaultImpersonationTTL
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = password.Default()
+	}
+	if opts.UserLimiter == nil {
+		opts.UserLimiter = lockout.New(lockout.NewMemoryStore(), lockout.Options{LockAfter: DefaultLockAfter})
+	}
+	if opts.IPLimiter == nil {
+		opts.IPLimiter = lockout.New(lockout.NewMemoryStore(), DefaultIPLimits)
+	}
+	if opts.Audit == nil {
+		opts.Audit = audit.LogRecorder{}
+	}
+	if opts.Denylist == nil {
+		opts.Denylist = NewSessionDenylist(repo)
+	}
+	dummyHash, _ := opts.Hasher.Hash("ekolo")
+	return &Service{
+		repo:      repo,
+		opts:      opts,
+		now:       time.Now,
+		dummyHash: dummyHash,
+	}
+}
+
+// RequestLogin is the payload of the login endpoint
+type RequestLogin struct {
+	Email    string     `json:"email" validate:"required,email"`
+	Password string     `json:"password" validate:"required"`
+	Org      *uuid.UUID `json:"org"` // Needed when the email is registered in several organizations.
+	OTP      string     `json:"otp"` // Code of the authenticator or recovery code, needed when two-factor authentication is enabled.
+	IP       string     `json:"-"`   // Address of the client, failed logins are tracked per address.
+	Device   string     `json:"-"`   // User agent of the client, shown in the sessions of the user.
+}
+
+// RequestRefresh is the payload of the refresh and logout endpoints
+type RequestRefresh struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+	IP           string `json:"-"` // Address of the client, the session is last seen from it.
+}
+
+// Login checks the credentials of a user and issues its tokens.
+// Failed logins delay the next ones of the user and of the IP address, until the account is locked.
+func (s Service) Login(ctx context.Context, req RequestLogin) (*Tokens, error) {
+	if err := s.opts.IPLimiter.Allow(ctx, lockout.IPKey(req.IP)); err != nil {
+		s.audit(ctx, audit.LoginThrottled, uuid.Nil, req.IP)
+		return nil, err
+	}
+	var users []accountModel.User
+	if _, err := s.repo.List(&users, map[string]any{"email": req.Email}, storage.ListOptions{}); err != nil {
+		return nil, err
+	}
+	memberships, err := s.activeMemberships(users, req.Org)
+	if err != nil {
+		return nil, err
+	}
+	// Accounts which can not log into any organization, or into the requested one, are treated as unknown ones
+	users = slices.DeleteFunc(users, func(u accountModel.User) bool { return len(memberships[u.UUID]) == 0 })
+	// Accounts which must wait are not even tried, the login is refused when all of them must
+	candidates, err := s.allowed(ctx, users, req.IP)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		s.opts.Hasher.Verify(s.dummyHash, req.Password)
+		return nil, s.fail(ctx, req.IP, nil, ErrInvalidCredentials)
+	}
+	var (
+		matches = []accountModel.User{}
+		rehash  bool
+	)
+	for _, u := range candidates {
+		outdated, err := u.Authenticate(s.opts.Hasher, req.Password)
+		if err == nil {
+			matches = append(matches, u)
+			rehash = outdated
+		}
+	}
+	if len(matches) == 0 {
+		return nil, s.fail(ctx, req.IP, candidates, ErrInvalidCredentials)
+	}
+	// The password must unlock a single account, which must belong to a single organization unless one is requested
+	switch {
+	case len(matches) == 1 && len(memberships[matches[0].UUID]) == 1:
+		user, member := matches[0], memberships[matches[0].UUID][0]
+		if err := account.RequireVerified(s.repo, user, member.OrgUUID); err != nil {
+			return nil, err
+		}
+		twoFactor, err := account.CheckTwoFactor(ctx, s.repo, user, req.OTP)
+		if errors.Is(err, account.ErrInvalidOTP) {
+			return nil, s.fail(ctx, req.IP, matches, ErrInvalidOTP)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := s.opts.UserLimiter.Reset(ctx, lockout.UserKey(user.UUID)); err != nil {
+			return nil, err
+		}
+		s.audit(ctx, audit.LoginSucceeded, user.UUID, req.IP)
+		if rehash {
+			s.rehash(user, req.Password)
+		}
+		session, err := s.startSession(s.repo, user, member, req)
+		if err != nil {
+			return nil, err
+		}
+		return s.issue(ctx, s.repo, user, member, session.UUID, twoFactor)
+	default:
+		return nil, ErrOrgRequired
+	}
+}
+
+// Refresh exchanges a refresh token for new tokens, the refresh token can only be used once.
+// Presenting a token which was already rotated revokes its whole family and session since it has likely been stolen.
+func (s Service) Refresh(ctx context.Context, req RequestRefresh) (*Tokens, error) {
+	var (
+		tokens *Tokens
+		reused bool
+	)
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		rt, err := s.getRefreshToken(tx, req.RefreshToken)
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		if rt.RevokedAt == nil && !now.Before(rt.ExpiresAt) {
+			return ErrInvalidToken
+		}
+		// The token is revoked only if no concurrent refresh did it first, which makes a reuse
+		n := int64(0)
+		if rt.RevokedAt == nil {
+			n, err = tx.UpdateWhere(&model.RefreshToken{BaseModel: storage.BaseModel{UUID: rt.UUID}, RevokedAt: &now}, map[string]any{"revoked_at__isnull": true})
+			if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			// The revocation must be committed, the error is returned once the transaction is done
+			xlog.Warn("refresh-token-reuse", "family", rt.FamilyUUID, "user", rt.UserUUID)
+			reused = true
+			if err := s.revokeFamily(tx, rt.FamilyUUID, now); err != nil {
+				return err
+			}
+			return s.endSession(tx, rt.FamilyUUID, now)
+		}
+		session, err := s.touchSession(tx, rt.FamilyUUID, req.IP, now)
+		if err != nil {
+			return err
+		}
+		// The session goes on within the organization it logged into, as long as the user still belongs to it
+		user, member, err := s.getSessionMember(tx, session)
+		if err != nil {
+			return err
+		}
+		tokens, err = s.issue(ctx, tx, user, member, rt.FamilyUUID, rt.TwoFactor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, ErrInvalidToken
+	}
+	return tokens, nil
+}
+
+// Logout ends the session of the refresh token, revoking every token it was rotated from or into
+func (s Service) Logout(ctx context.Context, req RequestRefresh) error {
+	return s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		rt, err := s.getRefreshToken(tx, req.RefreshToken)
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		if err := s.revokeFamily(tx, rt.FamilyUUID, now); err != nil {
+			return err
+		}
+		return s.endSession(tx, rt.FamilyUUID, now)
+	})
+}
+
+// Verify returns the principal of a valid access token, or of a valid API key when the token is one.
+// Access tokens of revoked sessions are rejected before they expire.
+func (s Service) Verify(ctx context.Context, token string) (principal.Principal, error) {
+	if s.opts.APIKeys != nil && strings.HasPrefix(token, account.APIKeyPrefix) {
+		return s.opts.APIKeys.Verify(ctx, token)
+	}
+	claims, err := s.parseAccessToken(token)
+	if err != nil {
+		return principal.Principal{}, ErrInvalidToken
+	}
+	userUUID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return principal.Principal{}, ErrInvalidToken
+	}
+	if claims.Session != uuid.Nil {
+		denied, err := s.opts.Denylist.Denied(ctx, claims.Session)
+		if err != nil {
+			return principal.Principal{}, err
+		}
+		if denied {
+			return principal.Principal{}, ErrInvalidToken
+		}
+	}
+	p := principal.Principal{UserUUID: userUUID, OrgUUID: claims.Org, Type: claims.Type, Verified: claims.Verified, TwoFactor: claims.TwoFactor, Session: claims.Session}
+	if claims.Actor != nil {
+		if p.Impersonator, err = uuid.Parse(claims.Actor.Subject); err != nil {
+			return principal.Principal{}, ErrInvalidToken
+		}
+	}
+	return p, nil
+}
+
+// activeMemberships returns the active memberships of users by user, within org when it is not nil
+func (s Service) activeMemberships(users []accountModel.User, org *uuid.UUID) (map[uuid.UUID][]accountModel.Membership, error) {
+	uuids := make([]uuid.UUID, len(users))
+	for i, u := range users {
+		uuids[i] = u.UUID
+	}
+	filter := map[string]any{"user_uuid": uuids, "status": accountModel.MembershipActive}
+	if org != nil {
+		filter["org_uuid"] = *org
+	}
+	var mm []accountModel.Membership
+	if _, err := s.repo.List(&mm, filter, storage.ListOptions{}); err != nil {
+		return nil, err
+	}
+	memberships := map[uuid.UUID][]accountModel.Membership{}
+	for _, m := range mm {
+		memberships[m.UserUUID] = append(memberships[m.UserUUID], m)
+	}
+	return memberships, nil
+}
+
+// getSessionMember returns the user of a session along with the membership it logged in with, which must still be active
+func (s Service) getSessionMember(repo storage.Storer, session accountModel.Session) (accountModel.User, accountModel.Membership, error) {
+	var (
+		user   accountModel.User
+		member accountModel.Membership
+	)
+	_, err := repo.Get(&member, map[string]any{"uuid": session.MembershipUUID, "user_uuid": session.UserUUID})
+	if err == nil {
+		_, err = repo.Get(&user, map[string]any{"uuid": session.UserUUID})
+	}
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && !member.IsActive()) {
+		return user, member, ErrInvalidToken
+	}
+	return user, member, err
+}
+
+// allowed returns the users whose account may be tried, or the error of the first one when none may
+func (s Service) allowed(ctx context.Context, users []accountModel.User, ip string) ([]accountModel.User, error) {
+	var (
+		allowed  = []accountModel.User{}
+		firstErr error
+	)
+	for _, u := range users {
+		err := s.opts.UserLimiter.Allow(ctx, lockout.UserKey(u.UUID))
+		if errors.Is(err, xerr.ErrTooManyRequests) {
+			s.audit(ctx, audit.LoginThrottled, u.UUID, ip)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		allowed = append(allowed, u)
+	}
+	if len(allowed) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return allowed, nil
+}
+
+// fail records a failed login from ip on the accounts of users and returns err
+func (s Service) fail(ctx context.Context, ip string, users []accountModel.User, err error) error {
+	if _, _, ferr := s.opts.IPLimiter.Fail(ctx, lockout.IPKey(ip)); ferr != nil {
+		return ferr
+	}
+	if len(users) == 0 {
+		s.audit(ctx, audit.LoginFailed, uuid.Nil, ip)
+	}
+	for _, u := range users {
+		_, locked, ferr := s.opts.UserLimiter.Fail(ctx, lockout.UserKey(u.UUID))
+		if ferr != nil {
+			return ferr
+		}
+		s.audit(ctx, audit.LoginFailed, u.UUID, ip)
+		if locked {
+			s.audit(ctx, audit.AccountLocked, u.UUID, ip)
+		}
+	}
+	return err
+}
+
+// audit records an event about a login of the user from ip, the user is nil when unknown
+func (s Service) audit(ctx context.Context, typ string, user uuid.UUID, ip string) {
+	e := audit.NewEvent(ctx, typ)
+	e.User, e.IP = user, ip
+	s.opts.Audit.Record(ctx, e)
+}
+
+// rehash replaces the outdated password hash of a user, the login goes on when it fails
+func (s Service) rehash(user accountModel.User, plain string) {
+	u := accountModel.User{BaseModel: storage.BaseModel{UUID: user.UUID}, Email: user.Email}
+	if err := u.SetPassword(s.opts.Hasher, plain); err != nil {
+		return
+	}
+	if _, err := s.repo.Update(&u); err != nil {
+		xlog.Warn("password-rehash", "user", user.UUID, "err", err)
+	}
+}
+
+// issue signs an access token for the member and stores a new refresh token of the family, which is the session of the tokens.
+// twoFactor tells whether the family was issued by a login with a second factor.
+func (s Service) issue(ctx context.Context, repo storage.Storer, user accountModel.User, member accountModel.Membership, family uuid.UUID, twoFactor bool) (*Tokens, error) {
+	now := s.now()
+	access, err := s.signAccessToken(newPrincipal(user, member, family, twoFactor), now, s.opts.AccessTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, hash, err := token.New()
+	if err != nil {
+		return nil, err
+	}
+	rt := model.RefreshToken{
+		TokenHash:  hash,
+		FamilyUUID: family,
+		UserUUID:   user.UUID,
+		ExpiresAt:  now.Add(s.opts.RefreshTTL),
+		TwoFactor:  twoFactor,
+	}
+	if _, err := repo.Create(&rt); err != nil {
+		return nil, err
+	}
+	return &Tokens{
+		AccessToken:  access,
+		TokenType:    TokenType,
+		ExpiresIn:    int(s.opts.AccessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// newPrincipal returns the principal of the access tokens of a user issued for a session, acting within the organization of the membership
+func newPrincipal(user accountModel.User, member accountModel.Membership, session uuid.UUID, twoFactor bool) principal.Principal {
+	p := principal.Principal{UserUUID: user.UUID, OrgUUID: member.OrgUUID, Verified: user.VerifiedAt != nil, TwoFactor: twoFactor, Session: session}
+	if member.Type != nil {
+		p.Type = *member.Type
+	}
+	return p
+}
+
+// getRefreshToken returns the stored refresh token matching plain
+func (s Service) getRefreshToken(repo storage.Storer, plain string) (model.RefreshToken, error) {
+	var rt model.RefreshToken
+	if _, err := repo.Get(&rt, map[string]any{"token_hash": token.Hash(plain)}); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return rt, ErrInvalidToken
+		}
+		return rt, err
+	}
+	return rt, nil
+}
+
+// revokeFamily revokes every token of a family which is not revoked yet
+func (s Service) revokeFamily(repo storage.Storer, family uuid.UUID, now time.Time) error {
+	var tokens []model.RefreshToken
+	filter := map[string]any{"family_uuid": family, "revoked_at__isnull": true}
+	if _, err := repo.List(&tokens, filter, storage.ListOptions{}); err != nil {
+		return err
+	}
+	for i := range tokens {
+		tokens[i].RevokedAt = &now
+		if _, err := repo.Update(&tokens[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,487 @@
+package service
+
+import (
+	"context"
+	accountModel "ekolo/account/model"
+	account "ekolo/account/service"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/audit"
+	"ekolo/pkg/lockout"
+	"ekolo/pkg/password"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/totp"
+	"ekolo/pkg/xerr"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestService returns a service and a stored user holding the given password, a teacher of an organization
+func newTestService(t *testing.T, plain string) (*Service, accountModel.User) {
+	store := storage.NewMemoryStore()
+	user := accountModel.User{Email: "ada@ekolo.io"}
+	assert.Assert(t, user.SetPassword(password.Default(), plain), nil)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	addMembership(t, store, user, uuid.New())
+	return New(store, Options{Secret: []byte("secret")}), user
+}
+
+// addMembership makes user a teacher of org
+func addMembership(t *testing.T, repo storage.Storer, user accountModel.User, org uuid.UUID) accountModel.Membership {
+	userType := "TEACHER"
+	m := accountModel.Membership{UserUUID: user.UUID, OrgUUID: org, Type: &userType, Status: accountModel.MembershipActive}
+	_, err := repo.Create(&m)
+	assert.Assert(t, err, nil)
+	return m
+}
+
+// membershipOf returns the single membership of user
+func membershipOf(t *testing.T, repo storage.Storer, user accountModel.User) accountModel.Membership {
+	var m accountModel.Membership
+	_, err := repo.Get(&m, map[string]any{"user_uuid": user.UUID})
+	assert.Assert(t, err, nil)
+	return m
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+
+	_, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "wrong"})
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+	_, err = svc.Login(ctx, RequestLogin{Email: "bob@ekolo.io", Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, tokens.TokenType, "Bearer")
+	assert.Assert(t, tokens.ExpiresIn, 900)
+
+	p, err := svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.UserUUID, user.UUID)
+	assert.Assert(t, p.OrgUUID, membershipOf(t, svc.repo, user).OrgUUID)
+	assert.Assert(t, p.Type, "TEACHER")
+
+	// Access tokens signed with another key or expired are rejected
+	other := New(svc.repo, Options{Secret: []byte("other")})
+	_, err = other.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	svc.now = func() time.Time { return time.Now().Add(DefaultAccessTTL) }
+	_, err = svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+}
+
+func TestLoginOrganizations(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+	first := membershipOf(t, svc.repo, user)
+	second := addMembership(t, svc.repo, user, uuid.New())
+
+	// Users of several organizations pick the one they log into
+	_, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, ErrOrgRequired), true)
+	unknown := uuid.New()
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", Org: &unknown})
+	assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", Org: &second.OrgUUID})
+	assert.Assert(t, err, nil)
+	p, err := svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.OrgUUID, second.OrgUUID)
+
+	// The session ends once the user leaves the organization, the other one is still open to them
+	_, err = svc.repo.Delete(&accountModel.Membership{}, map[string]any{"uuid": second.UUID})
+	assert.Assert(t, err, nil)
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: tokens.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	tokens, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	p, err = svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.OrgUUID, first.OrgUUID)
+}
+
+func TestLoginRehash(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+	stored := func() string {
+		var u accountModel.User
+		_, err := svc.repo.Get(&u, map[string]any{"uuid": user.UUID})
+		assert.Assert(t, err, nil)
+		return *u.Password
+	}
+
+	// Hashes made with other parameters are replaced once the password is known
+	bcrypt, err := password.New(password.Options{Algorithm: password.Bcrypt, BcryptCost: 4})
+	assert.Assert(t, err, nil)
+	svc.opts.Hasher = bcrypt
+	before := stored()
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "wrong"})
+	assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	assert.Assert(t, stored(), before)
+
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	after := stored()
+	assert.Assert(t, after != before, true)
+	rehash, err := bcrypt.Verify(after, "s3cret")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, rehash, false)
+
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, stored(), after)
+}
+
+func TestLoginRequireVerified(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+	required := true
+	org := accountModel.Organization{Name: "school", RequireVerifiedEmail: &required}
+	_, err := svc.repo.Create(&org)
+	assert.Assert(t, err, nil)
+	_, err = svc.repo.Update(&accountModel.Membership{BaseModel: membershipOf(t, svc.repo, user).BaseModel, OrgUUID: org.UUID})
+	assert.Assert(t, err, nil)
+
+	// The password is checked first so that the error does not reveal the account
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "wrong"})
+	assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+
+	now := time.Now()
+	_, err = svc.repo.Update(&accountModel.User{BaseModel: user.BaseModel, Email: user.Email, VerifiedAt: &now})
+	assert.Assert(t, err, nil)
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	p, err := svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.Verified, true)
+}
+
+func TestLoginDeactivated(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+
+	// Deactivated users can neither log in nor refresh their tokens
+	_, err = svc.repo.Update(&accountModel.Membership{BaseModel: membershipOf(t, svc.repo, user).BaseModel, Status: accountModel.MembershipInactive})
+	assert.Assert(t, err, nil)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: tokens.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+
+	first, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+
+	second, err := svc.Refresh(ctx, RequestRefresh{RefreshToken: first.RefreshToken})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, second.RefreshToken != first.RefreshToken, true)
+
+	// Replaying a rotated token revokes the tokens issued from it
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: first.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: second.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: "unknown"})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+
+	third, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	svc.now = func() time.Time { return time.Now().Add(DefaultRefreshTTL) }
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: third.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+}
+
+func TestRefreshConcurrent(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+	first, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+
+	// A single one of concurrent refreshes of a token rotates it, the others are reuses revoking the family
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		rotated  []*Tokens
+		rejected int
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens, err := svc.Refresh(ctx, RequestRefresh{RefreshToken: first.RefreshToken})
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, ErrInvalidToken) {
+				rejected++
+			} else if err == nil {
+				rotated = append(rotated, tokens)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Assert(t, len(rotated), 1)
+	assert.Assert(t, rejected, 1)
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: rotated[0].RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, svc.Logout(ctx, RequestRefresh{RefreshToken: tokens.RefreshToken}), nil)
+
+	_, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: tokens.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	svc, user := newTestService(t, "s3cret")
+	ctx := principal.NewContext(context.Background(), principal.Principal{UserUUID: user.UUID})
+	twoFactor := account.NewTwoFactorService(svc.repo, password.Default(), nil, "")
+	enrollment, err := twoFactor.Enroll(ctx)
+	assert.Assert(t, err, nil)
+	now := time.Now()
+	first, err := totp.Code(enrollment.Secret, totp.Step(now))
+	assert.Assert(t, err, nil)
+	codes, err := twoFactor.Confirm(ctx, account.RequestTwoFactorCode{Code: first})
+	assert.Assert(t, err, nil)
+
+	// The password is checked first, then the second factor which can not be replayed
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "wrong"})
+	assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, errors.Is(err, account.ErrOTPRequired), true)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", OTP: first})
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+
+	next, _ := totp.Code(enrollment.Secret, totp.Step(now)+1)
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", OTP: next})
+	assert.Assert(t, err, nil)
+	p, err := svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.TwoFactor, true)
+
+	// Refreshed tokens keep the second factor of their login
+	tokens, err = svc.Refresh(ctx, RequestRefresh{RefreshToken: tokens.RefreshToken})
+	assert.Assert(t, err, nil)
+	p, err = svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.TwoFactor, true)
+
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", OTP: codes.Codes[0]})
+	assert.Assert(t, err, nil)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", OTP: codes.Codes[0]})
+	assert.Assert(t, errors.Is(err, ErrInvalidOTP), true)
+}
+
+func TestLoginLockout(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		recorder = &audit.MemoryRecorder{}
+		users    = lockout.New(lockout.NewMemoryStore(), lockout.Options{FreeAttempts: 1, BaseDelay: time.Nanosecond, MaxDelay: time.Nanosecond, LockAfter: 3})
+		ips      = lockout.New(lockout.NewMemoryStore(), lockout.Options{FreeAttempts: 4, BaseDelay: time.Hour, MaxDelay: time.Hour})
+	)
+	svc, user := newTestService(t, "s3cret")
+	svc = New(svc.repo, Options{Secret: []byte("secret"), UserLimiter: users, IPLimiter: ips, Audit: recorder})
+
+	// The account is locked after enough failures, whatever the address the next logins come from
+	for i := 0; i < 3; i++ {
+		_, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "wrong", IP: "10.0.0.1"})
+		assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	}
+	assert.Assert(t, len(recorder.Events(audit.LoginFailed)), 3)
+	locked := recorder.Events(audit.AccountLocked)
+	assert.Assert(t, len(locked), 1)
+	assert.Assert(t, locked[0].User, user.UUID)
+	assert.Assert(t, locked[0].IP, "10.0.0.1")
+	_, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", IP: "10.0.0.2"})
+	assert.Assert(t, errors.Is(err, xerr.ErrTooManyRequests), true)
+	assert.Assert(t, len(recorder.Events(audit.LoginThrottled)), 1)
+
+	// Unlocking the account lets the user log in again
+	assert.Assert(t, users.Reset(ctx, lockout.UserKey(user.UUID)), nil)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", IP: "10.0.0.2"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(recorder.Events(audit.LoginSucceeded)), 1)
+
+	// An address failing too often is delayed, even for valid credentials
+	for i := 0; i < 5; i++ {
+		_, err = svc.Login(ctx, RequestLogin{Email: "bob@ekolo.io", Password: "s3cret", IP: "10.0.0.3"})
+		assert.Assert(t, errors.Is(err, ErrInvalidCredentials), true)
+	}
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", IP: "10.0.0.3"})
+	var xe *xerr.Error
+	assert.Assert(t, errors.As(err, &xe), true)
+	assert.Assert(t, xe.Kind, xerr.KindTooManyRequests)
+	assert.Assert(t, xe.RetryAfter > 59*time.Minute, true)
+	_, err = svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret", IP: "10.0.0.1"})
+	assert.Assert(t, err, nil)
+}
+
+// keyVerifier accepts a single API key
+type keyVerifier struct {
+	key string
+	p   principal.Principal
+}
+
+func (v keyVerifier) Verify(ctx context.Context, key string) (principal.Principal, error) {
+	if key != v.key {
+		return principal.Principal{}, account.ErrInvalidAPIKey
+	}
+	return v.p, nil
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	ctx := context.Background()
+	svc, user := newTestService(t, "s3cret")
+	key := keyVerifier{key: account.APIKeyPrefix + "abc", p: principal.Principal{OrgUUID: membershipOf(t, svc.repo, user).OrgUUID, APIKey: uuid.New(), Scopes: []string{"tag:read"}}}
+	svc = New(svc.repo, Options{Secret: []byte("secret"), APIKeys: key})
+
+	// Keys and access tokens are both accepted
+	p, err := svc.Verify(ctx, key.key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p, key.p)
+	_, err = svc.Verify(ctx, account.APIKeyPrefix+"abd")
+	assert.Assert(t, errors.Is(err, account.ErrInvalidAPIKey), true)
+	tokens, err := svc.Login(ctx, RequestLogin{Email: user.Email, Password: "s3cret"})
+	assert.Assert(t, err, nil)
+	p, err = svc.Verify(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.UserUUID, user.UUID)
+}
+
+func TestSessions(t *testing.T) {
+	svc, user := newTestService(t, "s3cret")
+	sessions := account.NewSessionService(svc.repo)
+	laptop, err := svc.Login(context.Background(), RequestLogin{Email: user.Email, Password: "s3cret", Device: "laptop", IP: "10.0.0.1"})
+	assert.Assert(t, err, nil)
+	phone, err := svc.Login(context.Background(), RequestLogin{Email: user.Email, Password: "s3cret", Device: "phone", IP: "10.0.0.2"})
+	assert.Assert(t, err, nil)
+
+	// Every login is a session, the one of the request is flagged
+	p, err := svc.Verify(context.Background(), laptop.AccessToken)
+	assert.Assert(t, err, nil)
+	ctx := principal.NewContext(context.Background(), p)
+	views, err := sessions.List(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(views), 2)
+	for _, v := range views {
+		assert.Assert(t, v.Current, v.Device == "laptop")
+	}
+
+	// Refreshing keeps the session and records where it is seen from
+	phone, err = svc.Refresh(context.Background(), RequestRefresh{RefreshToken: phone.RefreshToken, IP: "10.0.0.3"})
+	assert.Assert(t, err, nil)
+	views, err = sessions.List(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(views), 2)
+	assert.Assert(t, views[0].IP, "10.0.0.3")
+
+	// A revoked session is denied right away, the others go on
+	assert.Assert(t, sessions.Revoke(ctx, account.RequestSession{SessionParam: views[0].UUID}), nil)
+	_, err = svc.Verify(context.Background(), phone.AccessToken)
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	_, err = svc.Refresh(context.Background(), RequestRefresh{RefreshToken: phone.RefreshToken})
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	_, err = svc.Verify(context.Background(), laptop.AccessToken)
+	assert.Assert(t, err, nil)
+	err = sessions.Revoke(principal.NewContext(context.Background(), principal.Principal{UserUUID: uuid.New()}), account.RequestSession{SessionParam: p.Session})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	// Logging out ends the session as well
+	assert.Assert(t, svc.Logout(context.Background(), RequestRefresh{RefreshToken: laptop.RefreshToken}), nil)
+	_, err = svc.Verify(context.Background(), laptop.AccessToken)
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	views, err = sessions.List(ctx)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(views), 0)
+}
+
+func TestImpersonate(t *testing.T) {
+	recorder := &audit.MemoryRecorder{}
+	svc, user := newTestService(t, "s3cret")
+	svc = New(svc.repo, Options{Secret: []byte("secret"), Audit: recorder})
+	admin := principal.Principal{UserUUID: uuid.New(), OrgUUID: uuid.New(), Type: "MANAGER", TwoFactor: true, Session: uuid.New()}
+	ctx := principal.NewContext(context.Background(), admin)
+
+	_, err := svc.Impersonate(ctx, RequestImpersonate{User: admin.UserUUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	_, err = svc.Impersonate(ctx, RequestImpersonate{User: uuid.New()})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	// The token acts as the user across organizations, naming the administrator
+	tokens, err := svc.Impersonate(ctx, RequestImpersonate{User: user.UUID, IP: "10.0.0.1", Device: "browser"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, tokens.ExpiresIn, 600)
+	assert.Assert(t, tokens.RefreshToken, "")
+	p, err := svc.Verify(context.Background(), tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.UserUUID, user.UUID)
+	assert.Assert(t, p.OrgUUID, membershipOf(t, svc.repo, user).OrgUUID)
+	assert.Assert(t, p.Type, "TEACHER")
+	assert.Assert(t, p.Impersonator, admin.UserUUID)
+	assert.Assert(t, p.TwoFactor, true)
+	started := recorder.Events(audit.ImpersonationStarted)
+	assert.Assert(t, len(started), 1)
+	assert.Assert(t, started[0].Actor, admin.UserUUID)
+	assert.Assert(t, started[0].User, user.UUID)
+
+	// The user sees the impersonation among their sessions
+	var session accountModel.Session
+	_, err = svc.repo.Get(&session, map[string]any{"uuid": p.Session})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *session.Impersonator, admin.UserUUID)
+
+	// Impersonations can not be chained and expire quickly
+	impersonating := principal.NewContext(context.Background(), p)
+	_, err = svc.Impersonate(impersonating, RequestImpersonate{User: admin.UserUUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	svc.now = func() time.Time { return time.Now().Add(DefaultImpersonationTTL) }
+	_, err = svc.Verify(context.Background(), tokens.AccessToken)
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	svc.now = time.Now
+
+	// Ending the impersonation rejects its token, events name both the user and the administrator
+	err = svc.EndImpersonation(ctx, "")
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	assert.Assert(t, svc.EndImpersonation(impersonating, "10.0.0.1"), nil)
+	_, err = svc.Verify(context.Background(), tokens.AccessToken)
+	assert.Assert(t, errors.Is(err, ErrInvalidToken), true)
+	ended := recorder.Events(audit.ImpersonationEnded)
+	assert.Assert(t, len(ended), 1)
+	assert.Assert(t, ended[0].Actor, user.UUID)
+	assert.Assert(t, ended[0].Impersonator, admin.UserUUID)
+
+	// Users of several organizations are impersonated within one of them, deactivated users can not be
+	other := addMembership(t, svc.repo, user, uuid.New())
+	_, err = svc.Impersonate(ctx, RequestImpersonate{User: user.UUID})
+	assert.Assert(t, errors.Is(err, ErrOrgRequired), true)
+	tokens, err = svc.Impersonate(ctx, RequestImpersonate{User: user.UUID, Org: &other.OrgUUID})
+	assert.Assert(t, err, nil)
+	p, err = svc.Verify(context.Background(), tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.OrgUUID, other.OrgUUID)
+	_, err = svc.repo.Update(&accountModel.Membership{BaseModel: other.BaseModel, Status: accountModel.MembershipInactive})
+	assert.Assert(t, err, nil)
+	_, err = svc.Impersonate(ctx, RequestImpersonate{User: user.UUID, Org: &other.OrgUUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+}
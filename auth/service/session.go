@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	accountModel "ekolo/account/model"
+	account "ekolo/account/service"
+	"ekolo/pkg/storage"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxDeviceLen bounds the user agent stored with a session
+const maxDeviceLen = 255
+
+// Denylist tells whether the access tokens of a session were revoked, they are otherwise valid until they expire
+type Denylist interface {
+	Denied(ctx context.Context, session uuid.UUID) (bool, error)
+}
+
+// SessionDenylist denies the access tokens of the sessions which are revoked or gone from the storage
+type SessionDenylist struct {
+	repo storage.Storer
+}
+
+// NewSessionDenylist returns a denylist reading sessions from repo
+func NewSessionDenylist(repo storage.Storer) *SessionDenylist {
+	return &SessionDenylist{repo: repo}
+}
+
+func (d SessionDenylist) Denied(ctx context.Context, session uuid.UUID) (bool, error) {
+	var s accountModel.Session
+	_, err := d.repo.WithContext(ctx).Get(&s, map[string]any{"uuid": session})
+	if errors.Is(err, storage.ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.RevokedAt != nil, nil
+}
+
+// startSession stores the session of a login into the organization of a membership, its uuid is the family of the tokens it issues
+func (s Service) startSession(repo storage.Storer, user accountModel.User, member accountModel.Membership, req RequestLogin) (accountModel.Session, error) {
+	now := s.now()
+	device := req.Device
+	if len(device) > maxDeviceLen {
+		device = device[:maxDeviceLen]
+	}
+	session := accountModel.Session{
+		UserUUID:       user.UUID,
+		MembershipUUID: member.UUID,
+		Device:         device,
+		IP:             req.IP,
+		LastSeenAt:     now,
+		ExpiresAt:      now.Add(s.opts.RefreshTTL),
+	}
+	_, err := repo.Create(&session)
+	return session, err
+}
+
+// touchSession records that the session of a family was seen again, it returns an invalid token error when the session was revoked
+func (s Service) touchSession(repo storage.Storer, family uuid.UUID, ip string, now time.Time) (accountModel.Session, error) {
+	var session accountModel.Session
+	_, err := repo.Get(&session, map[string]any{"uuid": family})
+	if errors.Is(err, storage.ErrNotFound) {
+		return session, ErrInvalidToken
+	}
+	if err != nil {
+		return session, err
+	}
+	if session.RevokedAt != nil {
+		return session, ErrInvalidToken
+	}
+	session.IP = ip
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(s.opts.RefreshTTL)
+	_, err = repo.Update(&session)
+	return session, err
+}
+
+// endSession revokes the session of a family, denying its access tokens
+func (s Service) endSession(repo storage.Storer, family uuid.UUID, now time.Time) error {
+	return account.RevokeSession(repo, family, now)
+}
+
+var _ Denylist = (*SessionDenylist)(nil)
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"ekolo/pkg/principal"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const TokenType = "Bearer"
+
+// Tokens is the response of a successful login or refresh
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`              // Lifetime of the access token in seconds.
+	RefreshToken string `json:"refresh_token,omitempty"` // Missing for impersonations, which can not be refreshed.
+}
+
+// Claims are the claims of an access token, the subject is the user uuid
+type Claims struct {
+	jwt.RegisteredClaims
+	Org       uuid.UUID `json:"org"`
+	Type      string    `json:"type"`
+	Verified  bool      `json:"verified,omitempty"`
+	TwoFactor bool      `json:"two_factor,omitempty"`
+	Session   uuid.UUID `json:"sid"`
+	Actor     *Actor    `json:"act,omitempty"` // Platform administrator acting as the subject, if any.
+}
+
+// Actor is the party acting on behalf of the subject of a token (RFC 8693)
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// signAccessToken returns a signed access token for the principal, valid for ttl
+func (s Service) signAccessToken(p principal.Principal, now time.Time, ttl time.Duration) (string, error) {
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    s.opts.Issuer,
+			Subject:   p.UserUUID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Org:       p.OrgUUID,
+		Type:      p.Type,
+		Verified:  p.Verified,
+		TwoFactor: p.TwoFactor,
+		Session:   p.Session,
+	}
+	if p.Impersonator != uuid.Nil {
+		claims.Actor = &Actor{Subject: p.Impersonator.String()}
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.opts.Secret)
+}
+
+// parseAccessToken verifies the signature, issuer and lifetime of an access token and returns its claims
+func (s Service) parseAccessToken(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return s.opts.Secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(s.opts.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(s.now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"ekolo/oidc/service"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/xerr"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type OIDCHandler struct {
+	svc *service.Provider
+}
+
+func NewOIDCHandler(svc *service.Provider) *OIDCHandler {
+	return &OIDCHandler{
+		svc: svc,
+	}
+}
+
+// Redirect tells the web application where to send the browser once the user authorized a client
+type Redirect struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// Mount registers the OpenID Connect endpoints on the given Echo instance.
+// Users grant codes from the web application, authMW must authenticate those requests.
+func (h *OIDCHandler) Mount(e *echo.Echo, authMW echo.MiddlewareFunc) {
+	e.GET(service.DiscoveryPath, h.Discovery()).Name = "oidc-discovery"
+	e.GET(service.JWKSPath, h.JWKS()).Name = "oidc-jwks"
+	e.GET(service.AuthorizePath, h.Authorize()).Name = "oidc-authorize"
+	e.POST(service.AuthorizePath, h.Grant(), authMW).Name = "oidc-grant"
+	e.POST(service.TokenPath, h.Token()).Name = "oidc-token"
+	e.GET(service.UserInfoPath, h.UserInfo()).Name = "oidc-userinfo"
+	e.POST(service.UserInfoPath, h.UserInfo()).Name = "oidc-userinfo-post"
+}
+
+// Discovery returns the discovery document
+// @Summary OpenID Connect discovery
+// @Description Describe the endpoints and the capabilities of the provider
+// @ID oidc-discovery
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} service.Configuration
+// @Router /.well-known/openid-configuration [get]
+func (h *OIDCHandler) Discovery() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, h.svc.Discovery())
+	}
+}
+
+// JWKS returns the signing keys
+// @Summary JSON Web Key Set
+// @Description List the public keys verifying the tokens of the provider
+// @ID oidc-jwks
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} service.JSONWebKeySet
+// @Router /oidc/jwks [get]
+func (h *OIDCHandler) JWKS() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, h.svc.JWKS())
+	}
+}
+
+// Authorize starts an authorization request
+// @Summary Authorization endpoint
+// @Description Check an authorization code request with PKCE and redirect to the login page of the web application, which grants the code
+// @ID oidc-authorize
+// @Tags oidc
+// @Param response_type query string true "code"
+// @Param client_id query string true "Client ID"
+// @Param redirect_uri query string true "Redirect URI registered for the client"
+// @Param scope query string true "Space separated scopes, openid is required"
+// @Param state query string false "Opaque value sent back to the client"
+// @Param nonce query string false "Value copied into the ID token"
+// @Param code_challenge query string true "Base64url encoded SHA-256 of the code verifier"
+// @Param code_challenge_method query string true "S256"
+// @Success 302
+// @Failure 400 {object} service.Error
+// @Router /oidc/authorize [get]
+func (h *OIDCHandler) Authorize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestAuthorize
+		if err := c.Bind(&req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		to, err := h.svc.Authorize(c.Request().Context(), req)
+		if err != nil {
+			return renderError(c, err)
+		}
+		return c.Redirect(http.StatusFound, to)
+	}
+}
+
+// Grant issues an authorization code
+// @Summary Grant an authorization code
+// @Description Issue a code to the client for the authenticated user, the web application then sends the browser to the returned redirect URI
+// @ID oidc-grant
+// @Tags oidc
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param request body service.RequestAuthorize true "Authorization request"
+// @Success 200 {object} Redirect
+// @Failure 400 {object} service.Error
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /oidc/authorize [post]
+func (h *OIDCHandler) Grant() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestAuthorize
+		if err := c.Bind(&req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		to, err := h.svc.Grant(c.Request().Context(), req)
+		if err != nil {
+			return renderError(c, err)
+		}
+		return c.JSON(http.StatusOK, Redirect{RedirectTo: to})
+	}
+}
+
+// Token exchanges an authorization code
+// @Summary Token endpoint
+// @Description Exchange an authorization code and its PKCE verifier for an access token and an ID token. Confidential clients authenticate with HTTP basic authentication or client_secret
+// @ID oidc-token
+// @Tags oidc
+// @Security BasicAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code"
+// @Param code formData string true "Authorization code"
+// @Param redirect_uri formData string true "Redirect URI of the authorization request"
+// @Param code_verifier formData string true "PKCE code verifier"
+// @Param client_id formData string false "Client ID, unless sent with basic authentication"
+// @Param client_secret formData string false "Client secret, unless sent with basic authentication"
+// @Success 200 {object} service.TokenResponse
+// @Failure 400 {object} service.Error
+// @Failure 401 {object} service.Error
+// @Failure 500 {object} generic.Response
+// @Router /oidc/token [post]
+func (h *OIDCHandler) Token() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.RequestToken
+		if err := c.Bind(&req); err != nil {
+			return generic.RenderError(c, err)
+		}
+		// Basic credentials are form encoded before being joined
+		if id, secret, ok := c.Request().BasicAuth(); ok {
+			req.ClientID, _ = url.QueryUnescape(id)
+			req.ClientSecret, _ = url.QueryUnescape(secret)
+		}
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+		tokens, err := h.svc.Token(c.Request().Context(), req)
+		if err != nil {
+			if xerr.KindOf(err) == xerr.KindUnauthenticated {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Basic")
+			}
+			return renderError(c, err)
+		}
+		return c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// UserInfo returns the claims of the user of an access token
+// @Summary UserInfo endpoint
+// @Description Return the claims of the user of an access token issued by the token endpoint, as far as its scopes allow
+// @ID oidc-userinfo
+// @Tags oidc
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} service.UserInfo
+// @Failure 401 {object} service.Error
+// @Failure 403 {object} service.Error
+// @Failure 500 {object} generic.Response
+// @Router /oidc/userinfo [get]
+func (h *OIDCHandler) UserInfo() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		scheme, token, _ := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return generic.RenderError(c, xerr.Unauthenticated("missing bearer token"))
+		}
+		info, err := h.svc.UserInfo(c.Request().Context(), token)
+		if err != nil {
+			var oerr *service.Error
+			if errors.As(err, &oerr) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="`+oerr.Code+`"`)
+			}
+			return renderError(c, err)
+		}
+		return c.JSON(http.StatusOK, info)
+	}
+}
+
+// renderError writes OAuth errors the way OAuth clients expect them, and other errors the way generic handlers do
+func renderError(c echo.Context, err error) error {
+	var oerr *service.Error
+	if errors.As(err, &oerr) {
+		return c.JSON(oerr.Status(), oerr)
+	}
+	return generic.RenderError(c, err)
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	orgmodel "ekolo/account/model"
+	"ekolo/pkg/storage"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client is an application of an organization which signs its users in through OpenID Connect, its uuid is its client id.
+// Only the hash of the secret of a confidential client is stored, public clients have none and rely on PKCE alone.
+type Client struct {
+	storage.BaseModel
+	Name         string                `json:"name" gorm:"not null" validate:"required,max=255"`
+	Public       bool                  `json:"public"` // Whether the client runs where it can not keep a secret, like a browser.
+	SecretHash   *string               `json:"-"`
+	RedirectURIs []string              `json:"redirect_uris" gorm:"serializer:json"` // Codes are only sent back to these exact URIs.
+	OrgUUID      uuid.UUID             `json:"org" gorm:"index"`
+	Org          orgmodel.Organization `json:"-" validate:"-"`
+}
+
+// AuthCode is a single use authorization code a client exchanges for tokens of a user.
+// Only the hash of the code is stored, along with the PKCE challenge the exchange must answer.
+type AuthCode struct {
+	storage.BaseModel
+	CodeHash      string     `json:"-" gorm:"uniqueIndex;not null"`
+	ClientUUID    uuid.UUID  `json:"client" gorm:"index"`
+	UserUUID      uuid.UUID  `json:"user"`
+	RedirectURI   string     `json:"redirect_uri"`
+	Scope         string     `json:"scope"`
+	Nonce         string     `json:"-"`
+	CodeChallenge string     `json:"-"`
+	AuthTime      time.Time  `json:"auth_time"` // When the user authorized the client.
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at"`
+}
+
+func GetModels() []any {
+	return []any{
+		Client{}, AuthCode{},
+	}
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"context"
+	"ekolo/oidc/model"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"fmt"
+	"net/url"
+
+	"github.com/google/uuid"
+)
+
+// GetModels returns service models
+func GetModels() []any {
+	return model.GetModels()
+}
+
+// ClientService is the service object
+type ClientService struct {
+	repo storage.Storer
+}
+
+func (s ClientService) GetName() string {
+	return "organization/:org/oidc-client"
+}
+
+// GetPathParams returns service' path params
+func (s ClientService) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org"), generic.UUIDParam("client")}
+}
+
+// GetPermissions returns the permissions required by an operation
+func (s ClientService) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpCreate:
+		return []rbac.Permission{rbac.ClientCreate}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.ClientUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.ClientDelete}
+	default:
+		return []rbac.Permission{rbac.ClientRead}
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s ClientService) GetFilters() storage.Filters {
+	return storage.Filters{
+		"name":       {storage.OpEq, storage.OpIContains},
+		"public":     {storage.OpEq},
+		"created_at": {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s ClientService) GetSortFields() []string {
+	return []string{"name", "created_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s ClientService) GetDefaultSort() []string {
+	return []string{"name"}
+}
+
+// GetRequest returns the request object for the service
+func (s ClientService) GetRequest(name string) generic.IRequest {
+	switch name {
+	case "create":
+		return &RequestClientCreate{}
+	case "get":
+		return &RequestClientGet{}
+	case "list":
+		return &RequestClientList{}
+	case "update":
+		return &RequestClientUpdate{}
+	case "delete":
+		return &RequestClientDelete{}
+	default:
+		return RequestClient{}
+	}
+}
+
+// NewClientService returns a new service
+func NewClientService(repo storage.Storer) *ClientService {
+	return &ClientService{
+		repo: repo,
+	}
+}
+
+// RequestClient is the request object for the service
+type RequestClient struct{}
+
+func (r RequestClient) GetID() string {
+	return "client"
+}
+
+// PayloadClient is the struct representing the create request payload
+type PayloadClient struct {
+	Name         string   `json:"name" validate:"required,max=255"`
+	Public       bool     `json:"public"` // Public clients get no secret, they must run in a browser or on a device.
+	RedirectURIs []string `json:"redirect_uris" validate:"required,min=1,max=16,dive,url,max=2048"`
+}
+
+// PayloadClientUpdate is the struct representing the update request payload
+type PayloadClientUpdate struct {
+	Name         *string  `json:"name" validate:"omitempty,max=255"`
+	RedirectURIs []string `json:"redirect_uris" validate:"omitempty,max=16,dive,url,max=2048"`
+}
+
+// ClientCreated is a client along with its secret, which is only returned when a confidential client is created
+type ClientCreated struct {
+	model.Client
+	Secret string `json:"secret,omitempty"`
+}
+
+// RequestClientCreate is the request object for the create method
+type RequestClientCreate struct {
+	RequestClient
+	PayloadClient
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestClientGet is the request object for the get method
+type RequestClientGet struct {
+	RequestClient
+	OrgParam    uuid.UUID `param:"org" json:"-"`
+	ClientParam uuid.UUID `param:"client" json:"-"`
+}
+
+// RequestClientList is the request object for the list method
+type RequestClientList struct {
+	RequestClient
+	OrgParam uuid.UUID `param:"org" json:"-"`
+}
+
+// RequestClientUpdate is the request object for the update method
+type RequestClientUpdate struct {
+	RequestClient
+	ClientParam uuid.UUID `param:"client" json:"-"`
+	OrgParam    uuid.UUID `param:"org" json:"-"`
+	PayloadClientUpdate
+}
+
+// RequestClientDelete is the request object for the delete method
+type RequestClientDelete struct {
+	RequestClient
+	ClientParam uuid.UUID `param:"client" json:"-"`
+	OrgParam    uuid.UUID `param:"org" json:"-"`
+}
+
+// Create registers a client
+// @Summary Register an OpenID Connect client
+// @Description Register an application signing the users of the organization in. Its uuid is its client id, the secret of a confidential client is only returned by this call
+// @ID client-create
+// @Tags oidc-client
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param client body PayloadClient true "Client data"
+// @Success 200 {object} generic.Response{data=ClientCreated}
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /organization/{org}/oidc-client [post]
+func (s ClientService) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestClientCreate)
+	if err := checkRedirectURIs(r.RedirectURIs); err != nil {
+		return nil, err
+	}
+	client := model.Client{
+		Name:         r.Name,
+		Public:       r.Public,
+		RedirectURIs: r.RedirectURIs,
+		OrgUUID:      r.OrgParam,
+	}
+	var secret string
+	if !r.Public {
+		plain, hash, err := token.New()
+		if err != nil {
+			return nil, err
+		}
+		secret, client.SecretHash = plain, &hash
+	}
+	if _, err := s.repo.WithContext(ctx).Create(&client); err != nil {
+		return nil, err
+	}
+	return generic.NewResponse(200, nil, ClientCreated{Client: client, Secret: secret}), nil
+}
+
+// Get gets a client
+// @Summary Get an OpenID Connect client
+// @Description Get a client of the organization, its secret is never returned
+// @ID client-get
+// @Tags oidc-client
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param client path string true "Client ID"
+// @Success 200 {object} generic.Response
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 404 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /organization/{org}/oidc-client/{client} [get]
+func (s ClientService) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	var (
+		r      = req.(*RequestClientGet)
+		client model.Client
+		filter = map[string]any{
+			"uuid":     r.ClientParam,
+			"org_uuid": r.OrgParam,
+		}
+	)
+	if _, err := s.repo.WithContext(ctx).Get(&client, filter); err != nil {
+		return nil, err
+	}
+	return generic.NewResponse(200, nil, client), nil
+}
+
+// List lists clients
+// @Summary List OpenID Connect clients
+// @Description List the clients of the organization
+// @ID clients-get
+// @Tags oidc-client
+// @Security ApiKeyAuth
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
+// @Success 200 {object} generic.Response
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /organization/{org}/oidc-client [get]
+func (s ClientService) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
+	var (
+		r       = req.(*RequestClientList)
+		clients []model.Client
+	)
+	filter["org_uuid"] = r.OrgParam
+	total, err := s.repo.WithContext(ctx).Count(&clients, filter)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.WithContext(ctx).List(&clients, filter, opts); err != nil {
+		return nil, err
+	}
+	return generic.NewListResponse(200, clients, total, opts), nil
+}
+
+// Update updates a client
+// @Summary Update an OpenID Connect client
+// @Description Rename a client or replace its redirect URIs
+// @ID client-update
+// @Tags oidc-client
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param org path string true "Organization ID"
+// @Param client path string true "Client ID"
+// @Param payload body PayloadClientUpdate true "Client data"
+// @Success 200 {object} generic.Response
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 404 {object} generic.Response
+// @Failure 422 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /organization/{org}/oidc-client/{client} [patch]
+func (s ClientService) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
+	r := req.(*RequestClientUpdate)
+	if r.RedirectURIs != nil {
+		if err := checkRedirectURIs(r.RedirectURIs); err != nil {
+			return nil, err
+		}
+	}
+	var client model.Client
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Get(&client, map[string]any{"uuid": r.ClientParam, "org_uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if r.Name != nil {
+			client.Name = *r.Name
+		}
+		if len(r.RedirectURIs) > 0 {
+			client.RedirectURIs = r.RedirectURIs
+		}
+		_, err := tx.Update(&client)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return generic.NewResponse(200, nil, client), nil
+}
+
+// Delete deletes a client
+// @Summary Delete an OpenID Connect client
+// @Description Delete a client, it can no longer sign users in nor exchange its codes
+// @ID client-delete
+// @Tags oidc-client
+// @Security ApiKeyAuth
+// @Param org path string true "Organization ID"
+// @Param client path string true "Client ID"
+// @Success 204
+// @Failure 400 {object} generic.Response
+// @Failure 401 {object} generic.Response
+// @Failure 403 {object} generic.Response
+// @Failure 404 {object} generic.Response
+// @Failure 500 {object} generic.Response
+// @Router /organization/{org}/oidc-client/{client} [delete]
+func (s ClientService) Delete(ctx context.Context, req generic.IRequest) error {
+	r := req.(*RequestClientDelete)
+	n, err := s.repo.WithContext(ctx).Delete(&model.Client{}, map[string]any{"uuid": r.ClientParam, "org_uuid": r.OrgParam})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return xerr.NotFound("client not found")
+	}
+	return nil
+}
+
+// checkRedirectURIs returns a validation error listing the redirect URIs which are not absolute or hold a fragment
+func checkRedirectURIs(uris []string) error {
+	details := []string{}
+	for i, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			details = append(details, fmt.Sprintf("redirect_uris.%d: must be an absolute URI without fragment", i))
+		}
+	}
+	if len(details) > 0 {
+		return xerr.Validation("validation failed", details...)
+	}
+	return nil
+}
+
+// ClientService is the service interface
+var _ generic.IService = new(ClientService)
+var _ generic.IFilterable = new(ClientService)
+var _ generic.ISortable = new(ClientService)
+var _ generic.IAuthorized = new(ClientService)
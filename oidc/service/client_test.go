@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"ekolo/oidc/model"
+	"ekolo/pkg/assert"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestClientService(t *testing.T) {
+	var (
+		ctx = context.Background()
+		svc = NewClientService(storage.NewMemoryStore())
+		org = uuid.New()
+	)
+
+	_, err := svc.Create(ctx, &RequestClientCreate{OrgParam: org, PayloadClient: PayloadClient{Name: "library", RedirectURIs: []string{"https://library.ekolo.io/callback#top"}}})
+	assert.Assert(t, errors.Is(err, xerr.ErrValidation), true)
+
+	// Confidential clients get a secret once, only its hash is stored
+	resp, err := svc.Create(ctx, &RequestClientCreate{OrgParam: org, PayloadClient: PayloadClient{Name: "library", RedirectURIs: []string{"https://library.ekolo.io/callback"}}})
+	assert.Assert(t, err, nil)
+	created := resp.(generic.Response).Data.(ClientCreated)
+	assert.Assert(t, created.Secret != "", true)
+	assert.Assert(t, *created.SecretHash, token.Hash(created.Secret))
+
+	resp, err = svc.Create(ctx, &RequestClientCreate{OrgParam: org, PayloadClient: PayloadClient{Name: "timetable", Public: true, RedirectURIs: []string{"https://timetable.ekolo.io/"}}})
+	assert.Assert(t, err, nil)
+	public := resp.(generic.Response).Data.(ClientCreated)
+	assert.Assert(t, public.Secret, "")
+	assert.Assert(t, public.SecretHash == nil, true)
+
+	resp, err = svc.List(ctx, &RequestClientList{OrgParam: org}, map[string]any{}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(resp.(generic.Response).Data.([]model.Client)), 2)
+
+	// Clients are not reachable through another organization
+	other := uuid.New()
+	_, err = svc.Get(ctx, &RequestClientGet{OrgParam: other, ClientParam: created.UUID})
+	assert.Assert(t, errors.Is(err, storage.ErrNotFound), true)
+	err = svc.Delete(ctx, &RequestClientDelete{OrgParam: other, ClientParam: created.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	name := "books"
+	resp, err = svc.Update(ctx, &RequestClientUpdate{OrgParam: org, ClientParam: created.UUID, PayloadClientUpdate: PayloadClientUpdate{Name: &name, RedirectURIs: []string{"https://books.ekolo.io/cb"}}})
+	assert.Assert(t, err, nil)
+	updated := resp.(generic.Response).Data.(model.Client)
+	assert.Assert(t, updated.Name, "books")
+	assert.Assert(t, updated.RedirectURIs, []string{"https://books.ekolo.io/cb"})
+	assert.Assert(t, *updated.SecretHash, *created.SecretHash)
+
+	assert.Assert(t, svc.Delete(ctx, &RequestClientDelete{OrgParam: org, ClientParam: created.UUID}), nil)
+	_, err = svc.Get(ctx, &RequestClientGet{OrgParam: org, ClientParam: created.UUID})
+	assert.Assert(t, errors.Is(err, storage.ErrNotFound), true)
+}
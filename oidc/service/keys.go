@@ -0,0 +1,70 @@
+package service
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// SigningAlg is the algorithm signing the tokens of the provider
+const SigningAlg = "RS256"
+
+// JSONWebKey is the public part of an RSA signing key, as published to clients
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JSONWebKeySet lists the keys clients verify tokens with
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// newJSONWebKey returns the public JWK of key, its id is its RFC 7638 thumbprint
+func newJSONWebKey(key *rsa.PublicKey) JSONWebKey {
+	jwk := JSONWebKey{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: SigningAlg,
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+	// The members of the thumbprint input are required and ordered lexicographically
+	thumbprint, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{jwk.Exponent, jwk.KeyType, jwk.Modulus})
+	sum := sha256.Sum256(thumbprint)
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return jwk
+}
+
+// ParsePrivateKey returns the RSA key of a PEM block, in PKCS #1 or PKCS #8 form
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return key, nil
+}
@@ -0,0 +1,638 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	accountModel "ekolo/account/model"
+	account "ekolo/account/service"
+	"ekolo/oidc/model"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Paths of the endpoints of the provider, relative to its issuer
+const (
+	DiscoveryPath = "/.well-known/openid-configuration"
+	AuthorizePath = "/oidc/authorize"
+	TokenPath     = "/oidc/token"
+	UserInfoPath  = "/oidc/userinfo"
+	JWKSPath      = "/oidc/jwks"
+)
+
+const (
+	DefaultCodeTTL  = time.Minute
+	DefaultTokenTTL = 15 * time.Minute
+
+	// accessTokenType is the type of the header of access tokens, telling them apart from ID tokens
+	accessTokenType = "at+jwt"
+)
+
+// Scopes a client may request, unknown ones are ignored
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OAuth 2.0 error codes
+const (
+	ErrCodeInvalidRequest       = "invalid_request"
+	ErrCodeInvalidClient        = "invalid_client"
+	ErrCodeInvalidGrant         = "invalid_grant"
+	ErrCodeInvalidScope         = "invalid_scope"
+	ErrCodeInvalidToken         = "invalid_token"
+	ErrCodeAccessDenied         = "access_denied"
+	ErrCodeUnsupportedGrantType = "unsupported_grant_type"
+	ErrCodeUnsupportedResponse  = "unsupported_response_type"
+)
+
+// Error is an OAuth 2.0 error, rendered as such so that standard clients understand it.
+// It unwraps to an application error of the matching kind.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	kind        xerr.Kind
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func (e *Error) Unwrap() error {
+	return xerr.New(e.kind, e.Description)
+}
+
+// Status returns the HTTP status code of the error
+func (e *Error) Status() int {
+	return e.kind.Status()
+}
+
+func newError(kind xerr.Kind, code, description string) *Error {
+	return &Error{Code: code, Description: description, kind: kind}
+}
+
+// Options configures the provider
+type Options struct {
+	Issuer   string          // URL of the provider, named by every token it issues.
+	LoginURL string          // Page of the web application where users log in and authorize clients, it is sent the authorization request.
+	Key      *rsa.PrivateKey // Signs the tokens, a random key is generated when nil.
+	CodeTTL  time.Duration
+	TokenTTL time.Duration // Lifetime of access and ID tokens.
+}
+
+// Provider is an OpenID Connect provider signing the users of the account module into the clients of their organization
+type Provider struct {
+	repo storage.Storer
+	opts Options
+	jwk  JSONWebKey
+	now  func() time.Time
+}
+
+// NewProvider returns a new provider, zero options are replaced by their default.
+// Clients, codes and users are looked up across organizations so repo must not be scoped to one.
+func NewProvider(repo storage.Storer, opts Options) (*Provider, error) {
+	if opts.Key == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		opts.Key = key
+	}
+	if opts.CodeTTL == 0 {
+		opts.CodeTTL = DefaultCodeTTL
+	}
+	if opts.TokenTTL == 0 {
+		opts.TokenTTL = DefaultTokenTTL
+	}
+	opts.Issuer = strings.TrimSuffix(opts.Issuer, "/")
+	return &Provider{
+		repo: repo,
+		opts: opts,
+		jwk:  newJSONWebKey(&opts.Key.PublicKey),
+		now:  time.Now,
+	}, nil
+}
+
+// Configuration is the discovery document of the provider
+type Configuration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// RequestAuthorize is an authorization request, sent as the query of the authorization endpoint
+type RequestAuthorize struct {
+	ResponseType        string `query:"response_type" json:"response_type"`
+	ClientID            string `query:"client_id" json:"client_id"`
+	RedirectURI         string `query:"redirect_uri" json:"redirect_uri"`
+	Scope               string `query:"scope" json:"scope"`
+	State               string `query:"state" json:"state"`
+	Nonce               string `query:"nonce" json:"nonce"`
+	CodeChallenge       string `query:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" json:"code_challenge_method"`
+}
+
+// RequestToken is a token request, sent as a form to the token endpoint.
+// Confidential clients authenticate with HTTP basic authentication or with their credentials in the form.
+type RequestToken struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+// TokenResponse is the response of a successful token request
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// Profile holds the claims describing a user, depending on the granted scopes
+type Profile struct {
+	Email         string    `json:"email,omitempty"`
+	EmailVerified *bool     `json:"email_verified,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	GivenName     string    `json:"given_name,omitempty"`
+	FamilyName    string    `json:"family_name,omitempty"`
+	Birthdate     string    `json:"birthdate,omitempty"`
+	Org           uuid.UUID `json:"org"`
+	Type          string    `json:"type,omitempty"` // Name of the role of the user in the organization.
+}
+
+// UserInfo is the response of the userinfo endpoint
+type UserInfo struct {
+	Subject string `json:"sub"`
+	Profile
+}
+
+// IDClaims are the claims of an ID token
+type IDClaims struct {
+	jwt.RegisteredClaims
+	Profile
+	Nonce    string `json:"nonce,omitempty"`
+	AuthTime int64  `json:"auth_time"`
+}
+
+// AccessClaims are the claims of an access token, they only grant access to the userinfo endpoint
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+}
+
+// Discovery returns the discovery document of the provider
+func (p Provider) Discovery() Configuration {
+	return Configuration{
+		Issuer:                            p.opts.Issuer,
+		AuthorizationEndpoint:             p.opts.Issuer + AuthorizePath,
+		TokenEndpoint:                     p.opts.Issuer + TokenPath,
+		UserInfoEndpoint:                  p.opts.Issuer + UserInfoPath,
+		JWKSURI:                           p.opts.Issuer + JWKSPath,
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{SigningAlg},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"email", "email_verified", "name", "given_name", "family_name", "birthdate", "org", "type",
+		},
+	}
+}
+
+// JWKS returns the keys verifying the tokens of the provider
+func (p Provider) JWKS() JSONWebKeySet {
+	return JSONWebKeySet{Keys: []JSONWebKey{p.jwk}}
+}
+
+// Authorize checks an authorization request and returns where to send the browser: the login page of the web application,
+// or the redirect URI of the client with an error. Requests naming an unknown client or redirect URI fail with an error
+// since they can not be redirected.
+func (p Provider) Authorize(ctx context.Context, req RequestAuthorize) (string, error) {
+	if _, err := p.getClient(ctx, req); err != nil {
+		return "", err
+	}
+	if err := checkAuthorize(req); err != nil {
+		return redirectError(req, err), nil
+	}
+	return p.opts.LoginURL + "?" + req.query().Encode(), nil
+}
+
+// Grant issues an authorization code to the client for the authenticated user and returns the redirect URI of the client holding it.
+// Users can only sign into the clients of their organization, once they meet its verification and two-factor policies.
+func (p Provider) Grant(ctx context.Context, req RequestAuthorize) (string, error) {
+	pr, ok := principal.FromContext(ctx)
+	if !ok {
+		return "", xerr.ErrUnauthenticated
+	}
+	if pr.APIKey != uuid.Nil {
+		return "", xerr.Forbidden("API keys can not sign into clients")
+	}
+	if pr.Impersonated() {
+		return "", principal.ErrImpersonated
+	}
+	client, err := p.getClient(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAuthorize(req); err != nil {
+		return redirectError(req, err), nil
+	}
+	if client.OrgUUID != pr.OrgUUID {
+		return redirectError(req, newError(xerr.KindForbidden, ErrCodeAccessDenied, "the client belongs to another organization")), nil
+	}
+	user, member, err := p.getMember(ctx, pr.UserUUID, pr.OrgUUID)
+	if err != nil {
+		return "", err
+	}
+	if err := account.RequireVerified(p.repo.WithContext(ctx), user, member.OrgUUID); err != nil {
+		return "", err
+	}
+	required, err := account.RequireTwoFactor(p.repo.WithContext(ctx), member)
+	if err != nil {
+		return "", err
+	}
+	if required && !pr.TwoFactor {
+		return "", account.ErrTwoFactorRequired
+	}
+	plain, hash, err := token.New()
+	if err != nil {
+		return "", err
+	}
+	now := p.now()
+	code := model.AuthCode{
+		CodeHash:      hash,
+		ClientUUID:    client.UUID,
+		UserUUID:      user.UUID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(parseScope(req.Scope), " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      now,
+		ExpiresAt:     now.Add(p.opts.CodeTTL),
+	}
+	if _, err := p.repo.WithContext(ctx).Create(&code); err != nil {
+		return "", err
+	}
+	query := url.Values{"code": {plain}}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	return appendQuery(req.RedirectURI, query), nil
+}
+
+// Token exchanges an authorization code for an access token and an ID token.
+// The code can only be exchanged once, by the client it was issued to and with the verifier of its PKCE challenge.
+func (p Provider) Token(ctx context.Context, req RequestToken) (*TokenResponse, error) {
+	if req.GrantType != "authorization_code" {
+		return nil, newError(xerr.KindInvalid, ErrCodeUnsupportedGrantType, "only the authorization_code grant is supported")
+	}
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, newError(xerr.KindInvalid, ErrCodeInvalidRequest, "code and code_verifier are required")
+	}
+	client, err := p.authenticateClient(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	var code model.AuthCode
+	err = p.repo.WithTx(ctx, func(tx storage.Storer) error {
+		_, err := tx.Get(&code, map[string]any{"code_hash": token.Hash(req.Code)})
+		if errors.Is(err, storage.ErrNotFound) {
+			return newError(xerr.KindInvalid, ErrCodeInvalidGrant, "invalid authorization code")
+		}
+		if err != nil {
+			return err
+		}
+		now := p.now()
+		reused := func() error {
+			xlog.Warn("authorization-code-reuse", "client", client.UUID, "user", code.UserUUID)
+			return newError(xerr.KindInvalid, ErrCodeInvalidGrant, "authorization code already used")
+		}
+		switch {
+		case code.UsedAt != nil:
+			return reused()
+		case !now.Before(code.ExpiresAt):
+			return newError(xerr.KindInvalid, ErrCodeInvalidGrant, "authorization code expired")
+		case code.ClientUUID != client.UUID:
+			return newError(xerr.KindInvalid, ErrCodeInvalidGrant, "authorization code issued to another client")
+		case code.RedirectURI != req.RedirectURI:
+			return newError(xerr.KindInvalid, ErrCodeInvalidGrant, "redirect_uri does not match the authorization request")
+		case !verifyChallenge(code.CodeChallenge, req.CodeVerifier):
+			return newError(xerr.KindInvalid, ErrCodeInvalidGrant, "code_verifier does not match the code_challenge")
+		}
+		// The code is used only if no concurrent exchange used it first
+		n, err := tx.UpdateWhere(&model.AuthCode{BaseModel: storage.BaseModel{UUID: code.UUID}, UsedAt: &now}, map[string]any{"used_at__isnull": true})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return reused()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user, member, err := p.getMember(ctx, code.UserUUID, client.OrgUUID)
+	if errors.Is(err, xerr.ErrUnauthenticated) {
+		return nil, newError(xerr.KindInvalid, ErrCodeInvalidGrant, "the user no longer belongs to the organization")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.issue(client, user, member, code)
+}
+
+// UserInfo returns the claims of the user of an access token, as far as its scopes allow
+func (p Provider) UserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(accessToken, claims, func(t *jwt.Token) (any, error) {
+		if t.Header["typ"] != accessTokenType {
+			return nil, errors.New("not an access token")
+		}
+		return &p.opts.Key.PublicKey, nil
+	},
+		jwt.WithValidMethods([]string{SigningAlg}),
+		jwt.WithIssuer(p.opts.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(p.now),
+	)
+	invalid := newError(xerr.KindUnauthenticated, ErrCodeInvalidToken, "invalid or expired access token")
+	if err != nil {
+		return nil, invalid
+	}
+	scopes := strings.Fields(claims.Scope)
+	if !slices.Contains(scopes, ScopeOpenID) {
+		return nil, newError(xerr.KindForbidden, "insufficient_scope", "the openid scope is required")
+	}
+	userUUID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, invalid
+	}
+	clientUUID, err := uuid.Parse(claims.ClientID)
+	if err != nil {
+		return nil, invalid
+	}
+	// The claims are the ones of the user within the organization of the client
+	var client model.Client
+	_, err = p.repo.WithContext(ctx).Get(&client, map[string]any{"uuid": clientUUID})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, member, err := p.getMember(ctx, userUUID, client.OrgUUID)
+	if errors.Is(err, xerr.ErrUnauthenticated) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &UserInfo{Subject: user.UUID.String(), Profile: newProfile(user, member, scopes)}, nil
+}
+
+// issue signs the tokens of a code
+func (p Provider) issue(client model.Client, user accountModel.User, member accountModel.Membership, code model.AuthCode) (*TokenResponse, error) {
+	now := p.now()
+	registered := jwt.RegisteredClaims{
+		Issuer:    p.opts.Issuer,
+		Subject:   user.UUID.String(),
+		Audience:  jwt.ClaimStrings{client.UUID.String()},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(p.opts.TokenTTL)),
+	}
+	id := IDClaims{
+		RegisteredClaims: registered,
+		Profile:          newProfile(user, member, strings.Fields(code.Scope)),
+		Nonce:            code.Nonce,
+		AuthTime:         code.AuthTime.Unix(),
+	}
+	idToken, err := p.sign(id, "JWT")
+	if err != nil {
+		return nil, err
+	}
+	registered.ID = uuid.NewString()
+	accessToken, err := p.sign(AccessClaims{RegisteredClaims: registered, Scope: code.Scope, ClientID: client.UUID.String()}, accessTokenType)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(p.opts.TokenTTL.Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	}, nil
+}
+
+// sign signs claims with the key of the provider, typ is the type of the header
+func (p Provider) sign(claims jwt.Claims, typ string) (string, error) {
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["typ"] = typ
+	t.Header["kid"] = p.jwk.KeyID
+	return t.SignedString(p.opts.Key)
+}
+
+// getClient returns the client of an authorization request, checking that the redirect URI is one of its own
+func (p Provider) getClient(ctx context.Context, req RequestAuthorize) (model.Client, error) {
+	var client model.Client
+	id, err := uuid.Parse(req.ClientID)
+	if err != nil {
+		return client, newError(xerr.KindInvalid, ErrCodeInvalidClient, "unknown client_id")
+	}
+	_, err = p.repo.WithContext(ctx).Get(&client, map[string]any{"uuid": id})
+	if errors.Is(err, storage.ErrNotFound) {
+		return client, newError(xerr.KindInvalid, ErrCodeInvalidClient, "unknown client_id")
+	}
+	if err != nil {
+		return client, err
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return client, newError(xerr.KindInvalid, ErrCodeInvalidRequest, "redirect_uri is not registered for the client")
+	}
+	return client, nil
+}
+
+// authenticateClient returns the client of a token request, confidential clients must present their secret
+func (p Provider) authenticateClient(ctx context.Context, id, secret string) (model.Client, error) {
+	var client model.Client
+	invalid := newError(xerr.KindUnauthenticated, ErrCodeInvalidClient, "client authentication failed")
+	clientUUID, err := uuid.Parse(id)
+	if err != nil {
+		return client, invalid
+	}
+	_, err = p.repo.WithContext(ctx).Get(&client, map[string]any{"uuid": clientUUID})
+	if errors.Is(err, storage.ErrNotFound) {
+		return client, invalid
+	}
+	if err != nil {
+		return client, err
+	}
+	if client.Public {
+		return client, nil
+	}
+	if client.SecretHash == nil || subtle.ConstantTimeCompare([]byte(token.Hash(secret)), []byte(*client.SecretHash)) != 1 {
+		return client, invalid
+	}
+	return client, nil
+}
+
+// getMember returns a user along with their membership of an organization,
+// an unauthenticated error tells that they no longer belong to it or were deactivated
+func (p Provider) getMember(ctx context.Context, id, org uuid.UUID) (accountModel.User, accountModel.Membership, error) {
+	var (
+		user   accountModel.User
+		member accountModel.Membership
+	)
+	_, err := p.repo.WithContext(ctx).Get(&member, map[string]any{"user_uuid": id, "org_uuid": org})
+	if err == nil {
+		_, err = p.repo.WithContext(ctx).Get(&user, map[string]any{"uuid": id})
+	}
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && !member.IsActive()) {
+		return user, member, xerr.ErrUnauthenticated
+	}
+	return user, member, err
+}
+
+// checkAuthorize checks the parameters of an authorization request once its client and redirect URI are known
+func checkAuthorize(req RequestAuthorize) error {
+	switch {
+	case req.ResponseType != "code":
+		return newError(xerr.KindInvalid, ErrCodeUnsupportedResponse, "only the code response type is supported")
+	case !slices.Contains(strings.Fields(req.Scope), ScopeOpenID):
+		return newError(xerr.KindInvalid, ErrCodeInvalidScope, "the openid scope is required")
+	case req.CodeChallengeMethod != "S256":
+		return newError(xerr.KindInvalid, ErrCodeInvalidRequest, "a S256 code_challenge is required")
+	case len(req.CodeChallenge) != base64.RawURLEncoding.EncodedLen(sha256.Size):
+		return newError(xerr.KindInvalid, ErrCodeInvalidRequest, "code_challenge must be a base64url encoded SHA-256")
+	}
+	return nil
+}
+
+// verifyChallenge reports whether verifier answers the S256 challenge
+func verifyChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// parseScope returns the known scopes of a scope parameter, in order and without duplicates
+func parseScope(scope string) []string {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if (s == ScopeOpenID || s == ScopeProfile || s == ScopeEmail) && !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// newProfile returns the claims of a user and their membership the scopes grant
+func newProfile(user accountModel.User, member accountModel.Membership, scopes []string) Profile {
+	profile := Profile{Org: member.OrgUUID}
+	if member.Type != nil {
+		profile.Type = *member.Type
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		verified := user.VerifiedAt != nil
+		profile.Email, profile.EmailVerified = user.Email, &verified
+	}
+	if slices.Contains(scopes, ScopeProfile) {
+		if user.FirstName != nil {
+			profile.GivenName = *user.FirstName
+		}
+		if user.LastName != nil {
+			profile.FamilyName = *user.LastName
+		}
+		profile.Name = strings.TrimSpace(profile.GivenName + " " + profile.FamilyName)
+		if user.BirthDate != nil {
+			profile.Birthdate = *user.BirthDate
+		}
+	}
+	return profile
+}
+
+// query returns the parameters of an authorization request
+func (r RequestAuthorize) query() url.Values {
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"response_type":         r.ResponseType,
+		"client_id":             r.ClientID,
+		"redirect_uri":          r.RedirectURI,
+		"scope":                 r.Scope,
+		"state":                 r.State,
+		"nonce":                 r.Nonce,
+		"code_challenge":        r.CodeChallenge,
+		"code_challenge_method": r.CodeChallengeMethod,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+// redirectError returns the redirect URI of a request holding an error, along with the state of the request
+func redirectError(req RequestAuthorize, err error) string {
+	var oerr *Error
+	if !errors.As(err, &oerr) {
+		oerr = newError(xerr.KindInternal, "server_error", "")
+	}
+	query := url.Values{"error": {oerr.Code}}
+	if oerr.Description != "" {
+		query.Set("error_description", oerr.Description)
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	return appendQuery(req.RedirectURI, query)
+}
+
+// appendQuery adds parameters to the query of a URI, which may already have one
+func appendQuery(uri string, query url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	for key, values := range query {
+		q[key] = values
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
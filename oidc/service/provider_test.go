@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	accountModel "ekolo/account/model"
+	"ekolo/oidc/model"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/token"
+	"ekolo/pkg/xerr"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+// testChallenge returns the S256 challenge of a verifier
+func testChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// queryOf returns a query parameter of a redirect URI
+func queryOf(t *testing.T, uri, key string) string {
+	u, err := url.Parse(uri)
+	assert.Assert(t, err, nil)
+	return u.Query().Get(key)
+}
+
+func TestProvider(t *testing.T) {
+	var (
+		store    = storage.NewMemoryStore()
+		ctx      = context.Background()
+		org      = accountModel.Organization{Name: "school"}
+		first    = "Ada"
+		last     = "Lovelace"
+		teacher  = "TEACHER"
+		verified = time.Now()
+	)
+	_, err := store.Create(&org)
+	assert.Assert(t, err, nil)
+	user := accountModel.User{Email: "ada@ekolo.io", FirstName: &first, LastName: &last, VerifiedAt: &verified}
+	_, err = store.Create(&user)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&accountModel.Membership{UserUUID: user.UUID, OrgUUID: org.UUID, Type: &teacher, Status: accountModel.MembershipActive})
+	assert.Assert(t, err, nil)
+	secret, hash, _ := token.New()
+	client := model.Client{Name: "library", SecretHash: &hash, RedirectURIs: []string{"https://library.ekolo.io/callback"}, OrgUUID: org.UUID}
+	_, err = store.Create(&client)
+	assert.Assert(t, err, nil)
+
+	p, err := NewProvider(store, Options{Issuer: "https://api.ekolo.io/", LoginURL: "https://app.ekolo.io/oidc/authorize"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, p.Discovery().TokenEndpoint, "https://api.ekolo.io/oidc/token")
+
+	req := RequestAuthorize{
+		ResponseType:        "code",
+		ClientID:            client.UUID.String(),
+		RedirectURI:         "https://library.ekolo.io/callback",
+		Scope:               "openid email profile offline_access",
+		State:               "xyz",
+		Nonce:               "n-0S6",
+		CodeChallenge:       testChallenge(testVerifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	// Requests which can not be redirected to the client fail
+	bad := req
+	bad.RedirectURI = "https://evil.io/callback"
+	_, err = p.Authorize(ctx, bad)
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+	bad = req
+	bad.ClientID = uuid.NewString()
+	_, err = p.Authorize(ctx, bad)
+	var oerr *Error
+	assert.Assert(t, errors.As(err, &oerr), true)
+	assert.Assert(t, oerr.Code, ErrCodeInvalidClient)
+
+	// Other errors are sent back to the client, PKCE is required
+	bad = req
+	bad.CodeChallengeMethod = "plain"
+	to, err := p.Authorize(ctx, bad)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, strings.HasPrefix(to, "https://library.ekolo.io/callback?"), true)
+	assert.Assert(t, queryOf(t, to, "error"), ErrCodeInvalidRequest)
+	assert.Assert(t, queryOf(t, to, "state"), "xyz")
+
+	// The browser is sent to the login page of the web application with the request
+	to, err = p.Authorize(ctx, req)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, strings.HasPrefix(to, "https://app.ekolo.io/oidc/authorize?"), true)
+	assert.Assert(t, queryOf(t, to, "code_challenge"), req.CodeChallenge)
+
+	// Codes are granted to users of the organization of the client
+	_, err = p.Grant(ctx, req)
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+	stranger := principal.NewContext(ctx, principal.Principal{UserUUID: uuid.New(), OrgUUID: uuid.New()})
+	to, err = p.Grant(stranger, req)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, queryOf(t, to, "error"), ErrCodeAccessDenied)
+	userCtx := principal.NewContext(ctx, principal.Principal{UserUUID: user.UUID, OrgUUID: org.UUID, Type: teacher, Verified: true})
+	to, err = p.Grant(userCtx, req)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, queryOf(t, to, "state"), "xyz")
+	code := queryOf(t, to, "code")
+	assert.Assert(t, code != "", true)
+
+	exchange := RequestToken{GrantType: "authorization_code", Code: code, RedirectURI: req.RedirectURI, CodeVerifier: testVerifier, ClientID: client.UUID.String(), ClientSecret: secret}
+	wrong := exchange
+	wrong.ClientSecret = "wrong"
+	_, err = p.Token(ctx, wrong)
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+	wrong = exchange
+	wrong.CodeVerifier = strings.Repeat("a", 43)
+	_, err = p.Token(ctx, wrong)
+	assert.Assert(t, errors.As(err, &oerr), true)
+	assert.Assert(t, oerr.Code, ErrCodeInvalidGrant)
+
+	tokens, err := p.Token(ctx, exchange)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, tokens.Scope, "openid email profile")
+
+	// Codes are single use
+	_, err = p.Token(ctx, exchange)
+	assert.Assert(t, errors.As(err, &oerr), true)
+	assert.Assert(t, oerr.Code, ErrCodeInvalidGrant)
+
+	// The ID token is verified with the published key
+	jwk := p.JWKS().Keys[0]
+	n, _ := base64.RawURLEncoding.DecodeString(jwk.Modulus)
+	e, _ := base64.RawURLEncoding.DecodeString(jwk.Exponent)
+	public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	claims := &IDClaims{}
+	parsed, err := jwt.ParseWithClaims(tokens.IDToken, claims, func(*jwt.Token) (any, error) { return public, nil },
+		jwt.WithIssuer("https://api.ekolo.io"), jwt.WithAudience(client.UUID.String()))
+	assert.Assert(t, err, nil)
+	assert.Assert(t, parsed.Header["kid"], jwk.KeyID)
+	assert.Assert(t, claims.Subject, user.UUID.String())
+	assert.Assert(t, claims.Nonce, "n-0S6")
+	assert.Assert(t, claims.Email, "ada@ekolo.io")
+	assert.Assert(t, claims.Name, "Ada Lovelace")
+	assert.Assert(t, claims.Org, org.UUID)
+
+	info, err := p.UserInfo(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, info.Subject, user.UUID.String())
+	assert.Assert(t, *info.EmailVerified, true)
+	assert.Assert(t, info.Type, teacher)
+
+	// ID tokens are not access tokens, and access tokens expire
+	_, err = p.UserInfo(ctx, tokens.IDToken)
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+	p.now = func() time.Time { return time.Now().Add(DefaultTokenTTL) }
+	_, err = p.UserInfo(ctx, tokens.AccessToken)
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+
+	// A single one of concurrent exchanges of a code succeeds
+	p.now = time.Now
+	to, err = p.Grant(userCtx, req)
+	assert.Assert(t, err, nil)
+	exchange.Code = queryOf(t, to, "code")
+	var (
+		wg        sync.WaitGroup
+		exchanged atomic.Int32
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Token(ctx, exchange); err == nil {
+				exchanged.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Assert(t, exchanged.Load(), int32(1))
+
+	// Codes expire
+	to, err = p.Grant(userCtx, req)
+	assert.Assert(t, err, nil)
+	exchange.Code = queryOf(t, to, "code")
+	p.now = func() time.Time { return time.Now().Add(DefaultCodeTTL) }
+	_, err = p.Token(ctx, exchange)
+	assert.Assert(t, errors.As(err, &oerr), true)
+	assert.Assert(t, oerr.Code, ErrCodeInvalidGrant)
+}
+
+func TestProviderPublicClient(t *testing.T) {
+	var (
+		store = storage.NewMemoryStore()
+		ctx   = context.Background()
+		user  = accountModel.User{Email: "ada@ekolo.io"}
+	)
+	_, err := store.Create(&user)
+	assert.Assert(t, err, nil)
+	// The user belongs to another organization as well, tokens are about the one of the client
+	member := accountModel.Membership{UserUUID: user.UUID, OrgUUID: uuid.New(), Status: accountModel.MembershipActive}
+	_, err = store.Create(&member)
+	assert.Assert(t, err, nil)
+	_, err = store.Create(&accountModel.Membership{UserUUID: user.UUID, OrgUUID: uuid.New(), Status: accountModel.MembershipActive})
+	assert.Assert(t, err, nil)
+	client := model.Client{Name: "timetable", Public: true, RedirectURIs: []string{"https://timetable.ekolo.io/"}, OrgUUID: member.OrgUUID}
+	_, err = store.Create(&client)
+	assert.Assert(t, err, nil)
+	p, err := NewProvider(store, Options{Issuer: "https://api.ekolo.io"})
+	assert.Assert(t, err, nil)
+
+	req := RequestAuthorize{ResponseType: "code", ClientID: client.UUID.String(), RedirectURI: "https://timetable.ekolo.io/", Scope: "openid", CodeChallenge: testChallenge(testVerifier), CodeChallengeMethod: "S256"}
+	to, err := p.Grant(principal.NewContext(ctx, principal.Principal{UserUUID: user.UUID, OrgUUID: member.OrgUUID}), req)
+	assert.Assert(t, err, nil)
+
+	// Public clients have no secret, the verifier proves they requested the code
+	tokens, err := p.Token(ctx, RequestToken{GrantType: "authorization_code", Code: queryOf(t, to, "code"), RedirectURI: req.RedirectURI, CodeVerifier: testVerifier, ClientID: client.UUID.String()})
+	assert.Assert(t, err, nil)
+	info, err := p.UserInfo(ctx, tokens.AccessToken)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, info.Email, "")
+	assert.Assert(t, info.Org, member.OrgUUID)
+
+	// Users who left the organization of the client are no longer known to it
+	_, err = store.Delete(&accountModel.Membership{}, map[string]any{"uuid": member.UUID})
+	assert.Assert(t, err, nil)
+	_, err = p.UserInfo(ctx, tokens.AccessToken)
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+
+	_, err = p.Token(ctx, RequestToken{GrantType: "password"})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+}
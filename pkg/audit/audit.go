@@ -0,0 +1,83 @@
+// Package audit records security relevant events, like failed logins or account lockouts.
+package audit
+
+import (
+	"context"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/xlog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	LoginSucceeded  = "login.succeeded"
+	LoginFailed     = "login.failed"
+	LoginThrottled  = "login.throttled" // A login was refused because of previous failures.
+	AccountLocked   = "account.locked"
+	AccountUnlocked = "account.unlocked"
+
+	ImpersonationStarted = "impersonation.started" // A platform administrator started acting as the user.
+	ImpersonationEnded   = "impersonation.ended"
+)
+
+// Event is something which happened to an account
+type Event struct {
+	Type         string            `json:"type"`
+	At           time.Time         `json:"at"`
+	Actor        uuid.UUID         `json:"actor"`        // Authenticated user who caused the event, if any.
+	Impersonator uuid.UUID         `json:"impersonator"` // Platform administrator acting as the actor, if any.
+	User         uuid.UUID         `json:"user"`         // User the event is about, if known.
+	Org          uuid.UUID         `json:"org"`
+	IP           string            `json:"ip,omitempty"`
+	Detail       map[string]string `json:"detail,omitempty"`
+}
+
+// Recorder records audit events, failures to record must not prevent the audited action
+type Recorder interface {
+	Record(ctx context.Context, e Event)
+}
+
+// NewEvent returns an event of the given type whose actor is the principal of ctx, if any
+func NewEvent(ctx context.Context, typ string) Event {
+	e := Event{Type: typ, At: time.Now()}
+	if p, ok := principal.FromContext(ctx); ok {
+		e.Actor, e.Impersonator, e.Org = p.UserUUID, p.Impersonator, p.OrgUUID
+	}
+	return e
+}
+
+// LogRecorder writes events to the log
+type LogRecorder struct{}
+
+func (LogRecorder) Record(ctx context.Context, e Event) {
+	xlog.Info("audit", "event", e)
+}
+
+// MemoryRecorder keeps events in memory, it is meant for tests
+type MemoryRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *MemoryRecorder) Record(ctx context.Context, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// Events returns the recorded events of the given types, or all of them when none is given
+func (r *MemoryRecorder) Events(types ...string) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := []Event{}
+	for _, e := range r.events {
+		if len(types) == 0 || slices.Contains(types, e.Type) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
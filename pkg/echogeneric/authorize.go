@@ -0,0 +1,64 @@
+package generic
+
+import (
+	"context"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// TenantParam is the path parameter holding the organization a resource belongs to
+const TenantParam = "org"
+
+// IAuthorized can be implemented by services to require permissions on their operations.
+type IAuthorized interface {
+	GetPermissions(op string) []rbac.Permission // Get the permissions required to run an operation, none makes it public.
+}
+
+// IAuthorizer decides whether the caller of a request is granted permissions within an organization.
+type IAuthorizer interface {
+	Authorize(ctx context.Context, org uuid.UUID, permissions ...rbac.Permission) error
+}
+
+// authorize is a route middleware denying requests whose caller lacks the permissions the service requires for op.
+// It runs after the path parameters are parsed since the organization is read from them.
+func (s GenericServiceHandler) authorize(op string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			svc, ok := s.svc.(IAuthorized)
+			if !ok {
+				return next(ctx)
+			}
+			permissions := svc.GetPermissions(op)
+			if len(permissions) == 0 {
+				return next(ctx)
+			}
+			if s.authorizer == nil {
+				xlog.Error("authorize", "err", "no authorizer mounted", "service", s.svc.GetName())
+				return RenderError(ctx, xerr.Forbidden("forbidden"))
+			}
+			org, _ := uuid.Parse(ctx.Param(TenantParam))
+			if err := s.authorizer.Authorize(ctx.Request().Context(), org, permissions...); err != nil {
+				return RenderError(ctx, err)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// RequirePermissions returns a middleware denying requests whose caller lacks the permissions,
+// for routes which are not mounted with MountService.
+func RequirePermissions(authorizer IAuthorizer, permissions ...rbac.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			org, _ := uuid.Parse(ctx.Param(TenantParam))
+			if err := authorizer.Authorize(ctx.Request().Context(), org, permissions...); err != nil {
+				return RenderError(ctx, err)
+			}
+			return next(ctx)
+		}
+	}
+}
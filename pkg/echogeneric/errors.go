@@ -0,0 +1,80 @@
+package generic
+
+import (
+	"ekolo/pkg/xerr"
+	"ekolo/pkg/xlog"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEProblemJSON = "application/problem+json"
+
+// Problem is an RFC 7807 problem details document
+type Problem struct {
+	Type     string   `json:"type"`
+	Title    string   `json:"title"`
+	Status   int      `json:"status"`
+	Detail   string   `json:"detail,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// describe returns the status code, message and field level details of an error.
+// The cause of internal errors is logged and never sent to the client.
+func describe(err error) (int, string, []string) {
+	var (
+		he *echo.HTTPError
+		e  *xerr.Error
+	)
+	switch {
+	case errors.As(err, &he):
+		return he.Code, fmt.Sprint(he.Message), nil
+	case errors.As(err, &e) && e.Kind != xerr.KindInternal:
+		return e.Kind.Status(), e.Error(), e.Details
+	default:
+		xlog.Error("internal-error", "err", err)
+		return http.StatusInternalServerError, xerr.ErrInternal.Message, nil
+	}
+}
+
+// RenderError writes err as a Response, or as a problem document when the client accepts application/problem+json
+func RenderError(ctx echo.Context, err error) error {
+	status, message, details := describe(err)
+	var e *xerr.Error
+	if errors.As(err, &e) && e.RetryAfter > 0 {
+		ctx.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	if strings.Contains(ctx.Request().Header.Get(echo.HeaderAccept), MIMEProblemJSON) {
+		problem := Problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(status),
+			Status:   status,
+			Detail:   message,
+			Instance: ctx.Request().URL.Path,
+			Errors:   details,
+		}
+		// JSON keeps a content type which is already set
+		ctx.Response().Header().Set(echo.HeaderContentType, MIMEProblemJSON)
+		return ctx.JSON(status, problem)
+	}
+	if len(details) == 0 {
+		details = []string{message}
+	}
+	return ctx.JSON(status, NewResponse(status, details, nil))
+}
+
+// ErrorHandler is an echo.HTTPErrorHandler rendering errors the way generic handlers do
+func ErrorHandler(err error, ctx echo.Context) {
+	if ctx.Response().Committed {
+		return
+	}
+	if err := RenderError(ctx, err); err != nil {
+		xlog.Error("render-error", "err", err)
+	}
+}
@@ -2,10 +2,11 @@ package generic
 
 import (
 	"context"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
 	"ekolo/pkg/xlog"
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/labstack/echo/v4"
 )
@@ -30,9 +31,10 @@ type IResponse interface {
 
 // Response is the response object for the service
 type Response struct {
-	Status int      `json:"status"`
-	Errors []string `json:"errors"`
-	Data   any      `json:"data"`
+	Status     int         `json:"status"`
+	Errors     []string    `json:"errors"`
+	Data       any         `json:"data"`
+	Pagination *Pagination `json:"pagination,omitempty"`
 }
 
 func (r Response) GetStatusCode() int { return r.Status }
@@ -48,20 +50,52 @@ func NewResponse(status int, errors []string, data any) Response {
 
 // Service is an interface representing a generic service with CRUD operations.
 type IService interface {
-	GetName() string                                                   // Get the service name.
-	GetPathParams() []string                                           // Get path parameters
-	GetRequest(string) IRequest                                        // Get an instance of the request object.
-	Create(context.Context, IRequest) (IResponse, error)               // Create a resource.
-	Get(context.Context, IRequest) (IResponse, error)                  // Get a resource.
-	List(context.Context, IRequest, map[string]any) (IResponse, error) // Get list of resource
-	Update(context.Context, IRequest) (IResponse, error)               // Update a resource.
-	Delete(context.Context, IRequest) error                            // Delete a resource.
+	GetName() string                                                                        // Get the service name.
+	GetPathParams() []PathParam                                                             // Get path parameters, parents first
+	GetRequest(string) IRequest                                                             // Get an instance of the request object.
+	Create(context.Context, IRequest) (IResponse, error)                                    // Create a resource.
+	Get(context.Context, IRequest) (IResponse, error)                                       // Get a resource.
+	List(context.Context, IRequest, map[string]any, storage.ListOptions) (IResponse, error) // Get a page of resources
+	Update(context.Context, IRequest) (IResponse, error)                                    // Update a resource.
+	Delete(context.Context, IRequest) error                                                 // Delete a resource.
+}
+
+// IFilterable can be implemented by services to allow filtering list results.
+type IFilterable interface {
+	GetFilters() storage.Filters // Get the filterable fields and their operators.
+}
+
+// getFilters returns the filters declared by a service, none by default
+func getFilters(svc IService) storage.Filters {
+	if f, ok := svc.(IFilterable); ok {
+		return f.GetFilters()
+	}
+	return storage.Filters{}
 }
 
 // GenericServiceHandler is a handler for generic service operations.
 type GenericServiceHandler struct {
-	svc IService
-	e   *echo.Echo
+	svc        IService
+	e          *echo.Echo
+	mw         []echo.MiddlewareFunc
+	authorizer IAuthorizer
+}
+
+// MountOption configures a GenericServiceHandler mounted by MountService.
+type MountOption func(*GenericServiceHandler)
+
+// WithMiddleware runs the middlewares on every route of the service, before the path parameters are parsed.
+func WithMiddleware(mw ...echo.MiddlewareFunc) MountOption {
+	return func(h *GenericServiceHandler) {
+		h.mw = append(h.mw, mw...)
+	}
+}
+
+// WithAuthorizer checks the permissions declared by an IAuthorized service with the authorizer.
+func WithAuthorizer(authorizer IAuthorizer) MountOption {
+	return func(h *GenericServiceHandler) {
+		h.authorizer = authorizer
+	}
 }
 
 // Create is a handler for the create operation.
@@ -74,12 +108,15 @@ func (s GenericServiceHandler) Create(context context.Context) echo.HandlerFunc
 		// Try to bind payload.
 		if err = ctx.Bind(req); err != nil {
 			xlog.Error("create-bind-error", "err", err)
-			return ctx.JSON(http.StatusInternalServerError, err.Error())
+			return RenderError(ctx, err)
+		}
+		if errs := Validate(req); errs != nil {
+			return RenderError(ctx, xerr.Validation("validation failed", errs...))
 		}
 		// Let the target service process the request.
-		resp, err := s.svc.Create(context, req)
+		resp, err := s.svc.Create(ctx.Request().Context(), req)
 		if err != nil {
-			return ctx.JSON(resp.GetStatusCode(), resp)
+			return RenderError(ctx, err)
 		}
 		return ctx.JSON(resp.GetStatusCode(), resp)
 	}
@@ -91,11 +128,14 @@ func (s GenericServiceHandler) Get(ctx context.Context) echo.HandlerFunc {
 		req := s.svc.GetRequest(OpGet)
 		if err := ctx.Bind(req); err != nil {
 			xlog.Error("get-bind-error", "err", err)
-			return ctx.JSON(http.StatusInternalServerError, err.Error())
+			return RenderError(ctx, err)
+		}
+		if errs := Validate(req); errs != nil {
+			return RenderError(ctx, xerr.Validation("validation failed", errs...))
 		}
 		resp, err := s.svc.Get(ctx.Request().Context(), req)
 		if err != nil {
-			return ctx.JSON(resp.GetStatusCode(), resp)
+			return RenderError(ctx, err)
 		}
 		return ctx.JSON(resp.GetStatusCode(), resp)
 	}
@@ -107,15 +147,25 @@ func (s GenericServiceHandler) List(ctx context.Context) echo.HandlerFunc {
 		req := s.svc.GetRequest(OpList)
 		if err := ctx.Bind(req); err != nil {
 			xlog.Error("list-bind-error", "err", err)
-			return ctx.JSON(http.StatusInternalServerError, err.Error())
+			return RenderError(ctx, err)
+		}
+		if errs := Validate(req); errs != nil {
+			return RenderError(ctx, xerr.Validation("validation failed", errs...))
 		}
 		filter := map[string]any{}
 		if err := (&echo.DefaultBinder{}).BindQueryParams(ctx, &filter); err != nil {
-			return ctx.JSON(http.StatusBadRequest, err.Error())
+			return RenderError(ctx, err)
+		}
+		opts, err := parsePage(s.svc, filter)
+		if err != nil {
+			return RenderError(ctx, xerr.Wrap(xerr.KindInvalid, err, ""))
+		}
+		if err := getFilters(s.svc).Validate(filter); err != nil {
+			return RenderError(ctx, xerr.Wrap(xerr.KindInvalid, err, ""))
 		}
-		resp, err := s.svc.List(ctx.Request().Context(), req, filter)
+		resp, err := s.svc.List(ctx.Request().Context(), req, filter, opts)
 		if err != nil {
-			return ctx.JSON(resp.GetStatusCode(), resp)
+			return RenderError(ctx, err)
 		}
 
 		return ctx.JSON(resp.GetStatusCode(), resp)
@@ -130,11 +180,14 @@ func (s GenericServiceHandler) Update(ctx context.Context) echo.HandlerFunc {
 		// Try to bind payload.
 		if err = ctx.Bind(req); err != nil {
 			xlog.Error("updated-bind-error", "err", err)
-			return ctx.JSON(http.StatusBadRequest, err.Error())
+			return RenderError(ctx, err)
+		}
+		if errs := Validate(req); errs != nil {
+			return RenderError(ctx, xerr.Validation("validation failed", errs...))
 		}
 		resp, err := s.svc.Update(ctx.Request().Context(), req)
 		if err != nil {
-			return ctx.JSON(resp.GetStatusCode(), resp)
+			return RenderError(ctx, err)
 		}
 		return ctx.JSON(resp.GetStatusCode(), resp)
 	}
@@ -146,32 +199,42 @@ func (s GenericServiceHandler) Delete(ctx context.Context) echo.HandlerFunc {
 		req := s.svc.GetRequest(OpDelete)
 		if err := ctx.Bind(req); err != nil {
 			xlog.Error("delete-bind-error", "err", err)
-			return ctx.JSON(http.StatusBadRequest, err.Error())
+			return RenderError(ctx, err)
+		}
+		if errs := Validate(req); errs != nil {
+			return RenderError(ctx, xerr.Validation("validation failed", errs...))
 		}
 		if err := s.svc.Delete(ctx.Request().Context(), req); err != nil {
-			return ctx.JSON(http.StatusInternalServerError, nil)
+			return RenderError(ctx, err)
 		}
-		return ctx.JSON(http.StatusNoContent, nil)
+		return ctx.NoContent(http.StatusNoContent)
 	}
 }
 
 // GetPathParamName returns the path parameter name used for routing.
 func (s GenericServiceHandler) GetPathParamName() string {
-	params := []string{""}
-	params = append(params, s.svc.GetPathParams()...)
-	return strings.Join(params, "/:")
+	return "/:" + resourceParam(s.svc).Name
 }
 
 // MountService creates and mounts a GenericServiceHandler for the provided service on the given Echo instance.
-func MountService(e *echo.Echo, svc IService) {
+func MountService(e *echo.Echo, svc IService, opts ...MountOption) {
 	ctx := context.Background()
 	h := GenericServiceHandler{svc: svc, e: e}
+	for _, opt := range opts {
+		opt(&h)
+	}
 	g := h.e.Group(svc.GetName())
 	paramPath := h.GetPathParamName()
-	param := svc.GetPathParams()[0]
-	g.POST("", h.Create(ctx)).Name = fmt.Sprintf("%s-create", param)
-	g.GET("", h.List(ctx)).Name = fmt.Sprintf("%s-list", param)
-	g.GET(paramPath, h.Get(ctx)).Name = fmt.Sprintf("%s-get", param)
-	g.PATCH(paramPath, h.Update(ctx)).Name = fmt.Sprintf("%s-update", param)
-	g.DELETE(paramPath, h.Delete(ctx)).Name = fmt.Sprintf("%s-delete", param)
+	param := resourceParam(svc).Name
+	g.POST("", h.Create(ctx), h.middlewares(OpCreate)...).Name = fmt.Sprintf("%s-create", param)
+	g.GET("", h.List(ctx), h.middlewares(OpList)...).Name = fmt.Sprintf("%s-list", param)
+	g.GET(paramPath, h.Get(ctx), h.middlewares(OpGet)...).Name = fmt.Sprintf("%s-get", param)
+	g.PATCH(paramPath, h.Update(ctx), h.middlewares(OpUpdate)...).Name = fmt.Sprintf("%s-update", param)
+	g.DELETE(paramPath, h.Delete(ctx), h.middlewares(OpDelete)...).Name = fmt.Sprintf("%s-delete", param)
+}
+
+// middlewares returns the route middlewares of an operation: the mounted ones, then path parameters parsing and authorization.
+func (s GenericServiceHandler) middlewares(op string) []echo.MiddlewareFunc {
+	mw := append([]echo.MiddlewareFunc{}, s.mw...)
+	return append(mw, s.parsePathParams, s.authorize(op))
 }
@@ -0,0 +1,255 @@
+package generic
+
+import (
+	"context"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/rbac"
+	"ekolo/pkg/storage"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type item struct {
+	storage.BaseModel
+	Name string `json:"name" validate:"required"`
+}
+
+type itemRequest struct {
+	item
+	ItemParam uuid.UUID `param:"item" json:"-"`
+}
+
+func (r itemRequest) GetID() string { return "item" }
+
+type itemParams struct {
+	ItemParam uuid.UUID `param:"item" json:"-"`
+}
+
+func (r itemParams) GetID() string { return "item" }
+
+// itemService is a minimal IService backed by a MemoryStore
+type itemService struct {
+	repo storage.Storer
+}
+
+func (s itemService) GetName() string            { return "item" }
+func (s itemService) GetPathParams() []PathParam { return []PathParam{UUIDParam("item")} }
+func (s itemService) GetRequest(op string) IRequest {
+	if op == OpCreate || op == OpUpdate {
+		return &itemRequest{}
+	}
+	return &itemParams{}
+}
+func (s itemService) GetFilters() storage.Filters            { return storage.Filters{"name": {storage.OpEq}} }
+func (s itemService) Delete(context.Context, IRequest) error { return nil }
+func (s itemService) GetSortFields() []string                { return []string{"name"} }
+func (s itemService) GetDefaultSort() []string               { return []string{"-name"} }
+
+func (s itemService) Create(ctx context.Context, req IRequest) (IResponse, error) {
+	r := req.(*itemRequest)
+	if _, err := s.repo.Create(&r.item); err != nil {
+		return nil, err
+	}
+	return NewResponse(201, nil, r.item), nil
+}
+
+func (s itemService) Get(ctx context.Context, req IRequest) (IResponse, error) {
+	var i item
+	if _, err := s.repo.Get(&i, map[string]any{"uuid": req.(*itemParams).ItemParam}); err != nil {
+		return nil, err
+	}
+	return NewResponse(200, nil, i), nil
+}
+
+func (s itemService) List(ctx context.Context, req IRequest, filter map[string]any, opts storage.ListOptions) (IResponse, error) {
+	var items []item
+	total, err := s.repo.Count(&items, filter)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.List(&items, filter, opts); err != nil {
+		return nil, err
+	}
+	return NewListResponse(200, items, total, opts), nil
+}
+
+func (s itemService) Update(ctx context.Context, req IRequest) (IResponse, error) {
+	return nil, errors.New("connection refused")
+}
+
+func newTestServer(t *testing.T) *echo.Echo {
+	e := echo.New()
+	MountService(e, itemService{repo: storage.NewMemoryStore()})
+	return e
+}
+
+func doRequest(e *echo.Echo, method, target, body string, headers ...string) (*httptest.ResponseRecorder, Response) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var resp Response
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec, resp
+}
+
+func TestHandlerValidation(t *testing.T) {
+	e := newTestServer(t)
+	rec, resp := doRequest(e, http.MethodPost, "/item", `{"name":""}`)
+	assert.Assert(t, rec.Code, 422)
+	assert.Assert(t, resp.Errors, []string{"name: is required"})
+}
+
+func TestHandlerErrors(t *testing.T) {
+	e := newTestServer(t)
+	rec, resp := doRequest(e, http.MethodGet, "/item/"+uuid.NewString(), "")
+	assert.Assert(t, rec.Code, 404)
+	assert.Assert(t, resp.Status, 404)
+	assert.Assert(t, resp.Errors, []string{"resource not found: record not found"})
+
+	rec, _ = doRequest(e, http.MethodGet, "/item/"+uuid.NewString(), "", echo.HeaderAccept, MIMEProblemJSON)
+	assert.Assert(t, rec.Code, 404)
+	assert.Assert(t, rec.Header().Get(echo.HeaderContentType), MIMEProblemJSON)
+	var problem Problem
+	json.Unmarshal(rec.Body.Bytes(), &problem)
+	assert.Assert(t, problem.Status, 404)
+	assert.Assert(t, problem.Title, "Not Found")
+
+	rec, resp = doRequest(e, http.MethodPatch, "/item/"+uuid.NewString(), `{"name":"a"}`)
+	assert.Assert(t, rec.Code, 500)
+	assert.Assert(t, resp.Errors, []string{"internal error"})
+
+	rec, resp = doRequest(e, http.MethodDelete, "/item/42", "")
+	assert.Assert(t, rec.Code, 400)
+	assert.Assert(t, resp.Errors, []string{"invalid path parameter item: must be a valid UUID"})
+
+	rec, resp = doRequest(e, http.MethodPost, "/item", `{"name":`)
+	assert.Assert(t, rec.Code, 400)
+	assert.Assert(t, resp.Status, 400)
+}
+
+func TestHandlerList(t *testing.T) {
+	e := newTestServer(t)
+	for _, name := range []string{"a", "b", "c"} {
+		rec, _ := doRequest(e, http.MethodPost, "/item", `{"name":"`+name+`"}`)
+		assert.Assert(t, rec.Code, 201)
+	}
+
+	rec, resp := doRequest(e, http.MethodGet, "/item?limit=2", "")
+	assert.Assert(t, rec.Code, 200)
+	assert.Assert(t, len(resp.Data.([]any)), 2)
+	assert.Assert(t, resp.Pagination.Total, int64(3))
+
+	rec, resp = doRequest(e, http.MethodGet, "/item?cursor="+resp.Pagination.Next, "")
+	assert.Assert(t, rec.Code, 200)
+	assert.Assert(t, len(resp.Data.([]any)), 1)
+
+	assert.Assert(t, resp.Data.([]any)[0].(map[string]any)["name"], "a")
+
+	rec, resp = doRequest(e, http.MethodGet, "/item?sort=name&limit=1", "")
+	assert.Assert(t, rec.Code, 200)
+	assert.Assert(t, resp.Data.([]any)[0].(map[string]any)["name"], "a")
+
+	rec, _ = doRequest(e, http.MethodGet, "/item?sort=-uuid", "")
+	assert.Assert(t, rec.Code, 400)
+
+	rec, resp = doRequest(e, http.MethodGet, "/item?name=b", "")
+	assert.Assert(t, rec.Code, 200)
+	assert.Assert(t, resp.Pagination.Total, int64(1))
+
+	rec, _ = doRequest(e, http.MethodGet, "/item?name__icontains=b", "")
+	assert.Assert(t, rec.Code, 400)
+
+	rec, _ = doRequest(e, http.MethodGet, "/item?password=x", "")
+	assert.Assert(t, rec.Code, 400)
+}
+
+// childService is an itemService nested under a parent resource
+type childService struct{ itemService }
+
+func (s childService) GetName() string { return "parent/:parent/child" }
+func (s childService) GetPathParams() []PathParam {
+	return []PathParam{UUIDParam("parent"), {Name: "child", Type: ParamInt}}
+}
+
+func TestPathParams(t *testing.T) {
+	assert.Assert(t, resourceParam(childService{}).Name, "child")
+
+	e := echo.New()
+	MountService(e, childService{})
+	rec, resp := doRequest(e, http.MethodGet, "/parent/x/child/1", "")
+	assert.Assert(t, rec.Code, 400)
+	assert.Assert(t, resp.Errors, []string{"invalid path parameter parent: must be a valid UUID"})
+
+	rec, resp = doRequest(e, http.MethodGet, "/parent/"+uuid.NewString()+"/child/one", "")
+	assert.Assert(t, rec.Code, 400)
+	assert.Assert(t, resp.Errors, []string{"invalid path parameter child: must be an integer"})
+}
+
+// tenantService is an itemService belonging to organizations and requiring permissions
+type tenantService struct{ itemService }
+
+func (s tenantService) GetName() string { return "org/:org/item" }
+func (s tenantService) GetPathParams() []PathParam {
+	return []PathParam{UUIDParam("org"), UUIDParam("item")}
+}
+func (s tenantService) GetPermissions(op string) []rbac.Permission {
+	if op == OpList || op == OpGet {
+		return []rbac.Permission{"item:read"}
+	}
+	return []rbac.Permission{"item:write"}
+}
+
+func TestHandlerAuthorize(t *testing.T) {
+	var (
+		e   = echo.New()
+		org = uuid.New()
+		// The principal is read from a header in place of an authentication middleware
+		authenticate = func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				if role := c.Request().Header.Get("X-Role"); role != "" {
+					p := principal.Principal{UserUUID: uuid.New(), OrgUUID: org, Type: role}
+					c.SetRequest(c.Request().WithContext(principal.NewContext(c.Request().Context(), p)))
+				}
+				return next(c)
+			}
+		}
+		authorizer = rbac.NewAuthorizer(rbac.Roles{"READER": {"item:read"}, "WRITER": {"item:*"}})
+	)
+	MountService(e, tenantService{itemService{repo: storage.NewMemoryStore()}}, WithMiddleware(authenticate), WithAuthorizer(authorizer))
+
+	rec, _ := doRequest(e, http.MethodGet, "/org/"+org.String()+"/item", "")
+	assert.Assert(t, rec.Code, 401)
+
+	rec, _ = doRequest(e, http.MethodGet, "/org/"+org.String()+"/item", "", "X-Role", "READER")
+	assert.Assert(t, rec.Code, 200)
+
+	rec, resp := doRequest(e, http.MethodPost, "/org/"+org.String()+"/item", `{"name":"a"}`, "X-Role", "READER")
+	assert.Assert(t, rec.Code, 403)
+	assert.Assert(t, resp.Errors, []string{"missing permission item:write"})
+
+	rec, _ = doRequest(e, http.MethodPost, "/org/"+uuid.NewString()+"/item", `{"name":"a"}`, "X-Role", "WRITER")
+	assert.Assert(t, rec.Code, 403)
+
+	rec, _ = doRequest(e, http.MethodPost, "/org/"+org.String()+"/item", `{"name":"a"}`, "X-Role", "WRITER")
+	assert.Assert(t, rec.Code, 201)
+
+	// Services requiring permissions are denied when no authorizer is mounted
+	e = echo.New()
+	MountService(e, tenantService{itemService{repo: storage.NewMemoryStore()}}, WithMiddleware(authenticate))
+	rec, _ = doRequest(e, http.MethodGet, "/org/"+org.String()+"/item", "", "X-Role", "READER")
+	assert.Assert(t, rec.Code, 403)
+}
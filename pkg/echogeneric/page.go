@@ -0,0 +1,198 @@
+package generic
+
+import (
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xlog"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+
+	queryLimit  = "limit"
+	queryOffset = "offset"
+	queryCursor = "cursor"
+	querySort   = "sort"
+)
+
+var (
+	ErrInvalidPage = errors.New("invalid pagination parameters")
+	ErrInvalidSort = errors.New("invalid sort")
+)
+
+// IPaginated can be implemented by services to change their page sizes.
+type IPaginated interface {
+	GetPageSize() (int, int) // Get the default and maximum page size.
+}
+
+// ISortable can be implemented by services to allow ordering list results.
+type ISortable interface {
+	GetSortFields() []string  // Get the fields list results can be ordered by.
+	GetDefaultSort() []string // Get the order used when none is requested.
+}
+
+// Pagination describes the page of a list response
+type Pagination struct {
+	Total  int64  `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Next   string `json:"next,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+// NewListResponse returns a response holding a page of data out of total items.
+// data is the slice of rows listed with opts, the cursors of the next and previous pages point at its last and first rows.
+func NewListResponse(status int, data any, total int64, opts storage.ListOptions) Response {
+	page := &Pagination{
+		Total:  total,
+		Limit:  opts.Limit,
+		Offset: opts.Offset,
+	}
+	rows := reflect.ValueOf(data)
+	if opts.Limit > 0 && rows.Kind() == reflect.Slice && rows.Len() > 0 {
+		n := rows.Len()
+		// A page before a cursor is followed by the row of the cursor, a page after one is preceded by it
+		var next, prev bool
+		switch {
+		case opts.Before != "":
+			next, prev = true, n == opts.Limit
+		case opts.After != "":
+			next, prev = n == opts.Limit, true
+		default:
+			next, prev = int64(opts.Offset+n) < total, opts.Offset > 0
+		}
+		if next {
+			page.Next = encodeCursor(rows.Index(n-1), opts.Sort, false)
+		}
+		if prev {
+			page.Prev = encodeCursor(rows.Index(0), opts.Sort, true)
+		}
+	}
+	resp := NewResponse(status, nil, data)
+	resp.Pagination = page
+	return resp
+}
+
+// cursor points at a row of list results, pages start right after it or end right before it.
+// It keeps the order of the results, the sort key of the row is only meaningful within it.
+type cursor struct {
+	Sort   []string `json:"s,omitempty"`
+	After  string   `json:"a,omitempty"`
+	Before string   `json:"b,omitempty"`
+}
+
+// encodeCursor returns an opaque cursor pointing at a row of results ordered by sort, or an empty one if the row has no sort key
+func encodeCursor(row reflect.Value, sort []string, before bool) string {
+	key, err := storage.SortKey(row.Addr().Interface(), sort)
+	if err != nil {
+		xlog.Error("page-cursor", "err", err)
+		return ""
+	}
+	c := cursor{Sort: sort, After: key}
+	if before {
+		c = cursor{Sort: sort, Before: key}
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the cursor held by a value
+func decodeCursor(value string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, ErrInvalidPage
+	}
+	if err := json.Unmarshal(b, &c); err != nil || (c.After == "") == (c.Before == "") {
+		return c, ErrInvalidPage
+	}
+	return c, nil
+}
+
+// getPageSize returns the default and maximum page size of a service
+func getPageSize(svc IService) (int, int) {
+	if p, ok := svc.(IPaginated); ok {
+		return p.GetPageSize()
+	}
+	return DefaultPageSize, MaxPageSize
+}
+
+// parsePage extracts pagination parameters from the query filter.
+// A cursor takes precedence over the offset and the limit is capped to the service's maximum page size.
+func parsePage(svc IService, filter map[string]any) (storage.ListOptions, error) {
+	defaultSize, maxSize := getPageSize(svc)
+	opts := storage.ListOptions{Limit: defaultSize}
+	params := map[string]string{}
+	for _, key := range []string{queryLimit, queryOffset, queryCursor, querySort} {
+		if v, ok := filter[key]; ok {
+			s, _ := v.(string)
+			params[key] = s
+			delete(filter, key)
+		}
+	}
+	if v, ok := params[queryLimit]; ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return opts, ErrInvalidPage
+		}
+		opts.Limit = min(limit, maxSize)
+	}
+	if v, ok := params[queryOffset]; ok {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return opts, ErrInvalidPage
+		}
+		opts.Offset = offset
+	}
+	sort := params[querySort]
+	if v, ok := params[queryCursor]; ok {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return opts, err
+		}
+		// Cursors keep the order of the results they point in
+		if sort != "" && sort != strings.Join(c.Sort, ",") {
+			return opts, ErrInvalidPage
+		}
+		sort = strings.Join(c.Sort, ",")
+		opts.Offset, opts.After, opts.Before = 0, c.After, c.Before
+	}
+	sorted, err := parseSort(svc, sort)
+	if err != nil {
+		return opts, err
+	}
+	opts.Sort = sorted
+	return opts, nil
+}
+
+// parseSort returns the comma separated sort fields after checking the service allows them
+func parseSort(svc IService, value string) ([]string, error) {
+	s, ok := svc.(ISortable)
+	if !ok {
+		if value != "" {
+			return nil, fmt.Errorf("%w: results can not be ordered", ErrInvalidSort)
+		}
+		return nil, nil
+	}
+	if value == "" || value == strings.Join(s.GetDefaultSort(), ",") {
+		return s.GetDefaultSort(), nil
+	}
+	allowed := map[string]bool{}
+	for _, field := range s.GetSortFields() {
+		allowed[field] = true
+	}
+	sort := strings.Split(value, ",")
+	for _, field := range sort {
+		if name, _ := storage.ParseSortField(field); !allowed[name] {
+			return nil, fmt.Errorf("%w: can not order by %q", ErrInvalidSort, name)
+		}
+	}
+	return sort, nil
+}
@@ -0,0 +1,95 @@
+package generic
+
+import (
+	"ekolo/pkg/assert"
+	"ekolo/pkg/storage"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type pagedService struct{ IService }
+
+func (p pagedService) GetPageSize() (int, int) { return 5, 10 }
+
+// pagedRow is a model listed by the pagination tests
+type pagedRow struct {
+	storage.BaseModel
+	Name string
+}
+
+func TestParsePage(t *testing.T) {
+	svc := pagedService{}
+
+	opts, err := parsePage(svc, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, opts, storage.ListOptions{Limit: 5})
+
+	filter := map[string]any{"limit": "50", "offset": "3", "name": "x"}
+	opts, err = parsePage(svc, filter)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, opts, storage.ListOptions{Limit: 10, Offset: 3})
+	assert.Assert(t, filter, map[string]any{"name": "x"})
+
+	// Cursors point at a row rather than an offset
+	row := pagedRow{BaseModel: storage.BaseModel{UUID: uuid.New()}}
+	key, err := storage.SortKey(&row, nil)
+	assert.Assert(t, err, nil)
+	opts, err = parsePage(svc, map[string]any{"offset": "3", "cursor": encodeCursor(reflect.ValueOf(&row).Elem(), nil, false)})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, opts, storage.ListOptions{Limit: 5, After: key})
+	opts, err = parsePage(svc, map[string]any{"cursor": encodeCursor(reflect.ValueOf(&row).Elem(), nil, true)})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, opts, storage.ListOptions{Limit: 5, Before: key})
+
+	_, err = parsePage(svc, map[string]any{"sort": "name"})
+	assert.Assert(t, errors.Is(err, ErrInvalidSort), true)
+
+	for _, filter := range []map[string]any{
+		{"limit": "0"},
+		{"limit": "x"},
+		{"offset": "-1"},
+		{"cursor": "not-a-cursor"},
+		{"cursor": base64.RawURLEncoding.EncodeToString([]byte("{}"))},
+		{"cursor": encodeCursor(reflect.ValueOf(&row).Elem(), nil, false), "sort": "name"},
+	} {
+		_, err = parsePage(svc, filter)
+		assert.Assert(t, err, ErrInvalidPage)
+	}
+}
+
+func TestNewListResponse(t *testing.T) {
+	rows := []pagedRow{{Name: "a"}, {Name: "b"}}
+	for i := range rows {
+		rows[i].UUID = uuid.New()
+	}
+	first, err := storage.SortKey(&rows[0], []string{"name"})
+	assert.Assert(t, err, nil)
+	last, err := storage.SortKey(&rows[1], []string{"name"})
+	assert.Assert(t, err, nil)
+
+	resp := NewListResponse(200, rows, 7, storage.ListOptions{Limit: 2, Offset: 2, Sort: []string{"name"}})
+	assert.Assert(t, resp.Pagination.Total, int64(7))
+
+	// The next page starts after the last row and the previous one ends before the first row, in the same order
+	next, err := decodeCursor(resp.Pagination.Next)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, next, cursor{Sort: []string{"name"}, After: last})
+	prev, err := decodeCursor(resp.Pagination.Prev)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, prev, cursor{Sort: []string{"name"}, Before: first})
+
+	resp = NewListResponse(200, rows[:1], 7, storage.ListOptions{Limit: 2, Offset: 6})
+	assert.Assert(t, resp.Pagination.Next, "")
+
+	// Pages seeking a cursor are followed, or preceded, by its row
+	resp = NewListResponse(200, rows[:1], 7, storage.ListOptions{Limit: 2, After: last})
+	assert.Assert(t, resp.Pagination.Next, "")
+	assert.Assert(t, resp.Pagination.Prev != "", true)
+	resp = NewListResponse(200, rows[:1], 7, storage.ListOptions{Limit: 2, Before: first})
+	assert.Assert(t, resp.Pagination.Next != "", true)
+	assert.Assert(t, resp.Pagination.Prev, "")
+}
@@ -0,0 +1,80 @@
+package generic
+
+import (
+	"ekolo/pkg/xerr"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// ParamType is the type a path parameter value must parse to
+type ParamType string
+
+const (
+	ParamString ParamType = "string"
+	ParamUUID   ParamType = "uuid"
+	ParamInt    ParamType = "int"
+)
+
+// PathParam declares a path parameter of a service
+type PathParam struct {
+	Name string
+	Type ParamType
+}
+
+// UUIDParam returns a path parameter holding a UUID
+func UUIDParam(name string) PathParam {
+	return PathParam{Name: name, Type: ParamUUID}
+}
+
+// Parse returns the typed value of the parameter or an invalid error
+func (p PathParam) Parse(value string) (any, error) {
+	switch p.Type {
+	case ParamUUID:
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, xerr.Invalid(fmt.Sprintf("invalid path parameter %s: must be a valid UUID", p.Name))
+		}
+		return id, nil
+	case ParamInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, xerr.Invalid(fmt.Sprintf("invalid path parameter %s: must be an integer", p.Name))
+		}
+		return n, nil
+	default:
+		return value, nil
+	}
+}
+
+// resourceParam returns the parameter identifying a resource of the service,
+// parameters of parent resources are already part of the service name.
+func resourceParam(svc IService) PathParam {
+	params := svc.GetPathParams()
+	for i := len(params) - 1; i >= 0; i-- {
+		if !strings.Contains(svc.GetName()+"/", ":"+params[i].Name+"/") {
+			return params[i]
+		}
+	}
+	return params[len(params)-1]
+}
+
+// parsePathParams is a route middleware rejecting requests whose path parameters do not parse,
+// so that services can bind them to typed fields.
+func (s GenericServiceHandler) parsePathParams(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		for _, p := range s.svc.GetPathParams() {
+			value := ctx.Param(p.Name)
+			if value == "" {
+				continue
+			}
+			if _, err := p.Parse(value); err != nil {
+				return RenderError(ctx, err)
+			}
+		}
+		return next(ctx)
+	}
+}
@@ -0,0 +1,105 @@
+package generic
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// embeddedMarker prefixes the name of embedded structs so they can be left out of field paths
+const embeddedMarker = "~"
+
+var validate = newValidator()
+
+// newValidator returns a validator reporting fields by their json name and supporting the regex=<pattern> rule,
+// and the maxbytes=<n> rule which bounds the length of strings in bytes rather than characters (e.g. bcrypt passwords)
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		if f.Anonymous {
+			return embeddedMarker + f.Name
+		}
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.RegisterValidation("regex", func(fl validator.FieldLevel) bool {
+		re, err := regexp.Compile(fl.Param())
+		return err == nil && re.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("maxbytes", func(fl validator.FieldLevel) bool {
+		n, err := strconv.Atoi(fl.Param())
+		return err == nil && len(fl.Field().String()) <= n
+	})
+	return v
+}
+
+// Validate runs the validate struct tags of v and returns one message per invalid field
+func Validate(v any) []string {
+	err := validate.Struct(v)
+	if err == nil {
+		return nil
+	}
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return []string{err.Error()}
+	}
+	messages := make([]string, len(verrs))
+	for i, e := range verrs {
+		messages[i] = fmt.Sprintf("%s: %s", fieldPath(e), fieldMessage(e))
+	}
+	return messages
+}
+
+// fieldPath returns the dotted json path of the invalid field, embedded structs are flattened like encoding/json does
+func fieldPath(e validator.FieldError) string {
+	path := []string{}
+	for _, name := range strings.Split(e.Namespace(), ".")[1:] {
+		if !strings.HasPrefix(name, embeddedMarker) {
+			path = append(path, name)
+		}
+	}
+	return strings.Join(path, ".")
+}
+
+// fieldMessage returns a human readable message for a failed rule
+func fieldMessage(e validator.FieldError) string {
+	unit := ""
+	switch e.Kind() {
+	case reflect.String:
+		unit = " characters long"
+	case reflect.Slice, reflect.Map:
+		unit = " items"
+	}
+	switch e.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "uuid", "uuid4":
+		return "must be a valid UUID"
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", strings.Join(strings.Fields(e.Param()), ", "))
+	case "min":
+		return fmt.Sprintf("must be at least %s%s", e.Param(), unit)
+	case "max":
+		return fmt.Sprintf("must be at most %s%s", e.Param(), unit)
+	case "maxbytes":
+		return fmt.Sprintf("must be at most %s bytes long", e.Param())
+	case "len":
+		return fmt.Sprintf("must be exactly %s%s", e.Param(), unit)
+	case "datetime":
+		return fmt.Sprintf("must be formatted as %s", e.Param())
+	case "regex":
+		return fmt.Sprintf("must match %s", e.Param())
+	default:
+		return fmt.Sprintf("failed on the %s rule", e.Tag())
+	}
+}
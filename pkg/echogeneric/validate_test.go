@@ -0,0 +1,46 @@
+package generic
+
+import (
+	"ekolo/pkg/assert"
+	"testing"
+)
+
+type address struct {
+	City string `json:"city" validate:"required"`
+}
+
+type profile struct {
+	Email string `json:"email" validate:"required,email"`
+	Role  string `json:"role" validate:"oneof=ADMIN USER"`
+	Code  string `json:"code" validate:"regex=^[A-Z]{3}$"`
+	Org   string `json:"org" validate:"omitempty,uuid"`
+	Bio   string `json:"bio" validate:"max=5"`
+	Motto string `json:"motto" validate:"maxbytes=4"`
+}
+
+type payload struct {
+	profile
+	Address *address `json:"address"`
+}
+
+func TestValidate(t *testing.T) {
+	valid := payload{
+		profile: profile{Email: "a@ekolo.io", Role: "ADMIN", Code: "ABC", Org: "8d7ad3ac-9d5e-4bb4-9b5b-6a0b1c1c9a8e", Motto: "éà"},
+		Address: &address{City: "Paris"},
+	}
+	assert.Assert(t, Validate(valid), []string(nil))
+
+	errs := Validate(payload{
+		profile: profile{Email: "nope", Role: "ROOT", Code: "abc", Org: "42", Bio: "too long", Motto: "ébène"},
+		Address: &address{},
+	})
+	assert.Assert(t, errs, []string{
+		"email: must be a valid email address",
+		"role: must be one of: ADMIN, USER",
+		"code: must match ^[A-Z]{3}$",
+		"org: must be a valid UUID",
+		"bio: must be at most 5 characters long",
+		"motto: must be at most 4 bytes long",
+		"address.city: is required",
+	})
+}
@@ -0,0 +1,139 @@
+// Package lockout tracks failed attempts per key, like a user or an IP address,
+// and slows them down exponentially until the key is temporarily locked.
+package lockout
+
+import (
+	"context"
+	"ekolo/pkg/xerr"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultFreeAttempts = 3
+	DefaultBaseDelay    = time.Second
+	DefaultMaxDelay     = 15 * time.Minute
+	DefaultLockFor      = time.Hour
+	DefaultWindow       = 24 * time.Hour
+)
+
+// Record holds the failed attempts of a key
+type Record struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time // Zero when the key was never locked.
+}
+
+// Store keeps the records, Get returns a zero record with the key when there is none.
+// Update saves what fn makes of the record of a key atomically, fn runs again when the record changed meanwhile.
+type Store interface {
+	Get(ctx context.Context, key string) (Record, error)
+	Update(ctx context.Context, key string, fn func(Record) Record) (Record, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// UserKey returns the key of the attempts on the account of a user
+func UserKey(user uuid.UUID) string {
+	return "user:" + user.String()
+}
+
+// IPKey returns the key of the attempts from an IP address
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Options configures a limiter, zero values are replaced by their default except LockAfter
+type Options struct {
+	FreeAttempts int           // Failures allowed before any delay applies.
+	BaseDelay    time.Duration // Delay after the first failure past the free ones, doubled on each following failure.
+	MaxDelay     time.Duration
+	LockAfter    int           // Failures locking the key, zero never locks it.
+	LockFor      time.Duration // How long a key stays locked.
+	Window       time.Duration // Failures older than this are forgotten.
+}
+
+// Limiter delays and locks keys after failed attempts
+type Limiter struct {
+	store Store
+	opts  Options
+	now   func() time.Time
+}
+
+// New returns a new limiter, zero options are replaced by their default
+func New(store Store, opts Options) *Limiter {
+	if opts.FreeAttempts == 0 {
+		opts.FreeAttempts = DefaultFreeAttempts
+	}
+	if opts.BaseDelay == 0 {
+		opts.BaseDelay = DefaultBaseDelay
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = DefaultMaxDelay
+	}
+	if opts.LockFor == 0 {
+		opts.LockFor = DefaultLockFor
+	}
+	if opts.Window == 0 {
+		opts.Window = DefaultWindow
+	}
+	return &Limiter{store: store, opts: opts, now: time.Now}
+}
+
+// Allow returns a too many requests error when the key is locked or must still wait after its last failure
+func (l *Limiter) Allow(ctx context.Context, key string) error {
+	r, err := l.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	now := l.now()
+	if now.Before(r.LockedUntil) {
+		return xerr.TooManyRequests("temporarily locked after too many failed attempts", r.LockedUntil.Sub(now))
+	}
+	if next := r.LastFailure.Add(l.delay(r.Failures)); now.Before(next) {
+		return xerr.TooManyRequests("too many failed attempts, retry later", next.Sub(now))
+	}
+	return nil
+}
+
+// Fail records a failed attempt of the key and tells whether it locked the key
+func (l *Limiter) Fail(ctx context.Context, key string) (Record, bool, error) {
+	var (
+		now    = l.now()
+		locked bool
+	)
+	r, err := l.store.Update(ctx, key, func(r Record) Record {
+		if r.Failures > 0 && !now.Before(r.LastFailure.Add(l.opts.Window)) && !now.Before(r.LockedUntil) {
+			r = Record{Key: key}
+		}
+		r.Failures++
+		r.LastFailure = now
+		locked = l.opts.LockAfter > 0 && r.Failures >= l.opts.LockAfter && !now.Before(r.LockedUntil)
+		if locked {
+			r.LockedUntil = now.Add(l.opts.LockFor)
+		}
+		return r
+	})
+	return r, locked, err
+}
+
+// Reset forgets the failed attempts of the key, unlocking it
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.store.Delete(ctx, key)
+}
+
+// delay returns how long to wait after the last of n failures
+func (l *Limiter) delay(n int) time.Duration {
+	n -= l.opts.FreeAttempts
+	if n <= 0 {
+		return 0
+	}
+	d := l.opts.BaseDelay
+	for i := 1; i < n; i++ {
+		if d *= 2; d >= l.opts.MaxDelay {
+			return l.opts.MaxDelay
+		}
+	}
+	return min(d, l.opts.MaxDelay)
+}
@@ -0,0 +1,130 @@
+package lockout
+
+import (
+	"context"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// retryAfter returns the delay of a too many requests error
+func retryAfter(t *testing.T, err error) time.Duration {
+	var xe *xerr.Error
+	assert.Assert(t, errors.As(err, &xe), true)
+	assert.Assert(t, xe.Kind, xerr.KindTooManyRequests)
+	return xe.RetryAfter
+}
+
+func TestLimiter(t *testing.T) {
+	sqlStore, err := storage.NewStore(storage.DriverMemory, "")
+	assert.Assert(t, err, nil)
+	memStore := storage.NewMemoryStore()
+	for name, repo := range map[string]storage.Storer{"sql": sqlStore, "memory": memStore} {
+		assert.Assert(t, repo.(interface{ RunMigrations(...any) error }).RunMigrations(GetModels()...), nil)
+		t.Run("storage-"+name, func(t *testing.T) { testLimiter(t, NewStorageStore(repo)) })
+		t.Run("storage-"+name+"-concurrent", func(t *testing.T) { testConcurrentFailures(t, NewStorageStore(repo)) })
+	}
+	t.Run("memory", func(t *testing.T) { testLimiter(t, NewMemoryStore()) })
+	t.Run("memory-concurrent", func(t *testing.T) { testConcurrentFailures(t, NewMemoryStore()) })
+}
+
+// testConcurrentFailures checks that parallel failures are all counted
+func testConcurrentFailures(t *testing.T, store Store) {
+	var (
+		ctx = context.Background()
+		l   = New(store, Options{LockAfter: 10})
+		key = UserKey(uuid.New())
+		wg  sync.WaitGroup
+	)
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := l.Fail(ctx, key)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Assert(t, err, nil)
+	}
+	r, err := store.Get(ctx, key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, r.Failures, 20)
+	assert.Assert(t, r.LockedUntil.IsZero(), false)
+}
+
+func testLimiter(t *testing.T, store Store) {
+	var (
+		ctx = context.Background()
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		l   = New(store, Options{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 4 * time.Second, LockAfter: 6, LockFor: time.Hour, Window: 24 * time.Hour})
+		key = IPKey("10.0.0.1")
+	)
+	l.now = func() time.Time { return now }
+
+	// Free attempts are not delayed
+	for i := 0; i < 2; i++ {
+		assert.Assert(t, l.Allow(ctx, key), nil)
+		_, locked, err := l.Fail(ctx, key)
+		assert.Assert(t, err, nil)
+		assert.Assert(t, locked, false)
+	}
+	assert.Assert(t, l.Allow(ctx, key), nil)
+
+	// Then the delay doubles on each failure up to the maximum
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		_, _, err := l.Fail(ctx, key)
+		assert.Assert(t, err, nil)
+		assert.Assert(t, retryAfter(t, l.Allow(ctx, key)), want)
+		now = now.Add(want / 2)
+		assert.Assert(t, retryAfter(t, l.Allow(ctx, key)), want/2)
+		now = now.Add(want / 2)
+		assert.Assert(t, l.Allow(ctx, key), nil)
+	}
+
+	// The key is locked after enough failures, until it is reset
+	r, locked, err := l.Fail(ctx, key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, locked, true)
+	assert.Assert(t, r.Failures, 6)
+	assert.Assert(t, r.LockedUntil.Equal(now.Add(time.Hour)), true)
+	now = now.Add(time.Minute)
+	assert.Assert(t, retryAfter(t, l.Allow(ctx, key)), 59*time.Minute)
+	assert.Assert(t, l.Reset(ctx, key), nil)
+	assert.Assert(t, l.Allow(ctx, key), nil)
+	r, err = store.Get(ctx, key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, r, Record{Key: key})
+
+	// Once the lock expired another failure locks the key again
+	for i := 0; i < 6; i++ {
+		_, locked, err = l.Fail(ctx, key)
+		assert.Assert(t, err, nil)
+	}
+	assert.Assert(t, locked, true)
+	now = now.Add(time.Hour)
+	assert.Assert(t, l.Allow(ctx, key), nil)
+	_, locked, err = l.Fail(ctx, key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, locked, true)
+
+	// Failures older than the window are forgotten
+	now = now.Add(25 * time.Hour)
+	r, locked, err = l.Fail(ctx, key)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, locked, false)
+	assert.Assert(t, r.Failures, 1)
+	assert.Assert(t, l.Allow(ctx, key), nil)
+
+	// Keys are independent
+	assert.Assert(t, l.Allow(ctx, IPKey("10.0.0.2")), nil)
+}
@@ -0,0 +1,161 @@
+package lockout
+
+import (
+	"context"
+	"ekolo/pkg/storage"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps records in memory, they are lost on restart and not shared between instances
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryStore returns an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[key]; ok {
+		return r, nil
+	}
+	return Record{Key: key}, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, key string, fn func(Record) Record) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[key]
+	if !ok {
+		r = Record{Key: key}
+	}
+	r = fn(r)
+	s.records[key] = r
+	return r, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// Attempt is the stored record of a key.
+// Records are deleted rather than cleared since updates only write non zero fields.
+type Attempt struct {
+	storage.BaseModel
+	Key           string     `json:"key" gorm:"uniqueIndex:idx_attempts_unique_key,where:deleted_at IS NULL;not null"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// GetModels returns the models used by the storage store
+func GetModels() []any {
+	return []any{
+		Attempt{},
+	}
+}
+
+// StorageStore keeps records in a storage, they are shared by every instance using it
+type StorageStore struct {
+	repo storage.Storer
+}
+
+// NewStorageStore returns a store keeping records in repo, which must have migrated the models of GetModels
+func NewStorageStore(repo storage.Storer) *StorageStore {
+	return &StorageStore{repo: repo}
+}
+
+func (s *StorageStore) Get(ctx context.Context, key string) (Record, error) {
+	a, err := s.get(s.repo.WithContext(ctx), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Record{Key: key}, nil
+	}
+	return a.record(), err
+}
+
+// Update compares and swaps the record on its failure count, which every update changes.
+// Records whose lock fn clears are replaced, the concurrent creation of a record fails on the unique key.
+func (s *StorageStore) Update(ctx context.Context, key string, fn func(Record) Record) (Record, error) {
+	repo := s.repo.WithContext(ctx)
+	for {
+		current, err := s.get(repo, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			r := fn(Record{Key: key})
+			_, err = repo.Create(newAttempt(r))
+			if errors.Is(err, storage.ErrDuplicate) {
+				continue
+			}
+			return r, err
+		}
+		if err != nil {
+			return Record{}, err
+		}
+		r := fn(current.record())
+		swap := map[string]any{"uuid": current.UUID, "failures": current.Failures}
+		if r.LockedUntil.IsZero() && current.LockedUntil != nil {
+			n, err := repo.Delete(&Attempt{}, swap)
+			if err != nil {
+				return Record{}, err
+			}
+			if n == 0 {
+				continue
+			}
+			_, err = repo.Create(newAttempt(r))
+			if errors.Is(err, storage.ErrDuplicate) {
+				continue
+			}
+			return r, err
+		}
+		n, err := repo.UpdateWhere(newAttempt(r), swap)
+		if err != nil {
+			return Record{}, err
+		}
+		if n == 1 {
+			return r, nil
+		}
+	}
+}
+
+// get returns the attempt of a key
+func (s *StorageStore) get(repo storage.Storer, key string) (Attempt, error) {
+	var a Attempt
+	_, err := repo.Get(&a, map[string]any{"key": key})
+	return a, err
+}
+
+// newAttempt returns the attempt storing a record
+func newAttempt(r Record) *Attempt {
+	a := Attempt{Key: r.Key, Failures: r.Failures, LastFailureAt: r.LastFailure}
+	if !r.LockedUntil.IsZero() {
+		a.LockedUntil = &r.LockedUntil
+	}
+	return &a
+}
+
+// record returns the record an attempt stores
+func (a Attempt) record() Record {
+	r := Record{Key: a.Key, Failures: a.Failures, LastFailure: a.LastFailureAt}
+	if a.LockedUntil != nil {
+		r.LockedUntil = *a.LockedUntil
+	}
+	return r
+}
+
+func (s *StorageStore) Delete(ctx context.Context, key string) error {
+	_, err := s.repo.WithContext(ctx).Delete(&Attempt{}, map[string]any{"key": key})
+	return err
+}
+
+var (
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*StorageStore)(nil)
+)
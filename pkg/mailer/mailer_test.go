@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"ekolo/pkg/assert"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mails.txt")
+	m := NewFileMailer(path, "noreply@ekolo.io")
+
+	assert.Assert(t, m.Send(context.Background(), Message{To: "ada@ekolo.io", Subject: "Hello", Body: "first"}), nil)
+	assert.Assert(t, m.Send(context.Background(), Message{To: "bob@ekolo.io", Subject: "Hello", Body: "second"}), nil)
+	err := m.Send(context.Background(), Message{To: "ada@ekolo.io\r\nBcc: eve@ekolo.io", Subject: "Hello"})
+	assert.Assert(t, errors.Is(err, ErrInvalidHeader), true)
+
+	b, err := os.ReadFile(path)
+	assert.Assert(t, err, nil)
+	content := string(b)
+	assert.Assert(t, strings.Contains(content, "To: ada@ekolo.io\r\n"), true)
+	assert.Assert(t, strings.Contains(content, "To: bob@ekolo.io\r\n"), true)
+	assert.Assert(t, strings.Contains(content, "eve@ekolo.io"), false)
+}
+
+// smtpServer is a stand-in SMTP server accepting a single message, it sends what it received to its channel
+type smtpServer struct {
+	ln       net.Listener
+	received chan string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Assert(t, err, nil)
+	s := &smtpServer{ln: ln, received: make(chan string, 1)}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var (
+		r          = bufio.NewReader(conn)
+		transcript strings.Builder
+		reply      = func(line string) { conn.Write([]byte(line + "\r\n")) }
+	)
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		transcript.WriteString(line)
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				transcript.WriteString(line)
+			}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			s.received <- transcript.String()
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newSMTPServer(t)
+	m := SMTPMailer{Addr: server.ln.Addr().String(), From: "noreply@ekolo.io"}
+
+	err := m.Send(context.Background(), Message{To: "ada@ekolo.io", Subject: "Reset your password", Body: "Follow the link"})
+	assert.Assert(t, err, nil)
+
+	transcript := <-server.received
+	assert.Assert(t, strings.Contains(transcript, "MAIL FROM:<noreply@ekolo.io>"), true)
+	assert.Assert(t, strings.Contains(transcript, "RCPT TO:<ada@ekolo.io>"), true)
+	assert.Assert(t, strings.Contains(transcript, "Subject: Reset your password\r\n"), true)
+	assert.Assert(t, strings.Contains(transcript, "\r\n\r\nFollow the link\r\n"), true)
+}
+
+func TestSMTPMailerUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Assert(t, err, nil)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	err = SMTPMailer{Addr: addr, From: "noreply@ekolo.io"}.Send(context.Background(), Message{To: "ada@ekolo.io"})
+	assert.Assert(t, err != nil, true)
+}
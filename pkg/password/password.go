@@ -0,0 +1,169 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported algorithms
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// Default parameters, argon2id ones follow the OWASP recommendations
+const (
+	DefaultAlgorithm     = Argon2id
+	DefaultBcryptCost    = bcrypt.DefaultCost
+	DefaultArgon2Memory  = 19 * 1024 // KiB
+	DefaultArgon2Time    = 2
+	DefaultArgon2Threads = 1
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var (
+	ErrMismatch    = errors.New("password: hash and password mismatch")
+	ErrUnknownHash = errors.New("password: unknown hash format")
+)
+
+// Options configures the hashing of new passwords, zero options are replaced by their default
+type Options struct {
+	Algorithm     string // bcrypt or argon2id.
+	BcryptCost    int
+	Argon2Memory  uint32 // Memory used by argon2id in KiB.
+	Argon2Time    uint32 // Number of passes of argon2id.
+	Argon2Threads uint8
+}
+
+// Hasher hashes passwords with the configured algorithm and verifies hashes of any supported one
+type Hasher struct {
+	opts Options
+}
+
+// New returns a new hasher
+func New(opts Options) (*Hasher, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = DefaultAlgorithm
+	}
+	if opts.BcryptCost == 0 {
+		opts.BcryptCost = DefaultBcryptCost
+	}
+	if opts.Argon2Memory == 0 {
+		opts.Argon2Memory = DefaultArgon2Memory
+	}
+	if opts.Argon2Time == 0 {
+		opts.Argon2Time = DefaultArgon2Time
+	}
+	if opts.Argon2Threads == 0 {
+		opts.Argon2Threads = DefaultArgon2Threads
+	}
+	switch opts.Algorithm {
+	case Bcrypt:
+		if opts.BcryptCost < bcrypt.MinCost || opts.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("password: bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+	default:
+		return nil, fmt.Errorf("password: unknown algorithm %q", opts.Algorithm)
+	}
+	return &Hasher{opts: opts}, nil
+}
+
+// Default returns a hasher with the default options
+func Default() *Hasher {
+	h, _ := New(Options{})
+	return h
+}
+
+// Hash returns the hash of a password, it embeds the algorithm and its parameters
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.opts.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.opts.BcryptCost)
+		return string(hash), err
+	}
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	params := argon2Params{memory: h.opts.Argon2Memory, time: h.opts.Argon2Time, threads: h.opts.Argon2Threads}
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyLen)
+	return params.encode(salt, key), nil
+}
+
+// Verify checks a password against its hash, it returns ErrMismatch when they differ.
+// rehash reports whether the hash was made with another algorithm or other parameters than the configured ones.
+func (h *Hasher) Verify(hash, password string) (rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		got := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, ErrMismatch
+		}
+		current := argon2Params{memory: h.opts.Argon2Memory, time: h.opts.Argon2Time, threads: h.opts.Argon2Threads}
+		return h.opts.Algorithm != Argon2id || params != current, nil
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, ErrMismatch
+		}
+		if err != nil {
+			return false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return h.opts.Algorithm != Bcrypt || cost != h.opts.BcryptCost, err
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// encode returns the hash in the PHC string format
+func (p argon2Params) encode(salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2(hash string) (argon2Params, []byte, []byte, error) {
+	var (
+		p       argon2Params
+		version int
+	)
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	return p, salt, key, nil
+}
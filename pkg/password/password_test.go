@@ -0,0 +1,62 @@
+package password
+
+import (
+	"ekolo/pkg/assert"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(Options{Algorithm: "md5"})
+	assert.Assert(t, err != nil, true)
+	_, err = New(Options{Algorithm: Bcrypt, BcryptCost: 64})
+	assert.Assert(t, err != nil, true)
+	assert.Assert(t, Default().opts.Algorithm, Argon2id)
+}
+
+func TestHashVerify(t *testing.T) {
+	for _, opts := range []Options{
+		{Algorithm: Bcrypt, BcryptCost: 4},
+		{Algorithm: Argon2id, Argon2Memory: 64, Argon2Time: 1},
+	} {
+		h, err := New(opts)
+		assert.Assert(t, err, nil)
+		hash, err := h.Hash("s3cret")
+		assert.Assert(t, err, nil)
+		assert.Assert(t, strings.Contains(hash, "s3cret"), false)
+
+		rehash, err := h.Verify(hash, "s3cret")
+		assert.Assert(t, err, nil)
+		assert.Assert(t, rehash, false)
+		_, err = h.Verify(hash, "wrong")
+		assert.Assert(t, errors.Is(err, ErrMismatch), true)
+	}
+
+	_, err := Default().Verify("plain", "plain")
+	assert.Assert(t, errors.Is(err, ErrUnknownHash), true)
+}
+
+func TestRehash(t *testing.T) {
+	bcrypt4, _ := New(Options{Algorithm: Bcrypt, BcryptCost: 4})
+	bcrypt5, _ := New(Options{Algorithm: Bcrypt, BcryptCost: 5})
+	argon, _ := New(Options{Algorithm: Argon2id, Argon2Memory: 64, Argon2Time: 1})
+	argonSlow, _ := New(Options{Algorithm: Argon2id, Argon2Memory: 64, Argon2Time: 2})
+
+	hash, _ := bcrypt4.Hash("s3cret")
+	// Hashes of another algorithm or other parameters are still verified
+	rehash, err := bcrypt5.Verify(hash, "s3cret")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, rehash, true)
+	rehash, err = argon.Verify(hash, "s3cret")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, rehash, true)
+
+	hash, _ = argon.Hash("s3cret")
+	rehash, err = argonSlow.Verify(hash, "s3cret")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, rehash, true)
+	rehash, err = bcrypt4.Verify(hash, "s3cret")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, rehash, true)
+}
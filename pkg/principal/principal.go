@@ -0,0 +1,46 @@
+package principal
+
+import (
+	"context"
+	"ekolo/pkg/xerr"
+
+	"github.com/google/uuid"
+)
+
+type contextKey struct{}
+
+// ErrImpersonated refuses an administrator acting as a user the operations whose credentials would outlive the impersonation
+var ErrImpersonated = xerr.Forbidden("credentials can not be managed while impersonating a user")
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserUUID  uuid.UUID `json:"user"`
+	OrgUUID   uuid.UUID `json:"org"`
+	Type      string    `json:"type"`
+	Verified  bool      `json:"verified"`   // Whether the email address of the user is verified.
+	TwoFactor bool      `json:"two_factor"` // Whether the user logged in with a second factor.
+	Session   uuid.UUID `json:"session"`    // Login the access token was issued for.
+
+	// Principals authenticated by an API key have no user, they are granted the scopes of the key rather than a role
+	APIKey uuid.UUID `json:"api_key"`
+	Scopes []string  `json:"scopes,omitempty"`
+
+	// Impersonator is the platform administrator acting as the user, if any
+	Impersonator uuid.UUID `json:"impersonator"`
+}
+
+// Impersonated reports whether a platform administrator is acting as the user
+func (p Principal) Impersonated() bool {
+	return p.Impersonator != uuid.Nil
+}
+
+// NewContext returns a copy of ctx carrying the principal
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, if any
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(Principal)
+	return p, ok
+}
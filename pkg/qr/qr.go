@@ -0,0 +1,427 @@
+// Package qr encodes short texts, like otpauth URIs, into QR codes.
+// Codes use the byte mode and the M error correction level, which restore up to 15% of damaged codewords.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// MaxVersion is the largest supported version, a 57x57 code holding up to 213 bytes
+const MaxVersion = 10
+
+// QuietZone is the width in modules of the light border scanners need around a code
+const QuietZone = 4
+
+var ErrTooLong = errors.New("qr: text too long")
+
+// blocks describes the error correction blocks of a version at level M
+type blocks struct {
+	ecc           int // Error correction codewords per block.
+	count1, data1 int // Number of blocks of the first group and their data codewords.
+	count2, data2 int // Number of blocks of the second group, they hold one more data codeword.
+	alignment     []int
+}
+
+var versions = [MaxVersion + 1]blocks{
+	1:  {ecc: 10, count1: 1, data1: 16},
+	2:  {ecc: 16, count1: 1, data1: 28, alignment: []int{6, 18}},
+	3:  {ecc: 26, count1: 1, data1: 44, alignment: []int{6, 22}},
+	4:  {ecc: 18, count1: 2, data1: 32, alignment: []int{6, 26}},
+	5:  {ecc: 24, count1: 2, data1: 43, alignment: []int{6, 30}},
+	6:  {ecc: 16, count1: 4, data1: 27, alignment: []int{6, 34}},
+	7:  {ecc: 18, count1: 4, data1: 31, alignment: []int{6, 22, 38}},
+	8:  {ecc: 22, count1: 2, data1: 38, count2: 2, data2: 39, alignment: []int{6, 24, 42}},
+	9:  {ecc: 22, count1: 3, data1: 36, count2: 2, data2: 37, alignment: []int{6, 26, 46}},
+	10: {ecc: 26, count1: 4, data1: 43, count2: 1, data2: 44, alignment: []int{6, 28, 50}},
+}
+
+func (b blocks) dataCodewords() int {
+	return b.count1*b.data1 + b.count2*b.data2
+}
+
+// Code is a QR code
+type Code struct {
+	Version  int
+	Size     int // Width and height in modules, without the quiet zone.
+	modules  []bool
+	function []bool // Modules of the patterns, which hold no data and are not masked.
+}
+
+// Encode returns the smallest QR code holding text
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+	version := 1
+	for ; version <= MaxVersion; version++ {
+		if headerBits(version)+8*len(data) <= 8*versions[version].dataCodewords() {
+			break
+		}
+	}
+	if version > MaxVersion {
+		return nil, ErrTooLong
+	}
+	size := 17 + 4*version
+	c := &Code{Version: version, Size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+	c.drawFunctionPatterns()
+	c.drawCodewords(interleave(version, encodeData(version, data)))
+
+	best, penalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); penalty < 0 || p < penalty {
+			best, penalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+// Black reports whether the module at column x and row y is dark
+func (c *Code) Black(x, y int) bool {
+	return c.modules[y*c.Size+x]
+}
+
+// Image returns the code surrounded by its quiet zone, each module is scale pixels wide
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	width := (c.Size + 2*QuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.Black(x, y) {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((QuietZone+x)*scale+dx, (QuietZone+y)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// PNG returns the image of the code encoded as PNG
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.Image(scale)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// headerBits returns the size of the mode indicator and character count of the byte mode
+func headerBits(version int) int {
+	if version < 10 {
+		return 4 + 8
+	}
+	return 4 + 16
+}
+
+// encodeData returns the data codewords of a version holding data in byte mode, padded to capacity
+func encodeData(version int, data []byte) []byte {
+	var (
+		bits     []bool
+		capacity = 8 * versions[version].dataCodewords()
+	)
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4)
+	appendBits(len(data), headerBits(version)-4)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	// Terminator, then zeros up to a byte boundary
+	appendBits(0, min(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+
+	codewords := make([]byte, 0, capacity/8)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xec); len(codewords) < capacity/8; pad ^= 0xec ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// interleave splits the data codewords into blocks, computes their error correction codewords
+// and returns the final sequence: data codewords of every block column by column, then theirs.
+func interleave(version int, data []byte) []byte {
+	var (
+		b      = versions[version]
+		split  = [][]byte{}
+		ecc    = [][]byte{}
+		result = []byte{}
+	)
+	for i := 0; i < b.count1+b.count2; i++ {
+		n := b.data1
+		if i >= b.count1 {
+			n = b.data2
+		}
+		split = append(split, data[:n])
+		ecc = append(ecc, rsEncode(data[:n], b.ecc))
+		data = data[n:]
+	}
+	for i := 0; i < max(b.data1, b.data2); i++ {
+		for _, block := range split {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ecc; i++ {
+		for _, block := range ecc {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// set sets a module of a function pattern
+func (c *Code) set(x, y int, black bool) {
+	c.modules[y*c.Size+x] = black
+	c.function[y*c.Size+x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	positions := versions[c.Version].alignment
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Alignment patterns do not overlap the finders
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+	// Reserve the format areas, they are drawn once the mask is chosen
+	c.drawFormat(0)
+	c.drawVersion()
+}
+
+// drawFinder draws a finder pattern and its separator around the center x, y
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.set(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern around the center x, y
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information of level M and the mask, and the dark module
+func (c *Code) drawFormat(mask int) {
+	data := mask // The bits of level M are 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	c.set(8, c.Size-8, true)
+}
+
+// drawVersion draws both copies of the version information, codes from version 7 have them
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	rem := c.Version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1f25
+	}
+	bits := c.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		black := bits>>i&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, black)
+		c.set(b, a, black)
+	}
+}
+
+// drawCodewords places the codewords in the modules which are not part of a pattern,
+// going up and down two columns at a time from the bottom right corner.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// The vertical timing pattern is skipped
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y*c.Size+x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = codewords[i>>3]>>(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by a mask, applying it twice restores them
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.function[y*c.Size+x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to scan, the mask with the lowest score is kept
+func (c *Code) penalty() int {
+	var (
+		score int
+		dark  int
+	)
+	line := func(get func(i int) bool) {
+		run := 1
+		for i := 1; i <= c.Size; i++ {
+			if i < c.Size && get(i) == get(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				score += 3 + run - 5
+			}
+			run = 1
+		}
+		// Patterns looking like a finder: 1011101 preceded or followed by 4 light modules
+		finder := []bool{true, false, true, true, true, false, true}
+		for i := 0; i+7 <= c.Size; i++ {
+			match := true
+			for j, black := range finder {
+				if get(i+j) != black {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			before, after := true, true
+			for j := 1; j <= 4; j++ {
+				if i-j >= 0 && get(i-j) {
+					before = false
+				}
+				if i+6+j < c.Size && get(i+6+j) {
+					after = false
+				}
+			}
+			if before || after {
+				score += 40
+			}
+		}
+	}
+	for k := 0; k < c.Size; k++ {
+		line(func(i int) bool { return c.Black(i, k) })
+		line(func(i int) bool { return c.Black(k, i) })
+	}
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			black := c.Black(x, y)
+			if black {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && black == c.Black(x+1, y) && black == c.Black(x, y+1) && black == c.Black(x+1, y+1) {
+				score += 3
+			}
+		}
+	}
+	percent := dark * 100 / (c.Size * c.Size)
+	return score + 10*(abs(percent-50)/5)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,139 @@
+package qr
+
+import (
+	"bytes"
+	"ekolo/pkg/assert"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// The codewords of "HELLO WORLD" at version 1-M, as worked out in the usual QR code tutorials
+func TestRSEncode(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	assert.Assert(t, rsEncode(data, 10), []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23})
+}
+
+func TestFormatVersion(t *testing.T) {
+	c := &Code{Version: 7, Size: 45, modules: make([]bool, 45*45), function: make([]bool, 45*45)}
+	read := func(coords [][2]int) (bits int) {
+		for _, xy := range coords {
+			bits <<= 1
+			if c.Black(xy[0], xy[1]) {
+				bits |= 1
+			}
+		}
+		return bits
+	}
+
+	// Format bits of level M are 101010000010010 with mask 0 and 100000011001110 with mask 5
+	for mask, want := range map[int]int{0: 0b101010000010010, 5: 0b100000011001110} {
+		c.drawFormat(mask)
+		coords := [][2]int{}
+		for i := 14; i >= 9; i-- {
+			coords = append(coords, [2]int{14 - i, 8})
+		}
+		coords = append(coords, [2]int{7, 8}, [2]int{8, 8}, [2]int{8, 7})
+		for i := 5; i >= 0; i-- {
+			coords = append(coords, [2]int{8, i})
+		}
+		assert.Assert(t, read(coords), want)
+	}
+
+	// Version information of version 7 is 000111110010010100
+	c.drawVersion()
+	coords := [][2]int{}
+	for i := 17; i >= 0; i-- {
+		coords = append(coords, [2]int{c.Size - 11 + i%3, i / 3})
+	}
+	assert.Assert(t, read(coords), 0b000111110010010100)
+}
+
+// readCodewords reads the codewords back from a code in placement order, once unmasked
+func readCodewords(c *Code, mask int) []byte {
+	c.applyMask(mask)
+	defer c.applyMask(mask)
+	var (
+		result []byte
+		cur    byte
+		n      int
+	)
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if c.function[y*c.Size+right-j] {
+					continue
+				}
+				cur <<= 1
+				if c.Black(right-j, y) {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					result = append(result, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+	return result
+}
+
+func TestEncode(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		version int
+	}{
+		{"ekolo", 1},
+		{strings.Repeat("x", 14), 1},
+		{strings.Repeat("x", 15), 2},
+		{"otpauth://totp/ekolo:ada%40ekolo.io?algorithm=SHA1&digits=6&issuer=ekolo&period=30&secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP", 7},
+		{strings.Repeat("x", 213), 10},
+	} {
+		c, err := Encode(tc.text)
+		assert.Assert(t, err, nil)
+		assert.Assert(t, c.Version, tc.version)
+		assert.Assert(t, c.Size, 17+4*tc.version)
+
+		// The mask is the one whose format information the code holds
+		mask := -1
+		for m := 0; m < 8 && mask < 0; m++ {
+			ref := &Code{Version: c.Version, Size: c.Size, modules: make([]bool, len(c.modules)), function: make([]bool, len(c.modules))}
+			ref.drawFormat(m)
+			mask = m
+			for i, f := range ref.function {
+				if f && ref.modules[i] != c.modules[i] {
+					mask = -1
+					break
+				}
+			}
+		}
+		assert.Assert(t, mask >= 0, true)
+		want := interleave(c.Version, encodeData(c.Version, []byte(tc.text)))
+		got := readCodewords(c, mask)
+		assert.Assert(t, got[:len(want)], want)
+	}
+	_, err := Encode(strings.Repeat("x", 214))
+	assert.Assert(t, err, ErrTooLong)
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode("ekolo")
+	assert.Assert(t, err, nil)
+	b, err := c.PNG(4)
+	assert.Assert(t, err, nil)
+	img, err := png.Decode(bytes.NewReader(b))
+	assert.Assert(t, err, nil)
+	assert.Assert(t, img.Bounds().Dx(), (21+2*QuietZone)*4)
+	// The top left module of the finder is dark, the quiet zone is not
+	r, _, _, _ := img.At(QuietZone*4, QuietZone*4).RGBA()
+	assert.Assert(t, r, uint32(0))
+	r, _, _, _ = img.At(0, 0).RGBA()
+	assert.Assert(t, r, uint32(0xffff))
+}
@@ -0,0 +1,80 @@
+package rbac
+
+// Permissions checked by the services
+const (
+	OrgList   Permission = "org:list" // List every organization, not granted to organization roles.
+	OrgRead   Permission = "org:read"
+	OrgUpdate Permission = "org:update"
+	OrgDelete Permission = "org:delete"
+
+	UserCreate Permission = "user:create"
+	UserRead   Permission = "user:read"
+	UserUpdate Permission = "user:update"
+	UserDelete Permission = "user:delete"
+
+	TagCreate Permission = "tag:create"
+	TagRead   Permission = "tag:read"
+	TagUpdate Permission = "tag:update"
+	TagDelete Permission = "tag:delete"
+
+	RoleCreate Permission = "role:create"
+	RoleRead   Permission = "role:read"
+	RoleUpdate Permission = "role:update"
+	RoleDelete Permission = "role:delete"
+
+	InvitationCreate Permission = "invitation:create"
+	InvitationRead   Permission = "invitation:read"
+	InvitationUpdate Permission = "invitation:update"
+	InvitationDelete Permission = "invitation:delete"
+
+	APIKeyCreate Permission = "apikey:create"
+	APIKeyRead   Permission = "apikey:read"
+	APIKeyUpdate Permission = "apikey:update"
+	APIKeyDelete Permission = "apikey:delete"
+
+	ClientCreate Permission = "client:create"
+	ClientRead   Permission = "client:read"
+	ClientUpdate Permission = "client:update"
+	ClientDelete Permission = "client:delete"
+
+	PlatformImpersonate Permission = "platform:impersonate" // Act as any user, not granted to organization roles.
+)
+
+// GetPermissions returns every permission checked by the services
+func GetPermissions() []Permission {
+	return []Permission{
+		OrgList, OrgRead, OrgUpdate, OrgDelete,
+		UserCreate, UserRead, UserUpdate, UserDelete,
+		TagCreate, TagRead, TagUpdate, TagDelete,
+		RoleCreate, RoleRead, RoleUpdate, RoleDelete,
+		InvitationCreate, InvitationRead, InvitationUpdate, InvitationDelete,
+		APIKeyCreate, APIKeyRead, APIKeyUpdate, APIKeyDelete,
+		ClientCreate, ClientRead, ClientUpdate, ClientDelete,
+		PlatformImpersonate,
+	}
+}
+
+// GetPlatformPermissions returns the permissions of platform administrators, which organization roles and keys can not grant
+func GetPlatformPermissions() []Permission {
+	return []Permission{OrgList, PlatformImpersonate}
+}
+
+// IsPlatform reports whether p grants a permission of platform administrators
+func IsPlatform(p Permission) bool {
+	for _, platform := range GetPlatformPermissions() {
+		if p.Grants(platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsKnown reports whether p is a permission checked by the services or a wildcard on their resources
+func IsKnown(p Permission) bool {
+	for _, known := range GetPermissions() {
+		if p == known || (p != All && p.Grants(known)) {
+			return true
+		}
+	}
+	return false
+}
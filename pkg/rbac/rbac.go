@@ -0,0 +1,114 @@
+package rbac
+
+import (
+	"context"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/xerr"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Permission allows an action on a resource, formatted as <resource>:<action> (e.g. tag:update)
+type Permission string
+
+const (
+	// All grants every permission
+	All Permission = "*"
+
+	wildcard = "*"
+)
+
+// Grants reports whether p grants the permission, a * action grants every action on its resource
+func (p Permission) Grants(permission Permission) bool {
+	if p == All || p == permission {
+		return true
+	}
+	resource, action, _ := strings.Cut(string(p), ":")
+	return action == wildcard && strings.HasPrefix(string(permission), resource+":")
+}
+
+// Resolver returns the permissions a role grants within an organization
+type Resolver interface {
+	GetPermissions(ctx context.Context, org uuid.UUID, role string) ([]Permission, error)
+}
+
+// Roles is a Resolver granting the same permissions to a role in every organization
+type Roles map[string][]Permission
+
+func (r Roles) GetPermissions(_ context.Context, _ uuid.UUID, role string) ([]Permission, error) {
+	return r[role], nil
+}
+
+// Authorizer checks the permissions of the principal of a request
+type Authorizer struct {
+	resolver Resolver
+	admins   map[uuid.UUID]bool
+}
+
+// NewAuthorizer returns an authorizer resolving roles with the given resolver.
+// The given platform administrators are granted the platform permissions on top of their role.
+func NewAuthorizer(resolver Resolver, admins ...uuid.UUID) *Authorizer {
+	a := &Authorizer{
+		resolver: resolver,
+		admins:   map[uuid.UUID]bool{},
+	}
+	for _, admin := range admins {
+		a.admins[admin] = true
+	}
+	return a
+}
+
+// Authorize returns an error unless the principal of ctx belongs to org and its role grants every permission.
+// The permissions of a principal authenticated by an API key are the scopes of the key.
+// A nil org skips the organization check, for resources which do not belong to one.
+func (a Authorizer) Authorize(ctx context.Context, org uuid.UUID, permissions ...Permission) error {
+	if len(permissions) == 0 {
+		return nil
+	}
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return xerr.ErrUnauthenticated
+	}
+	if org != uuid.Nil && org != p.OrgUUID {
+		return xerr.Forbidden("access to another organization is forbidden")
+	}
+	granted, err := a.getPermissions(ctx, p)
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if !grants(granted, permission) {
+			return xerr.Forbidden(fmt.Sprintf("missing permission %s", permission))
+		}
+	}
+	return nil
+}
+
+// getPermissions returns the permissions granted to a principal.
+// Administrators acting as another user are only granted the permissions of that user.
+func (a Authorizer) getPermissions(ctx context.Context, p principal.Principal) ([]Permission, error) {
+	if p.APIKey == uuid.Nil {
+		granted, err := a.resolver.GetPermissions(ctx, p.OrgUUID, p.Type)
+		if err != nil || p.Impersonator != uuid.Nil || !a.admins[p.UserUUID] {
+			return granted, err
+		}
+		return append(GetPlatformPermissions(), granted...), nil
+	}
+	granted := make([]Permission, len(p.Scopes))
+	for i, scope := range p.Scopes {
+		granted[i] = Permission(scope)
+	}
+	return granted, nil
+}
+
+// grants reports whether any of the granted permissions grants the permission
+func grants(granted []Permission, permission Permission) bool {
+	for _, g := range granted {
+		if g.Grants(permission) {
+			return true
+		}
+	}
+	return false
+}
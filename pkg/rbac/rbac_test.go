@@ -0,0 +1,94 @@
+package rbac
+
+import (
+	"context"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/xerr"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPermissionGrants(t *testing.T) {
+	assert.Assert(t, All.Grants(TagDelete), true)
+	assert.Assert(t, Permission("tag:*").Grants(TagDelete), true)
+	assert.Assert(t, Permission("tag:*").Grants(UserRead), false)
+	assert.Assert(t, TagRead.Grants(TagRead), true)
+	assert.Assert(t, TagRead.Grants(TagUpdate), false)
+}
+
+func TestAuthorize(t *testing.T) {
+	var (
+		org        = uuid.New()
+		authorizer = NewAuthorizer(Roles{"TEACHER": {OrgRead, "tag:*"}})
+		ctx        = principal.NewContext(context.Background(), principal.Principal{UserUUID: uuid.New(), OrgUUID: org, Type: "TEACHER"})
+	)
+
+	assert.Assert(t, authorizer.Authorize(ctx, org, TagUpdate, OrgRead), nil)
+	assert.Assert(t, authorizer.Authorize(ctx, uuid.Nil, TagRead), nil)
+	assert.Assert(t, authorizer.Authorize(context.Background(), org), nil)
+
+	err := authorizer.Authorize(ctx, org, UserDelete)
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	assert.Assert(t, err.Error(), "missing permission user:delete")
+
+	err = authorizer.Authorize(ctx, uuid.New(), TagRead)
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+
+	err = authorizer.Authorize(context.Background(), org, TagRead)
+	assert.Assert(t, errors.Is(err, xerr.ErrUnauthenticated), true)
+}
+
+func TestAuthorizeAPIKey(t *testing.T) {
+	var (
+		org        = uuid.New()
+		authorizer = NewAuthorizer(Roles{"MANAGER": {All}})
+		ctx        = principal.NewContext(context.Background(), principal.Principal{OrgUUID: org, Type: "MANAGER", APIKey: uuid.New(), Scopes: []string{"tag:*"}})
+	)
+
+	// Keys are only granted their scopes, whatever the type of the principal
+	assert.Assert(t, authorizer.Authorize(ctx, org, TagUpdate), nil)
+	err := authorizer.Authorize(ctx, org, UserRead)
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	err = authorizer.Authorize(ctx, uuid.New(), TagRead)
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+}
+
+func TestIsKnown(t *testing.T) {
+	assert.Assert(t, IsKnown(TagRead), true)
+	assert.Assert(t, IsKnown("tag:*"), true)
+	assert.Assert(t, IsKnown("tag:publish"), false)
+	assert.Assert(t, IsKnown("course:*"), false)
+	assert.Assert(t, IsKnown(All), false)
+}
+
+func TestAuthorizePlatformAdmin(t *testing.T) {
+	var (
+		org        = uuid.New()
+		admin      = uuid.New()
+		authorizer = NewAuthorizer(Roles{"TEACHER": {TagRead}}, admin)
+		p          = principal.Principal{UserUUID: admin, OrgUUID: org, Type: "TEACHER"}
+	)
+
+	// Administrators keep the permissions of their role
+	ctx := principal.NewContext(context.Background(), p)
+	assert.Assert(t, authorizer.Authorize(ctx, uuid.Nil, PlatformImpersonate), nil)
+	assert.Assert(t, authorizer.Authorize(ctx, org, TagRead), nil)
+
+	// Neither other users nor administrators acting as them are granted the platform permissions
+	p.UserUUID = uuid.New()
+	err := authorizer.Authorize(principal.NewContext(context.Background(), p), uuid.Nil, PlatformImpersonate)
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	p.Impersonator = admin
+	err = authorizer.Authorize(principal.NewContext(context.Background(), p), uuid.Nil, OrgList)
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+}
+
+func TestIsPlatform(t *testing.T) {
+	assert.Assert(t, IsPlatform(OrgList), true)
+	assert.Assert(t, IsPlatform("platform:*"), true)
+	assert.Assert(t, IsPlatform(All), true)
+	assert.Assert(t, IsPlatform("org:read"), false)
+}
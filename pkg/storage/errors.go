@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"ekolo/pkg/xerr"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// translateError turns driver and storage errors into typed errors, the original error stays wrapped
+func translateError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound):
+		return xerr.Wrap(xerr.KindNotFound, err, "resource not found")
+	case errors.Is(err, ErrDuplicate):
+		return xerr.Wrap(xerr.KindConflict, err, "resource already exists")
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return xerr.Wrap(xerr.KindValidation, err, "referenced resource does not exist")
+	case errors.Is(err, ErrInvalidFilter), errors.Is(err, ErrInvalidSort):
+		return xerr.Wrap(xerr.KindInvalid, err, "")
+	default:
+		return err
+	}
+}
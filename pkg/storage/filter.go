@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Filter operators, appended to a field name with a double underscore (e.g. name__icontains).
+// A field without operator is compared for equality.
+const (
+	OpEq         = "eq"
+	OpNe         = "ne"
+	OpGt         = "gt"
+	OpGte        = "gte"
+	OpLt         = "lt"
+	OpLte        = "lte"
+	OpIn         = "in"
+	OpContains   = "contains"
+	OpIContains  = "icontains"
+	OpStartsWith = "startswith"
+	OpIsNull     = "isnull"
+
+	opSeparator = "__"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filters declares, for each filterable field, the operators that may be used on it
+type Filters map[string][]string
+
+// Validate checks that every key of the filter is a declared field and operator
+func (f Filters) Validate(filter map[string]any) error {
+	for key := range filter {
+		field, op := ParseFilterKey(key)
+		ops, ok := f[field]
+		if !ok {
+			return fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, field)
+		}
+		allowed := false
+		for _, o := range ops {
+			allowed = allowed || o == op
+		}
+		if !allowed {
+			return fmt.Errorf("%w: operator %q not allowed on %q", ErrInvalidFilter, op, field)
+		}
+	}
+	return nil
+}
+
+// ParseFilterKey splits a filter key into its field and operator
+func ParseFilterKey(key string) (string, string) {
+	if i := strings.LastIndex(key, opSeparator); i > 0 {
+		return key[:i], key[i+len(opSeparator):]
+	}
+	return key, OpEq
+}
+
+// Subquery is a filter value matching the values a column takes in the live rows of another model satisfying a filter,
+// the rows are selected by the same query (e.g. {"uuid": Subquery{Model: &Membership{}, Column: "user_uuid", Filter: ...}}).
+// It may be given to the eq and in operators.
+type Subquery struct {
+	Model  any
+	Column string
+	Filter map[string]any
+}
+
+// filterCondition is a parsed filter entry
+type filterCondition struct {
+	field *schema.Field
+	op    string
+	value any
+	sub   *subquery // Set for in conditions on a Subquery, whose values are then left to the Storer.
+}
+
+// subquery is a parsed Subquery
+type subquery struct {
+	model      any
+	sch        *schema.Schema
+	field      *schema.Field
+	conditions []filterCondition
+}
+
+// parseFilter resolves the filter keys against the model schema, sorted by key so that queries are stable.
+// parse returns the schemas of the models of subqueries.
+func parseFilter(sch *schema.Schema, filter map[string]any, parse func(any) (*schema.Schema, error)) ([]filterCondition, error) {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	conditions := make([]filterCondition, 0, len(keys))
+	for _, key := range keys {
+		name, op := ParseFilterKey(key)
+		field := sch.LookUpField(name)
+		if field == nil || field.DBName == "" {
+			return nil, fmt.Errorf("%w: unknown field %q on %s", ErrInvalidFilter, name, sch.Table)
+		}
+		value := filter[key]
+		if sq, ok := value.(Subquery); ok {
+			if op != OpEq && op != OpIn {
+				return nil, fmt.Errorf("%w: %q does not take a subquery", ErrInvalidFilter, key)
+			}
+			sub, err := parseSubquery(sq, parse)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, filterCondition{field: field, op: OpIn, sub: sub})
+			continue
+		}
+		switch op {
+		case OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpContains, OpIContains, OpStartsWith:
+		case OpIn:
+			value = toList(value)
+		case OpIsNull:
+			isNull, err := strconv.ParseBool(fmt.Sprint(value))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q expects a boolean", ErrInvalidFilter, key)
+			}
+			value = isNull
+		default:
+			return nil, fmt.Errorf("%w: unknown operator %q", ErrInvalidFilter, op)
+		}
+		conditions = append(conditions, filterCondition{field: field, op: op, value: value})
+	}
+	return conditions, nil
+}
+
+// parseSubquery resolves a subquery against the schema of its model
+func parseSubquery(sq Subquery, parse func(any) (*schema.Schema, error)) (*subquery, error) {
+	sch, err := parse(sq.Model)
+	if err != nil {
+		return nil, err
+	}
+	field := sch.LookUpField(sq.Column)
+	if field == nil || field.DBName == "" {
+		return nil, fmt.Errorf("%w: unknown field %q on %s", ErrInvalidFilter, sq.Column, sch.Table)
+	}
+	conditions, err := parseFilter(sch, sq.Filter, parse)
+	if err != nil {
+		return nil, err
+	}
+	return &subquery{model: sq.Model, sch: sch, field: field, conditions: conditions}, nil
+}
+
+// toList turns a comma separated string or a slice into a list of values
+func toList(value any) []any {
+	if s, ok := value.(string); ok {
+		items := []any{}
+		for _, item := range strings.Split(s, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+		return items
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice {
+		return []any{value}
+	}
+	items := make([]any, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items
+}
+
+// expression translates the condition into a gorm clause, columns are always quoted by gorm
+func (c filterCondition) expression() clause.Expression {
+	column := clause.Column{Table: clause.CurrentTable, Name: c.field.DBName}
+	rv := reflect.ValueOf(c.value)
+	if c.op == OpEq && c.value != nil && rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+		return clause.IN{Column: column, Values: toList(c.value)}
+	}
+	switch c.op {
+	case OpNe:
+		return clause.Neq{Column: column, Value: c.value}
+	case OpGt:
+		return clause.Gt{Column: column, Value: c.value}
+	case OpGte:
+		return clause.Gte{Column: column, Value: c.value}
+	case OpLt:
+		return clause.Lt{Column: column, Value: c.value}
+	case OpLte:
+		return clause.Lte{Column: column, Value: c.value}
+	case OpIn:
+		return clause.IN{Column: column, Values: c.value.([]any)}
+	case OpContains:
+		return clause.Expr{SQL: `? LIKE ? ESCAPE '\'`, Vars: []any{column, "%" + escapeLike(c.value) + "%"}}
+	case OpIContains:
+		return clause.Expr{SQL: `LOWER(?) LIKE ? ESCAPE '\'`, Vars: []any{column, "%" + strings.ToLower(escapeLike(c.value)) + "%"}}
+	case OpStartsWith:
+		return clause.Expr{SQL: `? LIKE ? ESCAPE '\'`, Vars: []any{column, escapeLike(c.value) + "%"}}
+	case OpIsNull:
+		if c.value.(bool) {
+			return clause.Eq{Column: column, Value: nil}
+		}
+		return clause.Neq{Column: column, Value: nil}
+	default:
+		return clause.Eq{Column: column, Value: c.value}
+	}
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike returns a value as a LIKE pattern matching it literally, as the MemoryStore does
+func escapeLike(value any) string {
+	return likeEscaper.Replace(fmt.Sprint(value))
+}
+
+// match tells whether a column value satisfies the condition, used by the MemoryStore
+func (c filterCondition) match(got any) bool {
+	switch c.op {
+	case OpEq:
+		return matchValue(got, c.value)
+	case OpNe:
+		return !matchValue(got, c.value)
+	case OpIn:
+		return matchValue(got, c.value)
+	case OpIsNull:
+		_, isNull := normalize(got)
+		return isNull == c.value.(bool)
+	}
+	g, gNull := normalize(got)
+	w, wNull := normalize(c.value)
+	if gNull || wNull {
+		return false
+	}
+	switch c.op {
+	case OpContains:
+		return strings.Contains(g, w)
+	case OpIContains:
+		return strings.Contains(strings.ToLower(g), strings.ToLower(w))
+	case OpStartsWith:
+		return strings.HasPrefix(g, w)
+	}
+	cmp := compareValues(g, w)
+	switch c.op {
+	case OpGt:
+		return cmp > 0
+	case OpGte:
+		return cmp >= 0
+	case OpLt:
+		return cmp < 0
+	case OpLte:
+		return cmp <= 0
+	}
+	return false
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// compareValues compares two normalized values as numbers, then as times, then as strings
+func compareValues(a, b string) int {
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := parseTime(a); ok {
+		if y, ok := parseTime(b); ok {
+			return x.Compare(y)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func parseTime(value string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,586 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"ekolo/pkg/xlog"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// MemoryStore is a map backed Storer meant for unit tests.
+// Rows are kept per table in insertion order and copied in and out so callers never share memory with the store.
+// Unlike a database it does not enforce foreign keys, though it enforces primary keys and unique indexes.
+type MemoryStore struct {
+	mu     *sync.RWMutex
+	tables map[string][]reflect.Value
+	cache  *sync.Map
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu:     &sync.RWMutex{},
+		tables: map[string][]reflect.Value{},
+		cache:  &sync.Map{},
+	}
+}
+
+// RunMigrations only checks that models can be parsed, tables are created lazily
+func (s *MemoryStore) RunMigrations(models ...any) error {
+	for _, m := range models {
+		if _, err := s.parse(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) parse(m any) (*schema.Schema, error) {
+	return schema.Parse(m, s.cache, schema.NamingStrategy{})
+}
+
+func (s *MemoryStore) Create(m any) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	if hook, ok := m.(interface{ BeforeCreate(*gorm.DB) error }); ok {
+		if err := hook.BeforeCreate(nil); err != nil {
+			return 0, translateError(err)
+		}
+	}
+	ctx := context.Background()
+	rv := addressable(m)
+	now := time.Now()
+	for _, f := range sch.Fields {
+		if f.AutoCreateTime > 0 || f.AutoUpdateTime > 0 {
+			if _, zero := f.ValueOf(ctx, rv); zero {
+				if err := f.Set(ctx, rv, now); err != nil {
+					return 0, translateError(err)
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range s.tables[sch.Table] {
+		if samePrimaryKey(sch, row, rv) {
+			xlog.Error("storage-create", "error", ErrDuplicate.Error())
+			return 0, translateError(ErrDuplicate)
+		}
+	}
+	if s.violatesUnique(sch, rv) {
+		xlog.Error("storage-create", "error", ErrDuplicate.Error())
+		return 0, translateError(ErrDuplicate)
+	}
+	s.tables[sch.Table] = append(s.tables[sch.Table], clone(rv))
+	return 1, nil
+}
+
+func (s *MemoryStore) Get(m any, filter map[string]any) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.match(sch, withPrimaryKey(sch, m, filter))
+	if err != nil {
+		return 0, translateError(err)
+	}
+	if len(rows) == 0 {
+		xlog.Error("storage-get", "error", ErrNotFound.Error())
+		return 0, translateError(ErrNotFound)
+	}
+	// Mimic gorm's First which orders by primary key
+	sortByPrimaryKey(sch, rows)
+	reflect.Indirect(reflect.ValueOf(m)).Set(clone(rows[0]))
+	return 1, nil
+}
+
+func (s *MemoryStore) List(m any, filter map[string]any, opts ListOptions) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.match(sch, filter)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	columns, err := parseSort(sch, opts.Sort)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	key, err := seekKey(columns, opts)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	sortRows(columns, rows)
+	if key != nil {
+		rows = seek(columns, rows, key, opts.Before != "")
+	}
+	rows = paginate(rows, opts)
+	dest := reflect.Indirect(reflect.ValueOf(m))
+	if dest.Kind() != reflect.Slice {
+		return 0, fmt.Errorf("storage: list destination must be a slice, got %s", dest.Kind())
+	}
+	result := reflect.MakeSlice(dest.Type(), 0, len(rows))
+	for _, row := range rows {
+		result = reflect.Append(result, clone(row))
+	}
+	dest.Set(result)
+	return int64(len(rows)), nil
+}
+
+func (s *MemoryStore) Count(m any, filter map[string]any) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.match(sch, filter)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	return int64(len(rows)), nil
+}
+
+func (s *MemoryStore) Update(m any) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	ctx := context.Background()
+	rv := addressable(m)
+	for _, f := range sch.PrimaryFields {
+		if _, zero := f.ValueOf(ctx, rv); zero {
+			xlog.Error("storage-update", "error", gorm.ErrMissingWhereClause.Error())
+			return 0, gorm.ErrMissingWhereClause
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range s.tables[sch.Table] {
+		if isDeleted(sch, row) || !samePrimaryKey(sch, row, rv) {
+			continue
+		}
+		if err := s.update(sch, row, rv); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryStore) UpdateWhere(m any, filter map[string]any) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	conditions := withPrimaryKey(sch, m, filter)
+	if len(conditions) == 0 {
+		xlog.Error("storage-update", "error", gorm.ErrMissingWhereClause.Error())
+		return 0, gorm.ErrMissingWhereClause
+	}
+	rv := addressable(m)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.match(sch, conditions)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	for _, row := range rows {
+		if err := s.update(sch, row, rv); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(rows)), nil
+}
+
+// update writes the non-zero fields of rv to a row, like gorm's Updates with a struct
+func (s *MemoryStore) update(sch *schema.Schema, row, rv reflect.Value) error {
+	ctx := context.Background()
+	updated := clone(row)
+	now := time.Now()
+	for _, f := range sch.Fields {
+		if f.AutoUpdateTime > 0 {
+			if err := f.Set(ctx, rv, now); err != nil {
+				return translateError(err)
+			}
+		}
+		if f.PrimaryKey || f.AutoCreateTime > 0 || f.DBName == "" {
+			continue
+		}
+		if _, zero := f.ValueOf(ctx, rv); zero {
+			continue
+		}
+		f.ReflectValueOf(ctx, updated).Set(clone(f.ReflectValueOf(ctx, rv)))
+	}
+	if s.violatesUnique(sch, updated) {
+		xlog.Error("storage-update", "error", ErrDuplicate.Error())
+		return translateError(ErrDuplicate)
+	}
+	row.Set(updated)
+	return nil
+}
+
+func (s *MemoryStore) Delete(m any, filter map[string]any) (int64, error) {
+	sch, err := s.parse(m)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	ctx := context.Background()
+	conditions := withPrimaryKey(sch, m, filter)
+	if len(conditions) == 0 {
+		xlog.Error("storage-delete", "error", gorm.ErrMissingWhereClause.Error())
+		return 0, gorm.ErrMissingWhereClause
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.match(sch, conditions)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	deletedAt := deletedAtField(sch)
+	for _, row := range rows {
+		if deletedAt != nil {
+			deletedAt.ReflectValueOf(ctx, row).Set(reflect.ValueOf(gorm.DeletedAt{Time: time.Now(), Valid: true}))
+			continue
+		}
+		s.remove(sch, row)
+	}
+	return int64(len(rows)), nil
+}
+
+// WithContext returns the store itself, queries in memory can not be canceled
+func (s *MemoryStore) WithContext(ctx context.Context) Storer {
+	return s
+}
+
+// WithTx runs fn against a snapshot of the store which replaces the store's rows when fn returns nil.
+// The store is locked until fn returns, so other queries wait for the transaction as they would on a single connection.
+// fn must therefore only use the Storer it is given.
+func (s *MemoryStore) WithTx(ctx context.Context, fn func(Storer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &MemoryStore{
+		mu:     &sync.RWMutex{},
+		tables: make(map[string][]reflect.Value, len(s.tables)),
+		cache:  s.cache,
+	}
+	for table, rows := range s.tables {
+		for _, row := range rows {
+			tx.tables[table] = append(tx.tables[table], clone(row))
+		}
+	}
+	if err := fn(tx); err != nil {
+		xlog.Error("storage-tx", "error", err.Error())
+		return err
+	}
+	s.tables = tx.tables
+	return nil
+}
+
+// withPrimaryKey adds the non-zero primary key of the model to the filter, as gorm does
+func withPrimaryKey(sch *schema.Schema, m any, filter map[string]any) map[string]any {
+	conditions := map[string]any{}
+	for k, v := range filter {
+		conditions[k] = v
+	}
+	rv := reflect.Indirect(reflect.ValueOf(m))
+	for _, f := range sch.PrimaryFields {
+		if v, zero := f.ValueOf(context.Background(), rv); !zero {
+			conditions[f.DBName] = v
+		}
+	}
+	return conditions
+}
+
+// remove drops a row from its table, used for models without soft delete
+func (s *MemoryStore) remove(sch *schema.Schema, row reflect.Value) {
+	rows := s.tables[sch.Table]
+	for i, r := range rows {
+		if samePrimaryKey(sch, r, row) {
+			s.tables[sch.Table] = append(rows[:i], rows[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns the live rows of the schema table satisfying every filter entry
+func (s *MemoryStore) match(sch *schema.Schema, filter map[string]any) ([]reflect.Value, error) {
+	conditions, err := parseFilter(sch, filter, s.parse)
+	if err != nil {
+		return nil, err
+	}
+	return s.matchConditions(sch, conditions), nil
+}
+
+// matchConditions returns the live rows of the schema table satisfying every condition, subqueries are run first
+func (s *MemoryStore) matchConditions(sch *schema.Schema, conditions []filterCondition) []reflect.Value {
+	ctx := context.Background()
+	for i, c := range conditions {
+		if c.sub == nil {
+			continue
+		}
+		values := []any{}
+		for _, row := range s.matchConditions(c.sub.sch, c.sub.conditions) {
+			value, _ := c.sub.field.ValueOf(ctx, row)
+			values = append(values, value)
+		}
+		conditions[i].value = values
+	}
+	rows := []reflect.Value{}
+	for _, row := range s.tables[sch.Table] {
+		if isDeleted(sch, row) {
+			continue
+		}
+		ok := true
+		for _, c := range conditions {
+			got, _ := c.field.ValueOf(ctx, row)
+			if !c.match(got) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// matchValue compares a column value against a filter value, slices match any of their items
+func matchValue(got, want any) bool {
+	wv := reflect.ValueOf(want)
+	if want != nil && wv.Kind() == reflect.Slice && wv.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < wv.Len(); i++ {
+			if matchValue(got, wv.Index(i).Interface()) {
+				return true
+			}
+		}
+		return false
+	}
+	g, gNull := normalize(got)
+	w, wNull := normalize(want)
+	if gNull || wNull {
+		return gNull == wNull
+	}
+	return g == w
+}
+
+// normalize returns a comparable representation of a value and whether it is NULL
+func normalize(v any) (string, bool) {
+	if v == nil {
+		return "", true
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "", true
+		}
+		rv = rv.Elem()
+	}
+	v = rv.Interface()
+	if valuer, ok := v.(driver.Valuer); ok {
+		dv, err := valuer.Value()
+		if err != nil || dv == nil {
+			return "", true
+		}
+		v = dv
+	}
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano), false
+	case []byte:
+		return string(t), false
+	default:
+		return fmt.Sprint(t), false
+	}
+}
+
+// addressable returns the settable struct value behind m, copying it when m is not a pointer
+func addressable(m any) reflect.Value {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() == reflect.Ptr {
+		return rv.Elem()
+	}
+	c := reflect.New(rv.Type()).Elem()
+	c.Set(rv)
+	return c
+}
+
+func deletedAtField(sch *schema.Schema) *schema.Field {
+	for _, f := range sch.Fields {
+		if f.FieldType == reflect.TypeOf(gorm.DeletedAt{}) {
+			return f
+		}
+	}
+	return nil
+}
+
+func isDeleted(sch *schema.Schema, row reflect.Value) bool {
+	f := deletedAtField(sch)
+	if f == nil {
+		return false
+	}
+	v, _ := f.ValueOf(context.Background(), row)
+	d, ok := v.(gorm.DeletedAt)
+	return ok && d.Valid
+}
+
+func primaryKey(sch *schema.Schema, row reflect.Value) string {
+	keys := []string{}
+	for _, f := range sch.PrimaryFields {
+		v, _ := f.ValueOf(context.Background(), row)
+		k, _ := normalize(v)
+		keys = append(keys, k)
+	}
+	return strings.Join(keys, "|")
+}
+
+func sortByPrimaryKey(sch *schema.Schema, rows []reflect.Value) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return primaryKey(sch, rows[i]) < primaryKey(sch, rows[j])
+	})
+}
+
+// seek returns the sorted rows after the key, or before it, as keysetCondition selects them
+func seek(columns []sortColumn, rows []reflect.Value, key []any, before bool) []reflect.Value {
+	selected := []reflect.Value{}
+	for _, row := range rows {
+		cmp := compareKeys(columns, sortKey(columns, row), key)
+		if (before && cmp < 0) || (!before && cmp > 0) {
+			selected = append(selected, row)
+		}
+	}
+	return selected
+}
+
+// paginate returns the window of rows selected by the list options, a page before a key ends right before it
+func paginate(rows []reflect.Value, opts ListOptions) []reflect.Value {
+	if opts.Offset >= len(rows) {
+		return nil
+	}
+	if opts.Before != "" {
+		rows = rows[:len(rows)-opts.Offset]
+		if opts.Limit > 0 && opts.Limit < len(rows) {
+			rows = rows[len(rows)-opts.Limit:]
+		}
+		return rows
+	}
+	rows = rows[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(rows) {
+		rows = rows[:opts.Limit]
+	}
+	return rows
+}
+
+// violatesUnique reports whether another row of the table has the values of a unique index of row.
+// Rows with a NULL in the index are never duplicates, partial indexes are taken to leave soft deleted rows out.
+func (s *MemoryStore) violatesUnique(sch *schema.Schema, row reflect.Value) bool {
+	for _, idx := range sch.ParseIndexes() {
+		if idx.Class != "UNIQUE" {
+			continue
+		}
+		key, null := indexKey(idx, row)
+		if null {
+			continue
+		}
+		for _, other := range s.tables[sch.Table] {
+			if samePrimaryKey(sch, other, row) || (idx.Where != "" && isDeleted(sch, other)) {
+				continue
+			}
+			if k, null := indexKey(idx, other); !null && k == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexKey returns the values of the fields of an index in a row and whether one of them is NULL
+func indexKey(idx schema.Index, row reflect.Value) (string, bool) {
+	keys := make([]string, len(idx.Fields))
+	for i, f := range idx.Fields {
+		v, _ := f.ValueOf(context.Background(), row)
+		k, null := normalize(v)
+		if null {
+			return "", true
+		}
+		keys[i] = k
+	}
+	return strings.Join(keys, "|"), false
+}
+
+func samePrimaryKey(sch *schema.Schema, a, b reflect.Value) bool {
+	return primaryKey(sch, a) == primaryKey(sch, b)
+}
+
+// clone deep copies a value so that pointers, slices and maps are not shared
+func clone(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(clone(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(clone(v.Field(i)))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(clone(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), clone(iter.Value()))
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(clone(v.Elem()))
+		return c
+	default:
+		return v
+	}
+}
+
+var _ Storer = new(MemoryStore)
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// sortDesc prefixes a sort field to order it in descending order (e.g. -created_at)
+const sortDesc = "-"
+
+var ErrInvalidSort = errors.New("invalid sort")
+
+// ParseSortField splits a sort entry into its field name and direction
+func ParseSortField(value string) (string, bool) {
+	if strings.HasPrefix(value, sortDesc) {
+		return value[len(sortDesc):], true
+	}
+	return value, false
+}
+
+type sortColumn struct {
+	field *schema.Field
+	desc  bool
+}
+
+// parseSort resolves the sort entries against the model schema.
+// The creation time, then the primary key, are appended so that the order is total and stable from a page to the next.
+func parseSort(sch *schema.Schema, fields []string) ([]sortColumn, error) {
+	columns := []sortColumn{}
+	sorted := map[string]bool{}
+	for _, value := range fields {
+		name, desc := ParseSortField(value)
+		field := sch.LookUpField(name)
+		if field == nil || field.DBName == "" {
+			return nil, fmt.Errorf("%w: unknown field %q on %s", ErrInvalidSort, name, sch.Table)
+		}
+		columns = append(columns, sortColumn{field: field, desc: desc})
+		sorted[field.DBName] = true
+	}
+	if field := sch.LookUpField("created_at"); field != nil && !sorted[field.DBName] {
+		columns = append(columns, sortColumn{field: field})
+	}
+	for _, field := range sch.PrimaryFields {
+		columns = append(columns, sortColumn{field: field})
+	}
+	return columns, nil
+}
+
+// orderBy translates the sort columns into an ORDER BY clause, NULL values always come last unless the order is reversed
+func orderBy(columns []sortColumn, reverse bool) clause.OrderBy {
+	terms := make([]string, len(columns))
+	vars := make([]any, len(columns))
+	for i, c := range columns {
+		terms[i] = "? ASC NULLS LAST"
+		if c.desc != reverse {
+			terms[i] = "? DESC NULLS LAST"
+		}
+		if reverse {
+			terms[i] = strings.Replace(terms[i], "LAST", "FIRST", 1)
+		}
+		vars[i] = clause.Column{Table: clause.CurrentTable, Name: c.field.DBName}
+	}
+	return clause.OrderBy{Expression: clause.Expr{SQL: strings.Join(terms, ", "), Vars: vars}}
+}
+
+// sortKey returns the values of the sort columns of a row
+func sortKey(columns []sortColumn, row reflect.Value) []any {
+	key := make([]any, len(columns))
+	for i, c := range columns {
+		key[i], _ = c.field.ValueOf(context.Background(), row)
+	}
+	return key
+}
+
+// compareKeys compares the sort keys of two rows in the order of orderBy
+func compareKeys(columns []sortColumn, a, b []any) int {
+	for i, c := range columns {
+		x, xNull := normalize(a[i])
+		y, yNull := normalize(b[i])
+		switch {
+		case xNull && yNull:
+			continue
+		case xNull:
+			return 1
+		case yNull:
+			return -1
+		}
+		cmp := compareValues(x, y)
+		if cmp == 0 {
+			continue
+		}
+		if c.desc {
+			return -cmp
+		}
+		return cmp
+	}
+	return 0
+}
+
+// sortRows orders rows like orderBy does, used by the MemoryStore
+func sortRows(columns []sortColumn, rows []reflect.Value) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return compareKeys(columns, sortKey(columns, rows[i]), sortKey(columns, rows[j])) < 0
+	})
+}
+
+// keyCache holds the schemas parsed by SortKey
+var keyCache = &sync.Map{}
+
+// SortKey returns the key of a row within list results ordered by sort, which ListOptions.After and Before take.
+// The key is opaque, it holds the values of the sort columns of the row.
+func SortKey(row any, sort []string) (string, error) {
+	sch, err := schema.Parse(row, keyCache, schema.NamingStrategy{})
+	if err != nil {
+		return "", err
+	}
+	columns, err := parseSort(sch, sort)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(sortKey(columns, reflect.Indirect(reflect.ValueOf(row))))
+	return string(b), err
+}
+
+// parseKey returns the values of a key returned by SortKey, typed as the fields of the sort columns
+func parseKey(columns []sortColumn, key string) ([]any, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(key), &raw); err != nil || len(raw) != len(columns) {
+		return nil, fmt.Errorf("%w: invalid sort key", ErrInvalidSort)
+	}
+	values := make([]any, len(columns))
+	for i, c := range columns {
+		v := reflect.New(c.field.FieldType)
+		if err := json.Unmarshal(raw[i], v.Interface()); err != nil {
+			return nil, fmt.Errorf("%w: invalid sort key", ErrInvalidSort)
+		}
+		values[i] = v.Elem().Interface()
+	}
+	return values, nil
+}
+
+// seekKey returns the values of the key the list options start after or end before, if any
+func seekKey(columns []sortColumn, opts ListOptions) ([]any, error) {
+	switch {
+	case opts.After != "" && opts.Before != "":
+		return nil, fmt.Errorf("%w: a page can not both start after and end before a key", ErrInvalidSort)
+	case opts.After != "":
+		return parseKey(columns, opts.After)
+	case opts.Before != "":
+		return parseKey(columns, opts.Before)
+	}
+	return nil, nil
+}
+
+// reverseRows reverses a slice of rows in place
+func reverseRows(rows reflect.Value) {
+	if rows.Kind() != reflect.Slice {
+		return
+	}
+	swap := reflect.Swapper(rows.Interface())
+	for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+		swap(i, j)
+	}
+}
+
+// keysetCondition selects the rows orderBy puts after the key, or before it
+func keysetCondition(columns []sortColumn, key []any, before bool) clause.Expression {
+	var condition clause.Expression
+	for i := len(columns) - 1; i >= 0; i-- {
+		column := clause.Column{Table: clause.CurrentTable, Name: columns[i].field.DBName}
+		// Rows beyond the key on this column, NULL values come last
+		var beyond clause.Expression
+		_, null := normalize(key[i])
+		switch {
+		case null && before:
+			beyond = clause.Neq{Column: column, Value: nil}
+		case null:
+		case before == columns[i].desc:
+			beyond = clause.Gt{Column: column, Value: key[i]}
+		default:
+			beyond = clause.Lt{Column: column, Value: key[i]}
+		}
+		if !null && !before {
+			beyond = clause.Or(beyond, clause.Eq{Column: column, Value: nil})
+		}
+		if condition == nil {
+			condition = beyond
+			continue
+		}
+		var equal clause.Expression = clause.Eq{Column: column, Value: key[i]}
+		if null {
+			equal = clause.Eq{Column: column, Value: nil}
+		}
+		tie := clause.And(equal, condition)
+		if beyond == nil {
+			condition = tie
+		} else {
+			condition = clause.Or(beyond, tie)
+		}
+	}
+	return condition
+}
@@ -1,15 +1,35 @@
 package storage
 
 import (
+	"context"
 	"ekolo/pkg/xlog"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/glebarez/sqlite"
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
 )
 
-var ErrNotFound = gorm.ErrRecordNotFound
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
+)
+
+// sqlitePragmas make sqlite enforce foreign keys and compare LIKE patterns case sensitively, as postgres does
+const sqlitePragmas = "_pragma=foreign_keys(1)&_pragma=case_sensitive_like(1)"
+
+var (
+	ErrNotFound  = gorm.ErrRecordNotFound
+	ErrDuplicate = gorm.ErrDuplicatedKey
+)
 
 type BaseModel struct {
 	UUID      uuid.UUID      `json:"uuid,omitempty" gorm:"primaryKey"`
@@ -24,22 +44,74 @@ func (b *BaseModel) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// ListOptions holds the pagination and order of a List call, a zero Limit means no limit.
+// Sort lists fields to order by, prefixed with - for descending order, the creation time and the primary key break ties.
+// After and Before take a key returned by SortKey, the page then starts right after its row, or ends right before it.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Sort   []string
+	After  string
+	Before string
+}
+
 type Storer interface {
 	Create(any) (int64, error)
 	Get(any, map[string]any) (int64, error)
-	List(any, map[string]any) (int64, error)
+	List(any, map[string]any, ListOptions) (int64, error)
+	Count(any, map[string]any) (int64, error)
 	Update(any) (int64, error)
+	UpdateWhere(any, map[string]any) (int64, error)
 	Delete(any, map[string]any) (int64, error)
+	WithTx(context.Context, func(Storer) error) error
+	WithContext(context.Context) Storer
 }
 
 type Store struct {
-	DSN string
-	db  *gorm.DB
+	Driver string
+	DSN    string
+	db     *gorm.DB
+	cache  *sync.Map
+}
+
+// getDialector returns the gorm dialector matching the driver name
+func getDialector(driver, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case DriverPostgres, "":
+		return postgres.Open(dsn), nil
+	case DriverSQLite:
+		return sqlite.Open(fmt.Sprintf("file:%s?%s", dsn, sqlitePragmas)), nil
+	case DriverMemory:
+		// Every in-memory store gets its own database unless a name is given
+		if dsn == "" {
+			dsn = uuid.NewString()
+		}
+		return sqlite.Open(fmt.Sprintf("file:%s?mode=memory&%s", dsn, sqlitePragmas)), nil
+	default:
+		return nil, fmt.Errorf("storage: unknown driver %q", driver)
+	}
 }
 
-func NewStore(dsn string) (*Store, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	s := Store{DSN: dsn, db: db}
+// NewStore opens a store using the given driver (postgres, sqlite or memory).
+// For sqlite the dsn is the database file path, for memory it is an optional database name.
+func NewStore(driver, dsn string) (*Store, error) {
+	dialector, err := getDialector(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverMemory {
+		// An in-memory database lives as long as its connection, keep a single one
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+	s := Store{Driver: driver, DSN: dsn, db: db, cache: &sync.Map{}}
 	return &s, err
 }
 
@@ -48,28 +120,172 @@ func (s Store) RunMigrations(models ...any) error {
 	return s.db.AutoMigrate(models...)
 }
 
+// HasColumn reports whether the table of a model has a column, data migrations check for the legacy columns they read
+func (s Store) HasColumn(m any, column string) bool {
+	return s.db.Migrator().HasColumn(m, column)
+}
+
+// HasTable reports whether the table of a model exists
+func (s Store) HasTable(m any) bool {
+	return s.db.Migrator().HasTable(m)
+}
+
+// RenameTable renames the table of a model, so that the schema migration creates it again.
+// Index names are shared by the tables of a database, the given indexes are dropped for the new table to create them.
+func (s Store) RenameTable(m any, name string, indexes ...string) error {
+	sch, err := schema.Parse(m, s.cache, s.db.NamingStrategy)
+	if err != nil {
+		return err
+	}
+	migrator := s.db.Migrator()
+	for _, index := range indexes {
+		// Looking the index up by its table rather than the model keeps gorm from parsing the indexes of the model,
+		// which marks the column of a single column unique index as unique, partial indexes included
+		if !migrator.HasIndex(sch.Table, index) {
+			continue
+		}
+		if err := migrator.DropIndex(sch.Table, index); err != nil {
+			return err
+		}
+	}
+	return migrator.RenameTable(sch.Table, name)
+}
+
+// CopyTable copies the rows of a table into the table of a model, for every column of the model.
+// Rows keep their primary key, the ones the model already has are left as they are.
+func (s Store) CopyTable(from string, m any) error {
+	sch, err := schema.Parse(m, s.cache, s.db.NamingStrategy)
+	if err != nil {
+		return err
+	}
+	columns := make([]any, len(sch.DBNames))
+	for i, name := range sch.DBNames {
+		columns[i] = clause.Column{Name: name}
+	}
+	list := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	key := sch.PrioritizedPrimaryField.DBName
+	vars := append([]any{clause.Table{Name: sch.Table}}, columns...)
+	vars = append(vars, columns...)
+	vars = append(vars, clause.Table{Name: from}, clause.Column{Name: key}, clause.Column{Name: key}, clause.Table{Name: sch.Table})
+	return s.db.Exec("INSERT INTO ? ("+list+") SELECT "+list+" FROM ? WHERE ? NOT IN (SELECT ? FROM ?)", vars...).Error
+}
+
+// DropTable drops the table of a model
+func (s Store) DropTable(m any) error {
+	return s.db.Migrator().DropTable(m)
+}
+
 func (s Store) Create(m any) (int64, error) {
 	result := s.db.Create(m)
 	if result.Error != nil {
 		xlog.Error("storage-create", "error", result.Error.Error())
 	}
-	return result.RowsAffected, result.Error
+	return result.RowsAffected, translateError(result.Error)
+}
+
+// where returns a query constrained by the filter, whose keys may carry an operator (e.g. name__icontains)
+func (s Store) where(m any, filter map[string]any) (*gorm.DB, error) {
+	sch, err := schema.Parse(m, s.cache, s.db.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+	conditions, err := parseFilter(sch, filter, s.parse)
+	if err != nil {
+		return nil, err
+	}
+	if len(conditions) == 0 {
+		return s.db, nil
+	}
+	return s.db.Clauses(clause.Where{Exprs: s.expressions(conditions)}), nil
+}
+
+func (s Store) parse(m any) (*schema.Schema, error) {
+	return schema.Parse(m, s.cache, s.db.NamingStrategy)
+}
+
+// expressions translates the conditions into gorm clauses, subqueries are selected by a nested query
+func (s Store) expressions(conditions []filterCondition) []clause.Expression {
+	exprs := make([]clause.Expression, len(conditions))
+	for i, c := range conditions {
+		if c.sub == nil {
+			exprs[i] = c.expression()
+			continue
+		}
+		query := s.db.Session(&gorm.Session{NewDB: true}).Model(c.sub.model).Select(c.sub.field.DBName)
+		if len(c.sub.conditions) > 0 {
+			query = query.Clauses(clause.Where{Exprs: s.expressions(c.sub.conditions)})
+		}
+		exprs[i] = clause.Expr{SQL: "? IN (?)", Vars: []any{clause.Column{Table: clause.CurrentTable, Name: c.field.DBName}, query}}
+	}
+	return exprs
 }
 
 func (s Store) Get(m any, filter map[string]any) (int64, error) {
-	result := s.db.Where(filter).First(m)
+	query, err := s.where(m, filter)
+	if err != nil {
+		xlog.Error("storage-get", "error", err.Error())
+		return 0, translateError(err)
+	}
+	result := query.First(m)
 	if result.Error != nil {
 		xlog.Error("storage-get", "error", result.Error.Error())
 	}
-	return result.RowsAffected, result.Error
+	return result.RowsAffected, translateError(result.Error)
 }
 
-func (s Store) List(m any, filter map[string]any) (int64, error) {
-	result := s.db.Where(filter).Find(m)
+func (s Store) List(m any, filter map[string]any, opts ListOptions) (int64, error) {
+	query, err := s.where(m, filter)
+	if err != nil {
+		xlog.Error("storage-list", "error", err.Error())
+		return 0, translateError(err)
+	}
+	sch, err := schema.Parse(m, s.cache, s.db.NamingStrategy)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	columns, err := parseSort(sch, opts.Sort)
+	if err != nil {
+		xlog.Error("storage-list", "error", err.Error())
+		return 0, translateError(err)
+	}
+	key, err := seekKey(columns, opts)
+	if err != nil {
+		xlog.Error("storage-list", "error", err.Error())
+		return 0, translateError(err)
+	}
+	if key != nil {
+		query = query.Where(keysetCondition(columns, key, opts.Before != ""))
+	}
+	// The page before a key is the first one in reverse order, its rows are put back in order once found
+	query = query.Clauses(orderBy(columns, opts.Before != ""))
+	if opts.Limit > 0 {
+		query = query.Limit(opts.Limit)
+	}
+	if opts.Offset > 0 {
+		query = query.Offset(opts.Offset)
+	}
+	result := query.Find(m)
 	if result.Error != nil {
 		xlog.Error("storage-list", "error", result.Error.Error())
 	}
-	return result.RowsAffected, result.Error
+	if opts.Before != "" {
+		reverseRows(reflect.Indirect(reflect.ValueOf(m)))
+	}
+	return result.RowsAffected, translateError(result.Error)
+}
+
+func (s Store) Count(m any, filter map[string]any) (int64, error) {
+	var count int64
+	query, err := s.where(m, filter)
+	if err != nil {
+		xlog.Error("storage-count", "error", err.Error())
+		return 0, translateError(err)
+	}
+	result := query.Model(m).Count(&count)
+	if result.Error != nil {
+		xlog.Error("storage-count", "error", result.Error.Error())
+	}
+	return count, translateError(result.Error)
 }
 
 func (s Store) Update(m any) (int64, error) {
@@ -77,13 +293,50 @@ func (s Store) Update(m any) (int64, error) {
 	if result.Error != nil {
 		xlog.Error("storage-update", "error", result.Error.Error())
 	}
-	return result.RowsAffected, result.Error
+	return result.RowsAffected, translateError(result.Error)
+}
+
+// UpdateWhere writes the non-zero fields of m to the rows matching the filter and the primary key of m, if set.
+// The number of rows it returns tells whether a condition held, making the update atomic.
+func (s Store) UpdateWhere(m any, filter map[string]any) (int64, error) {
+	query, err := s.where(m, filter)
+	if err != nil {
+		xlog.Error("storage-update", "error", err.Error())
+		return 0, translateError(err)
+	}
+	result := query.Model(m).Updates(m)
+	if result.Error != nil {
+		xlog.Error("storage-update", "error", result.Error.Error())
+	}
+	return result.RowsAffected, translateError(result.Error)
 }
 
 func (s Store) Delete(m any, filter map[string]any) (int64, error) {
-	result := s.db.Where(filter).Delete(m)
+	query, err := s.where(m, filter)
+	if err != nil {
+		xlog.Error("storage-delete", "error", err.Error())
+		return 0, translateError(err)
+	}
+	result := query.Delete(m)
 	if result.Error != nil {
 		xlog.Error("storage-delete", "error", result.Error.Error())
 	}
-	return result.RowsAffected, result.Error
+	return result.RowsAffected, translateError(result.Error)
+}
+
+// WithContext returns a Storer running its queries with ctx, within the transaction of s if any
+func (s Store) WithContext(ctx context.Context) Storer {
+	return Store{Driver: s.Driver, DSN: s.DSN, db: s.db.WithContext(ctx), cache: s.cache}
+}
+
+// WithTx runs fn inside a transaction which is committed when fn returns nil and rolled back otherwise.
+// Calling WithTx on the Storer handed to fn nests the transaction using a savepoint.
+func (s Store) WithTx(ctx context.Context, fn func(Storer) error) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(Store{Driver: s.Driver, DSN: s.DSN, db: tx, cache: s.cache})
+	})
+	if err != nil {
+		xlog.Error("storage-tx", "error", err.Error())
+	}
+	return err
 }
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"ekolo/pkg/assert"
+	"errors"
+	"testing"
+)
+
+func TestNewStoreUnknownDriver(t *testing.T) {
+	_, err := NewStore("oracle", "")
+	assert.Assert(t, err != nil, true)
+}
+
+func TestStoreMemoryIsolation(t *testing.T) {
+	s1 := newStore(t)
+	s2 := newStore(t)
+	_, err := s1.Create(&Item{Name: "pen"})
+	assert.Assert(t, err, nil)
+
+	var items []Item
+	n, err := s2.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+}
+
+func TestFiltersValidate(t *testing.T) {
+	filters := Filters{"name": {OpEq, OpIContains}}
+	assert.Assert(t, filters.Validate(map[string]any{"name": "x", "name__icontains": "x"}), nil)
+	assert.Assert(t, errors.Is(filters.Validate(map[string]any{"name__gt": "x"}), ErrInvalidFilter), true)
+	assert.Assert(t, errors.Is(filters.Validate(map[string]any{"price": "1"}), ErrInvalidFilter), true)
+}
+
+func TestStoreCopyTable(t *testing.T) {
+	s, err := NewStore(DriverMemory, "")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, s.RunMigrations(Item{}), nil)
+	pen := Item{Name: "pen", Price: 2}
+	_, err = s.Create(&pen)
+	assert.Assert(t, err, nil)
+
+	// Rows moved aside come back with their primary key, the copy can be run again
+	assert.Assert(t, s.RenameTable(&Item{}, "old_items", "idx_items_deleted_at"), nil)
+	assert.Assert(t, s.HasTable(&Item{}), false)
+	assert.Assert(t, s.RunMigrations(Item{}), nil)
+	assert.Assert(t, s.CopyTable("old_items", &Item{}), nil)
+	assert.Assert(t, s.CopyTable("old_items", &Item{}), nil)
+	var items []Item
+	n, err := s.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+	assert.Assert(t, items[0].UUID, pen.UUID)
+	assert.Assert(t, items[0].Price, 2)
+}
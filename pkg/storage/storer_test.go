@@ -0,0 +1,601 @@
+package storage
+
+import (
+	"context"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/xerr"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Item is a soft deletable model used by the contract tests
+type Item struct {
+	BaseModel
+	Name  string  `json:"name"`
+	Price int     `json:"price"`
+	Note  *string `json:"note"`
+}
+
+// Setting is a model with a natural primary key and no soft delete
+type Setting struct {
+	Key   string `gorm:"primaryKey"`
+	Value string
+}
+
+// Account is a model whose email is unique among the rows which are not deleted
+type Account struct {
+	BaseModel
+	Email string `gorm:"uniqueIndex:idx_accounts_email,where:deleted_at IS NULL"`
+}
+
+func newStore(t *testing.T) Storer {
+	s, err := NewStore(DriverMemory, "")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, s.RunMigrations(Item{}, Setting{}, Account{}), nil)
+	return s
+}
+
+func newMemoryStore(t *testing.T) Storer {
+	s := NewMemoryStore()
+	assert.Assert(t, s.RunMigrations(Item{}, Setting{}, Account{}), nil)
+	return s
+}
+
+// TestStorerContract runs the same suite against every Storer implementation
+func TestStorerContract(t *testing.T) {
+	impls := map[string]func(*testing.T) Storer{
+		"store":  newStore,
+		"memory": newMemoryStore,
+	}
+	tests := map[string]func(*testing.T, Storer){
+		"create":      testCreate,
+		"duplicate":   testDuplicate,
+		"unique":      testUnique,
+		"get":         testGet,
+		"list":        testList,
+		"update":      testUpdate,
+		"updateWhere": testUpdateWhere,
+		"delete":      testDelete,
+		"hardDelete":  testHardDelete,
+		"copies":      testCopies,
+		"concurrent":  testConcurrent,
+		"paginate":    testPaginate,
+		"keyset":      testKeyset,
+		"operators":   testOperators,
+		"wildcards":   testWildcards,
+		"subquery":    testSubquery,
+		"sort":        testSort,
+		"txCommit":    testTxCommit,
+		"txRollback":  testTxRollback,
+		"txNested":    testTxNested,
+		"txOutside":   testTxOutside,
+	}
+	for name, impl := range impls {
+		for tname, test := range tests {
+			t.Run(fmt.Sprintf("%s/%s", name, tname), func(t *testing.T) {
+				test(t, impl(t))
+			})
+		}
+	}
+}
+
+func testCreate(t *testing.T, s Storer) {
+	item := Item{Name: "book", Price: 10}
+	n, err := s.Create(&item)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+	assert.Assert(t, item.UUID.String() != "00000000-0000-0000-0000-000000000000", true)
+	assert.Assert(t, item.CreatedAt != nil, true)
+	assert.Assert(t, item.UpdatedAt != nil, true)
+}
+
+func testDuplicate(t *testing.T, s Storer) {
+	_, err := s.Create(&Setting{Key: "lang", Value: "fr"})
+	assert.Assert(t, err, nil)
+	n, err := s.Create(&Setting{Key: "lang", Value: "en"})
+	assert.Assert(t, errors.Is(err, ErrDuplicate), true)
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	assert.Assert(t, n, int64(0))
+}
+
+func testUnique(t *testing.T, s Storer) {
+	ada := Account{Email: "ada@ekolo.io"}
+	_, err := s.Create(&ada)
+	assert.Assert(t, err, nil)
+	_, err = s.Create(&Account{Email: "ada@ekolo.io"})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+
+	bob := Account{Email: "bob@ekolo.io"}
+	_, err = s.Create(&bob)
+	assert.Assert(t, err, nil)
+	_, err = s.Update(&Account{BaseModel: BaseModel{UUID: bob.UUID}, Email: "ada@ekolo.io"})
+	assert.Assert(t, errors.Is(err, xerr.ErrConflict), true)
+	var got Account
+	_, err = s.Get(&got, map[string]any{"uuid": bob.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, got.Email, "bob@ekolo.io")
+
+	// The index leaves deleted rows out
+	_, err = s.Delete(&Account{}, map[string]any{"uuid": ada.UUID})
+	assert.Assert(t, err, nil)
+	_, err = s.Create(&Account{Email: "ada@ekolo.io"})
+	assert.Assert(t, err, nil)
+}
+
+func testGet(t *testing.T, s Storer) {
+	item := Item{Name: "book", Price: 10}
+	_, err := s.Create(&item)
+	assert.Assert(t, err, nil)
+
+	var got Item
+	n, err := s.Get(&got, map[string]any{"uuid": item.UUID.String()})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+	assert.Assert(t, got.Name, "book")
+	assert.Assert(t, got.Price, 10)
+
+	n, err = s.Get(&got, map[string]any{"name": "book", "price": 11})
+	assert.Assert(t, errors.Is(err, ErrNotFound), true)
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	assert.Assert(t, n, int64(0))
+
+	_, err = s.Get(&got, map[string]any{"unknown": 1})
+	assert.Assert(t, errors.Is(err, xerr.ErrInvalid), true)
+}
+
+func testList(t *testing.T, s Storer) {
+	for i, name := range []string{"a", "b", "c"} {
+		_, err := s.Create(&Item{Name: name, Price: i % 2})
+		assert.Assert(t, err, nil)
+	}
+
+	var items []Item
+	n, err := s.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(3))
+	assert.Assert(t, len(items), 3)
+
+	n, err = s.List(&items, map[string]any{"price": 0}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+
+	n, err = s.List(&items, map[string]any{"name": []string{"a", "b"}}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+
+	n, err = s.List(&items, map[string]any{"note": nil}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(3))
+}
+
+func testPaginate(t *testing.T, s Storer) {
+	for i := 0; i < 5; i++ {
+		_, err := s.Create(&Item{Name: fmt.Sprintf("item-%d", i), Price: i})
+		assert.Assert(t, err, nil)
+	}
+
+	total, err := s.Count(&[]Item{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, total, int64(5))
+
+	// Pages do not overlap and cover every row
+	seen := map[string]bool{}
+	for offset := 0; offset < 6; offset += 2 {
+		var items []Item
+		n, err := s.List(&items, map[string]any{}, ListOptions{Limit: 2, Offset: offset})
+		assert.Assert(t, err, nil)
+		assert.Assert(t, n, int64(len(items)))
+		for _, item := range items {
+			assert.Assert(t, seen[item.Name], false)
+			seen[item.Name] = true
+		}
+	}
+	assert.Assert(t, len(seen), 5)
+
+	var items []Item
+	n, err := s.List(&items, map[string]any{}, ListOptions{Limit: 2, Offset: 10})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+
+	n, err = s.Count(&Item{}, map[string]any{"price": []int{1, 2}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+}
+
+func testKeyset(t *testing.T, s Storer) {
+	note := "x"
+	for i := 0; i < 7; i++ {
+		item := Item{Name: fmt.Sprintf("item-%d", i), Price: i % 3}
+		if i%2 == 0 {
+			item.Note = &note
+		}
+		_, err := s.Create(&item)
+		assert.Assert(t, err, nil)
+	}
+	sort := []string{"note", "-price"}
+	names := func(items []Item) []string {
+		out := []string{}
+		for _, item := range items {
+			out = append(out, item.Name)
+		}
+		return out
+	}
+	var all []Item
+	_, err := s.List(&all, map[string]any{}, ListOptions{Sort: sort})
+	assert.Assert(t, err, nil)
+
+	// Pages after the last row of the previous one walk through every row in order, despite ties and NULL values
+	walked := []string{}
+	var page []Item
+	opts := ListOptions{Limit: 2, Sort: sort}
+	for {
+		_, err := s.List(&page, map[string]any{}, opts)
+		assert.Assert(t, err, nil)
+		if len(page) == 0 {
+			break
+		}
+		walked = append(walked, names(page)...)
+		opts.After, err = SortKey(&page[len(page)-1], sort)
+		assert.Assert(t, err, nil)
+		// Rows created meanwhile do not shift the pages
+		_, err = s.Create(&Item{Name: "late", Price: 9, Note: &note})
+		assert.Assert(t, err, nil)
+	}
+	assert.Assert(t, walked, names(all))
+
+	// Pages before the first row of the previous one walk back the same rows
+	walked = []string{}
+	opts = ListOptions{Limit: 2, Sort: sort}
+	opts.Before, err = SortKey(&all[len(all)-1], sort)
+	assert.Assert(t, err, nil)
+	walked = append(walked, all[len(all)-1].Name)
+	for {
+		_, err := s.List(&page, map[string]any{"name__ne": "late"}, opts)
+		assert.Assert(t, err, nil)
+		if len(page) == 0 {
+			break
+		}
+		walked = append(names(page), walked...)
+		opts.Before, err = SortKey(&page[0], sort)
+		assert.Assert(t, err, nil)
+	}
+	assert.Assert(t, walked, names(all))
+
+	_, err = s.List(&page, map[string]any{}, ListOptions{Sort: sort, After: `["x"]`})
+	assert.Assert(t, errors.Is(err, ErrInvalidSort), true)
+}
+
+func testOperators(t *testing.T, s Storer) {
+	note := "Hello World"
+	for i, name := range []string{"Apple", "apricot", "banana"} {
+		item := Item{Name: name, Price: i * 10}
+		if i == 0 {
+			item.Note = &note
+		}
+		_, err := s.Create(&item)
+		assert.Assert(t, err, nil)
+	}
+
+	tests := []struct {
+		filter map[string]any
+		count  int64
+	}{
+		{map[string]any{"name__eq": "Apple"}, 1},
+		{map[string]any{"name__ne": "Apple"}, 2},
+		{map[string]any{"price__gt": "0"}, 2},
+		{map[string]any{"price__gte": "10", "price__lt": "20"}, 1},
+		{map[string]any{"price__lte": 10}, 2},
+		{map[string]any{"name__in": "Apple,banana"}, 2},
+		{map[string]any{"name__in": []string{"apricot"}}, 1},
+		{map[string]any{"name__contains": "an"}, 1},
+		{map[string]any{"name__icontains": "AP"}, 2},
+		{map[string]any{"name__startswith": "ap"}, 1},
+		{map[string]any{"note__isnull": "true"}, 2},
+		{map[string]any{"note__isnull": "false"}, 1},
+		{map[string]any{"note__icontains": "world"}, 1},
+	}
+	for _, test := range tests {
+		n, err := s.Count(&Item{}, test.filter)
+		assert.Assert(t, err, nil)
+		if n != test.count {
+			t.Fatalf("filter %v: got %d rows, want %d", test.filter, n, test.count)
+		}
+	}
+
+	for _, filter := range []map[string]any{
+		{"unknown": "x"},
+		{"name__regex": "x"},
+		{"note__isnull": "maybe"},
+	} {
+		_, err := s.Count(&Item{}, filter)
+		assert.Assert(t, errors.Is(err, ErrInvalidFilter), true)
+	}
+}
+
+func testWildcards(t *testing.T, s Storer) {
+	for _, name := range []string{"50% off", "500 off", "a_b", "axb", `c\d`, `c\\d`} {
+		_, err := s.Create(&Item{Name: name})
+		assert.Assert(t, err, nil)
+	}
+
+	// Wildcards of the values are matched literally
+	tests := []struct {
+		filter map[string]any
+		count  int64
+	}{
+		{map[string]any{"name__contains": "%"}, 1},
+		{map[string]any{"name__startswith": "50%"}, 1},
+		{map[string]any{"name__contains": "_"}, 1},
+		{map[string]any{"name__icontains": "A_B"}, 1},
+		{map[string]any{"name__contains": `\`}, 2},
+		{map[string]any{"name__startswith": `c\d`}, 1},
+	}
+	for _, test := range tests {
+		n, err := s.Count(&Item{}, test.filter)
+		assert.Assert(t, err, nil)
+		if n != test.count {
+			t.Fatalf("filter %v: got %d rows, want %d", test.filter, n, test.count)
+		}
+	}
+}
+
+func testSubquery(t *testing.T, s Storer) {
+	for _, name := range []string{"ada@ekolo.io", "bob@ekolo.io", "eve@ekolo.io"} {
+		_, err := s.Create(&Item{Name: name})
+		assert.Assert(t, err, nil)
+		_, err = s.Create(&Account{Email: name})
+		assert.Assert(t, err, nil)
+	}
+	_, err := s.Delete(&Account{}, map[string]any{"email": "eve@ekolo.io"})
+	assert.Assert(t, err, nil)
+
+	// Items named after the live accounts matching the filter of the subquery
+	var items []Item
+	accounts := Subquery{Model: &Account{}, Column: "email", Filter: map[string]any{"email__ne": "bob@ekolo.io"}}
+	_, err = s.List(&items, map[string]any{"name": accounts}, ListOptions{Sort: []string{"name"}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(items), 1)
+	assert.Assert(t, items[0].Name, "ada@ekolo.io")
+	n, err := s.Count(&Item{}, map[string]any{"name__in": Subquery{Model: &Account{}, Column: "email"}, "price": 0})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+	n, err = s.Count(&Item{}, map[string]any{"name": Subquery{Model: &Account{}, Column: "email", Filter: map[string]any{"email": "none"}}})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+
+	_, err = s.Count(&Item{}, map[string]any{"name__ne": accounts})
+	assert.Assert(t, errors.Is(err, ErrInvalidFilter), true)
+	_, err = s.Count(&Item{}, map[string]any{"name": Subquery{Model: &Account{}, Column: "unknown"}})
+	assert.Assert(t, errors.Is(err, ErrInvalidFilter), true)
+}
+
+func testSort(t *testing.T, s Storer) {
+	note := "x"
+	for _, item := range []Item{{Name: "b", Price: 2}, {Name: "a", Price: 2, Note: &note}, {Name: "c", Price: 1}} {
+		_, err := s.Create(&item)
+		assert.Assert(t, err, nil)
+	}
+
+	names := func(sort ...string) string {
+		var items []Item
+		_, err := s.List(&items, map[string]any{}, ListOptions{Sort: sort})
+		assert.Assert(t, err, nil)
+		out := ""
+		for _, item := range items {
+			out += item.Name
+		}
+		return out
+	}
+	assert.Assert(t, names("name"), "abc")
+	assert.Assert(t, names("-name"), "cba")
+	assert.Assert(t, names("price", "-name"), "cba")
+	assert.Assert(t, names("-price", "name"), "abc")
+	// NULL values come last in both directions
+	assert.Assert(t, names("note", "name"), "abc")
+	assert.Assert(t, names("-note", "name"), "abc")
+
+	var items []Item
+	_, err := s.List(&items, map[string]any{}, ListOptions{Sort: []string{"unknown"}})
+	assert.Assert(t, errors.Is(err, ErrInvalidSort), true)
+}
+
+func testUpdate(t *testing.T, s Storer) {
+	item := Item{Name: "book", Price: 10}
+	_, err := s.Create(&item)
+	assert.Assert(t, err, nil)
+
+	// Zero fields are left untouched
+	n, err := s.Update(&Item{BaseModel: BaseModel{UUID: item.UUID}, Price: 12})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	var got Item
+	_, err = s.Get(&got, map[string]any{"uuid": item.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, got.Name, "book")
+	assert.Assert(t, got.Price, 12)
+
+	missing := Item{Name: "ghost"}
+	missing.BeforeCreate(nil)
+	n, err = s.Update(&missing)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+}
+
+func testUpdateWhere(t *testing.T, s Storer) {
+	item := Item{Name: "book", Price: 10}
+	_, err := s.Create(&item)
+	assert.Assert(t, err, nil)
+
+	// Rows are only updated while the condition holds
+	n, err := s.UpdateWhere(&Item{BaseModel: BaseModel{UUID: item.UUID}, Price: 12}, map[string]any{"price": 10})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+	n, err = s.UpdateWhere(&Item{BaseModel: BaseModel{UUID: item.UUID}, Price: 14}, map[string]any{"price": 10})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+
+	var got Item
+	_, err = s.Get(&got, map[string]any{"uuid": item.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, got.Name, "book")
+	assert.Assert(t, got.Price, 12)
+
+	_, err = s.Create(&Item{Name: "pen", Price: 1})
+	assert.Assert(t, err, nil)
+	n, err = s.UpdateWhere(&Item{Price: 2}, map[string]any{"price__lt": 20})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(2))
+}
+
+func testDelete(t *testing.T, s Storer) {
+	item := Item{Name: "book"}
+	_, err := s.Create(&item)
+	assert.Assert(t, err, nil)
+
+	n, err := s.Delete(&Item{}, map[string]any{"uuid": item.UUID.String()})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	var got Item
+	_, err = s.Get(&got, map[string]any{"uuid": item.UUID.String()})
+	assert.Assert(t, errors.Is(err, ErrNotFound), true)
+
+	var items []Item
+	n, err = s.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+
+	// Deleting twice affects nothing
+	n, err = s.Delete(&Item{}, map[string]any{"uuid": item.UUID.String()})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+
+	// Soft deleted rows can not be updated
+	n, err = s.Update(&Item{BaseModel: BaseModel{UUID: item.UUID}, Price: 1})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+}
+
+func testHardDelete(t *testing.T, s Storer) {
+	_, err := s.Create(&Setting{Key: "lang", Value: "fr"})
+	assert.Assert(t, err, nil)
+	n, err := s.Delete(&Setting{Key: "lang"}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	// The key is free again
+	_, err = s.Create(&Setting{Key: "lang", Value: "en"})
+	assert.Assert(t, err, nil)
+}
+
+func testCopies(t *testing.T, s Storer) {
+	note := "first"
+	item := Item{Name: "book", Note: &note}
+	_, err := s.Create(&item)
+	assert.Assert(t, err, nil)
+	note = "changed"
+
+	var got Item
+	_, err = s.Get(&got, map[string]any{"uuid": item.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, *got.Note, "first")
+}
+
+func testConcurrent(t *testing.T, s Storer) {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.Create(&Item{Name: fmt.Sprintf("item-%d", i)})
+			assert.Assert(t, err, nil)
+			var items []Item
+			_, err = s.List(&items, map[string]any{}, ListOptions{})
+			assert.Assert(t, err, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	var items []Item
+	n, err := s.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(20))
+}
+
+func countItems(t *testing.T, s Storer) int64 {
+	var items []Item
+	n, err := s.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	return n
+}
+
+func testTxCommit(t *testing.T, s Storer) {
+	err := s.WithTx(context.Background(), func(tx Storer) error {
+		if _, err := tx.Create(&Item{Name: "a"}); err != nil {
+			return err
+		}
+		_, err := tx.Create(&Item{Name: "b"})
+		return err
+	})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, countItems(t, s), int64(2))
+}
+
+func testTxRollback(t *testing.T, s Storer) {
+	errBoom := errors.New("boom")
+	err := s.WithTx(context.Background(), func(tx Storer) error {
+		if _, err := tx.Create(&Item{Name: "a"}); err != nil {
+			return err
+		}
+		assert.Assert(t, countItems(t, tx), int64(1))
+		return errBoom
+	})
+	assert.Assert(t, err, errBoom)
+	assert.Assert(t, countItems(t, s), int64(0))
+}
+
+func testTxNested(t *testing.T, s Storer) {
+	errBoom := errors.New("boom")
+	err := s.WithTx(context.Background(), func(tx Storer) error {
+		if _, err := tx.Create(&Item{Name: "outer"}); err != nil {
+			return err
+		}
+		// The inner transaction is rolled back to its savepoint only
+		err := tx.WithTx(context.Background(), func(inner Storer) error {
+			if _, err := inner.Create(&Item{Name: "inner"}); err != nil {
+				return err
+			}
+			return errBoom
+		})
+		assert.Assert(t, err, errBoom)
+		return nil
+	})
+	assert.Assert(t, err, nil)
+
+	var items []Item
+	_, err = s.List(&items, map[string]any{}, ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(items), 1)
+	assert.Assert(t, items[0].Name, "outer")
+}
+
+func testTxOutside(t *testing.T, s Storer) {
+	done := make(chan error)
+	err := s.WithTx(context.Background(), func(tx Storer) error {
+		go func() {
+			_, err := s.Create(&Item{Name: "outside"})
+			done <- err
+		}()
+		// The write made outside of the transaction waits for it, rather than being lost on commit
+		time.Sleep(10 * time.Millisecond)
+		_, err := tx.Create(&Item{Name: "inside"})
+		return err
+	})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, <-done, nil)
+	assert.Assert(t, countItems(t, s), int64(2))
+}
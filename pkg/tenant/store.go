@@ -0,0 +1,228 @@
+package tenant
+
+import (
+	"context"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/schema"
+)
+
+// DefaultField is the field holding the organization owning a model
+const DefaultField = "OrgUUID"
+
+var (
+	ErrNoTenant    = xerr.Forbidden("no organization to act on behalf of")
+	ErrOtherTenant = xerr.Forbidden("resource belongs to another organization")
+)
+
+// Store is a storage.Storer constraining the models owned by an organization to the organization of its context.
+// Models having the tenant field are owned: queries only match their rows of the organization,
+// writes set the field and can not reach rows of other organizations. Other models go through untouched.
+// Owned models can not be used without an organization, use WithContext or WithTx to bind one.
+type Store struct {
+	inner storage.Storer
+	field string
+	org   uuid.UUID
+	bound bool // Whether an organization was found in the context.
+	cache *sync.Map
+}
+
+// NewStore returns a Store wrapping inner, models holding an uuid.UUID field of the given name are owned
+func NewStore(inner storage.Storer, field string) *Store {
+	return &Store{
+		inner: inner,
+		field: field,
+		cache: &sync.Map{},
+	}
+}
+
+// WithContext returns a Store bound to the organization of ctx
+func (s *Store) WithContext(ctx context.Context) storage.Storer {
+	org, ok := FromContext(ctx)
+	return &Store{inner: s.inner.WithContext(ctx), field: s.field, org: org, bound: ok, cache: s.cache}
+}
+
+// WithTx runs fn inside a transaction of the inner store, bound to the organization of s or else of ctx
+func (s *Store) WithTx(ctx context.Context, fn func(storage.Storer) error) error {
+	scoped := s
+	if !s.bound {
+		scoped = s.WithContext(ctx).(*Store)
+	}
+	return scoped.inner.WithTx(ctx, func(tx storage.Storer) error {
+		return fn(&Store{inner: tx, field: s.field, org: scoped.org, bound: scoped.bound, cache: s.cache})
+	})
+}
+
+func (s *Store) Create(m any) (int64, error) {
+	if _, err := s.own(m); err != nil {
+		return 0, err
+	}
+	return s.inner.Create(m)
+}
+
+func (s *Store) Get(m any, filter map[string]any) (int64, error) {
+	filter, err := s.scope(m, filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.inner.Get(m, filter)
+}
+
+func (s *Store) List(m any, filter map[string]any, opts storage.ListOptions) (int64, error) {
+	filter, err := s.scope(m, filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.inner.List(m, filter, opts)
+}
+
+func (s *Store) Count(m any, filter map[string]any) (int64, error) {
+	filter, err := s.scope(m, filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.inner.Count(m, filter)
+}
+
+// Update updates a row of the organization, rows of other organizations are not found
+func (s *Store) Update(m any) (int64, error) {
+	sch, err := s.own(m)
+	if err != nil || sch == nil {
+		if err != nil {
+			return 0, err
+		}
+		return s.inner.Update(m)
+	}
+	// Updates only filter on the primary key, the row must first be found within the organization
+	filter := map[string]any{}
+	row := reflect.Indirect(reflect.ValueOf(m))
+	for _, f := range sch.PrimaryFields {
+		if v, zero := f.ValueOf(context.Background(), row); !zero {
+			filter[f.DBName] = v
+		}
+	}
+	n, err := s.Count(m, filter)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return s.inner.Update(m)
+}
+
+// UpdateWhere updates the rows of the organization matching the filter
+func (s *Store) UpdateWhere(m any, filter map[string]any) (int64, error) {
+	if _, err := s.own(m); err != nil {
+		return 0, err
+	}
+	filter, err := s.scope(m, filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.inner.UpdateWhere(m, filter)
+}
+
+func (s *Store) Delete(m any, filter map[string]any) (int64, error) {
+	filter, err := s.scope(m, filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.inner.Delete(m, filter)
+}
+
+// Unscoped returns the store repo wraps, within the same transaction, or repo itself when it is not a Store.
+// It is meant for the few queries which must look across organizations, like whether a user belongs to other ones.
+func Unscoped(repo storage.Storer) storage.Storer {
+	if s, ok := repo.(*Store); ok {
+		return s.inner
+	}
+	return repo
+}
+
+// owned returns the schema of m and the tenant field when m is owned by an organization
+func (s *Store) owned(m any) (*schema.Schema, *schema.Field, error) {
+	sch, err := schema.Parse(m, s.cache, schema.NamingStrategy{})
+	if err != nil {
+		return nil, nil, err
+	}
+	field := sch.LookUpField(s.field)
+	if field == nil || field.DBName == "" {
+		return nil, nil, nil
+	}
+	if !s.bound {
+		return nil, nil, ErrNoTenant
+	}
+	return sch, field, nil
+}
+
+// scope returns a copy of the filter only matching rows of the organization, subqueries included
+func (s *Store) scope(m any, filter map[string]any) (map[string]any, error) {
+	_, field, err := s.owned(m)
+	if err != nil {
+		return filter, err
+	}
+	scoped := make(map[string]any, len(filter)+1)
+	for k, v := range filter {
+		if sub, ok := v.(storage.Subquery); ok {
+			if sub.Filter, err = s.scope(sub.Model, sub.Filter); err != nil {
+				return nil, err
+			}
+			v = sub
+		}
+		scoped[k] = v
+	}
+	if field == nil {
+		return scoped, nil
+	}
+	if _, ok := scoped[field.DBName]; ok {
+		// Conditions are combined, a filter on another organization matches nothing
+		scoped[field.DBName+"__"+storage.OpIn] = s.org.String()
+	} else {
+		scoped[field.DBName] = s.org
+	}
+	return scoped, nil
+}
+
+// own sets the organization of the rows held by m, it returns the schema of m when it is owned
+func (s *Store) own(m any) (*schema.Schema, error) {
+	sch, field, err := s.owned(m)
+	if err != nil || field == nil {
+		return nil, err
+	}
+	rv := reflect.Indirect(reflect.ValueOf(m))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := s.setOrg(reflect.Indirect(rv.Index(i))); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if err := s.setOrg(rv); err != nil {
+			return nil, err
+		}
+	}
+	return sch, nil
+}
+
+// setOrg sets the tenant field of a row to the organization, a row of another organization is rejected
+func (s *Store) setOrg(row reflect.Value) error {
+	f := row.FieldByName(s.field)
+	if !f.CanSet() {
+		return fmt.Errorf("tenant: %s of %s can not be set", s.field, row.Type())
+	}
+	org, ok := f.Interface().(uuid.UUID)
+	if !ok {
+		return fmt.Errorf("tenant: %s of %s is not an uuid.UUID", s.field, row.Type())
+	}
+	if org != uuid.Nil && org != s.org {
+		return ErrOtherTenant
+	}
+	f.Set(reflect.ValueOf(s.org))
+	return nil
+}
+
+var _ storage.Storer = new(Store)
@@ -0,0 +1,201 @@
+package tenant
+
+import (
+	"context"
+	"ekolo/pkg/assert"
+	"ekolo/pkg/principal"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Note is a model owned by an organization
+type Note struct {
+	storage.BaseModel
+	Title   string
+	OrgUUID uuid.UUID
+}
+
+// Country is a model shared by every organization
+type Country struct {
+	storage.BaseModel
+	Name string
+}
+
+func newStore(t *testing.T) storage.Storer {
+	s, err := storage.NewStore(storage.DriverMemory, "")
+	assert.Assert(t, err, nil)
+	assert.Assert(t, s.RunMigrations(Note{}, Country{}), nil)
+	return s
+}
+
+// TestStoreIsolation runs the isolation suite over a database store, the storage contract tests keep the other Storers alike
+func TestStoreIsolation(t *testing.T) {
+	tests := map[string]func(*testing.T, storage.Storer){
+		"unbound": testUnbound,
+		"create":  testCreate,
+		"read":    testRead,
+		"update":  testUpdate,
+		"delete":  testDelete,
+		"tx":      testTx,
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+// onBehalf returns a store acting on behalf of org through the principal of the context
+func onBehalf(s *Store, org uuid.UUID) storage.Storer {
+	return s.WithContext(principal.NewContext(context.Background(), principal.Principal{UserUUID: uuid.New(), OrgUUID: org}))
+}
+
+func testUnbound(t *testing.T, inner storage.Storer) {
+	s := NewStore(inner, DefaultField)
+
+	_, err := s.Create(&Note{Title: "memo", OrgUUID: uuid.New()})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	var notes []Note
+	_, err = s.WithContext(context.Background()).List(&notes, map[string]any{}, storage.ListOptions{})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+
+	// Shared models need no organization
+	_, err = s.Create(&Country{Name: "Congo"})
+	assert.Assert(t, err, nil)
+	var countries []Country
+	n, err := s.List(&countries, map[string]any{}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
+
+func testCreate(t *testing.T, inner storage.Storer) {
+	s := NewStore(inner, DefaultField)
+	orgA, orgB := uuid.New(), uuid.New()
+
+	note := Note{Title: "memo"}
+	_, err := onBehalf(s, orgA).Create(&note)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, note.OrgUUID, orgA)
+
+	_, err = onBehalf(s, orgA).Create(&Note{Title: "memo", OrgUUID: orgB})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+	_, err = onBehalf(s, orgA).Create(&[]Note{{Title: "a"}, {Title: "b", OrgUUID: orgB}})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+
+	n, err := inner.Count(&Note{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
+
+func testRead(t *testing.T, inner storage.Storer) {
+	s := NewStore(inner, DefaultField)
+	orgA, orgB := uuid.New(), uuid.New()
+	note := Note{Title: "memo", OrgUUID: orgA}
+	_, err := inner.Create(&note)
+	assert.Assert(t, err, nil)
+
+	_, err = onBehalf(s, orgB).Get(&Note{}, map[string]any{"uuid": note.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	_, err = onBehalf(s, orgA).Get(&Note{}, map[string]any{"uuid": note.UUID})
+	assert.Assert(t, err, nil)
+
+	// Filtering on another organization matches nothing
+	var notes []Note
+	n, err := onBehalf(s, orgB).List(&notes, map[string]any{"org_uuid": orgA}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	n, err = onBehalf(s, orgB).Count(&Note{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	n, err = onBehalf(s, orgA).List(&notes, map[string]any{"org_uuid": orgA}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	// An explicit organization takes precedence over the principal's one
+	ctx := NewContext(principal.NewContext(context.Background(), principal.Principal{OrgUUID: orgB}), orgA)
+	n, err = s.WithContext(ctx).Count(&Note{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	// Subqueries only select rows of the organization
+	_, err = inner.Create(&Country{Name: "memo"})
+	assert.Assert(t, err, nil)
+	titles := storage.Subquery{Model: &Note{}, Column: "title"}
+	n, err = onBehalf(s, orgB).Count(&Country{}, map[string]any{"name": titles})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	n, err = onBehalf(s, orgA).Count(&Country{}, map[string]any{"name": titles})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
+
+func testUpdate(t *testing.T, inner storage.Storer) {
+	s := NewStore(inner, DefaultField)
+	orgA, orgB := uuid.New(), uuid.New()
+	note := Note{Title: "memo", OrgUUID: orgA}
+	_, err := inner.Create(&note)
+	assert.Assert(t, err, nil)
+
+	n, err := onBehalf(s, orgB).Update(&Note{BaseModel: storage.BaseModel{UUID: note.UUID}, Title: "hijacked"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	_, err = onBehalf(s, orgA).Update(&Note{BaseModel: storage.BaseModel{UUID: note.UUID}, OrgUUID: orgB})
+	assert.Assert(t, errors.Is(err, xerr.ErrForbidden), true)
+
+	n, err = onBehalf(s, orgA).Update(&Note{BaseModel: storage.BaseModel{UUID: note.UUID}, Title: "edited"})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+
+	var got Note
+	_, err = inner.Get(&got, map[string]any{"uuid": note.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, got.Title, "edited")
+	assert.Assert(t, got.OrgUUID, orgA)
+}
+
+func testDelete(t *testing.T, inner storage.Storer) {
+	s := NewStore(inner, DefaultField)
+	orgA, orgB := uuid.New(), uuid.New()
+	note := Note{Title: "memo", OrgUUID: orgA}
+	_, err := inner.Create(&note)
+	assert.Assert(t, err, nil)
+
+	n, err := onBehalf(s, orgB).Delete(&Note{}, map[string]any{"uuid": note.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+	n, err = onBehalf(s, orgB).Delete(&Note{}, map[string]any{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(0))
+
+	n, err = onBehalf(s, orgA).Delete(&Note{}, map[string]any{"uuid": note.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
+
+func testTx(t *testing.T, inner storage.Storer) {
+	s := NewStore(inner, DefaultField)
+	orgA, orgB := uuid.New(), uuid.New()
+	note := Note{Title: "memo", OrgUUID: orgA}
+	_, err := inner.Create(&note)
+	assert.Assert(t, err, nil)
+
+	// Transactions are bound to the organization of their context
+	ctx := NewContext(context.Background(), orgB)
+	err = s.WithTx(ctx, func(tx storage.Storer) error {
+		n, err := tx.Count(&Note{}, map[string]any{})
+		assert.Assert(t, err, nil)
+		assert.Assert(t, n, int64(0))
+		_, err = tx.Create(&Note{Title: "draft"})
+		return err
+	})
+	assert.Assert(t, err, nil)
+
+	var notes []Note
+	n, err := inner.List(&notes, map[string]any{"org_uuid": orgB}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, n, int64(1))
+}
@@ -0,0 +1,27 @@
+package tenant
+
+import (
+	"context"
+	"ekolo/pkg/principal"
+
+	"github.com/google/uuid"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx acting on behalf of an organization, it takes precedence over the principal's one.
+// It is meant for trusted flows without a principal, like the creation of an organization.
+func NewContext(ctx context.Context, org uuid.UUID) context.Context {
+	return context.WithValue(ctx, contextKey{}, org)
+}
+
+// FromContext returns the organization ctx acts on behalf of, defaulting to the organization of its principal
+func FromContext(ctx context.Context) (uuid.UUID, bool) {
+	if org, ok := ctx.Value(contextKey{}).(uuid.UUID); ok {
+		return org, true
+	}
+	if p, ok := principal.FromContext(ctx); ok && p.OrgUUID != uuid.Nil {
+		return p.OrgUUID, true
+	}
+	return uuid.Nil, false
+}
@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"ekolo/pkg/assert"
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got, err := Code(secret, Step(time.Unix(unix, 0)))
+		assert.Assert(t, err, nil)
+		assert.Assert(t, got, want)
+	}
+	_, err := Code("not base32!", 1)
+	assert.Assert(t, err, ErrInvalidSecret)
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(secret), 32)
+
+	now := time.Now()
+	code, _ := Code(secret, Step(now))
+	step, ok := Validate(secret, code, now)
+	assert.Assert(t, ok, true)
+	assert.Assert(t, step, Step(now))
+
+	// Codes of the neighbouring steps are accepted, older ones are not
+	_, ok = Validate(secret, code, now.Add(Period))
+	assert.Assert(t, ok, true)
+	_, ok = Validate(secret, code, now.Add(3*Period))
+	assert.Assert(t, ok, false)
+	_, ok = Validate(secret, "12345", now)
+	assert.Assert(t, ok, false)
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("ekolo", "ada@ekolo.io", "JBSWY3DPEHPK3PXP"))
+	assert.Assert(t, err, nil)
+	assert.Assert(t, uri.Scheme, "otpauth")
+	assert.Assert(t, uri.Host, "totp")
+	assert.Assert(t, uri.Path, "/ekolo:ada@ekolo.io")
+	assert.Assert(t, uri.Query().Get("secret"), "JBSWY3DPEHPK3PXP")
+	assert.Assert(t, uri.Query().Get("issuer"), "ekolo")
+}
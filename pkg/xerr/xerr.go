@@ -0,0 +1,124 @@
+package xerr
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Kind classifies an error, every kind maps to an HTTP status code
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindInvalid
+	KindValidation
+	KindUnauthenticated
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindTooManyRequests
+)
+
+// Status returns the HTTP status code of the kind
+func (k Kind) Status() int {
+	switch k {
+	case KindInvalid:
+		return http.StatusBadRequest
+	case KindValidation:
+		return http.StatusUnprocessableEntity
+	case KindUnauthenticated:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is a typed application error
+type Error struct {
+	Kind    Kind
+	Message string
+	Details []string // Field level messages of validation errors.
+	Err     error    // Wrapped cause.
+
+	RetryAfter time.Duration // Delay before the request may be retried, set on too many requests errors.
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Err == nil:
+		return e.Message
+	case e.Message == "":
+		return e.Err.Error()
+	default:
+		return e.Message + ": " + e.Err.Error()
+	}
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is makes errors.Is match any error of the same kind as the sentinel errors below
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+// Sentinel errors to test the kind of an error with errors.Is
+var (
+	ErrInternal        = &Error{Kind: KindInternal, Message: "internal error"}
+	ErrInvalid         = &Error{Kind: KindInvalid, Message: "invalid request"}
+	ErrValidation      = &Error{Kind: KindValidation, Message: "validation failed"}
+	ErrUnauthenticated = &Error{Kind: KindUnauthenticated, Message: "authentication required"}
+	ErrForbidden       = &Error{Kind: KindForbidden, Message: "forbidden"}
+	ErrNotFound        = &Error{Kind: KindNotFound, Message: "not found"}
+	ErrConflict        = &Error{Kind: KindConflict, Message: "conflict"}
+	ErrTooManyRequests = &Error{Kind: KindTooManyRequests, Message: "too many requests"}
+)
+
+// New returns an error of the given kind
+func New(kind Kind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+// Wrap returns an error of the given kind caused by err
+func Wrap(kind Kind, err error, message string) *Error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+func Invalid(message string) *Error         { return New(KindInvalid, message) }
+func Unauthenticated(message string) *Error { return New(KindUnauthenticated, message) }
+func Forbidden(message string) *Error       { return New(KindForbidden, message) }
+func NotFound(message string) *Error        { return New(KindNotFound, message) }
+func Conflict(message string) *Error        { return New(KindConflict, message) }
+
+// TooManyRequests returns an error telling the client to wait before retrying
+func TooManyRequests(message string, retryAfter time.Duration) *Error {
+	return &Error{Kind: KindTooManyRequests, Message: message, RetryAfter: retryAfter}
+}
+
+// Validation returns a validation error listing the invalid fields
+func Validation(message string, details ...string) *Error {
+	return &Error{Kind: KindValidation, Message: message, Details: details}
+}
+
+// KindOf returns the kind of err, errors which are not typed are internal
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// Status returns the HTTP status code matching err
+func Status(err error) int {
+	return KindOf(err).Status()
+}
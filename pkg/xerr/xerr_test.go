@@ -0,0 +1,26 @@
+package xerr
+
+import (
+	"ekolo/pkg/assert"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("record not found")
+	err := fmt.Errorf("get: %w", Wrap(KindNotFound, cause, "user not found"))
+
+	assert.Assert(t, errors.Is(err, ErrNotFound), true)
+	assert.Assert(t, errors.Is(err, ErrConflict), false)
+	assert.Assert(t, errors.Is(err, cause), true)
+	assert.Assert(t, err.Error(), "get: user not found: record not found")
+	assert.Assert(t, KindOf(err), KindNotFound)
+	assert.Assert(t, Status(err), 404)
+
+	assert.Assert(t, Status(cause), 500)
+	assert.Assert(t, Status(Validation("validation failed", "name: is required")), 422)
+	assert.Assert(t, Invalid("bad cursor").Error(), "bad cursor")
+	assert.Assert(t, Status(TooManyRequests("slow down", time.Second)), 429)
+}
@@ -13,5 +13,5 @@ type Tag struct {
 	Type        string                `json:"type"`
 	Description *string               `json:"description"`
 	OrgUUID     uuid.UUID             `json:"org"`
-	Org         orgmodel.Organization `json:"-"`
+	Org         orgmodel.Organization `json:"-" validate:"-"`
 }
@@ -3,9 +3,10 @@ package service
 import (
 	"context"
 	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/rbac"
 	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
 	"ekolo/tag/model"
-	"errors"
 
 	"github.com/google/uuid"
 )
@@ -27,8 +28,42 @@ func (s Tag) GetName() string {
 }
 
 // GetPathParams returns service' path params
-func (s Tag) GetPathParams() []string {
-	return []string{"tag"}
+func (s Tag) GetPathParams() []generic.PathParam {
+	return []generic.PathParam{generic.UUIDParam("org"), generic.UUIDParam("tag")}
+}
+
+// GetPermissions returns the permissions required by an operation
+func (s Tag) GetPermissions(op string) []rbac.Permission {
+	switch op {
+	case generic.OpCreate:
+		return []rbac.Permission{rbac.TagCreate}
+	case generic.OpUpdate:
+		return []rbac.Permission{rbac.TagUpdate}
+	case generic.OpDelete:
+		return []rbac.Permission{rbac.TagDelete}
+	default:
+		return []rbac.Permission{rbac.TagRead}
+	}
+}
+
+// GetFilters returns the fields list results can be filtered on
+func (s Tag) GetFilters() storage.Filters {
+	return storage.Filters{
+		"name":       {storage.OpEq, storage.OpIContains, storage.OpStartsWith},
+		"type":       {storage.OpEq, storage.OpIn},
+		"created_at": {storage.OpGte, storage.OpLte},
+		"updated_at": {storage.OpGte, storage.OpLte},
+	}
+}
+
+// GetSortFields returns the fields list results can be ordered by
+func (s Tag) GetSortFields() []string {
+	return []string{"name", "type", "created_at", "updated_at"}
+}
+
+// GetDefaultSort returns the order of list results when none is requested
+func (s Tag) GetDefaultSort() []string {
+	return []string{"name"}
 }
 
 // GetRequest returns the request object for the service
@@ -65,44 +100,51 @@ func (r RequestTag) GetID() string {
 
 // PayloadTagCreate is the struct representing the create request payload
 type PayloadTag struct {
-	Name        string `json:"name" validate:"required"`
-	Type        string `json:"type" validate:"required"`
-	Description string `json:"description"`
+	Name        string `json:"name" validate:"required,max=255"`
+	Type        string `json:"type" validate:"required,max=64"`
+	Description string `json:"description" validate:"max=1024"`
+}
+
+// PayloadTagUpdate is the struct representing the update request payload, fields which are not given are kept
+type PayloadTagUpdate struct {
+	Name        *string `json:"name" validate:"omitempty,max=255"`
+	Type        *string `json:"type" validate:"omitempty,max=64"`
+	Description *string `json:"description" validate:"omitempty,max=1024"`
 }
 
 // RequestTagCreate is the request object for the create method
 type RequestTagCreate struct {
 	RequestTag
 	PayloadTag
-	OrgParam string `param:"org"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
 }
 
 // RequestTagGet is the request object for the get method
 type RequestTagGet struct {
 	RequestTag
-	OrgParam string `param:"org"`
-	TagParam string `param:"tag"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
+	TagParam uuid.UUID `param:"tag" json:"-"`
 }
 
 // RequestTagList is the request object for the list method
 type RequestTagList struct {
 	RequestTag
-	OrgParam uuid.UUID `param:"org"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
 }
 
 // RequestTagUpdate is the request object for the update method
 type RequestTagUpdate struct {
 	RequestTag
-	TagParam string `param:"tag"`
-	OrgParam string `param:"org"`
-	PayloadTag
+	TagParam uuid.UUID `param:"tag" json:"-"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
+	PayloadTagUpdate
 }
 
 // RequestTagDelete is the request object for the delete method
 type RequestTagDelete struct {
 	RequestTag
-	TagParam string `param:"tag"`
-	OrgParam string `param:"org"`
+	TagParam uuid.UUID `param:"tag" json:"-"`
+	OrgParam uuid.UUID `param:"org" json:"-"`
 }
 
 // Create creates a new tag
@@ -116,6 +158,8 @@ type RequestTagDelete struct {
 // @Param tag body PayloadTag true "tag data"
 // @Success 201 {object} Response
 // @Failure 400 {object} Response
+// @Failure 409 {object} Response
+// @Failure 422 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/tag [post]
 func (s Tag) Create(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
@@ -124,12 +168,12 @@ func (s Tag) Create(ctx context.Context, req generic.IRequest) (generic.IRespons
 		Name:        r.Name,
 		Type:        r.Type,
 		Description: &r.Description,
-		OrgUUID:     uuid.MustParse(r.OrgParam),
+		OrgUUID:     r.OrgParam,
 	}
 
-	_, err := s.repo.Create(&tag)
+	_, err := s.repo.WithContext(ctx).Create(&tag)
 	if err != nil {
-		return generic.NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
 	return generic.NewResponse(200, nil, tag), err
 }
@@ -144,6 +188,7 @@ func (s Tag) Create(ctx context.Context, req generic.IRequest) (generic.IRespons
 // @Param tag path string true "tag ID" Format(uuid)
 // @Success 200 {object} Response
 // @Failure 400 {object} Response
+// @Failure 404 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/tag/{tag} [get]
 func (s Tag) Get(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
@@ -155,12 +200,9 @@ func (s Tag) Get(ctx context.Context, req generic.IRequest) (generic.IResponse,
 			"org_uuid": r.OrgParam,
 		}
 	)
-	_, err := s.repo.Get(&org, filter)
+	_, err := s.repo.WithContext(ctx).Get(&org, filter)
 	if err != nil {
-		if errors.Is(err, storage.ErrNotFound) {
-			return generic.NewResponse(404, []string{err.Error()}, nil), err
-		}
-		return generic.NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
 	return generic.NewResponse(200, nil, org), err
 }
@@ -172,21 +214,29 @@ func (s Tag) Get(ctx context.Context, req generic.IRequest) (generic.IResponse,
 // @Tags tag
 // @Produce json
 // @Param org path string true "organization ID" Format(uuid)
+// @Param limit query int false "Page size"
+// @Param offset query int false "Page offset"
+// @Param cursor query string false "Page cursor"
+// @Param sort query string false "Comma separated fields to order by, prefixed with - for descending order"
 // @Success 200 {object} Response
 // @Failure 400 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/tag [get]
-func (s Tag) List(ctx context.Context, req generic.IRequest, filter map[string]any) (generic.IResponse, error) {
+func (s Tag) List(ctx context.Context, req generic.IRequest, filter map[string]any, opts storage.ListOptions) (generic.IResponse, error) {
 	var (
 		r  = req.(*RequestTagList)
 		uu []model.Tag
 	)
 	filter["org_uuid"] = r.OrgParam
-	_, err := s.repo.List(&uu, filter)
+	total, err := s.repo.WithContext(ctx).Count(&uu, filter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.repo.WithContext(ctx).List(&uu, filter, opts)
 	if err != nil {
-		return generic.NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
-	return generic.NewResponse(200, nil, uu), nil
+	return generic.NewListResponse(200, uu, total, opts), nil
 }
 
 // Update updates an tag
@@ -198,23 +248,38 @@ func (s Tag) List(ctx context.Context, req generic.IRequest, filter map[string]a
 // @Produce json
 // @Param org path string true "organization ID" Format(uuid)
 // @Param tag path string true "tag ID" Format(uuid)
-// @Param tag body PayloadTag true "tag data"
+// @Param tag body PayloadTagUpdate true "tag data"
 // @Success 201 {object} Response
 // @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Failure 422 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/tag/{tag} [patch]
 func (s Tag) Update(ctx context.Context, req generic.IRequest) (generic.IResponse, error) {
 	r := req.(*RequestTagUpdate)
-	tag := model.Tag{
-		BaseModel:   storage.BaseModel{UUID: uuid.MustParse(r.TagParam)},
-		Name:        r.Name,
-		Type:        r.Type,
-		Description: &r.Description,
-		OrgUUID:     uuid.MustParse(r.OrgParam),
-	}
-	_, err := s.repo.Update(&tag)
+	var tag model.Tag
+	// The tag must belong to the organization of the path before it is written
+	err := s.repo.WithTx(ctx, func(tx storage.Storer) error {
+		if _, err := tx.Get(&tag, map[string]any{"uuid": r.TagParam, "org_uuid": r.OrgParam}); err != nil {
+			return err
+		}
+		if r.Name != nil {
+			tag.Name = *r.Name
+		}
+		if r.Type != nil {
+			tag.Type = *r.Type
+		}
+		if r.Description != nil {
+			tag.Description = r.Description
+		}
+		n, err := tx.Update(&tag)
+		if err == nil && n == 0 {
+			return xerr.NotFound("tag not found")
+		}
+		return err
+	})
 	if err != nil {
-		return generic.NewResponse(500, []string{err.Error()}, nil), err
+		return nil, err
 	}
 	return generic.NewResponse(200, nil, tag), nil
 }
@@ -226,23 +291,32 @@ func (s Tag) Update(ctx context.Context, req generic.IRequest) (generic.IRespons
 // @Tags tag
 // @Param org path string true "organization ID" Format(uuid)
 // @Param tag path string true "tag ID" Format(uuid)
-// @Success 200 {object} Response
+// @Success 204
 // @Failure 400 {object} Response
+// @Failure 404 {object} Response
 // @Failure 500 {object} Response
 // @Router /organization/{org}/tag/{tag} [delete]
 func (s Tag) Delete(ctx context.Context, req generic.IRequest) error {
 	var (
+		r      = req.(*RequestTagDelete)
 		org    model.Tag
 		filter = map[string]any{
-			"uuid": req.(*RequestTagDelete).TagParam,
+			"uuid":     r.TagParam,
+			"org_uuid": r.OrgParam,
 		}
 	)
-	_, err := s.repo.Delete(&org, filter)
+	n, err := s.repo.WithContext(ctx).Delete(&org, filter)
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return xerr.NotFound("tag not found")
+	}
 	return nil
 }
 
 // Tag is the service interface
 var _ generic.IService = new(Tag)
+var _ generic.IFilterable = new(Tag)
+var _ generic.ISortable = new(Tag)
+var _ generic.IAuthorized = new(Tag)
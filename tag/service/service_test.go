@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"ekolo/pkg/assert"
+	generic "ekolo/pkg/echogeneric"
+	"ekolo/pkg/storage"
+	"ekolo/pkg/xerr"
+	"ekolo/tag/model"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTagService(t *testing.T) {
+	var (
+		ctx = context.Background()
+		svc = New(storage.NewMemoryStore())
+		org = uuid.New()
+	)
+
+	resp, err := svc.Create(ctx, &RequestTagCreate{
+		PayloadTag: PayloadTag{Name: "math", Type: "subject"},
+		OrgParam:   org,
+	})
+	assert.Assert(t, err, nil)
+	tag := resp.(generic.Response).Data.(model.Tag)
+	assert.Assert(t, tag.OrgUUID, org)
+
+	resp, err = svc.Get(ctx, &RequestTagGet{OrgParam: org, TagParam: tag.UUID})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.GetStatusCode(), 200)
+
+	resp, err = svc.List(ctx, &RequestTagList{OrgParam: org}, map[string]any{}, storage.ListOptions{})
+	assert.Assert(t, err, nil)
+	assert.Assert(t, len(resp.(generic.Response).Data.([]model.Tag)), 1)
+
+	// Tags are not reachable through another organization
+	other, art := uuid.New(), "art"
+	_, err = svc.Get(ctx, &RequestTagGet{OrgParam: other, TagParam: tag.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	_, err = svc.Update(ctx, &RequestTagUpdate{OrgParam: other, TagParam: tag.UUID, PayloadTagUpdate: PayloadTagUpdate{Name: &art}})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+	err = svc.Delete(ctx, &RequestTagDelete{OrgParam: other, TagParam: tag.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+
+	// Updates only write the fields they are given, which are all optional
+	algebra := "algebra"
+	update := &RequestTagUpdate{OrgParam: org, TagParam: tag.UUID, PayloadTagUpdate: PayloadTagUpdate{Name: &algebra}}
+	assert.Assert(t, len(generic.Validate(update)), 0)
+	resp, err = svc.Update(ctx, update)
+	assert.Assert(t, err, nil)
+	assert.Assert(t, resp.(generic.Response).Data.(model.Tag).Name, "algebra")
+	assert.Assert(t, resp.(generic.Response).Data.(model.Tag).Type, "subject")
+
+	err = svc.Delete(ctx, &RequestTagDelete{OrgParam: org, TagParam: tag.UUID})
+	assert.Assert(t, err, nil)
+
+	_, err = svc.Get(ctx, &RequestTagGet{OrgParam: org, TagParam: tag.UUID})
+	assert.Assert(t, errors.Is(err, xerr.ErrNotFound), true)
+}